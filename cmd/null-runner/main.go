@@ -12,8 +12,9 @@ func main() {
 		Description: `
 This runner mocks a real runner and provides no function but to report statuses.
 `,
-		Launch:          &runner.Runner{},
-		TeardownTimeout: 0,
+		Launch:            &runner.Runner{},
+		TeardownTimeout:   0,
+		MaxConcurrentRuns: 10,
 	})
 	if err != nil {
 		utils.ErrOut(err)
@@ -17,6 +17,9 @@ leverages an overlayfs backend and git cache to make clones fast.
 `,
 		Launch:          &runner.Runner{},
 		TeardownTimeout: 10 * time.Second,
+		// one at a time, unless max_concurrent_runs raises it; concurrent
+		// runs each need a git worktree.
+		MaxConcurrentRuns: 1,
 	})
 	if err != nil {
 		utils.ErrOut(err)
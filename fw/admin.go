@@ -0,0 +1,210 @@
+package fw
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinyci/ci-agents/config"
+	fwconfig "github.com/tinyci/ci-runners/fw/config"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/urfave/cli"
+)
+
+const adminTimeout = 10 * time.Second
+
+// adminVerb is a command accepted on the admin socket. The result is encoded
+// as JSON in the reply.
+type adminVerb func(e *Entrypoint, args []string) (interface{}, error)
+
+var adminVerbs = map[string]adminVerb{
+	"drain": func(e *Entrypoint, args []string) (interface{}, error) {
+		var exit bool
+
+		for _, arg := range args {
+			switch arg {
+			case "exit":
+				exit = true
+			case "requeue":
+				// the queuesvc has no call to return a pulled queue item; see Drain.
+				return nil, errors.New("re-queueing unstarted items is not supported: the queuesvc cannot take back pulled queue items")
+			default:
+				return nil, fmt.Errorf("unknown drain option %q", arg)
+			}
+		}
+
+		e.Drain(exit)
+		e.logDrain(e.Launch.LogsvcClient(&fwcontext.RunContext{}), exit)
+		return e.DrainStatus(), nil
+	},
+	"undrain": func(e *Entrypoint, args []string) (interface{}, error) {
+		if !e.Undrain() {
+			return nil, errors.New("runner is terminating and cannot be undrained")
+		}
+
+		return e.DrainStatus(), nil
+	},
+	"pause": func(e *Entrypoint, args []string) (interface{}, error) {
+		e.Pause()
+		e.Launch.LogsvcClient(&fwcontext.RunContext{}).Info(context.Background(), "Paused; not accepting new work until resumed")
+		return e.DrainStatus(), nil
+	},
+	"resume": func(e *Entrypoint, args []string) (interface{}, error) {
+		e.Resume()
+		e.Launch.LogsvcClient(&fwcontext.RunContext{}).Info(context.Background(), "Resumed; accepting new work")
+		return e.DrainStatus(), nil
+	},
+	"status": func(e *Entrypoint, args []string) (interface{}, error) {
+		return e.DrainStatus(), nil
+	},
+	"cancel": func(e *Entrypoint, args []string) (interface{}, error) {
+		runID, err := parseRunID(args)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+		defer cancel()
+
+		if err := e.CancelRun(ctx, runID); err != nil {
+			return nil, err
+		}
+
+		return e.DrainStatus(), nil
+	},
+}
+
+type adminReply struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// listenAdmin starts serving the admin socket, if one is configured. Any
+// stale socket left by a previous process is removed.
+func (e *Entrypoint) listenAdmin(ctx context.Context, runner Runner) error {
+	path := runner.FrameworkConfig().AdminSocket
+	if path == "" {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing stale admin socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go e.serveAdmin(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (e *Entrypoint) serveAdmin(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	var reply adminReply
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		reply.Error = "no command"
+	} else if verb, ok := adminVerbs[fields[0]]; !ok {
+		reply.Error = fmt.Sprintf("unknown command %q", fields[0])
+	} else if result, err := verb(e, fields[1:]); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.OK = true
+		reply.Result = result
+	}
+
+	json.NewEncoder(conn).Encode(reply)
+}
+
+// adminCommand is the CLI subcommand which sends a command to the admin
+// socket of a running runner and prints the reply.
+func adminCommand() cli.Command {
+	return cli.Command{
+		Name:      "admin",
+		Usage:     "Send a command to the admin socket of a running runner",
+		ArgsUsage: "<drain [exit] [requeue]|undrain|pause|resume|status|cancel <run-id>>",
+		Action: func(ctx *cli.Context) error {
+			if !ctx.Args().Present() {
+				return errors.New("a command is required")
+			}
+
+			cfg := &fwconfig.Config{}
+			if err := config.Parse(ctx.GlobalString("config"), cfg); err != nil {
+				return err
+			}
+
+			if cfg.AdminSocket == "" {
+				return errors.New("admin_socket is not set in the configuration")
+			}
+
+			conn, err := net.DialTimeout("unix", cfg.AdminSocket, adminTimeout)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(adminTimeout))
+
+			if _, err := fmt.Fprintln(conn, strings.Join(ctx.Args(), " ")); err != nil {
+				return err
+			}
+
+			var reply struct {
+				adminReply
+				Result json.RawMessage `json:"result"`
+			}
+
+			if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+				return err
+			}
+
+			if !reply.OK {
+				return errors.New(reply.Error)
+			}
+
+			if len(reply.Result) != 0 {
+				fmt.Println(string(reply.Result))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,110 @@
+// Package build reads the image runs ask to have built from their repository
+// before the job runs in it, and packs the build context sent to the daemon.
+package build
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// BuildKey is the task or run metadata key asking for the image of the run to
+// be built from the repository, instead of pulled, with the Dockerfile, the
+// context directory and the target stage relative to the repository, and
+// build arguments. All are optional: an empty map builds the Dockerfile at the
+// root of the repository.
+//
+// e.g., {"build": {"dockerfile": "ci/Dockerfile", "context": ".",
+// "target": "test", "args": {"GO_VERSION": "1.16"}}}
+const BuildKey = "build"
+
+const (
+	defaultDockerfile = "Dockerfile"
+	defaultContext    = "."
+)
+
+// Spec is how the image of a run is built.
+type Spec struct {
+	// Dockerfile is relative to the context directory.
+	Dockerfile string
+	// Context is relative to the repository.
+	Context string
+	Target  string
+	Args    map[string]string
+}
+
+// FromMetadata returns the build under BuildKey in the metadata, if any.
+func FromMetadata(md map[string]interface{}) (*Spec, error) {
+	value, ok := md[BuildKey]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a map", BuildKey)
+	}
+
+	spec := &Spec{Dockerfile: defaultDockerfile, Context: defaultContext, Args: map[string]string{}}
+
+	for _, field := range []struct {
+		key    string
+		target *string
+	}{
+		{"dockerfile", &spec.Dockerfile},
+		{"context", &spec.Context},
+		{"target", &spec.Target},
+	} {
+		v, ok := m[field.key]
+		if !ok {
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("%v: %v must be a non-empty string", BuildKey, field.key)
+		}
+
+		*field.target = s
+	}
+
+	for _, p := range []string{spec.Dockerfile, spec.Context} {
+		if err := checkPath(p); err != nil {
+			return nil, fmt.Errorf("%v: %w", BuildKey, err)
+		}
+	}
+	spec.Dockerfile = path.Clean(spec.Dockerfile)
+	spec.Context = path.Clean(spec.Context)
+
+	if v, ok := m["args"]; ok {
+		args, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v: args must be a map of strings", BuildKey)
+		}
+
+		for name, arg := range args {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v: args must be a map of strings", BuildKey)
+			}
+
+			spec.Args[name] = s
+		}
+	}
+
+	return spec, nil
+}
+
+// checkPath errors out on paths which are not within the repository.
+func checkPath(p string) error {
+	if path.IsAbs(p) {
+		return fmt.Errorf("%v must be relative to the repository", p)
+	}
+
+	if clean := path.Clean(p); clean == ".." || strings.HasPrefix(clean, "../") {
+		return errors.New("paths may not leave the repository")
+	}
+
+	return nil
+}
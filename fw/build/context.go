@@ -0,0 +1,150 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// dockerignore lists the files of the context left out of it.
+const dockerignore = ".dockerignore"
+
+// Context returns the build context of the directory: a tar stream of its
+// files, less those matched by its .dockerignore. The Dockerfile and the
+// .dockerignore are always sent, as the daemon needs them. Symbolic links
+// are sent as such, never followed out of the directory.
+func Context(dir, dockerfile string) (io.ReadCloser, error) {
+	patterns, err := readIgnore(filepath.Join(dir, dockerignore))
+	if err != nil {
+		return nil, err
+	}
+
+	pm, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, p)
+			if err != nil || rel == "." {
+				return err
+			}
+
+			name := filepath.ToSlash(rel)
+
+			if name != dockerfile && name != dockerignore {
+				ignored, err := pm.Matches(rel)
+				if err != nil {
+					return err
+				}
+
+				// directories are still walked when patterns may bring back
+				// some of their files
+				if ignored {
+					if fi.IsDir() && !pm.Exclusions() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+			}
+
+			return addFile(tw, p, name, fi)
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+func addFile(tw *tar.Writer, p, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+		// sockets, devices and the like have no place in images
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// the owners of the files on the host mean nothing in the image
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// readIgnore returns the patterns of the .dockerignore file, if any.
+func readIgnore(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		exclusion := strings.HasPrefix(line, "!")
+		line = filepath.Clean(filepath.FromSlash(strings.TrimPrefix(line, "!")))
+		line = strings.TrimPrefix(line, string(filepath.Separator))
+
+		if exclusion {
+			line = "!" + line
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	return patterns, s.Err()
+}
@@ -0,0 +1,201 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TraceID is the id of the messages of the build stream carrying the
+// progress of BuildKit, as a StatusResponse of its control API.
+const TraceID = "moby.buildkit.trace"
+
+// Fields of the messages of the BuildKit control API read from traces.
+const (
+	statusVertexes = 1
+	statusLogs     = 3
+
+	vertexDigest    = 1
+	vertexName      = 3
+	vertexCached    = 4
+	vertexStarted   = 5
+	vertexCompleted = 6
+	vertexError     = 7
+
+	logVertex = 1
+	logMsg    = 4
+)
+
+// Progress writes the progress of a BuildKit build in the plain format of
+// docker build: each step, numbered in order of appearance, when it starts,
+// is cached, completes or fails, and its output.
+type Progress struct {
+	w       io.Writer
+	steps   map[string]int
+	started map[string]bool
+	done    map[string]bool
+}
+
+// NewProgress returns a Progress writing to w.
+func NewProgress(w io.Writer) *Progress {
+	return &Progress{w: w, steps: map[string]int{}, started: map[string]bool{}, done: map[string]bool{}}
+}
+
+type vertex struct {
+	digest, name, err          string
+	cached, started, completed bool
+}
+
+// Write writes the progress of a trace message.
+func (p *Progress) Write(trace []byte) error {
+	return forEachField(trace, func(num protowire.Number, value []byte) error {
+		switch num {
+		case statusVertexes:
+			v, err := parseVertex(value)
+			if err != nil {
+				return err
+			}
+			p.vertex(v)
+		case statusLogs:
+			return p.log(value)
+		}
+
+		return nil
+	})
+}
+
+func (p *Progress) step(digest string) int {
+	n, ok := p.steps[digest]
+	if !ok {
+		n = len(p.steps) + 1
+		p.steps[digest] = n
+	}
+
+	return n
+}
+
+func (p *Progress) vertex(v vertex) {
+	n := p.step(v.digest)
+
+	if (v.started || v.cached) && !p.started[v.digest] {
+		p.started[v.digest] = true
+		fmt.Fprintf(p.w, "#%d %v\n", n, v.name)
+	}
+
+	if p.done[v.digest] {
+		return
+	}
+
+	switch {
+	case v.err != "":
+		p.done[v.digest] = true
+		fmt.Fprintf(p.w, "#%d ERROR: %v\n", n, v.err)
+	case v.cached:
+		p.done[v.digest] = true
+		fmt.Fprintf(p.w, "#%d CACHED\n", n)
+	case v.completed:
+		p.done[v.digest] = true
+		fmt.Fprintf(p.w, "#%d DONE\n", n)
+	}
+}
+
+func (p *Progress) log(value []byte) error {
+	var digest, msg string
+
+	err := forEachField(value, func(num protowire.Number, value []byte) error {
+		switch num {
+		case logVertex:
+			digest = string(value)
+		case logMsg:
+			msg = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	n := p.step(digest)
+	for _, line := range strings.SplitAfter(msg, "\n") {
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+
+		fmt.Fprintf(p.w, "#%d %v", n, line)
+	}
+
+	return nil
+}
+
+func parseVertex(value []byte) (vertex, error) {
+	var v vertex
+
+	err := forEachField(value, func(num protowire.Number, value []byte) error {
+		switch num {
+		case vertexDigest:
+			v.digest = string(value)
+		case vertexName:
+			v.name = string(value)
+		case vertexCached:
+			v.cached = len(value) != 0 && value[0] != 0
+		case vertexStarted:
+			v.started = true
+		case vertexCompleted:
+			v.completed = true
+		case vertexError:
+			v.err = string(value)
+		}
+		return nil
+	})
+
+	return v, err
+}
+
+// forEachField calls fn with the number and value of each field of the
+// message which is bytes, a string, a message or a bool, skipping others.
+// Bools are passed as a byte.
+func forEachField(msg []byte, fn func(protowire.Number, []byte) error) error {
+	for len(msg) != 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		var value []byte
+
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(msg)
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(msg)
+			if v != 0 {
+				value = []byte{1}
+			} else {
+				value = []byte{0}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		if value != nil {
+			if err := fn(num, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
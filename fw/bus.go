@@ -0,0 +1,67 @@
+package fw
+
+import (
+	"context"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/events"
+)
+
+// openEvents creates the event bus from the webhooks in the configuration
+// and the sinks in the Entrypoint.
+func (e *Entrypoint) openEvents(runner Runner) {
+	sinks := append([]events.Sink{}, e.EventSinks...)
+
+	for _, wh := range runner.FrameworkConfig().Webhooks {
+		sinks = append(sinks, events.Filter(&events.Webhook{URL: wh.URL, Headers: wh.Headers}, wh.Events...))
+	}
+
+	e.events = events.New(sinks...)
+	if e.events == nil {
+		return
+	}
+
+	e.events.OnError = func(event *events.Event, err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		runner.LogsvcClient(&fwcontext.RunContext{}).Errorf(ctx, "Could not deliver %v event: %v", event.Type, err)
+	}
+}
+
+// emitRun emits an event about the run. Events of finished runs carry the
+// summary of their test reports, if any, under "report", and how their job
+// exited under "exit". Those of finished and canceled runs carry their timing
+// trace under "trace".
+func (e *Entrypoint) emitRun(typ string, runnerCtx *fwcontext.RunContext, outcome Outcome) {
+	data := map[string]interface{}{}
+
+	if typ == events.RunFinished {
+		if runnerCtx.Report != nil {
+			data["report"] = runnerCtx.Report
+		}
+
+		if runnerCtx.Exit != nil {
+			data["exit"] = runnerCtx.Exit
+		}
+	}
+
+	if typ == events.RunFinished || typ == events.RunCanceled {
+		if runnerCtx.Trace != nil {
+			data["trace"] = runnerCtx.Trace
+		}
+	}
+
+	if len(data) == 0 {
+		data = nil
+	}
+
+	e.events.Emit(&events.Event{
+		Type:     typ,
+		Hostname: e.Launch.Hostname(),
+		Queue:    runnerCtx.QueueItem.QueueName,
+		RunID:    runnerCtx.QueueItem.Run.Id,
+		Outcome:  string(outcome),
+		Data:     data,
+	})
+}
@@ -0,0 +1,79 @@
+package fw
+
+import (
+	"context"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// watchCancel cancels the context of the run once its cancellation is
+// requested in the queuesvc. The run is watched until its context is done.
+func (e *Entrypoint) watchCancel(runnerCtx *fwcontext.RunContext) {
+	e.runMapMutex.Lock()
+	defer e.runMapMutex.Unlock()
+
+	e.cancelWatch[runnerCtx] = true
+}
+
+// watchedRuns returns the runs being watched for cancellation, grouped by run
+// ID. Runs whose contexts are done are no longer watched.
+func (e *Entrypoint) watchedRuns() map[int64][]*fwcontext.RunContext {
+	runs := map[int64][]*fwcontext.RunContext{}
+
+	e.runMapMutex.Lock()
+	defer e.runMapMutex.Unlock()
+
+	for runnerCtx := range e.cancelWatch {
+		if runnerCtx.Ctx.Err() != nil {
+			delete(e.cancelWatch, runnerCtx)
+			continue
+		}
+
+		runs[runnerCtx.QueueItem.Run.Id] = append(runs[runnerCtx.QueueItem.Run.Id], runnerCtx)
+	}
+
+	return runs
+}
+
+// pollCancels checks the cancellation of all watched runs each cancel_poll
+// interval, from a single goroutine. The queuesvc has no API to check several
+// runs in one request, so one GetCancel is made per run ID; matrix cells and
+// retries of the same run share it. While the queuesvc is returning errors,
+// polls back off.
+func (e *Entrypoint) pollCancels(ctx context.Context, runner Runner) {
+	var failures int
+
+	for {
+		var errs int
+
+		for runID, runs := range e.watchedRuns() {
+			canceled, err := runner.QueueClient().GetCancel(ctx, runID)
+			if err != nil {
+				errs++
+				continue
+			}
+
+			if canceled {
+				for _, runnerCtx := range runs {
+					runnerCtx.CancelFunc()
+				}
+			}
+		}
+
+		if errs > 0 {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(runner.FrameworkConfig().CancelPoll.Delay(failures))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Package cgroup manages cgroup v2 control groups for work a runner executes
+// directly on the host, such as git operations and setup scripts.
+//
+// Each run gets its own cgroup below a common parent, with optional CPU,
+// memory and IO limits. Processes join it before they execute, and its
+// resource usage may be collected when the work completes. A pathological
+// clone or build script is then contained to its own cgroup instead of
+// taking down the runner host.
+//
+// Only the unified (v2) hierarchy is supported. The runner must be able to
+// write to the cgroup root, usually requiring root or a delegated subtree.
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRoot   = "/sys/fs/cgroup"
+	defaultParent = "tinyci"
+
+	cpuPeriod = 100000 // microseconds
+)
+
+// Config is the configuration for per-run cgroups.
+type Config struct {
+	// Root is the mount point of the cgroup v2 hierarchy. Defaults to /sys/fs/cgroup.
+	Root string `yaml:"root"`
+	// Parent is the cgroup, relative to the root, under which run cgroups are
+	// created. Defaults to "tinyci".
+	Parent string `yaml:"parent"`
+	// CPUs limits the amount of CPU time available, in cores.
+	CPUs float64 `yaml:"cpus"`
+	// Memory limits the memory available, in bytes.
+	Memory int64 `yaml:"memory"`
+	// IOWeight is the relative IO weight, from 1 to 10000. The kernel default is 100.
+	IOWeight int `yaml:"io_weight"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	if c.Root == "" {
+		c.Root = defaultRoot
+	}
+
+	if c.Parent == "" {
+		c.Parent = defaultParent
+	}
+
+	if !filepath.IsAbs(c.Root) {
+		return errors.New("cgroup root must be absolute")
+	}
+
+	if strings.Contains(c.Parent, "..") {
+		return errors.New("cgroup parent contains invalid paths: '..'")
+	}
+
+	if c.CPUs < 0 || c.Memory < 0 {
+		return errors.New("cgroup limits must not be negative")
+	}
+
+	if c.IOWeight != 0 && (c.IOWeight < 1 || c.IOWeight > 10000) {
+		return errors.New("cgroup io_weight must be between 1 and 10000")
+	}
+
+	return nil
+}
+
+// Cgroup is a single control group. Create one with New.
+type Cgroup struct {
+	path string
+}
+
+// Usage is the resource usage of a cgroup.
+type Usage struct {
+	// CPU is the total CPU time consumed.
+	CPU time.Duration
+	// MemoryPeak is the highest memory usage recorded, in bytes. It is zero on
+	// kernels which do not report it.
+	MemoryPeak uint64
+	// IORead is the amount of bytes read from block devices.
+	IORead uint64
+	// IOWrite is the amount of bytes written to block devices.
+	IOWrite uint64
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("cpu: %v, memory peak: %d bytes, io read: %d bytes, io written: %d bytes", u.CPU, u.MemoryPeak, u.IORead, u.IOWrite)
+}
+
+// New creates a cgroup with the name under the configured parent, applying
+// the configured limits. Validate must have been called on the config.
+func New(config Config, name string) (*Cgroup, error) {
+	if strings.ContainsAny(name, "/") || strings.Contains(name, "..") {
+		return nil, fmt.Errorf("invalid cgroup name %q", name)
+	}
+
+	parent := filepath.Join(config.Root, config.Parent)
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+
+	// controllers must be enabled at each level from the root down to be used
+	// by the run cgroups.
+	for dir := config.Root; ; {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+
+		if dir == parent {
+			break
+		}
+
+		rel, err := filepath.Rel(dir, parent)
+		if err != nil {
+			return nil, err
+		}
+
+		dir = filepath.Join(dir, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+	}
+
+	cg := &Cgroup{path: filepath.Join(parent, name)}
+
+	if err := os.Mkdir(cg.path, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	if config.CPUs > 0 {
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", int64(config.CPUs*cpuPeriod), cpuPeriod)); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Memory > 0 {
+		if err := cg.write("memory.max", strconv.FormatInt(config.Memory, 10)); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.IOWeight > 0 {
+		if err := cg.write("io.weight", fmt.Sprintf("default %d", config.IOWeight)); err != nil {
+			return nil, err
+		}
+	}
+
+	return cg, nil
+}
+
+func enableControllers(dir string) error {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers")) // #nosec
+	if err != nil {
+		return err
+	}
+
+	enable := []string{}
+
+	for _, controller := range strings.Fields(string(content)) {
+		switch controller {
+		case "cpu", "memory", "io":
+			enable = append(enable, "+"+controller)
+		}
+	}
+
+	if len(enable) == 0 {
+		return nil
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644) // #nosec
+}
+
+func (cg *Cgroup) write(file, content string) error {
+	return ioutil.WriteFile(filepath.Join(cg.path, file), []byte(content), 0644) // #nosec
+}
+
+// Path returns the path to the cgroup in the cgroup filesystem.
+func (cg *Cgroup) Path() string {
+	return cg.path
+}
+
+// Add moves the process into the cgroup. Children it spawns afterwards are
+// members as well; those it spawned before are not. Use Wrap for commands
+// which are yet to start.
+func (cg *Cgroup) Add(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// JoinFailed is the exit status of a command wrapped by Wrap which could not
+// join the cgroup.
+const JoinFailed = 125
+
+// Wrap returns the command wrapped in a shell which joins the cgroup before
+// executing it, so neither it nor any process it starts runs outside of the
+// cgroup. The shell exits with JoinFailed if it cannot join.
+func (cg *Cgroup) Wrap(command []string) []string {
+	script := fmt.Sprintf(`echo $$ > "$0" || exit %d; exec "$@"`, JoinFailed)
+	return append([]string{"/bin/sh", "-c", script, filepath.Join(cg.path, "cgroup.procs")}, command...)
+}
+
+// Usage collects the resource usage of the cgroup so far.
+func (cg *Cgroup) Usage() (Usage, error) {
+	var usage Usage
+
+	cpu, err := cg.readKeyed("cpu.stat")
+	if err != nil {
+		return usage, err
+	}
+
+	usage.CPU = time.Duration(cpu["usage_usec"]) * time.Microsecond
+
+	if content, err := ioutil.ReadFile(filepath.Join(cg.path, "memory.peak")); err == nil {
+		usage.MemoryPeak, _ = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	}
+
+	stat, err := ioutil.ReadFile(filepath.Join(cg.path, "io.stat"))
+	if err != nil {
+		// io controller may not be available; usage is still meaningful.
+		if os.IsNotExist(err) {
+			return usage, nil
+		}
+
+		return usage, err
+	}
+
+	// io.stat lines look like: 8:0 rbytes=1 wbytes=2 rios=3 wios=4 ...
+	s := bufio.NewScanner(strings.NewReader(string(stat)))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			value, _ := strconv.ParseUint(parts[1], 10, 64)
+
+			switch parts[0] {
+			case "rbytes":
+				usage.IORead += value
+			case "wbytes":
+				usage.IOWrite += value
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+func (cg *Cgroup) readKeyed(file string) (map[string]uint64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]uint64{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		ret[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+	}
+
+	return ret, nil
+}
+
+// Destroy kills any processes remaining in the cgroup and removes it.
+func (cg *Cgroup) Destroy() error {
+	for i := 0; i < 10; i++ {
+		content, err := ioutil.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		pids := strings.Fields(string(content))
+		if len(pids) == 0 {
+			break
+		}
+
+		for _, pid := range pids {
+			p, err := strconv.Atoi(pid)
+			if err != nil {
+				continue
+			}
+
+			if proc, err := os.FindProcess(p); err == nil {
+				proc.Kill()
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return os.Remove(cg.path)
+}
@@ -0,0 +1,52 @@
+package cgroup
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cg := &Cgroup{path: dir}
+
+	command := cg.Wrap([]string{"sh", "-c", "echo $$"})
+	out, err := exec.Command(command[0], command[1:]...).Output() // #nosec
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joined, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the wrapped command is executed in place of the shell which joined.
+	if strings.TrimSpace(string(joined)) != strings.TrimSpace(string(out)) {
+		t.Fatalf("pid %q joined the cgroup, but the command ran as %q", joined, out)
+	}
+
+	if _, err := strconv.Atoi(strings.TrimSpace(string(joined))); err != nil {
+		t.Fatalf("invalid pid %q joined the cgroup", joined)
+	}
+
+	cg = &Cgroup{path: filepath.Join(dir, "missing")}
+
+	command = cg.Wrap([]string{"true"})
+	err = exec.Command(command[0], command[1:]...).Run() // #nosec
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != JoinFailed {
+		t.Fatalf("expected exit status %d when the cgroup cannot be joined, got %v", JoinFailed, err)
+	}
+}
@@ -33,13 +33,23 @@
 package config
 
 import (
+	"fmt"
+	"math/rand"
 	"os"
 	"path"
+	"time"
 
 	"github.com/tinyci/ci-agents/clients/asset"
 	"github.com/tinyci/ci-agents/clients/log"
 	"github.com/tinyci/ci-agents/clients/queue"
 	"github.com/tinyci/ci-agents/config"
+	"github.com/tinyci/ci-runners/fw/cron"
+)
+
+const (
+	defaultPollInterval   = 5 * time.Second
+	defaultPollJitter     = 0.2
+	defaultPollMaxBackoff = 30 * time.Second
 )
 
 // Configurator is a loose wrapper around configuration objects. The
@@ -65,14 +75,244 @@ type Config struct {
 	Hostname string `yaml:"hostname"`
 	// QueueName is the name of the queue the runner should listen on.
 	QueueName string `yaml:"queue"`
+	// Queues, if set, are the queues the runner pulls work from instead of
+	// QueueName. Queues are polled in weighted round robin.
+	Queues []QueueConfig `yaml:"queues"`
 	// ClientConfig is the configuration of the various clients runners typically use.
 	ClientConfig ClientConfig `yaml:"clients"`
 
+	// MaxConcurrentRuns, if set, overrides the amount of queue items the runner
+	// may process in parallel.
+	MaxConcurrentRuns int `yaml:"max_concurrent_runs"`
+	// RateLimit limits how quickly the runner starts new queue items.
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// Capacity, if set, is the amount of resources of the host available to
+	// runs. Queue items requesting more than remains are deferred until runs
+	// finish; those requesting more than the whole capacity are rejected.
+	Capacity *CapacityConfig `yaml:"capacity"`
+	// Repositories, if set, restricts the repositories, and forks, whose
+	// queue items the runner accepts. Others are rejected.
+	Repositories *RepositoryPolicy `yaml:"repositories"`
+	// Labels are advertised by the runner in addition to those it detects.
+	// Queue items requiring labels the runner does not advertise are
+	// rejected. See fw.LabelsKey.
+	Labels map[string]string `yaml:"labels"`
+	// LongPoll, if set, is how long NextQueueItem requests may be held open by
+	// the queuesvc until a queue item is available, so that work is picked up
+	// as soon as it is queued. It is split evenly among the queues of the
+	// runner, and sent to the queuesvc under fw.LongPollHeader; the runner
+	// waits a few seconds longer for the answer. If the queuesvc answers with
+	// an empty queue well before that, it is assumed not to support long
+	// polls and the runner falls back to polling every second.
+	LongPoll time.Duration `yaml:"long_poll"`
+	// CancelPoll controls how often in-flight runs are checked for cancellation.
+	CancelPoll PollConfig `yaml:"cancel_poll"`
+	// Retry is the policy for retrying runs which fail due to transient
+	// infrastructure errors.
+	Retry RetryConfig `yaml:"retry"`
+	// DefaultTimeout is applied to runs which do not specify a timeout. If
+	// zero, such runs may run forever.
+	DefaultTimeout time.Duration `yaml:"default_timeout"`
+	// MaxTimeout, if non-zero, caps the timeout of all runs.
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+	// TimeoutGrace is how long runs which time out are given to stop
+	// gracefully before they are canceled. See fw.Terminator.
+	TimeoutGrace time.Duration `yaml:"timeout_grace"`
+	// MaxTimeoutExtension is the total time by which runs may extend their
+	// timeout while they run. Zero disables extensions. See
+	// fwcontext.RunContext.ExtendDeadline.
+	MaxTimeoutExtension time.Duration `yaml:"max_timeout_extension"`
+	// AdminSocket, if set, is the path of a unix socket on which the runner
+	// accepts administrative commands, such as "drain". See the "admin"
+	// subcommand.
+	AdminSocket string `yaml:"admin_socket"`
+	// MaintenanceWindows are periods during which the runner does not accept
+	// new queue items.
+	MaintenanceWindows []MaintenanceWindow `yaml:"maintenance_windows"`
+	// Webhooks receive lifecycle events of the runner as JSON. See fw/events.
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// HTTPAddr, if set, is the address of an HTTP server exposing /healthz,
+	// /readyz, /runs and /metrics, for probes, operators and monitoring.
+	HTTPAddr string `yaml:"http_addr"`
+	// StateDir, if set, is the directory in which in-flight runs are recorded,
+	// so they may be recovered or reported if the runner crashes.
+	StateDir string `yaml:"state_dir"`
+	// TraceDir, if set, is a directory the JSON timing trace of each run is
+	// also written to, named after the run id. The trace is always attached
+	// to the run_finished and run_canceled events.
+	TraceDir string `yaml:"trace_dir"`
+	// Vault, if set, resolves the references to Vault secrets in the string
+	// values of the configuration, e.g. "vault:runners/registry#password",
+	// and lets the runner fetch the secrets of jobs. See VaultPrefix.
+	Vault *VaultConfig `yaml:"vault"`
+
 	// Clients is a locally-populated struct (see Load()) based on ClientConfig.
 	// It contains the actual client structs.
 	Clients *Clients `yaml:"-"`
 }
 
+// Timeout returns the timeout to apply to a run that requested the given
+// timeout, after applying the default and maximum timeouts. Zero means no
+// timeout.
+func (c *Config) Timeout(requested time.Duration) time.Duration {
+	timeout := requested
+	if timeout <= 0 {
+		timeout = c.DefaultTimeout
+	}
+
+	if c.MaxTimeout > 0 && (timeout <= 0 || timeout > c.MaxTimeout) {
+		timeout = c.MaxTimeout
+	}
+
+	return timeout
+}
+
+// PollConfig is the configuration of a periodic poll against a service. Polls
+// are spread out with random jitter, and back off exponentially while the
+// service is returning errors.
+type PollConfig struct {
+	// Interval is the time between polls. Defaults to five seconds.
+	Interval time.Duration `yaml:"interval"`
+	// Jitter is the fraction of the interval to randomly add to or subtract
+	// from each delay, between 0 and 1. Defaults to 0.2; 0 disables it.
+	Jitter *float64 `yaml:"jitter"`
+	// MaxBackoff caps the delay while backing off from errors. Defaults to 30
+	// seconds.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// Validate errors out when the configuration doesn't match expectations.
+func (pc PollConfig) Validate() error {
+	if pc.Jitter != nil && (*pc.Jitter < 0 || *pc.Jitter > 1) {
+		return fmt.Errorf("jitter must be between 0 and 1, not %v", *pc.Jitter)
+	}
+
+	return nil
+}
+
+// Delay returns the time to wait before the next poll, given the number of
+// consecutive failures so far.
+func (pc PollConfig) Delay(failures int) time.Duration {
+	interval := pc.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	max := pc.MaxBackoff
+	if max <= 0 {
+		max = defaultPollMaxBackoff
+	}
+
+	for i := 0; i < failures && interval < max; i++ {
+		interval *= 2
+	}
+
+	if interval > max {
+		interval = max
+	}
+
+	jitter := defaultPollJitter
+	if pc.Jitter != nil {
+		jitter = *pc.Jitter
+	}
+
+	// scale by a random factor in [1-jitter, 1+jitter)
+	return time.Duration(float64(interval) * (1 + jitter*(2*rand.Float64()-1))) // #nosec
+}
+
+// MaintenanceWindow is a recurring period during which the runner does not
+// accept new queue items, e.g. for fleet upgrades.
+type MaintenanceWindow struct {
+	// Schedule is a cron-style schedule of the start of the window, e.g.
+	// "0 2 * * sun" for 2AM every sunday. See fw/cron for the syntax.
+	Schedule string `yaml:"schedule"`
+	// Duration is the length of the window.
+	Duration time.Duration `yaml:"duration"`
+	// Timezone is the IANA name of the timezone the schedule is in. Defaults
+	// to the local timezone.
+	Timezone string `yaml:"timezone"`
+	// Drain, if true, makes the runner exit once its in-flight runs complete
+	// when the window starts, so it can be upgraded or restarted by its
+	// supervisor.
+	Drain bool `yaml:"drain"`
+
+	schedule *cron.Schedule
+	location *time.Location
+}
+
+// Validate parses the schedule and timezone of the window.
+func (mw *MaintenanceWindow) Validate() error {
+	var err error
+
+	mw.schedule, err = cron.Parse(mw.Schedule)
+	if err != nil {
+		return err
+	}
+
+	if mw.Duration <= 0 {
+		return fmt.Errorf("maintenance window %q must have a positive duration", mw.Schedule)
+	}
+
+	mw.location = time.Local
+	if mw.Timezone != "" {
+		mw.location, err = time.LoadLocation(mw.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Active returns true if t is within the window. The window must have been
+// validated.
+func (mw *MaintenanceWindow) Active(t time.Time) bool {
+	return mw.schedule != nil && mw.schedule.Active(t.In(mw.location), mw.Duration)
+}
+
+// WebhookConfig is a webhook lifecycle events are posted to.
+type WebhookConfig struct {
+	// URL is the endpoint events are posted to.
+	URL string `yaml:"url"`
+	// Headers are added to each request, e.g. for authentication.
+	Headers map[string]string `yaml:"headers"`
+	// Events, if set, limits the event types posted, e.g. ["run_finished"].
+	Events []string `yaml:"events"`
+}
+
+// QueueConfig is a queue the runner pulls work from.
+type QueueConfig struct {
+	// Name is the name of the queue.
+	Name string `yaml:"name"`
+	// Weight is the share of polls given to the queue relative to the other
+	// queues. Defaults to 1.
+	Weight int `yaml:"weight"`
+}
+
+// RateLimitConfig limits the rate at which queue items are pulled, so a storm
+// of small jobs cannot exhaust host resources such as docker storage or
+// temporary directories. It is a token bucket: up to Burst items may be
+// pulled at once, after which items are pulled at RunsPerMinute.
+type RateLimitConfig struct {
+	// RunsPerMinute is the sustained rate of queue items pulled. Zero
+	// disables rate limiting.
+	RunsPerMinute float64 `yaml:"runs_per_minute"`
+	// Burst is the amount of queue items that may be pulled at once. Defaults
+	// to 1.
+	Burst int `yaml:"burst"`
+}
+
+// RetryConfig is the policy for retrying runs which fail due to transient
+// infrastructure errors, such as an image pull failing. Runners decide which
+// errors are retryable.
+type RetryConfig struct {
+	// MaxAttempts is the amount of times a run is attempted before its failure
+	// is reported. Defaults to 1, disabling retries.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff controls the delay between attempts.
+	Backoff PollConfig `yaml:"backoff"`
+}
+
 // ClientConfig is the configuration settings for each service we need a client
 // to. Please note that these are not urls -- just host:port pairs.
 type ClientConfig struct {
@@ -87,6 +327,8 @@ type Clients struct {
 	Log   *log.SubLogger
 	Queue *queue.Client
 	Asset *asset.Client
+	// Vault is the Vault client, if configured.
+	Vault *Vault
 }
 
 // Config satisfies the configurator interface.
@@ -108,6 +350,50 @@ func Load(filename string, c Configurator) error {
 
 	cfg := c.Config()
 
+	if cfg.Vault != nil {
+		if err := cfg.Vault.Validate(); err != nil {
+			return err
+		}
+
+		vault, err := NewVault(cfg.Vault)
+		if err != nil {
+			return err
+		}
+
+		if err := vault.Resolve(c); err != nil {
+			vault.Close()
+			return err
+		}
+
+		cfg.Clients.Vault = vault
+	}
+
+	if cfg.Repositories != nil {
+		if err := cfg.Repositories.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Capacity != nil {
+		if err := cfg.Capacity.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.CancelPoll.Validate(); err != nil {
+		return fmt.Errorf("cancel_poll: %w", err)
+	}
+
+	if err := cfg.Retry.Backoff.Validate(); err != nil {
+		return fmt.Errorf("retry backoff: %w", err)
+	}
+
+	for i := range cfg.MaintenanceWindows {
+		if err := cfg.MaintenanceWindows[i].Validate(); err != nil {
+			return err
+		}
+	}
+
 	cert, err := cfg.ClientConfig.TLS.Load()
 	if err != nil {
 		return err
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollConfigJitter(t *testing.T) {
+	zero, half, negative, over := 0.0, 0.5, -0.1, 1.5
+
+	table := []struct {
+		name     string
+		jitter   *float64
+		min, max time.Duration
+		invalid  bool
+	}{
+		{name: "unset", jitter: nil, min: 800 * time.Millisecond, max: 1200 * time.Millisecond},
+		{name: "disabled", jitter: &zero, min: time.Second, max: time.Second},
+		{name: "half", jitter: &half, min: 500 * time.Millisecond, max: 1500 * time.Millisecond},
+		{name: "negative", jitter: &negative, invalid: true},
+		{name: "above one", jitter: &over, invalid: true},
+	}
+
+	for _, test := range table {
+		pc := PollConfig{Interval: time.Second, Jitter: test.jitter}
+
+		err := pc.Validate()
+		if test.invalid {
+			if err == nil {
+				t.Fatalf("%v: jitter was not rejected", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			if delay := pc.Delay(0); delay < test.min || delay > test.max {
+				t.Fatalf("%v: delay %v is not within [%v, %v]", test.name, delay, test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestPollConfigDefaults(t *testing.T) {
+	pc := PollConfig{}
+
+	for i := 0; i < 100; i++ {
+		if delay := pc.Delay(0); delay < 4*time.Second || delay > 6*time.Second {
+			t.Fatalf("delay %v is not within [4s, 6s]", delay)
+		}
+	}
+
+	if delay := pc.Delay(10); delay > defaultPollMaxBackoff*6/5 {
+		t.Fatalf("delay %v exceeds the maximum backoff", delay)
+	}
+}
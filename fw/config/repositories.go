@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// RepositoryPolicy restricts the repositories a runner clones and runs jobs
+// for, so shared runners cannot be co-opted to run arbitrary code. Patterns
+// match repository names in owner/repo format with path.Match syntax, e.g.
+// "myorg/*", and are case-insensitive.
+type RepositoryPolicy struct {
+	// Allow, if set, are the only repositories permitted.
+	Allow []string `yaml:"allow"`
+	// Deny are repositories which are never permitted, even if allowed.
+	Deny []string `yaml:"deny"`
+}
+
+// Validate checks the patterns of the policy.
+func (rp *RepositoryPolicy) Validate() error {
+	for _, pattern := range append(append([]string{}, rp.Allow...), rp.Deny...) {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Permits returns nil if the repository is permitted by the policy, or an
+// error saying why it is not. A nil policy permits all repositories.
+func (rp *RepositoryPolicy) Permits(repoName string) error {
+	if rp == nil {
+		return nil
+	}
+
+	name := strings.ToLower(repoName)
+
+	for _, pattern := range rp.Deny {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return fmt.Errorf("repository %v is denied by pattern %q", repoName, pattern)
+		}
+	}
+
+	if len(rp.Allow) == 0 {
+		return nil
+	}
+
+	for _, pattern := range rp.Allow {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("repository %v is not allowed on this runner", repoName)
+}
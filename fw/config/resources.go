@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+)
+
+// quantitySuffixes are ordered so binary suffixes are matched before their
+// decimal counterparts.
+var quantitySuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"m", 0.001},
+	{"k", 1e3},
+	{"K", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"T", 1e12},
+}
+
+// Resources is an amount of host resources: CPUs, and bytes of memory and
+// disk.
+type Resources struct {
+	CPU    float64
+	Memory float64
+	Disk   float64
+}
+
+// ParseResources parses the resources requested by a run. Values use the
+// kubernetes quantity notation, e.g. "500m" CPUs or "2Gi" of memory. Unset
+// values are zero.
+func ParseResources(r *types.Resources) (Resources, error) {
+	var (
+		res Resources
+		err error
+	)
+
+	if r == nil {
+		return res, nil
+	}
+
+	if res.CPU, err = ParseQuantity(r.Cpu); err != nil {
+		return res, fmt.Errorf("cpu: %w", err)
+	}
+
+	if res.Memory, err = ParseQuantity(r.Memory); err != nil {
+		return res, fmt.Errorf("memory: %w", err)
+	}
+
+	if res.Disk, err = ParseQuantity(r.Disk); err != nil {
+		return res, fmt.Errorf("disk: %w", err)
+	}
+
+	return res, nil
+}
+
+// ParseQuantity parses a kubernetes-style quantity such as "1.5", "500m",
+// "512M" or "2Gi". The empty string is zero.
+func ParseQuantity(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+
+	for _, qs := range quantitySuffixes {
+		if strings.HasSuffix(s, qs.suffix) {
+			multiplier = qs.multiplier
+			s = strings.TrimSuffix(s, qs.suffix)
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+
+	return v * multiplier, nil
+}
+
+// Fits returns true if r is within the limits of each resource in capacity.
+// Resources without a capacity (zero) are not limited.
+func (r Resources) Fits(capacity Resources) bool {
+	return fits(r.CPU, capacity.CPU) && fits(r.Memory, capacity.Memory) && fits(r.Disk, capacity.Disk)
+}
+
+func fits(v, capacity float64) bool {
+	return capacity == 0 || v <= capacity
+}
+
+// Add returns the sum of the resources.
+func (r Resources) Add(o Resources) Resources {
+	return Resources{CPU: r.CPU + o.CPU, Memory: r.Memory + o.Memory, Disk: r.Disk + o.Disk}
+}
+
+// Sub returns the difference of the resources.
+func (r Resources) Sub(o Resources) Resources {
+	return Resources{CPU: r.CPU - o.CPU, Memory: r.Memory - o.Memory, Disk: r.Disk - o.Disk}
+}
+
+func (r Resources) String() string {
+	return fmt.Sprintf("cpu: %g, memory: %.0f bytes, disk: %.0f bytes", r.CPU, r.Memory, r.Disk)
+}
+
+// CapacityConfig is the capacity of the host available to runs, in the same
+// notation as the resources requested by runs. Unset resources are not
+// limited.
+type CapacityConfig struct {
+	CPU    string `yaml:"cpu"`
+	Memory string `yaml:"memory"`
+	Disk   string `yaml:"disk"`
+
+	resources Resources
+}
+
+// Validate parses the capacity.
+func (cc *CapacityConfig) Validate() error {
+	var err error
+
+	cc.resources, err = ParseResources(&types.Resources{Cpu: cc.CPU, Memory: cc.Memory, Disk: cc.Disk})
+	if err != nil {
+		return fmt.Errorf("capacity: %w", err)
+	}
+
+	return nil
+}
+
+// Resources returns the parsed capacity. The configuration must have been
+// validated.
+func (cc *CapacityConfig) Resources() Resources {
+	return cc.resources
+}
@@ -0,0 +1,423 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVaultMount   = "secret"
+	defaultVaultTimeout = 10 * time.Second
+
+	// VaultPrefix starts the string values of the configuration which are
+	// references to secrets in Vault, as vault:<path>#<key>, e.g.
+	// "vault:runners/registry#password". Paths are relative to the mount of
+	// the KV engine.
+	VaultPrefix = "vault:"
+)
+
+// VaultConfig configures the Vault client resolving the references to
+// secrets in the configuration, and from which runners may fetch the secrets
+// of jobs. The runner logs in with a token, or an AppRole.
+type VaultConfig struct {
+	// Addr is the address of Vault, e.g. https://vault:8200.
+	Addr string `yaml:"addr"`
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string `yaml:"namespace"`
+	// CACert, if set, is the file of the CA certificate of Vault.
+	CACert string `yaml:"ca_cert"`
+	// TokenFile is a file holding the token to log in with. Defaults to the
+	// VAULT_TOKEN environment variable.
+	TokenFile string `yaml:"token_file"`
+	// RoleID and SecretIDFile, if set, log in with AppRole instead of a
+	// token.
+	RoleID       string `yaml:"role_id"`
+	SecretIDFile string `yaml:"secret_id_file"`
+	// Mount is where the KV secrets engine is mounted. Defaults to "secret".
+	Mount string `yaml:"mount"`
+	// KVVersion is the version of the KV secrets engine, 1 or 2. Defaults to
+	// 2.
+	KVVersion int `yaml:"kv_version"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (vc *VaultConfig) Validate() error {
+	if vc.Addr == "" {
+		return errors.New("vault addr is required")
+	}
+
+	if vc.RoleID != "" && vc.SecretIDFile == "" {
+		return errors.New("vault role_id requires a secret_id_file")
+	}
+
+	if vc.Mount == "" {
+		vc.Mount = defaultVaultMount
+	}
+
+	switch vc.KVVersion {
+	case 0:
+		vc.KVVersion = 2
+	case 1, 2:
+	default:
+		return fmt.Errorf("invalid vault kv_version %d: must be 1 or 2", vc.KVVersion)
+	}
+
+	return nil
+}
+
+// Vault is a client of Vault reading secrets from its KV engine. Its token
+// is renewed, or the runner logs in again, past half its lifetime, until the
+// client is closed.
+type Vault struct {
+	config *VaultConfig
+	client *http.Client
+	stop   chan struct{}
+
+	mutex     sync.Mutex
+	token     string
+	issued    time.Time
+	ttl       time.Duration
+	renewable bool
+}
+
+// NewVault logs in to Vault.
+func NewVault(vc *VaultConfig) (*Vault, error) {
+	v := &Vault{config: vc, client: &http.Client{Timeout: defaultVaultTimeout}, stop: make(chan struct{})}
+
+	if vc.CACert != "" {
+		pem, err := ioutil.ReadFile(vc.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", vc.CACert)
+		}
+
+		v.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}
+	}
+
+	if err := v.login(); err != nil {
+		return nil, err
+	}
+
+	go v.renew()
+
+	return v, nil
+}
+
+// Close stops the renewal of the token.
+func (v *Vault) Close() {
+	close(v.stop)
+}
+
+func (v *Vault) renew() {
+	for {
+		v.mutex.Lock()
+		wait := time.Hour
+		if v.ttl != 0 {
+			wait = time.Until(v.issued.Add(v.ttl / 2))
+		}
+		v.mutex.Unlock()
+
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		select {
+		case <-v.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		// on failure, reads try again and report the error
+		v.mutex.Lock()
+		v.refresh()
+		v.mutex.Unlock()
+	}
+}
+
+type vaultAuth struct {
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// login logs in with the AppRole or the token. The mutex must be held or the
+// client not yet shared.
+func (v *Vault) login() error {
+	if v.config.RoleID != "" {
+		secretID, err := ioutil.ReadFile(v.config.SecretIDFile)
+		if err != nil {
+			return err
+		}
+
+		var resp vaultAuth
+		if err := v.do(http.MethodPost, "auth/approle/login", map[string]string{
+			"role_id":   v.config.RoleID,
+			"secret_id": strings.TrimSpace(string(secretID)),
+		}, &resp); err != nil {
+			return fmt.Errorf("vault approle login: %w", err)
+		}
+
+		if resp.Auth == nil {
+			return errors.New("vault approle login: no token returned")
+		}
+
+		v.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+		return nil
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if v.config.TokenFile != "" {
+		content, err := ioutil.ReadFile(v.config.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+
+	if token == "" {
+		return errors.New("no vault token: set token_file, VAULT_TOKEN or an approle")
+	}
+
+	v.token = token
+
+	var resp struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+
+	if err := v.do(http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+		return fmt.Errorf("vault token lookup: %w", err)
+	}
+
+	v.setToken(token, resp.Data.TTL, resp.Data.Renewable)
+	return nil
+}
+
+// setToken records the token and its ttl, in seconds; zero never expires.
+func (v *Vault) setToken(token string, ttl int, renewable bool) {
+	v.token = token
+	v.renewable = renewable
+	v.issued = time.Now()
+	v.ttl = time.Duration(ttl) * time.Second
+}
+
+// refresh renews the token, or logs in again, once it is past half its
+// lifetime. The mutex must be held.
+func (v *Vault) refresh() error {
+	if v.ttl == 0 || time.Since(v.issued) < v.ttl/2 {
+		return nil
+	}
+
+	if v.renewable {
+		var resp vaultAuth
+		if err := v.do(http.MethodPost, "auth/token/renew-self", map[string]string{}, &resp); err == nil && resp.Auth != nil {
+			// renewals are capped by the max ttl of the token; once they
+			// fall short, log in again with the approle for a new one
+			if resp.Auth.LeaseDuration*2 >= int(v.ttl/time.Second) || v.config.RoleID == "" {
+				v.setToken(v.token, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+				return nil
+			}
+		}
+	}
+
+	return v.login()
+}
+
+// Read returns the secret at the path, relative to the mount of the KV
+// engine, as a map of keys to values. Secrets which do not exist are empty.
+func (v *Vault) Read(path string) (map[string]string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+
+	path = strings.Trim(path, "/")
+	apiPath := v.config.Mount + "/" + path
+	if v.config.KVVersion == 2 {
+		apiPath = v.config.Mount + "/data/" + path
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+
+	err := v.do(http.MethodGet, apiPath, nil, &resp)
+	if errors.Is(err, errVaultNotFound) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %v from vault: %w", path, err)
+	}
+
+	data := resp.Data
+	if v.config.KVVersion == 2 {
+		data, _ = resp.Data["data"].(map[string]interface{})
+	}
+
+	secret := map[string]string{}
+	for key, value := range data {
+		secret[key] = fmt.Sprint(value)
+	}
+
+	return secret, nil
+}
+
+var errVaultNotFound = errors.New("not found")
+
+func (v *Vault) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(v.config.Addr, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+
+	if v.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.config.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errVaultNotFound
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+
+		return fmt.Errorf("status %d: %v", resp.StatusCode, strings.Join(e.Errors, "; "))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Resolve replaces the references to Vault secrets in the string fields of
+// the configuration, however nested, with the secrets.
+func (v *Vault) Resolve(c interface{}) error {
+	cache := map[string]map[string]string{}
+	return v.resolve(reflect.ValueOf(c), cache)
+}
+
+func (v *Vault) resolve(value reflect.Value, cache map[string]map[string]string) error {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			return v.resolve(value.Elem(), cache)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			// unexported, or not part of the configuration
+			if field := value.Type().Field(i); field.PkgPath != "" || field.Tag.Get("yaml") == "-" {
+				continue
+			}
+
+			if err := v.resolve(value.Field(i), cache); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := v.resolve(value.Index(i), cache); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if value.Type().Elem().Kind() != reflect.String {
+			for _, key := range value.MapKeys() {
+				if err := v.resolve(value.MapIndex(key), cache); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for _, key := range value.MapKeys() {
+			resolved, err := v.lookup(value.MapIndex(key).String(), cache)
+			if err != nil {
+				return err
+			}
+			value.SetMapIndex(key, reflect.ValueOf(resolved).Convert(value.Type().Elem()))
+		}
+	case reflect.String:
+		if !value.CanSet() {
+			return nil
+		}
+
+		resolved, err := v.lookup(value.String(), cache)
+		if err != nil {
+			return err
+		}
+		value.SetString(resolved)
+	}
+
+	return nil
+}
+
+// lookup returns the secret referenced by the string, or the string if it is
+// not a reference.
+func (v *Vault) lookup(ref string, cache map[string]map[string]string) (string, error) {
+	if !strings.HasPrefix(ref, VaultPrefix) {
+		return ref, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(ref, VaultPrefix), "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid vault reference %q: must be vault:<path>#<key>", ref)
+	}
+
+	secret, ok := cache[parts[0]]
+	if !ok {
+		var err error
+		if secret, err = v.Read(parts[0]); err != nil {
+			return "", err
+		}
+		cache[parts[0]] = secret
+	}
+
+	value, ok := secret[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("vault secret %v has no key %v", parts[0], parts[1])
+	}
+
+	return value, nil
+}
@@ -2,9 +2,12 @@ package context
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"github.com/tinyci/ci-runners/fw/reports"
+	"github.com/tinyci/ci-runners/fw/trace"
 	"github.com/urfave/cli"
 )
 
@@ -32,4 +35,41 @@ type RunContext struct {
 	Ctx context.Context
 	// RunCancelFunc is the cancel func to close the above context.
 	CancelFunc context.CancelFunc
+
+	// Trace records the timing of the phases and steps of the run. Runners may
+	// record their own steps into it.
+	Trace *trace.Trace
+
+	// Cell is the matrix cell this run executes, if the queue item contained a
+	// matrix specification. Nil otherwise.
+	Cell *MatrixCell
+	// Output, if set, is where the run should write its job output instead of
+	// shipping its own log. The framework sets it for matrix cells, so all
+	// cells share the log of the queue item.
+	Output io.Writer
+
+	// ExtendDeadline, if set, pushes the timeout of the run back by the given
+	// duration, up to the max_timeout_extension of the framework
+	// configuration, returning the new deadline. Runs may call it from Run()
+	// when they are making progress, e.g. still streaming output, but are
+	// close to timing out. It is nil for runs without a timeout.
+	ExtendDeadline func(time.Duration) (time.Time, error)
+
+	// Report, if set by Run(), summarizes the test reports of the run. The
+	// framework logs it with the outcome and attaches it to the run_finished
+	// event, as the queuesvc only records whether the run passed.
+	Report *reports.Summary
+	// Exit, if set by Run(), is how its job exited. The framework logs it
+	// with the outcome and attaches it to the run_finished event.
+	Exit *ExitStatus
+}
+
+// MatrixCell is a single combination of values from a matrix specification.
+type MatrixCell struct {
+	// Name is the human-readable name of the cell, e.g. "arch=amd64,go=1.16".
+	Name string
+	// Index is the position of the cell in the matrix, from 0.
+	Index int
+	// Values maps each matrix key to the value for this cell.
+	Values map[string]string
 }
@@ -0,0 +1,29 @@
+package context
+
+import "fmt"
+
+// ExitStatus is how the job of a run exited, telling e.g. a job killed for
+// running out of memory from a failing test.
+type ExitStatus struct {
+	// Code is the exit code of the job: 128 plus the signal if it was killed
+	// by one, as shells report it.
+	Code int `json:"code"`
+	// Signal is the name of the signal which killed the job, e.g. SIGKILL,
+	// if any.
+	Signal string `json:"signal,omitempty"`
+	// OOMKilled is set if the job was killed for running out of memory.
+	OOMKilled bool `json:"oom_killed"`
+}
+
+func (es *ExitStatus) String() string {
+	s := fmt.Sprintf("exited with code %d", es.Code)
+	if es.Signal != "" {
+		s += fmt.Sprintf(" (killed by %v)", es.Signal)
+	}
+
+	if es.OOMKilled {
+		s += ": out of memory"
+	}
+
+	return s
+}
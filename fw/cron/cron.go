@@ -0,0 +1,182 @@
+// Package cron parses cron-style schedules.
+//
+// Schedules have the five standard fields: minute, hour, day of month, month
+// and day of week. Each field may be "*", a number, a range ("1-5"), a step
+// ("*/15", "0-30/10") or a comma-separated list of those. Months and days of
+// the week may also be given as three-letter English names ("jan", "mon").
+// Sunday is 0 or 7. As in cron(8), if both the day of month and the day of
+// week are restricted, a time matches if either of them does.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	dayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: monthNames},
+	{name: "day of week", min: 0, max: 7, names: dayNames},
+}
+
+// Schedule is a parsed cron schedule.
+type Schedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	domStar, dowStar bool
+}
+
+// Parse parses a five-field cron schedule.
+func Parse(spec string) (*Schedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron schedule %q must have %d fields", spec, len(fields))
+	}
+
+	sets := make([]map[int]bool, len(fields))
+
+	for i, part := range parts {
+		set, err := fields[i].parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("cron schedule %q: %w", spec, err)
+		}
+
+		sets[i] = set
+	}
+
+	// sunday may be 0 or 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &Schedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// Matches returns true if the schedule matches the minute t falls in.
+func (s *Schedule) Matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+
+	dom := s.dom[t.Day()]
+	dow := s.dow[int(t.Weekday())]
+
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Active returns true if the schedule matched at some minute within the
+// duration before t, i.e. if t is within a window of the given duration
+// starting at a scheduled time.
+func (s *Schedule) Active(t time.Time, duration time.Duration) bool {
+	t = t.Truncate(time.Minute)
+
+	for start := t; t.Sub(start) < duration; start = start.Add(-time.Minute) {
+		if s.Matches(start) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f field) parse(spec string) (map[int]bool, error) {
+	set := map[int]bool{}
+
+	for _, item := range strings.Split(spec, ",") {
+		rng, step := item, 1
+
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+
+			rng = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %v %q", f.name, item)
+			}
+		}
+
+		lo, hi := f.min, f.max
+
+		if rng != "*" {
+			var err error
+
+			bounds := strings.SplitN(rng, "-", 2)
+
+			lo, err = f.value(bounds[0])
+			if err != nil {
+				return nil, err
+			}
+
+			hi = lo
+
+			if len(bounds) == 2 {
+				hi, err = f.value(bounds[1])
+				if err != nil {
+					return nil, err
+				}
+			} else if step != 1 {
+				hi = f.max
+			}
+
+			if hi < lo {
+				return nil, fmt.Errorf("invalid range in %v %q", f.name, item)
+			}
+		}
+
+		for i := lo; i <= hi; i += step {
+			set[i] = true
+		}
+	}
+
+	return set, nil
+}
+
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %v %q", f.name, s)
+	}
+
+	return v, nil
+}
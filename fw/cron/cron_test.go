@@ -0,0 +1,123 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	table := []struct {
+		name    string
+		spec    string
+		invalid bool
+	}{
+		{name: "stars", spec: "* * * * *"},
+		{name: "lists, ranges and steps", spec: "0,30 9-17 */2 1-12/3 1-5"},
+		{name: "names", spec: "0 0 * JAN,jul Mon-fri"},
+		{name: "sunday as 7", spec: "0 0 * * 7"},
+		{name: "too few fields", spec: "* * * *", invalid: true},
+		{name: "too many fields", spec: "* * * * * *", invalid: true},
+		{name: "out of range", spec: "60 * * * *", invalid: true},
+		{name: "day of month 0", spec: "* * 0 * *", invalid: true},
+		{name: "day of week 8", spec: "* * * * 8", invalid: true},
+		{name: "reversed range", spec: "* 17-9 * * *", invalid: true},
+		{name: "zero step", spec: "*/0 * * * *", invalid: true},
+		{name: "bad step", spec: "*/x * * * *", invalid: true},
+		{name: "unknown name", spec: "* * * foo *", invalid: true},
+		{name: "day name as month", spec: "* * * mon *", invalid: true},
+		{name: "empty item", spec: "1,,2 * * * *", invalid: true},
+	}
+
+	for _, test := range table {
+		_, err := Parse(test.spec)
+		if (err != nil) != test.invalid {
+			t.Fatalf("%v: got error %v, want invalid: %v", test.name, err, test.invalid)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	// 2021-06-01 is a tuesday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, time.June, day, hour, minute, 30, 0, time.UTC)
+	}
+
+	table := []struct {
+		name    string
+		spec    string
+		t       time.Time
+		matches bool
+	}{
+		{name: "every minute", spec: "* * * * *", t: at(1, 12, 34), matches: true},
+		{name: "minute", spec: "34 * * * *", t: at(1, 12, 34), matches: true},
+		{name: "other minute", spec: "35 * * * *", t: at(1, 12, 34)},
+		{name: "step", spec: "*/15 * * * *", t: at(1, 12, 45), matches: true},
+		{name: "off step", spec: "*/15 * * * *", t: at(1, 12, 44)},
+		{name: "range step", spec: "0-30/10 * * * *", t: at(1, 12, 30), matches: true},
+		{name: "past range step", spec: "0-30/10 * * * *", t: at(1, 12, 40)},
+		{name: "start step", spec: "5/20 * * * *", t: at(1, 12, 45), matches: true},
+		{name: "hour range", spec: "* 9-17 * * *", t: at(1, 17, 59), matches: true},
+		{name: "outside hour range", spec: "* 9-17 * * *", t: at(1, 18, 0)},
+		{name: "month name", spec: "* * * jun *", t: at(1, 0, 0), matches: true},
+		{name: "other month", spec: "* * * jul *", t: at(1, 0, 0)},
+		{name: "day of week", spec: "* * * * tue", t: at(1, 0, 0), matches: true},
+		{name: "other day of week", spec: "* * * * wed", t: at(1, 0, 0)},
+		{name: "sunday as 0", spec: "* * * * 0", t: at(6, 0, 0), matches: true},
+		{name: "sunday as 7", spec: "* * * * 7", t: at(6, 0, 0), matches: true},
+		{name: "day of month only", spec: "* * 1 * *", t: at(1, 0, 0), matches: true},
+		{name: "other day of month only", spec: "* * 2 * *", t: at(1, 0, 0)},
+		{name: "either day, by day of month", spec: "* * 1 * fri", t: at(1, 0, 0), matches: true},
+		{name: "either day, by day of week", spec: "* * 15 * tue", t: at(1, 0, 0), matches: true},
+		{name: "either day, neither", spec: "* * 15 * fri", t: at(1, 0, 0)},
+		{name: "day of week with stepped day of month", spec: "* * */2 * fri", t: at(2, 0, 0)},
+	}
+
+	for _, test := range table {
+		s, err := Parse(test.spec)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		if matches := s.Matches(test.t); matches != test.matches {
+			t.Fatalf("%v: %q matches %v: %v, want %v", test.name, test.spec, test.t, matches, test.matches)
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	at := func(day, hour, minute, second int) time.Time {
+		return time.Date(2021, time.June, day, hour, minute, second, 0, time.UTC)
+	}
+
+	table := []struct {
+		name     string
+		spec     string
+		duration time.Duration
+		t        time.Time
+		active   bool
+	}{
+		{name: "no duration", spec: "0 2 * * *", t: at(1, 2, 0, 0)},
+		{name: "start", spec: "0 2 * * *", duration: time.Hour, t: at(1, 2, 0, 0), active: true},
+		{name: "before start", spec: "0 2 * * *", duration: time.Hour, t: at(1, 1, 59, 59)},
+		{name: "last minute", spec: "0 2 * * *", duration: time.Hour, t: at(1, 2, 59, 59), active: true},
+		{name: "end", spec: "0 2 * * *", duration: time.Hour, t: at(1, 3, 0, 0)},
+		{name: "one minute", spec: "0 2 * * *", duration: time.Minute, t: at(1, 2, 0, 59), active: true},
+		{name: "after one minute", spec: "0 2 * * *", duration: time.Minute, t: at(1, 2, 1, 0)},
+		{name: "across midnight, before", spec: "0 23 * * *", duration: 2 * time.Hour, t: at(1, 23, 30, 0), active: true},
+		{name: "across midnight, after", spec: "0 23 * * *", duration: 2 * time.Hour, t: at(2, 0, 59, 0), active: true},
+		{name: "across midnight, end", spec: "0 23 * * *", duration: 2 * time.Hour, t: at(2, 1, 0, 0)},
+		{name: "across midnight, by day", spec: "0 23 * * tue", duration: 2 * time.Hour, t: at(2, 0, 30, 0), active: true},
+		{name: "across midnight, other day", spec: "0 23 * * wed", duration: 2 * time.Hour, t: at(2, 0, 30, 0)},
+	}
+
+	for _, test := range table {
+		s, err := Parse(test.spec)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		if active := s.Active(test.t, test.duration); active != test.active {
+			t.Fatalf("%v: %q for %v active at %v: %v, want %v", test.name, test.spec, test.duration, test.t, active, test.active)
+		}
+	}
+}
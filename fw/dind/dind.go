@@ -0,0 +1,88 @@
+// Package dind gives jobs which build images, e.g. with docker build, a
+// docker daemon to talk to: a daemon of their own next to the run, or a
+// dedicated daemon of the host shared by runs.
+package dind
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// DockerKey is the task or run metadata key asking for a docker daemon, which
+// jobs reach through DOCKER_HOST.
+//
+// e.g., {"docker": true}
+const DockerKey = "docker"
+
+// Modes of giving jobs a docker daemon.
+const (
+	// ModeSocket mounts the socket of a dedicated daemon of the host in the
+	// container of runs. Runs share the daemon: what they leave behind, such
+	// as images and containers, is seen by the next, and jobs are root on
+	// the host of the daemon, so it must not be the daemon of the runner.
+	ModeSocket = "socket"
+	// ModeDinD starts a docker daemon next to each run, as a privileged
+	// sidecar with its storage in the overlay temp dir, discarded with the
+	// run. Runs are isolated from each other, but the sidecar is privileged,
+	// so jobs may escape to the host from it.
+	ModeDinD = "dind"
+)
+
+const (
+	defaultImage = "docker:20.10-dind"
+
+	// Host is the host name of the daemon in dind mode.
+	Host = "docker"
+	// Port is the port the daemon listens on in dind mode, without TLS as it
+	// is only reachable from the network of the run.
+	Port = 2375
+)
+
+// Config is how the runner gives jobs a docker daemon.
+type Config struct {
+	// Mode is "socket" or "dind"; see ModeSocket and ModeDinD for their
+	// isolation.
+	Mode string `yaml:"mode"`
+	// Socket is the socket of the dedicated daemon of the host, in socket
+	// mode.
+	Socket string `yaml:"socket"`
+	// Image is the image of the daemon in dind mode. Defaults to
+	// docker:20.10-dind.
+	Image string `yaml:"image"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	switch c.Mode {
+	case ModeSocket:
+		if !filepath.IsAbs(c.Socket) {
+			return errors.New("nested_docker socket must be absolute in socket mode")
+		}
+	case ModeDinD:
+		if c.Image == "" {
+			c.Image = defaultImage
+		}
+	default:
+		return fmt.Errorf("invalid nested_docker mode %q: must be %v or %v", c.Mode, ModeSocket, ModeDinD)
+	}
+
+	return nil
+}
+
+// FromMetadata returns true if the metadata asks for a docker daemon under
+// DockerKey.
+func FromMetadata(md map[string]interface{}) (bool, error) {
+	value, ok := md[DockerKey]
+	if !ok {
+		return false, nil
+	}
+
+	requested, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%v must be a boolean", DockerKey)
+	}
+
+	return requested, nil
+}
@@ -0,0 +1,32 @@
+// Package disk contains helpers for measuring disk space used and available
+// to runners.
+package disk
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Size returns the apparent size of all regular files under path. Files
+// which disappear while walking are ignored.
+func Size(path string) (uint64, error) {
+	var size uint64
+
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			size += uint64(fi.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,15 @@
+package disk
+
+import "golang.org/x/sys/unix"
+
+// Free returns the bytes available to unprivileged users and the total size,
+// in bytes, of the filesystem containing path.
+func Free(path string) (uint64, uint64, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil // #nosec
+}
@@ -0,0 +1,20 @@
+package disk
+
+import "golang.org/x/sys/windows"
+
+// Free returns the bytes available to the user of the runner and the total
+// size, in bytes, of the volume containing path.
+func Free(path string) (uint64, uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var avail, total, free uint64
+
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, &total, &free); err != nil {
+		return 0, 0, err
+	}
+
+	return avail, total, nil
+}
@@ -0,0 +1,156 @@
+package fw
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/tinyci/ci-agents/clients/log"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/events"
+	"github.com/tinyci/ci-runners/fw/metrics"
+)
+
+// DrainStatus is a report of the progress of a drain.
+type DrainStatus struct {
+	// Draining is true if the runner is not accepting new work.
+	Draining bool `json:"draining"`
+	// Exit is true if the runner will exit once drained.
+	Exit bool `json:"exit"`
+	// Paused is true if the runner has been paused. See Entrypoint.Pause.
+	Paused bool `json:"paused"`
+	// Remaining is the amount of queue items still running.
+	Remaining int `json:"remaining"`
+	// Deferred is the amount of queue items deferred by the runner. See
+	// Prioritizer.
+	Deferred int `json:"deferred"`
+	// Runs lists the runs still in flight.
+	Runs []RunStatus `json:"runs"`
+	// ETA is the estimated time until all runs have completed, based on the
+	// average duration of previous runs. Zero if there is no estimate.
+	ETA time.Duration `json:"eta"`
+}
+
+// RunStatus describes a run in flight.
+type RunStatus struct {
+	Name        string        `json:"name"`
+	Queue       string        `json:"queue"`
+	QueueItemID int64         `json:"queue_item_id"`
+	RunID       int64         `json:"run_id"`
+	Start       time.Time     `json:"start"`
+	Elapsed     time.Duration `json:"elapsed"`
+}
+
+// Drain stops the runner from pulling new work. Runs in flight are left to
+// complete. If exit is true, the runner exits once they have; this is what
+// SIGHUP does. The queuesvc cannot take back queue items which have been
+// pulled; any still deferred by a Prioritizer on exit are left in the state
+// journal for the next runner process, or reported as infrastructure errors
+// without one.
+func (e *Entrypoint) Drain(exit bool) {
+	e.terminateMutex.Lock()
+	e.draining = true
+	e.terminate = e.terminate || exit
+	e.terminateMutex.Unlock()
+
+	e.events.Emit(&events.Event{
+		Type:     events.RunnerDraining,
+		Hostname: e.Launch.Hostname(),
+		Data:     map[string]interface{}{"exit": exit},
+	})
+}
+
+// Undrain resumes pulling new work after a Drain, unless the runner is
+// already set to exit.
+func (e *Entrypoint) Undrain() bool {
+	e.terminateMutex.Lock()
+	defer e.terminateMutex.Unlock()
+
+	if e.terminate {
+		return false
+	}
+
+	e.draining = false
+	return true
+}
+
+func (e *Entrypoint) getDraining() bool {
+	e.terminateMutex.RLock()
+	defer e.terminateMutex.RUnlock()
+
+	return e.draining || e.terminate
+}
+
+// DrainStatus reports the progress of the current drain.
+func (e *Entrypoint) DrainStatus() DrainStatus {
+	e.terminateMutex.RLock()
+	status := DrainStatus{Draining: e.draining || e.terminate, Exit: e.terminate, Paused: e.paused}
+	e.terminateMutex.RUnlock()
+
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+
+	status.Remaining = e.active + len(e.recovering)
+	status.Deferred = len(e.deferred)
+	status.Runs = e.runStatuses()
+
+	for _, run := range status.Runs {
+		if e.avgDuration > 0 && e.avgDuration-run.Elapsed > status.ETA {
+			status.ETA = e.avgDuration - run.Elapsed
+		}
+	}
+
+	return status
+}
+
+// runStatuses lists the runs in the run map, sorted by name. The caller must
+// hold runMapMutex.
+func (e *Entrypoint) runStatuses() []RunStatus {
+	runs := []RunStatus{}
+
+	for run, runnerCtx := range e.runMap {
+		runs = append(runs, RunStatus{
+			Name:        run.Name(),
+			Queue:       runnerCtx.QueueItem.QueueName,
+			QueueItemID: runnerCtx.QueueItem.Id,
+			RunID:       runnerCtx.QueueItem.Run.Id,
+			Start:       runnerCtx.Start,
+			Elapsed:     time.Since(runnerCtx.Start),
+		})
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Name < runs[j].Name })
+
+	return runs
+}
+
+// recordDuration folds the duration of a completed run into the moving
+// average used for drain estimates, and its metrics.
+func (e *Entrypoint) recordDuration(runnerCtx *fwcontext.RunContext) {
+	d := time.Since(runnerCtx.Start)
+	metrics.RunDuration.Observe(d.Seconds(), runnerCtx.QueueItem.QueueName)
+
+	e.runMapMutex.Lock()
+	defer e.runMapMutex.Unlock()
+
+	if e.avgDuration == 0 {
+		e.avgDuration = d
+		return
+	}
+
+	// exponential moving average, weighing recent runs more heavily.
+	e.avgDuration = (e.avgDuration*4 + d) / 5
+}
+
+func (e *Entrypoint) logDrain(log *log.SubLogger, exit bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	status := e.DrainStatus()
+
+	if exit {
+		log.Infof(ctx, "Termination requested at the end of any outstanding run; %d remaining, ETA %v", status.Remaining, status.ETA)
+	} else {
+		log.Infof(ctx, "Draining; no new work will be accepted. %d runs remaining, ETA %v", status.Remaining, status.ETA)
+	}
+}
@@ -0,0 +1,37 @@
+package fw
+
+// DryRunner is implemented by runs which can be prepared without being
+// executed. In dry-run mode (the --dry-run flag), queue items are pulled and
+// BeforeRun and AfterRun are called as usual, but DryRun is called instead of
+// Run; runs which do not implement it are skipped entirely. The outcome of
+// dry runs is logged, traced and counted, but never reported to the
+// queuesvc, so dry-run mode only polls the queue of the --dry-run-queue flag,
+// which must be dedicated to it: real runners would otherwise wait forever
+// for the status of the queue items it took.
+//
+// This allows validating a runner configuration against real workloads, e.g.
+// that repositories can be cloned and images pulled, without running jobs,
+// by submitting copies of them to the dry-run queue.
+type DryRunner interface {
+	Run
+
+	// DryRun performs the preparation of the run, such as cloning the
+	// repository and resolving the image, and cleans up after it.
+	DryRun() error
+}
+
+// dryRunMiddleware replaces the Run phase with the DryRun of the run, if it
+// implements DryRunner. See the --dry-run flag.
+func dryRunMiddleware(next RunHandler) RunHandler {
+	return func(run Run, phase Phase) (bool, error) {
+		if phase != PhaseRun {
+			return next(run, phase)
+		}
+
+		if dr, ok := run.(DryRunner); ok {
+			return false, dr.DryRun()
+		}
+
+		return false, nil
+	}
+}
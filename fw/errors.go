@@ -0,0 +1,113 @@
+package fw
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error classes. Errors are classified with Classed, and tested with Classify
+// or errors.Is, e.g. errors.Is(err, fw.ErrInfra).
+var (
+	// ErrInfra is a transient infrastructure failure, such as a failed image
+	// pull or mount. Runs failing with it are retried; see Retryable.
+	ErrInfra = errors.New("infrastructure error")
+	// ErrUserJob is a failure caused by the job itself, such as an invalid
+	// job definition. It is not retried.
+	ErrUserJob = errors.New("job error")
+	// ErrMergeConflict is a failure to combine the commit under test with the
+	// default branch because they conflict. The author has to resolve it, so
+	// it is not retried.
+	ErrMergeConflict = errors.New("merge conflict")
+	// ErrSkipped is a run that was not executed as it does not apply to the
+	// commit under test, e.g. because it changes none of the files the task
+	// watches. It is reported as a pass and not retried.
+	ErrSkipped = errors.New("skipped")
+	// ErrCanceled is a run that stopped because it was canceled or timed out.
+	ErrCanceled = errors.New("canceled")
+	// ErrQueueUnavailable is a failure to reach the queuesvc.
+	ErrQueueUnavailable = errors.New("queuesvc unavailable")
+	// ErrStatusAlreadySet is returned by the queuesvc when the status of a run
+	// was already reported.
+	ErrStatusAlreadySet = errors.New("status already set for run")
+)
+
+// classedError is an error with a class. See Classed.
+type classedError struct {
+	class error
+	err   error
+}
+
+func (ce *classedError) Error() string {
+	return ce.err.Error()
+}
+
+func (ce *classedError) Unwrap() error {
+	return ce.err
+}
+
+func (ce *classedError) Is(target error) bool {
+	return target == ce.class
+}
+
+// Classed returns err marked with the class, one of the Err* values of this
+// package. The message of err is unchanged. Errors which are already
+// classified keep their class, so the most specific classification wins.
+func Classed(class, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ce *classedError
+	if errors.As(err, &ce) {
+		return err
+	}
+
+	return &classedError{class: class, err: err}
+}
+
+// Classify returns the class of err: ErrCanceled for context cancellations,
+// even if marked otherwise, then the class it was marked with, and ErrUserJob
+// for any other error, as those are not known to be transient. It returns nil
+// for a nil error.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrCanceled
+	}
+
+	var ce *classedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+
+	return ErrUserJob
+}
+
+// queueError classifies an error returned by the queuesvc client.
+func queueError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// the queuesvc reports this as an internal error, so the message is all
+	// there is to go on.
+	if strings.Contains(err.Error(), ErrStatusAlreadySet.Error()) {
+		return Classed(ErrStatusAlreadySet, err)
+	}
+
+	if stat, ok := status.FromError(err); ok {
+		switch stat.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return Classed(ErrQueueUnavailable, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,43 @@
+package fw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	base := errors.New("boom")
+
+	table := []struct {
+		name  string
+		err   error
+		class error
+	}{
+		{name: "nil", err: nil, class: nil},
+		{name: "unclassed", err: base, class: ErrUserJob},
+		{name: "infra", err: Classed(ErrInfra, base), class: ErrInfra},
+		{name: "wrapped infra", err: fmt.Errorf("pulling: %w", Classed(ErrInfra, base)), class: ErrInfra},
+		{name: "first class wins", err: Classed(ErrUserJob, Classed(ErrInfra, base)), class: ErrInfra},
+		{name: "merge conflict", err: Classed(ErrMergeConflict, base), class: ErrMergeConflict},
+		{name: "skipped", err: Classed(ErrSkipped, base), class: ErrSkipped},
+		{name: "canceled", err: context.Canceled, class: ErrCanceled},
+		{name: "deadline", err: fmt.Errorf("git fetch: %w", context.DeadlineExceeded), class: ErrCanceled},
+		{name: "canceled over class", err: Classed(ErrInfra, context.Canceled), class: ErrCanceled},
+	}
+
+	for _, test := range table {
+		if class := Classify(test.err); class != test.class {
+			t.Fatalf("%v: got class %v, want %v", test.name, class, test.class)
+		}
+	}
+
+	if Classed(ErrInfra, nil) != nil {
+		t.Fatal("classing a nil error returned an error")
+	}
+
+	if err := Classed(ErrInfra, base); err.Error() != base.Error() || !errors.Is(err, base) {
+		t.Fatalf("classing changed the error: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+// Package events is a bus for runner lifecycle events, such as runs starting
+// and finishing, which are delivered to sinks like webhooks.
+//
+// Events are delivered asynchronously, so a slow sink never holds up the
+// runner; if the sinks fall too far behind, events are dropped. All methods
+// are safe to call on a nil *Bus, which discards events.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types emitted by the framework.
+const (
+	RunStarted     = "run_started"
+	RunFinished    = "run_finished"
+	RunCanceled    = "run_canceled"
+	RunnerDraining = "runner_draining"
+)
+
+const (
+	bufferSize     = 1000
+	defaultTimeout = 10 * time.Second
+)
+
+// Event is a lifecycle event.
+type Event struct {
+	// Type is the type of the event, e.g. RunStarted.
+	Type string `json:"type"`
+	// Time is when the event occurred.
+	Time time.Time `json:"time"`
+	// Hostname is the hostname of the runner.
+	Hostname string `json:"hostname"`
+	// Queue is the queue the run was pulled from, for run events.
+	Queue string `json:"queue,omitempty"`
+	// RunID is the id of the run, for run events.
+	RunID int64 `json:"run_id,omitempty"`
+	// Outcome is the outcome of the run, for RunFinished and RunCanceled.
+	Outcome string `json:"outcome,omitempty"`
+	// Data holds any additional details about the event.
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Sink receives events from the bus.
+type Sink interface {
+	Send(ctx context.Context, event *Event) error
+}
+
+// Bus delivers events to its sinks.
+type Bus struct {
+	// OnError, if set, is called with errors returned by sinks.
+	OnError func(event *Event, err error)
+
+	sinks []Sink
+	ch    chan *Event
+	done  chan struct{}
+	once  sync.Once
+}
+
+// New creates a bus delivering to the sinks. It returns nil if there are no
+// sinks.
+func New(sinks ...Sink) *Bus {
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	b := &Bus{sinks: sinks, ch: make(chan *Event, bufferSize), done: make(chan struct{})}
+	go b.deliver()
+
+	return b
+}
+
+// Emit queues the event for delivery, filling in its time if unset. The
+// event is dropped if the queue is full.
+func (b *Bus) Emit(event *Event) {
+	if b == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	select {
+	case b.ch <- event:
+	default:
+		b.error(event, fmt.Errorf("event queue full; dropping %v event", event.Type))
+	}
+}
+
+// Close delivers the events already queued and stops the bus.
+func (b *Bus) Close() {
+	if b == nil {
+		return
+	}
+
+	b.once.Do(func() {
+		close(b.ch)
+		<-b.done
+	})
+}
+
+func (b *Bus) deliver() {
+	defer close(b.done)
+
+	for event := range b.ch {
+		for _, sink := range b.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+			if err := sink.Send(ctx, event); err != nil {
+				b.error(event, err)
+			}
+			cancel()
+		}
+	}
+}
+
+func (b *Bus) error(event *Event, err error) {
+	if b.OnError != nil {
+		b.OnError(event, err)
+	}
+}
+
+// Filter returns a sink which only passes events of the given types to sink.
+// With no types, all events are passed.
+func Filter(sink Sink, types ...string) Sink {
+	if len(types) == 0 {
+		return sink
+	}
+
+	allowed := map[string]bool{}
+	for _, typ := range types {
+		allowed[typ] = true
+	}
+
+	return &filterSink{sink: sink, allowed: allowed}
+}
+
+type filterSink struct {
+	sink    Sink
+	allowed map[string]bool
+}
+
+func (fs *filterSink) Send(ctx context.Context, event *Event) error {
+	if !fs.allowed[event.Type] {
+		return nil
+	}
+
+	return fs.sink.Send(ctx, event)
+}
+
+// Webhook is a sink which POSTs each event as JSON to a URL.
+type Webhook struct {
+	// URL is the endpoint events are posted to.
+	URL string
+	// Headers are added to each request, e.g. for authentication.
+	Headers map[string]string
+	// Client is the HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Send satisfies the Sink interface. Any non-2xx response is an error.
+func (w *Webhook) Send(ctx context.Context, event *Event) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.Headers {
+		req.Header.Set(key, value)
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %v returned %v", w.URL, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+// Package flock takes exclusive locks on files, advisory on linux and
+// mandatory on windows, which the processes of a host use to share
+// repositories, caches and workspace layers. Locks are released when their
+// file is closed.
+package flock
+
+import "errors"
+
+// ErrLocked is returned by TryLock when another holds the lock.
+var ErrLocked = errors.New("file is locked")
@@ -0,0 +1,22 @@
+package flock
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// TryLock takes the lock of the file without waiting for it.
+func TryLock(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return ErrLocked
+	}
+
+	return err
+}
+
+// Unlock releases the lock of the file.
+func Unlock(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,22 @@
+package flock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// TryLock takes the lock of the file without waiting for it.
+func TryLock(f *os.File) error {
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+
+	return err
+}
+
+// Unlock releases the lock of the file.
+func Unlock(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -12,6 +12,8 @@
 //		* Coordinating and starting your run
 //		* Managing signals and cancellations
 //		* Logging certain functionality
+//		* Expanding matrix runs into cells (see MatrixRunner)
+//		* Wrapping each phase of a run in middleware (see RunMiddleware)
 //
 // What is done outside of these framework needs is largely irrelevant to the
 // framework itself.
@@ -20,18 +22,26 @@ package fw
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
 	"github.com/tinyci/ci-agents/clients/log"
 	"github.com/tinyci/ci-agents/clients/queue"
+	"github.com/tinyci/ci-runners/fw/config"
 	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/events"
+	"github.com/tinyci/ci-runners/fw/journal"
+	"github.com/tinyci/ci-runners/fw/metrics"
+	"github.com/tinyci/ci-runners/fw/retry"
+	"github.com/tinyci/ci-runners/fw/trace"
 	"github.com/urfave/cli"
-	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -59,10 +69,14 @@ type Runner interface {
 	//
 	// Data calls
 	//
-	// QueueName is the name of the queue to pull runs off of.
+	// QueueName is the name of the queue to pull runs off of. It is ignored if
+	// multiple queues are configured; see config.Config.Queues.
 	QueueName() string
 	// Hostname is the name of the host; a tag to uniquely identify it.
 	Hostname() string
+	// FrameworkConfig is the framework portion of the runner's configuration,
+	// used to tune the framework's own behavior.
+	FrameworkConfig() *config.Config
 
 	//
 	// Client acquisition
@@ -114,14 +128,57 @@ type Entrypoint struct {
 	// TeardownTimeout is the amount of time to wait for the runner to tear down
 	// everything so it can exit.
 	TeardownTimeout time.Duration
+	// MaxConcurrentRuns is the amount of queue items the runner may process in
+	// parallel. It may be overridden by the max_concurrent_runs configuration
+	// setting. Defaults to 1.
+	MaxConcurrentRuns int
+	// HeartbeatInterval is how often the Heartbeater, if any, is called for
+	// in-flight runs. Defaults to 30 seconds; a negative value disables
+	// heartbeats.
+	HeartbeatInterval time.Duration
+	// LeaseTimeout is how long heartbeats may fail before the lease on a run is
+	// considered lost. Defaults to three heartbeat intervals.
+	LeaseTimeout time.Duration
+	// Heartbeater renews leases on in-flight runs. There is none by default,
+	// and so no heartbeats; see QueueHeartbeater.
+	Heartbeater Heartbeater
+	// EventSinks receive the lifecycle events of the runner, in addition to
+	// any webhooks in the configuration. See fw/events.
+	EventSinks []events.Sink
+	// Middleware wraps the execution of the phases of every run. See
+	// RunMiddleware.
+	Middleware []RunMiddleware
 	// Launch is the Runner intended to be executed.
 	Launch Runner
 
 	terminate      bool
+	draining       bool
+	paused         bool
 	terminateMutex sync.RWMutex
 
 	runMap      runMap
-	runMapMutex sync.RWMutex
+	active      int
+	avgDuration time.Duration
+	leaseLost   map[int64]bool
+	timedOut    map[int64]bool
+	cancelWatch map[*fwcontext.RunContext]bool
+	deferred    []*types.QueueItem
+	recovering  []*journal.Entry
+	quotaUsed   config.Resources
+	queueErr    error
+
+	inMaintenance       bool
+	longPollUnsupported bool
+	runMapMutex         sync.RWMutex
+
+	journal *journal.Journal
+	queues  *queueScheduler
+	limiter *tokenBucket
+	dryRun  bool
+	// dryRunQueue is the only queue polled in dry-run mode.
+	dryRunQueue string
+	events      *events.Bus
+	wake        chan struct{}
 }
 
 // Launch runs the given Entrypoint, which should contain a Runner to launch as
@@ -132,6 +189,10 @@ type Entrypoint struct {
 // before this call.
 func Launch(e *Entrypoint) error {
 	e.runMap = runMap{}
+	e.leaseLost = map[int64]bool{}
+	e.timedOut = map[int64]bool{}
+	e.cancelWatch = map[*fwcontext.RunContext]bool{}
+	e.wake = make(chan struct{}, 1)
 
 	app := cli.NewApp()
 	app.Usage = e.Usage
@@ -142,9 +203,19 @@ func Launch(e *Entrypoint) error {
 		Name:  "config, c",
 		Value: "/etc/tinyci/runner.yml",
 		Usage: "Location of configuration file",
+	}, cli.StringFlag{
+		Name:  "local-run",
+		Usage: "Execute the queue item in this JSON file and exit, without using the queuesvc",
+	}, cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Prepare queue items without executing them or reporting their status; requires --dry-run-queue",
+	}, cli.StringFlag{
+		Name:  "dry-run-queue",
+		Usage: "Queue dedicated to dry runs, polled instead of those of the configuration",
 	})
 
 	app.Action = e.loop()
+	app.Commands = []cli.Command{adminCommand()}
 
 	return app.Run(os.Args)
 }
@@ -168,35 +239,78 @@ func (e *Entrypoint) loop() func(*cli.Context) error {
 	lifetimeCtx, lifetimeCancel := context.WithCancel(context.Background())
 
 	return func(ctx *cli.Context) error {
+		e.dryRun = ctx.Bool("dry-run")
+		e.dryRunQueue = ctx.String("dry-run-queue")
+
+		// queue items pulled in dry-run mode are never reported, so they must
+		// not be those real runners wait for
+		if e.dryRun && e.dryRunQueue == "" && ctx.String("local-run") == "" {
+			return errors.New("--dry-run requires --dry-run-queue, a queue dedicated to dry runs")
+		}
+
 		baseContext := &fwcontext.Context{CLIContext: ctx}
 		if err := runner.Init(baseContext); err != nil {
 			return err
 		}
 
 		log := runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext})
+		e.openEvents(runner)
+
+		if filename := ctx.String("local-run"); filename != "" {
+			return e.localRun(lifetimeCtx, baseContext, runner, filename)
+		}
+
 		log.Info(lifetimeCtx, "Initializing runner")
 
-		e.makeGracefulRestartSignal(lifetimeCancel, log)
+		e.queues = newQueueScheduler(runner, e.dryRunQueue)
+		e.limiter = newTokenBucket(runner.FrameworkConfig().RateLimit)
+
+		if err := e.openJournal(runner); err != nil {
+			return err
+		}
+
+		go e.pollCancels(lifetimeCtx, runner)
+
+		if err := e.recoverRuns(lifetimeCtx, baseContext, runner); err != nil {
+			return err
+		}
+
+		if err := e.listenAdmin(lifetimeCtx, runner); err != nil {
+			return err
+		}
+
+		if err := e.listenHTTP(lifetimeCtx, runner); err != nil {
+			return err
+		}
+
+		e.makeGracefulRestartSignal(lifetimeCancel, baseContext, log)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.wake:
+			}
 
-		for range time.Tick(time.Second) {
 			if err := e.iterate(lifetimeCtx, lifetimeCancel, baseContext, runner); err != nil {
 				return err
 			}
 		}
-
-		return nil
 	}
 }
 
-func (e *Entrypoint) makeGracefulRestartSignal(lifetimeCancel context.CancelFunc, log *log.SubLogger) {
+func (e *Entrypoint) makeGracefulRestartSignal(lifetimeCancel context.CancelFunc, baseContext *fwcontext.Context, log *log.SubLogger) {
 	sigChan := make(chan os.Signal, 1)
 
 	go func() {
 		for sig := range sigChan {
-			switch sig {
-			case unix.SIGINT, unix.SIGTERM:
+			switch {
+			case isShutdownSignal(sig):
 				wg := &sync.WaitGroup{}
 				e.runMapMutex.Lock() // will hold until exit
+				deferred := e.takeAllDeferred()
 				wg.Add(len(e.runMap))
 				for run, runnerCtx := range e.runMap {
 					go func(run Run, runnerCtx *fwcontext.RunContext, wg *sync.WaitGroup) {
@@ -205,165 +319,424 @@ func (e *Entrypoint) makeGracefulRestartSignal(lifetimeCancel context.CancelFunc
 					}(run, runnerCtx, wg)
 				}
 				wg.Wait()
+				e.handOverDeferred(context.Background(), baseContext, e.Launch, deferred)
+				e.events.Close()
 				lifetimeCancel()
 				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 				log.Info(ctx, "Shutting down runner")
 				cancel()
 				os.Exit(0)
-			case unix.SIGHUP:
+			case sig == drainSignal:
+				e.Drain(true)
+				e.logDrain(log, true)
+			case sig == undrainSignal:
 				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-				log.Info(ctx, "Termination requested at the end of any outstanding run")
+				if e.Undrain() {
+					log.Info(ctx, "Undrained; accepting new work")
+				} else {
+					log.Info(ctx, "Runner is terminating and cannot be undrained")
+				}
 				cancel()
-				e.SetTerminate(log)
+			case sig == reloadSignal:
+				e.reload(baseContext, e.Launch)
 			}
 		}
 	}()
 
-	signal.Notify(sigChan, unix.SIGHUP, unix.SIGINT, unix.SIGTERM)
+	signal.Notify(sigChan, handledSignals()...)
 }
 
 func (e *Entrypoint) processCancel(ctx context.Context, runnerCtx *fwcontext.RunContext, runner Runner) bool {
-retry:
 	runLogger := runner.LogsvcClient(runnerCtx)
-	didCancel, err := runner.QueueClient().GetCancel(ctx, runnerCtx.QueueItem.Run.Id)
-	if err != nil {
-		runLogger.Errorf(ctx, "Cannot retrieve cancel state of current job, retrying in 1s: %v\n", err)
-		time.Sleep(time.Second)
-	}
+	runID := runnerCtx.QueueItem.Run.Id
+
+	err := retry.Do(ctx, queueRetry(runLogger, "Canceling run"), func(ctx context.Context) error {
+		didCancel, err := runner.QueueClient().GetCancel(ctx, runID)
+		if err != nil || didCancel {
+			return err
+		}
 
-	if !didCancel {
 		runLogger.Info(ctx, "Canceling run")
-		if err := runner.QueueClient().SetCancel(context.Background(), runnerCtx.QueueItem.Run.Id); err != nil {
-			runLogger.Errorf(ctx, "Cannot cancel current job, retrying in 1s: %+v\n", err)
-			time.Sleep(time.Second)
+		if err := runner.QueueClient().SetCancel(ctx, runID); err != nil {
+			return err
 		}
 
-		goto retry
+		return errors.New("cancellation not yet visible")
+	})
+	if err != nil {
+		runLogger.Errorf(ctx, "Cannot cancel current job: %v", err)
+		return false
 	}
 
-	return didCancel
-}
-
-func (e *Entrypoint) respondToCancelSignal(runnerCtx *fwcontext.RunContext) {
-	for {
-		select {
-		case <-runnerCtx.Ctx.Done():
-			return
-		default:
-			cancel, _ := e.Launch.QueueClient().GetCancel(runnerCtx.Ctx, runnerCtx.QueueItem.Run.Id)
-			if cancel && runnerCtx.CancelFunc != nil {
-				runnerCtx.CancelFunc()
-			}
-			time.Sleep(time.Second)
-		}
-	}
+	return true
 }
 
 func (e *Entrypoint) iterate(ctx context.Context, cancel context.CancelFunc, baseContext *fwcontext.Context, runner Runner) error {
 	log := runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext})
 
-	e.runMapMutex.RLock()
-	count := uint(len(e.runMap))
-	e.runMapMutex.RUnlock()
+	for e.hasRecovering() && e.acquireSlot(runner) {
+		e.startRecovered(ctx, baseContext, runner)
+	}
 
-	if count == 0 && e.getTerminate() {
+	if e.activeRuns() == 0 && e.getTerminate() {
 		log.Info(ctx, "Termination requested after the end of the run")
+		e.runMapMutex.Lock()
+		deferred := e.takeAllDeferred()
+		e.runMapMutex.Unlock()
+
+		e.handOverDeferred(ctx, baseContext, runner, deferred)
+		e.events.Close()
 		os.Exit(0)
 	}
 
-	if e.getTerminate() || !runner.Ready() {
+	if e.maintenance(ctx, runner) {
 		return nil
 	}
 
-	qi, err := runner.QueueClient().NextQueueItem(ctx, runner.QueueName(), runner.Hostname())
-	if err != nil {
-		if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
-			return nil
+	for !e.getDraining() && !e.getPaused() && runner.Ready() && e.acquireSlot(runner) {
+		started, err := e.startNext(ctx, baseContext, runner)
+		if err != nil || !started {
+			e.releaseSlot()
+			return err
 		}
+	}
 
-		if stat, ok := status.FromError(err); ok && stat.Code() != codes.NotFound {
-			log.Errorf(ctx, "Error reading from queue: %v", err)
+	return nil
+}
+
+// startNext takes a deferred queue item that may now run, or pulls the next
+// one, and starts running it. It returns false if there was nothing to run.
+// The caller must hold a slot, which is released by the run when it
+// completes.
+func (e *Entrypoint) startNext(ctx context.Context, baseContext *fwcontext.Context, runner Runner) (bool, error) {
+	log := runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext})
+
+	qi := e.takeDeferred(ctx, baseContext, runner)
+	if qi == nil {
+		limiter := e.rateLimiter()
+		if e.deferredFull(runner) || !limiter.take() {
+			return false, nil
 		}
 
-		select {
-		case <-ctx.Done():
-			e.SetTerminate(log)
-		default:
+		var err error
+
+		qi, err = e.nextQueueItem(ctx, runner)
+		if err != nil {
+			limiter.refund()
+
+			// the queue is empty; any other error, classed or not, is logged
+			if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+				return false, nil
+			}
+
+			log.Errorf(ctx, "Error reading from queue: %v", err)
+
+			select {
+			case <-ctx.Done():
+				e.SetTerminate(log)
+			default:
+			}
+
+			return false, nil
 		}
 
-		return nil
+		if !e.admit(ctx, baseContext, runner, qi) {
+			return false, nil
+		}
 	}
 
-	runnerCtx := &fwcontext.RunContext{QueueItem: qi, Start: time.Now(), Context: baseContext}
+	runnerCtx := &fwcontext.RunContext{QueueItem: qi, Start: time.Now(), Context: baseContext, Trace: trace.New(qi.Run.Id)}
+	metrics.RunsStarted.Inc(qi.QueueName)
+	e.emitRun(events.RunStarted, runnerCtx, "")
 	runLogger := runner.LogsvcClient(runnerCtx)
 	runLogger.Info(ctx, "Received run data; commencing with test")
-	timeout := qi.Run.Settings.Timeout
+	stopTimeout := e.startTimeout(ctx, runner, runnerCtx)
+	releaseQuota := e.reserveQuota(runner, qi)
 
-	if timeout == 0 {
-		runnerCtx.Ctx, runnerCtx.CancelFunc = context.WithCancel(context.Background())
-	} else {
-		runnerCtx.Ctx, runnerCtx.CancelFunc = context.WithTimeout(context.Background(), time.Duration(qi.Run.Settings.Timeout))
+	runName := strings.Join([]string{qi.QueueName, fmt.Sprintf("%d", qi.Run.Id)}, ".")
+
+	cells, parallel, err := matrixCells(qi)
+	if err != nil {
+		runLogger.Errorf(ctx, "Invalid matrix specification; executing as a single run: %v", err)
 	}
 
-	runName := strings.Join([]string{runner.QueueName(), fmt.Sprintf("%d", qi.Run.Id)}, ".")
+	if len(cells) != 0 {
+		if mr, ok := runner.(MatrixRunner); ok {
+			e.watchCancel(runnerCtx)
+
+			e.journalAdd(ctx, runner, runName, runnerCtx)
+			stopHeartbeat := e.startHeartbeat(runner, runnerCtx)
+
+			go func() {
+				defer e.releaseSlot()
+				defer stopHeartbeat()
+				defer stopTimeout()
+				defer releaseQuota()
+				defer runnerCtx.CancelFunc()
+
+				status := e.runMatrix(ctx, mr, runName, runnerCtx, cells, parallel)
+				runLogger.Infof(ctx, "Matrix run finished in %v", time.Since(runnerCtx.Start))
+				e.recordDuration(runnerCtx)
+				e.reportStatus(ctx, runner, runnerCtx, status, nil)
+				e.journalRemove(ctx, runner, runnerCtx)
+				e.writeTrace(ctx, runner, runnerCtx)
+			}()
+
+			return true, nil
+		}
 
-	run, err := runner.MakeRun(runName, runnerCtx)
-	if err != nil {
+		runLogger.Info(ctx, "Runner does not support matrix runs; executing as a single run")
+	}
+
+	var run Run
+
+	err = protect(func() (err error) {
+		run, err = runner.MakeRun(runName, runnerCtx)
 		return err
+	})
+	if err != nil {
+		var pe *panicError
+		if !errors.As(err, &pe) {
+			stopTimeout()
+			releaseQuota()
+			runnerCtx.CancelFunc()
+			return false, err
+		}
+
+		runLogger.Errorf(ctx, "MakeRun %v", err)
+
+		go func() {
+			defer e.releaseSlot()
+			defer stopTimeout()
+			defer releaseQuota()
+			defer runnerCtx.CancelFunc()
+			e.reportStatus(ctx, runner, runnerCtx, false, err)
+			// it may have been deferred
+			e.journalRemove(ctx, runner, runnerCtx)
+		}()
+
+		return true, nil
 	}
 
-	e.runMapMutex.Lock()
-	e.runMap[run] = runnerCtx
-	e.runMapMutex.Unlock()
+	e.journalAdd(ctx, runner, runName, runnerCtx)
 
-	go e.respondToCancelSignal(runnerCtx)
+	e.watchCancel(runnerCtx)
+	stopHeartbeat := e.startHeartbeat(runner, runnerCtx)
 
 	go func() {
+		defer e.releaseSlot()
+		defer stopHeartbeat()
+		defer stopTimeout()
+		defer releaseQuota()
 		defer func() {
 			runLogger.Infof(ctx, "Run finished in %v", time.Since(runnerCtx.Start))
+			e.recordDuration(runnerCtx)
 
-			e.runMapMutex.Lock()
-			delete(e.runMap, run)
-			e.runMapMutex.Unlock()
-
-			runner.AfterRun(runName, runnerCtx)
+			if err := protect(func() error { runner.AfterRun(runName, runnerCtx); return nil }); err != nil {
+				runLogger.Errorf(ctx, "Runner AfterRun hook %v", err)
+			}
 		}()
 
-		if err := run.BeforeRun(); err != nil {
+		defer e.writeTrace(ctx, runner, runnerCtx)
+
+		defer e.journalRemove(ctx, runner, runnerCtx)
+
+		lastCtx, status, runErr, err := e.runAttempts(ctx, context.Background(), runner, runName, run)
+		if err != nil {
 			runLogger.Errorf(ctx, "Run configuration errored: %v", err)
 			return
 		}
 
-		status, err := run.Run()
-		if err != nil {
-			runLogger.Errorf(ctx, "Run concluded with error: %v", err)
+		e.reportStatus(ctx, runner, lastCtx, status, runErr)
+	}()
+
+	return true, nil
+}
+
+func (e *Entrypoint) maxConcurrentRuns(runner Runner) int {
+	if max := runner.FrameworkConfig().MaxConcurrentRuns; max > 0 {
+		return max
+	}
+
+	if e.MaxConcurrentRuns > 0 {
+		return e.MaxConcurrentRuns
+	}
+
+	return 1
+}
+
+// acquireSlot reserves a slot in the worker pool for a run, returning false
+// if all slots are taken.
+func (e *Entrypoint) acquireSlot(runner Runner) bool {
+	e.runMapMutex.Lock()
+	defer e.runMapMutex.Unlock()
+
+	if e.active >= e.maxConcurrentRuns(runner) {
+		return false
+	}
+
+	e.active++
+	return true
+}
+
+// releaseSlot returns a slot to the worker pool.
+func (e *Entrypoint) releaseSlot() {
+	e.runMapMutex.Lock()
+	e.active--
+	e.runMapMutex.Unlock()
+
+	e.wakeup()
+}
+
+// activeRuns returns the amount of queue items currently being run, including
+// those left by a previous runner process waiting for a slot to be recovered.
+func (e *Entrypoint) activeRuns() int {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return e.active + len(e.recovering)
+}
+
+// execute runs the lifecycle hooks of the run and returns its status, and the
+// error returned by Run, if any. An error is only returned if the run could
+// not be configured.
+func (e *Entrypoint) execute(ctx context.Context, runner Runner, run Run) (status bool, runErr, err error) {
+	runLogger := runner.LogsvcClient(run.RunContext())
+	handle := e.handler()
+
+	_, err = handle(run, PhaseBeforeRun)
+	if err != nil {
+		var pe *panicError
+		if errors.As(err, &pe) {
+			runLogger.Errorf(ctx, "BeforeRun hook %v", err)
+			return false, nil, nil
 		}
 
-		if err := run.AfterRun(); err != nil {
-			runLogger.Errorf(ctx, "AfterRun hook failed with error: %v", err)
+		return false, nil, err
+	}
+
+	status, runErr = handle(run, PhaseRun)
+	if runErr != nil {
+		runLogger.Errorf(ctx, "Run concluded with error: %v", runErr)
+	}
+
+	if _, err := handle(run, PhaseAfterRun); err != nil {
+		runLogger.Errorf(ctx, "AfterRun hook failed with error: %v", err)
+	}
+
+	return status, runErr, nil
+}
+
+// panicError is a panic recovered from a runner hook.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (pe *panicError) Error() string {
+	return fmt.Sprintf("panicked: %v\n%s", pe.value, pe.stack)
+}
+
+// protect calls fn, converting a panic within it into a *panicError carrying
+// the stack trace, so that a misbehaving run cannot take down the agent.
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &panicError{value: r, stack: debug.Stack()}
 		}
+	}()
+
+	return fn()
+}
+
+// writeTrace finishes the timing trace of the run and writes it to the
+// TraceDir, if configured.
+func (e *Entrypoint) writeTrace(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext) {
+	runnerCtx.Trace.Finish()
+
+	dir := runner.FrameworkConfig().TraceDir
+	if dir == "" {
+		return
+	}
+
+	filename, err := runnerCtx.Trace.WriteFile(dir)
+	if err != nil {
+		runner.LogsvcClient(runnerCtx).Errorf(ctx, "Could not write timing trace: %v", err)
+		return
+	}
 
-	normalRetry:
-		cancel, err := e.Launch.QueueClient().GetCancel(ctx, runnerCtx.QueueItem.Run.Id)
+	runner.LogsvcClient(runnerCtx).Debugf(ctx, "Timing trace written to %v", filename)
+}
+
+// reportStatus reports the outcome of the run to the queuesvc, unless it was
+// canceled, its lease was lost, or it is a dry run. runErr is the error
+// returned by the run, if any.
+func (e *Entrypoint) reportStatus(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext, status bool, runErr error) {
+	runLogger := runner.LogsvcClient(runnerCtx)
+	defer runnerCtx.Trace.Phase("report")()
+
+	runID := runnerCtx.QueueItem.Run.Id
+
+	if !e.hasLease(runID) {
+		runLogger.Info(ctx, "Lease on run was lost; not reporting status")
+		e.recordOutcome(ctx, runner, runnerCtx, OutcomeLost)
+		return
+	}
+
+	var outcome Outcome
+
+	err := retry.Do(ctx, queueRetry(runLogger, "Status report"), func(ctx context.Context) error {
+		cancel, err := e.Launch.QueueClient().GetCancel(ctx, runID)
 		if err != nil {
-			runLogger.Errorf(ctx, "Cancel check resulted in error: %v", err)
-			time.Sleep(time.Second)
+			return err
+		}
 
-			goto normalRetry
+		outcome = e.outcome(runID, status, runErr, cancel)
+
+		if e.dryRun {
+			runLogger.Infof(ctx, "Dry run; not reporting status %v", outcome.Passed())
+			return nil
 		}
 
 		if !cancel {
-			if err := runner.QueueClient().SetStatus(ctx, qi.Run.Id, status); err != nil {
-				// FIXME this should be a *constant*
-				if !strings.Contains(err.Error(), "status already set for run") {
-					runLogger.Errorf(ctx, "Status report resulted in error: %v", err)
-					time.Sleep(time.Second)
-
-					goto normalRetry
-				}
+			if err := queueError(runner.QueueClient().SetStatus(ctx, runID, outcome.Passed())); err != nil && !errors.Is(err, ErrStatusAlreadySet) {
+				return err
 			}
 		}
-	}()
 
-	return nil
+		return nil
+	})
+	if err != nil {
+		runLogger.Errorf(ctx, "Could not report status: %v", err)
+		outcome = OutcomeLost
+	}
+
+	e.recordOutcome(ctx, runner, runnerCtx, outcome)
+}
+
+// recordOutcome logs the outcome of the run, with the counts of its test
+// report if any, records it in its metrics, and finishes its trace with it
+// before emitting it as an event.
+func (e *Entrypoint) recordOutcome(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext, outcome Outcome) {
+	fields := log.FieldMap{"outcome": string(outcome)}
+	if report := runnerCtx.Report; report != nil {
+		fields["tests_total"] = fmt.Sprint(report.Total)
+		fields["tests_failed"] = fmt.Sprint(report.Failed)
+		fields["tests_skipped"] = fmt.Sprint(report.Skipped)
+	}
+	if exit := runnerCtx.Exit; exit != nil {
+		fields["exit_code"] = fmt.Sprint(exit.Code)
+		fields["signal"] = exit.Signal
+		fields["oom_killed"] = fmt.Sprint(exit.OOMKilled)
+	}
+
+	runner.LogsvcClient(runnerCtx).WithFields(fields).Infof(ctx, "Run completed: %v", outcome)
+	runnerCtx.Trace.SetOutcome(string(outcome))
+	runnerCtx.Trace.Finish()
+	metrics.RunsCompleted.Inc(runnerCtx.QueueItem.QueueName, string(outcome))
+
+	if outcome == OutcomeCanceled {
+		e.emitRun(events.RunCanceled, runnerCtx, outcome)
+	} else {
+		e.emitRun(events.RunFinished, runnerCtx, outcome)
+	}
 }
@@ -0,0 +1,157 @@
+package git
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	askpassSocketEnv = "TINYCI_ASKPASS_SOCKET"
+	askpassNonceEnv  = "TINYCI_ASKPASS_NONCE"
+)
+
+// The binary importing this package doubles as the GIT_ASKPASS program of the
+// git calls it makes: invoked by git with the askpass environment, it relays
+// the prompt to the askpass server of the call and prints the answer.
+func init() {
+	if os.Getenv(askpassSocketEnv) != "" && len(os.Args) == 2 {
+		os.Exit(askpass(os.Args[1]))
+	}
+}
+
+// askpass asks the askpass server for the answer to the prompt.
+func askpass(prompt string) int {
+	conn, err := net.Dial("unix", os.Getenv(askpassSocketEnv))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "askpass: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n%s\n", os.Getenv(askpassNonceEnv), prompt); err != nil {
+		fmt.Fprintf(os.Stderr, "askpass: %v\n", err)
+		return 1
+	}
+
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "askpass: no credentials for %q\n", prompt)
+		return 1
+	}
+
+	fmt.Print(answer)
+	return 0
+}
+
+// startAskpass serves the credentials of the repository to a single git call
+// over a private socket, so the token is never written to disk. Only callers
+// presenting the random nonce of the call are answered. It returns the
+// environment pointing git at the askpass program, and a func stopping the
+// server.
+func (rm *RepoManager) startAskpass() ([]string, func(), error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	nonce := hex.EncodeToString(buf)
+
+	dir, err := ioutil.TempDir("", "tinyci-askpass-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sock := filepath.Join(dir, "askpass.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go rm.serveAskpass(conn, nonce)
+		}
+	}()
+
+	env := []string{
+		fmt.Sprintf("GIT_ASKPASS=%s", exe),
+		fmt.Sprintf("%s=%s", askpassSocketEnv, sock),
+		fmt.Sprintf("%s=%s", askpassNonceEnv, nonce),
+	}
+
+	return env, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func (rm *RepoManager) serveAskpass(conn net.Conn, nonce string) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	given, err := r.ReadString('\n')
+	if err != nil || subtle.ConstantTimeCompare([]byte(strings.TrimSuffix(given, "\n")), []byte(nonce)) != 1 {
+		return
+	}
+
+	prompt, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	if answer, ok := rm.credential(strings.TrimSuffix(prompt, "\n")); ok {
+		fmt.Fprintln(conn, answer)
+	}
+}
+
+// credential answers the username or password prompt of git with the
+// credentials of the repository. Prompts for other hosts, such as those of
+// submodules elsewhere, are refused so the token is not leaked to them.
+// Prompts look like "Username for 'https://host': " and
+// "Password for 'https://user@host': ".
+func (rm *RepoManager) credential(prompt string) (string, bool) {
+	parts := strings.Split(prompt, "'")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return "", false
+	}
+
+	host := rm.host(rm.RepoName)
+	if u.Host != host.baseURL.Host {
+		return "", false
+	}
+
+	switch {
+	case strings.HasPrefix(prompt, "Username"):
+		return host.provider.Username(rm.AccessToken), true
+	case strings.HasPrefix(prompt, "Password"):
+		return rm.AccessToken, true
+	default:
+		return "", false
+	}
+}
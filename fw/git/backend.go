@@ -0,0 +1,260 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultBackend = "exec"
+
+// Backend performs the git operations of a RepoManager on its repository.
+// Select one with the backend setting of the configuration: "exec", the
+// default, runs the git binary; "go-git" works in-process and is only
+// available in binaries built with the gogit build tag.
+type Backend interface {
+	// Clone clones url into the empty repository path.
+	Clone(ctx context.Context, rm *RepoManager, url string) error
+	// Fetch fetches the refspecs from the remote, or its branches if none
+	// are given.
+	Fetch(ctx context.Context, rm *RepoManager, remote string, refspecs ...string) error
+	// Remotes lists the names of the remotes of the repository.
+	Remotes(ctx context.Context, rm *RepoManager) ([]string, error)
+	// AddRemote adds a remote to the repository.
+	AddRemote(ctx context.Context, rm *RepoManager, name, url string) error
+	// SetRemoteURL changes the url of a remote of the repository.
+	SetRemoteURL(ctx context.Context, rm *RepoManager, name, url string) error
+	// Checkout sets the working copy to the branch, tag or commit, and
+	// updates submodules.
+	Checkout(ctx context.Context, rm *RepoManager, ref string) error
+	// Reset discards changes and removes untracked files from the working
+	// copy.
+	Reset(ctx context.Context, rm *RepoManager) error
+	// Rebase rebases the current branch onto ref.
+	Rebase(ctx context.Context, rm *RepoManager, ref string) error
+	// Merge merges ref into the current branch with a merge commit.
+	Merge(ctx context.Context, rm *RepoManager, ref string) error
+	// Squash replaces the current commit with a single commit on top of ref,
+	// holding the result of merging the two.
+	Squash(ctx context.Context, rm *RepoManager, ref string) error
+	// MergeBase returns the best common ancestor of the current commit and
+	// ref.
+	MergeBase(ctx context.Context, rm *RepoManager, ref string) (string, error)
+	// Commit returns the metadata of the current commit and the files
+	// changed since its common ancestor with base.
+	Commit(ctx context.Context, rm *RepoManager, base string) (*Commit, error)
+	// RemoteHead returns the name of the branch HEAD of origin points to.
+	RemoteHead(ctx context.Context, rm *RepoManager) (string, error)
+}
+
+var backends = map[string]func() Backend{
+	defaultBackend: func() Backend { return execBackend{} },
+}
+
+func newBackend(name string) (Backend, error) {
+	if name == "" {
+		name = defaultBackend
+	}
+
+	fn, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("git backend %q is not available in this build", name)
+	}
+
+	return fn(), nil
+}
+
+// execBackend runs the git binary with the credentials of the RepoManager.
+type execBackend struct{}
+
+func (execBackend) Clone(ctx context.Context, rm *RepoManager, url string) error {
+	args := []string{"git", "clone", "--progress"}
+
+	if rm.sharedObjects() {
+		args = append(args, "--reference", rm.Config.SharedObjectsPath)
+	}
+
+	if mirror, ok := rm.mirror(rm.RepoName); ok {
+		args = append(args, "--reference", mirror)
+
+		if rm.Config.Dissociate {
+			args = append(args, "--dissociate")
+		}
+	}
+
+	if err := rm.Run(ctx, append(args, url, ".")...); err != nil {
+		return err
+	}
+
+	return rm.Run(ctx, "git", "config", "--add", "advice.detachedHead", "false")
+}
+
+func (execBackend) Fetch(ctx context.Context, rm *RepoManager, remote string, refspecs ...string) error {
+	return rm.Run(ctx, append([]string{"git", "fetch", "--progress", remote}, refspecs...)...)
+}
+
+func (execBackend) Remotes(ctx context.Context, rm *RepoManager) ([]string, error) {
+	out, err := rm.output(ctx, "git", "remote", "show")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(out), nil
+}
+
+func (execBackend) AddRemote(ctx context.Context, rm *RepoManager, name, url string) error {
+	return rm.Run(ctx, "git", "remote", "add", name, url)
+}
+
+func (execBackend) SetRemoteURL(ctx context.Context, rm *RepoManager, name, url string) error {
+	return rm.Run(ctx, "git", "remote", "set-url", name, url)
+}
+
+func (execBackend) Checkout(ctx context.Context, rm *RepoManager, ref string) error {
+	if err := rm.Run(ctx, "git", "checkout", ref); err != nil {
+		return err
+	}
+
+	args := append(append([]string{"git"}, rm.submoduleConfig()...), "submodule", "update", "--init", "--recursive")
+	return rm.Run(ctx, args...)
+}
+
+func (execBackend) Reset(ctx context.Context, rm *RepoManager) error {
+	if err := rm.Run(ctx, "git", "clean", "-fdx"); err != nil {
+		return err
+	}
+
+	return rm.Run(ctx, "git", "reset", "--hard", "HEAD")
+}
+
+func (execBackend) Rebase(ctx context.Context, rm *RepoManager, ref string) (retErr error) {
+	defer func() {
+		if retErr != nil {
+			retErr = conflictError(rm, retErr)
+			io.WriteString(rm.Log, "rebase error; trying to roll back")
+			if err := rm.Run(context.Background(), "git", "rebase", "--abort"); err != nil {
+				io.WriteString(rm.Log, fmt.Sprintf("while attempting to roll back: %v", err))
+			}
+		}
+	}()
+
+	return rm.Run(ctx, "git", "rebase", ref)
+}
+
+func (execBackend) Merge(ctx context.Context, rm *RepoManager, ref string) (retErr error) {
+	defer func() {
+		if retErr != nil {
+			retErr = conflictError(rm, retErr)
+			io.WriteString(rm.Log, "merge error; trying to roll back")
+			if err := rm.Run(context.Background(), "git", "merge", "--abort"); err != nil {
+				io.WriteString(rm.Log, fmt.Sprintf("while attempting to roll back: %v", err))
+			}
+		}
+	}()
+
+	return rm.Run(ctx, "git", "merge", "--no-ff", "-m", "CI merge", ref)
+}
+
+func (execBackend) Squash(ctx context.Context, rm *RepoManager, ref string) (retErr error) {
+	head, err := rm.output(ctx, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	if err := rm.Run(ctx, "git", "checkout", "--detach", ref); err != nil {
+		return err
+	}
+
+	defer func() {
+		if retErr != nil {
+			retErr = conflictError(rm, retErr)
+			io.WriteString(rm.Log, "squash error; trying to roll back")
+			if err := rm.Run(context.Background(), "git", "reset", "--hard"); err != nil {
+				io.WriteString(rm.Log, fmt.Sprintf("while attempting to roll back: %v", err))
+			} else if err := rm.Run(context.Background(), "git", "checkout", head); err != nil {
+				io.WriteString(rm.Log, fmt.Sprintf("while attempting to roll back: %v", err))
+			}
+		}
+	}()
+
+	if err := rm.Run(ctx, "git", "merge", "--squash", head); err != nil {
+		return err
+	}
+
+	return rm.Run(ctx, "git", "commit", "--allow-empty", "-m", "CI squash")
+}
+
+func (execBackend) MergeBase(ctx context.Context, rm *RepoManager, ref string) (string, error) {
+	return rm.output(ctx, "git", "merge-base", "HEAD", ref)
+}
+
+func (execBackend) Commit(ctx context.Context, rm *RepoManager, base string) (*Commit, error) {
+	out, err := rm.output(ctx, "git", "log", "-1", "--format=%H%x00%an%x00%ae%x00%at%x00%B", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.SplitN(out, "\x00", 5)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("unexpected output from git log: %q", out)
+	}
+
+	stamp, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing commit time %q: %w", fields[3], err)
+	}
+
+	commit := &Commit{
+		SHA:         fields[0],
+		Author:      fields[1],
+		AuthorEmail: fields[2],
+		Time:        time.Unix(stamp, 0),
+		Message:     strings.TrimSpace(fields[4]),
+	}
+
+	// the three dot form diffs against the merge base of the two
+	files, err := rm.output(ctx, "git", "diff", "--name-only", "-z", base+"...HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range strings.Split(files, "\x00") {
+		if file != "" {
+			commit.ChangedFiles = append(commit.ChangedFiles, file)
+		}
+	}
+
+	return commit, nil
+}
+
+// conflictError marks err as an ErrMergeConflict if the working copy has
+// unmerged paths. It must be called before the merge is rolled back.
+func conflictError(rm *RepoManager, err error) error {
+	paths, diffErr := rm.output(context.Background(), "git", "diff", "--name-only", "--diff-filter=U")
+	if diffErr != nil || paths == "" {
+		return err
+	}
+
+	return fmt.Errorf("%w in %v: %v", ErrMergeConflict, strings.Join(strings.Fields(paths), ", "), err)
+}
+
+func (execBackend) RemoteHead(ctx context.Context, rm *RepoManager) (string, error) {
+	if err := rm.Run(ctx, "git", "remote", "set-head", "origin", "--auto"); err != nil {
+		return "", err
+	}
+
+	head, err := rm.output(ctx, "git", "symbolic-ref", "--short", "refs/remotes/origin/HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(head, "origin/") {
+		return "", errors.New("HEAD of origin is not a branch")
+	}
+
+	return strings.TrimPrefix(head, "origin/"), nil
+}
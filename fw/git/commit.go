@@ -0,0 +1,85 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Environment variables holding the metadata of the commit under test, as
+// returned by Commit.Env.
+const (
+	EnvCommitSHA             = "TINYCI_COMMIT_SHA"
+	EnvCommitAuthor          = "TINYCI_COMMIT_AUTHOR"
+	EnvCommitAuthorEmail     = "TINYCI_COMMIT_AUTHOR_EMAIL"
+	EnvCommitTime            = "TINYCI_COMMIT_TIME"
+	EnvCommitMessage         = "TINYCI_COMMIT_MESSAGE"
+	EnvChangedFiles          = "TINYCI_CHANGED_FILES"
+	EnvChangedFilesTruncated = "TINYCI_CHANGED_FILES_TRUNCATED"
+)
+
+// maxChangedFilesEnv bounds the size of EnvChangedFiles, as the kernel limits
+// each environment string of a process.
+const maxChangedFilesEnv = 64 * 1024
+
+// Commit is the metadata of a commit, along with the files it changes.
+type Commit struct {
+	SHA         string
+	Author      string
+	AuthorEmail string
+	Time        time.Time
+	Message     string
+	// ChangedFiles are the paths changed since the commit diverged from the
+	// base it was compared against.
+	ChangedFiles []string
+}
+
+// Commit returns the metadata of the checked out commit. Its changed files
+// are those differing from its common ancestor with base, typically the
+// default branch, so it must be called before the commit is integrated.
+func (rm *RepoManager) Commit(ctx context.Context, base string) (*Commit, error) {
+	commit, err := rm.backend.Commit(ctx, rm, base)
+	if err != nil {
+		return nil, fmt.Errorf("reading commit metadata: %w", err)
+	}
+
+	return commit, nil
+}
+
+// Env returns the metadata of the commit as environment variables. The
+// changed files are separated by newlines; if there are too many to pass
+// along, the list is cut short and EnvChangedFilesTruncated is set.
+func (c *Commit) Env() []string {
+	env := []string{
+		EnvCommitSHA + "=" + c.SHA,
+		EnvCommitAuthor + "=" + c.Author,
+		EnvCommitAuthorEmail + "=" + c.AuthorEmail,
+		EnvCommitTime + "=" + c.Time.UTC().Format(time.RFC3339),
+		EnvCommitMessage + "=" + c.Message,
+	}
+
+	var (
+		files     strings.Builder
+		truncated bool
+	)
+
+	for _, file := range c.ChangedFiles {
+		if files.Len()+len(file)+1 > maxChangedFilesEnv {
+			truncated = true
+			break
+		}
+
+		if files.Len() != 0 {
+			files.WriteByte('\n')
+		}
+		files.WriteString(file)
+	}
+
+	env = append(env, EnvChangedFiles+"="+files.String())
+	if truncated {
+		env = append(env, EnvChangedFilesTruncated+"=1")
+	}
+
+	return env
+}
@@ -2,14 +2,17 @@ package git
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/config"
 )
 
 const (
-	defaultLoginScriptPath = "/tmp/tinyci-github-login.sh"
-	defaultBaseRepoPath    = "/tmp/git"
-	defaultGitUserName     = "tinyCI runner"
-	defaultGitEmail        = "no-reply@example.org"
+	defaultBaseRepoPath = "/tmp/git"
+	defaultGitUserName  = "tinyCI runner"
+	defaultGitEmail     = "no-reply@example.org"
 )
 
 // Config manages various one-off tidbits about the runner's git paths and
@@ -17,21 +20,107 @@ const (
 // you wish to use the runner framework, see fw/config documentation for more
 // information.
 type Config struct {
+	// LoginScriptPath is unused: credentials are served to each git call by a
+	// private askpass server instead of a login script.
+	//
+	// Deprecated: remove it from configurations.
 	LoginScriptPath string `yaml:"login_script_path"`
 	BaseRepoPath    string `yaml:"base_repo_path"`
+	// Repositories, if set, restricts the repositories, and forks, which may
+	// be cloned. It is normally enforced by the framework before a run
+	// starts, see fw/config, and checked again by Init.
+	Repositories *config.RepositoryPolicy `yaml:"repositories"`
+	// Hosts are the git hosts repositories are cloned from, matched in order
+	// against the names of repositories. Repositories which match none are
+	// cloned from github.com.
+	Hosts []HostConfig `yaml:"hosts"`
+	// Transport is how repositories are cloned: "https" (the default), with
+	// the token of the queue item, or "ssh", with a key.
+	Transport string `yaml:"transport"`
+	// SSHKeyPath is the private key used by the ssh transport, unless the
+	// runner provides one.
+	SSHKeyPath string `yaml:"ssh_key_path"`
+	// KnownHostsPath is the known_hosts file host keys are strictly checked
+	// against by the ssh transport. Required by it.
+	KnownHostsPath string `yaml:"known_hosts_path"`
+	// SubmoduleHTTPS, if true, rewrites the ssh urls of submodules on github
+	// and the configured hosts to https when checking them out, so private
+	// submodules on the host of the repository can be cloned with its token.
+	// Requires the https transport and the exec backend.
+	SubmoduleHTTPS bool `yaml:"submodule_https"`
+	// Backend is the implementation of git operations: "exec" (the default)
+	// or "go-git". See Backend.
+	Backend string `yaml:"backend"`
+	// SharedObjectsPath, if set, is the path to a bare repository that holds
+	// the objects of all cached repositories. Each repository borrows objects
+	// from it through git alternates, deduplicating forks and large repos.
+	SharedObjectsPath string `yaml:"shared_objects_path"`
+	// ReferencePath, if set, is a directory of mirrors of repositories, laid
+	// out like base_repo_path as <owner>/<repo>. Repositories with a mirror
+	// there are cloned with --reference against it, and forks with one are
+	// first fetched from it, so first-time clones only transfer what the
+	// mirror lacks. Requires the exec backend.
+	ReferencePath string `yaml:"reference_path"`
+	// Dissociate, if true, copies the objects borrowed from the reference
+	// mirrors at clone time, so the mirrors can be removed or rewritten
+	// safely afterwards.
+	Dissociate bool `yaml:"dissociate"`
+	// DefaultBranch is the branch runs are merged into when the queue item
+	// does not name one. If unset, the HEAD of the remote is used.
+	DefaultBranch string `yaml:"default_branch"`
+	// Worktrees, if true, gives each run its own worktree of the repository
+	// under base_repo_path, so concurrent runs of the same repository, such
+	// as matrix cells or those of a runner with max_concurrent_runs above 1,
+	// do not share a working copy. Requires the exec backend.
+	Worktrees bool `yaml:"worktrees"`
+	// MergeStrategy is how the commit of a run is combined with the default
+	// branch, unless the task or run metadata selects one under
+	// MergeStrategyKey: "merge" (the default), "rebase", "squash", "none" or
+	// "merge-base". See the MergeStrategy* constants. The go-git backend
+	// only supports "none" and "merge-base", which must then be set
+	// explicitly.
+	MergeStrategy string `yaml:"merge_strategy"`
+	// SparsePaths, if set, restricts the working copy of runs to these
+	// directories of the repository, unless the task or run metadata lists
+	// its own under SparseCheckoutKey. Requires the exec backend.
+	SparsePaths []string `yaml:"sparse_paths"`
+	// Output is how the output of git commands is captured: "pty" (the
+	// default), running git on a terminal as it would be interactively, or
+	// "pipe", with a plain pipe.
+	Output string `yaml:"output"`
+	// StripANSI, if true, removes ANSI escape sequences, such as colors, from
+	// the output of git commands.
+	StripANSI bool `yaml:"strip_ansi"`
+	// MaxOutputBytes, if set, is the amount of output of each git command,
+	// such as that of a runaway hook, written to the log. The rest is
+	// discarded.
+	MaxOutputBytes int64 `yaml:"max_output_bytes"`
+	// CommandTimeout, if set, is how long each git command may take before it
+	// is killed, in addition to the deadline of the run.
+	CommandTimeout time.Duration `yaml:"command_timeout"`
+	// MaxCacheSize, if set, is the size in bytes the cached repositories may
+	// take up, excluding the shared object store. Before each clone or fetch,
+	// and during maintenance, the least recently used repositories are
+	// evicted until they fit.
+	MaxCacheSize uint64 `yaml:"max_cache_size"`
+	// MinFree, if set, is the amount of bytes which must be free on the
+	// filesystem of base_repo_path before each clone or fetch, evicting the
+	// least recently used repositories otherwise. Runs fail if it cannot be
+	// met.
+	MinFree uint64 `yaml:"min_free"`
+	// Mirrors, if true, caches bare mirrors of repositories instead of
+	// clones, and gives each run its own worktree of the mirror; it implies
+	// worktrees. Requires the exec backend.
+	Mirrors bool `yaml:"mirrors"`
+	// Maintenance, if set, periodically garbage collects the repositories
+	// cached under base_repo_path and evicts those unused for long, or over
+	// the limits above. See Maintain.
+	Maintenance *MaintenanceConfig `yaml:"maintenance"`
 }
 
 // Validate corrects or errors out when the configuration doesn't match
 // expectations.
 func (rc *Config) Validate() error {
-	if rc.LoginScriptPath == "" {
-		rc.LoginScriptPath = defaultLoginScriptPath
-	}
-
-	if !filepath.IsAbs(rc.LoginScriptPath) {
-		return errors.New("login_script_path must be absolute")
-	}
-
 	if rc.BaseRepoPath == "" {
 		rc.BaseRepoPath = defaultBaseRepoPath
 	}
@@ -40,5 +129,115 @@ func (rc *Config) Validate() error {
 		return errors.New("base_repo_path must be absolute")
 	}
 
+	if rc.SharedObjectsPath != "" && !filepath.IsAbs(rc.SharedObjectsPath) {
+		return errors.New("shared_objects_path must be absolute")
+	}
+
+	if rc.ReferencePath != "" && !filepath.IsAbs(rc.ReferencePath) {
+		return errors.New("reference_path must be absolute")
+	}
+
+	if rc.Dissociate && rc.ReferencePath == "" {
+		return errors.New("dissociate requires a reference_path")
+	}
+
+	if rc.Repositories != nil {
+		if err := rc.Repositories.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for i := range rc.Hosts {
+		if err := rc.Hosts[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch rc.Transport {
+	case "":
+		rc.Transport = transportHTTPS
+	case transportHTTPS:
+	case transportSSH:
+		if !filepath.IsAbs(rc.KnownHostsPath) {
+			return errors.New("the ssh transport requires an absolute known_hosts_path")
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", rc.Transport)
+	}
+
+	if rc.Backend == "" {
+		rc.Backend = defaultBackend
+	}
+
+	if _, err := newBackend(rc.Backend); err != nil {
+		return err
+	}
+
+	if rc.SharedObjectsPath != "" && rc.Backend != defaultBackend {
+		return errors.New("shared_objects_path requires the exec backend")
+	}
+
+	if rc.ReferencePath != "" && rc.Backend != defaultBackend {
+		return errors.New("reference_path requires the exec backend")
+	}
+
+	if rc.SubmoduleHTTPS && (rc.Transport != transportHTTPS || rc.Backend != defaultBackend) {
+		return errors.New("submodule_https requires the https transport and the exec backend")
+	}
+
+	if rc.MergeStrategy == "" {
+		rc.MergeStrategy = MergeStrategyMerge
+	}
+
+	if err := validateMergeStrategy(rc.MergeStrategy); err != nil {
+		return err
+	}
+
+	if err := checkBackendStrategy(rc.Backend, rc.MergeStrategy); err != nil {
+		return err
+	}
+
+	if err := validateSparsePaths(rc.SparsePaths); err != nil {
+		return err
+	}
+
+	if len(rc.SparsePaths) != 0 && rc.Backend != defaultBackend {
+		return errors.New("sparse_paths requires the exec backend")
+	}
+
+	if rc.Mirrors {
+		if rc.Backend != defaultBackend {
+			return errors.New("mirrors requires the exec backend")
+		}
+
+		rc.Worktrees = true
+	}
+
+	if rc.Worktrees && rc.Backend != defaultBackend {
+		return errors.New("worktrees requires the exec backend")
+	}
+
+	switch rc.Output {
+	case "":
+		rc.Output = outputPTY
+	case outputPTY, outputPipe:
+	default:
+		return fmt.Errorf("unknown output mode %q", rc.Output)
+	}
+
+	if rc.MaxOutputBytes < 0 {
+		return errors.New("max_output_bytes must not be negative")
+	}
+
+	if rc.CommandTimeout < 0 {
+		return errors.New("command_timeout must not be negative")
+	}
+
+	if rc.Maintenance != nil {
+		if err := rc.Maintenance.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
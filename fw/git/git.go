@@ -1,8 +1,9 @@
-// Package git implements functionality to work with git and GitHub.
+// Package git implements functionality to work with git and git hosts.
 //
 // To leverage it, create a RepoManager and call Init() on it with the
 // appropriate arguments. Then, you can manage git repositories as a collection
-// of items coming from GitHub.
+// of items coming from GitHub, or the GitLab, Gitea and Bitbucket hosts
+// configured in Hosts.
 //
 // The filesystem is organized like so:
 //
@@ -13,32 +14,89 @@
 //      * parentOrg2
 //        * repo1
 //
+// If a shared objects path is configured, all repositories additionally
+// borrow their objects from a single bare repository through git alternates
+// (see gitrepository-layout(5)). Every parent and fork is fetched into the
+// shared repository under refs/remotes/<owner>/<repo>/ first, so objects
+// common to forks and their parents are stored only once.
+//
+// If a reference path of mirrors is configured, first-time clones borrow the
+// objects of the mirror of the repository with --reference, and new forks are
+// seeded from their mirror before being fetched.
+//
+// If mirrors are configured, the cache holds bare repositories instead of
+// clones, and each run gets its own worktree of the mirror. There is then no
+// shared working copy to reset between runs, which could be left in a state
+// that cannot be recovered from.
+//
 // No original clones of the forks are kept. These are stored as remotes in
 // each parent repository. This allows us to keep the filesystem footprint
 // simple as well as keeping a cache for each fork in a reliable way.
 //
-// Clones are done over HTTPS with a login script that is used in conjunction
-// with the token provided from the queuesvc to auth against github. SSH
-// cloning has a lot of intermediate caching challenges that we were trying to
-// avoid for future works; this is aside from how hard it can be to orchestrate
-// automated SSH without leaking secrets.
+// Clones are done over HTTPS with the token provided from the queuesvc, which
+// is served to each git call by a private askpass server answering only for
+// the host of the repository; the binary itself is the askpass program git
+// runs, so the token never touches the disk. Where only
+// SSH is permitted, the ssh transport may be configured instead: the key,
+// typically an ephemeral deploy key, is served to each git call by a private
+// in-process agent, and host keys are strictly checked against a known_hosts
+// file.
+//
+// Git operations are performed by a Backend selected in the configuration:
+// the git binary by default, or go-git in binaries built with the gogit tag.
 package git
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/creack/pty"
 	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw/cgroup"
+	"github.com/tinyci/ci-runners/fw/metrics"
 )
 
+// ErrFetch is returned when cloning or fetching a repository from its remote
+// fails, which is typically a transient failure of the network or of the git
+// host.
+var ErrFetch = errors.New("fetch failed")
+
+// fetchError marks an error of a transfer from a remote as ErrFetch, leaving
+// its message, and the errors it wraps, unchanged.
+type fetchError struct {
+	err error
+}
+
+func (fe *fetchError) Error() string {
+	return fe.err.Error()
+}
+
+func (fe *fetchError) Unwrap() error {
+	return fe.err
+}
+
+func (fe *fetchError) Is(target error) bool {
+	return target == ErrFetch
+}
+
+// fetchFailed marks err, if any, as ErrFetch.
+func fetchFailed(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &fetchError{err: err}
+}
+
 // RepoManager manages a series of repositories. Call Init() before using it.
 type RepoManager struct {
 	// Config addresses the configuration of certain git-centric items such as
@@ -50,9 +108,15 @@ type RepoManager struct {
 	Log io.Writer
 	// AccessToken is the github access token used to auth over https.
 	AccessToken string
+	// SSHKey is the PEM-encoded private key used to auth over ssh, such as an
+	// ephemeral deploy key. If empty, it is read from the ssh_key_path of the
+	// configuration.
+	SSHKey []byte
 	// Env is the set of environ(7)-style environment variable listings. They
 	// will be appended to each git call.
 	Env []string
+	// Cgroup, if set, is the cgroup each git call is placed in.
+	Cgroup *cgroup.Cgroup
 
 	//
 	// The following fields are populated at init time and should be left blank
@@ -66,6 +130,14 @@ type RepoManager struct {
 	ForkRepoName string
 	// ForkRemote is the computed owner name from the fork repo definition.
 	ForkRemote string
+	// DefaultBranch is the branch of the parent repo that runs are merged
+	// into, resolved by CloneOrFetch.
+	DefaultBranch string
+	// WorkPath is the path of the worktree of the run, if one was added with
+	// AddWorktree.
+	WorkPath string
+
+	backend Backend
 }
 
 func systemInit() error {
@@ -94,12 +166,24 @@ func systemInit() error {
 
 // Init initializes the repomanager for use. Must be called before using other functions.
 func (rm *RepoManager) Init(config Config, log *log.SubLogger, repoName, forkRepoName string) error {
-	if err := systemInit(); err != nil {
+	backend, err := newBackend(config.Backend)
+	if err != nil {
 		return err
 	}
+	rm.backend = backend
+
+	if _, ok := backend.(execBackend); ok {
+		if err := systemInit(); err != nil {
+			return err
+		}
+	}
 
 	rm.Config = config
 	rm.Logger = log
+
+	if err := rm.loadSSHKey(); err != nil {
+		return err
+	}
 	rm.RepoName = repoName
 	if err := rm.validateRepoName(rm.RepoName); err != nil {
 		return err
@@ -110,6 +194,12 @@ func (rm *RepoManager) Init(config Config, log *log.SubLogger, repoName, forkRep
 		return err
 	}
 
+	for _, name := range []string{rm.RepoName, rm.ForkRepoName} {
+		if err := rm.Config.Repositories.Permits(name); err != nil {
+			return err
+		}
+	}
+
 	parts := strings.SplitN(rm.ForkRepoName, "/", 2)
 	rm.ForkRemote = parts[0]
 
@@ -129,69 +219,249 @@ func (rm *RepoManager) validateRepoName(repoName string) error {
 	return nil
 }
 
-// CreateLoginScript creates a login script to be used by GIT_ASKPASS git
-// credentials functionality. It merely contains `echo <token>` which is enough
-// to get us in.
-func (rm *RepoManager) createLoginScript() error {
-	f, err := os.Create(rm.Config.LoginScriptPath)
-	if err != nil {
+func (rm *RepoManager) repoURL(repoName string) string {
+	return rm.host(repoName).repoURL(repoName, rm.useSSH())
+}
+
+func (rm *RepoManager) sharedObjects() bool {
+	return rm.Config.SharedObjectsPath != ""
+}
+
+func (rm *RepoManager) initSharedObjects(ctx context.Context) error {
+	if _, err := os.Stat(rm.Config.SharedObjectsPath); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(rm.Config.SharedObjectsPath, 0700); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = f.WriteString(
-		fmt.Sprintf(`
-#!/bin/sh
-echo %q
-`, rm.AccessToken))
+	return rm.Run(ctx, "git", "init", "--bare", rm.Config.SharedObjectsPath)
+}
+
+// fetchShared fetches the repository's branches into the shared object
+// store, so that the working repositories only need to transfer refs.
+func (rm *RepoManager) fetchShared(ctx context.Context, repoName string) error {
+	if !rm.sharedObjects() {
+		return nil
+	}
+
+	unlock, err := rm.lockPath(ctx, rm.Config.SharedObjectsPath)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	if err := rm.initSharedObjects(ctx); err != nil {
+		return err
+	}
+
+	return fetchFailed(rm.Run(
+		ctx, "git", "--git-dir", rm.Config.SharedObjectsPath,
+		"fetch", "--prune", rm.repoURL(repoName),
+		fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", repoName),
+	))
+}
+
+// mirror returns the path of the mirror of the repository in the reference
+// path, if there is one.
+func (rm *RepoManager) mirror(repoName string) (string, bool) {
+	if rm.Config.ReferencePath == "" {
+		return "", false
+	}
+
+	mirror := filepath.Join(rm.Config.ReferencePath, repoName)
+	if _, err := os.Stat(mirror); err != nil {
+		return "", false
+	}
+
+	return mirror, true
+}
+
+// fetchMirror seeds the branches of the remote from the mirror of the
+// repository in the reference path, if there is one, so the fetch from the
+// remote itself only transfers what the mirror lacks.
+func (rm *RepoManager) fetchMirror(ctx context.Context, repoName, remote string) error {
+	mirror, ok := rm.mirror(repoName)
+	if !ok {
+		return nil
+	}
 
-	return os.Chmod(f.Name(), 0700) // #nosec
+	return rm.Run(ctx, "git", "fetch", "--no-tags", mirror, fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", remote))
 }
 
-func (rm *RepoManager) removeLoginScript() error {
-	return os.Remove(rm.Config.LoginScriptPath)
+// gitDir is the git directory of the repository: the repository itself if it
+// is bare, as the shared object store and mirrors are.
+func (rm *RepoManager) gitDir() string {
+	if rm.RepoPath == rm.Config.SharedObjectsPath || rm.Config.Mirrors {
+		return rm.RepoPath
+	}
+
+	return filepath.Join(rm.RepoPath, ".git")
 }
 
-func (rm *RepoManager) clone() error {
+// linkSharedObjects points the repository's alternates at the shared object
+// store. This is only needed for repositories cloned before the shared
+// objects path was configured; clones made afterwards are already linked.
+func (rm *RepoManager) linkSharedObjects() error {
+	if !rm.sharedObjects() {
+		return nil
+	}
+
+	alternates := filepath.Join(rm.gitDir(), "objects", "info", "alternates")
+	objects := filepath.Join(rm.Config.SharedObjectsPath, "objects")
+
+	content, err := ioutil.ReadFile(alternates) // #nosec
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == objects {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(alternates), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(alternates, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, objects)
+	return err
+}
+
+func (rm *RepoManager) clone(ctx context.Context) error {
 	if err := os.MkdirAll(rm.RepoPath, 0700); err != nil {
 		return err
 	}
 
-	if err := rm.Run("git", "clone", fmt.Sprintf("https://github.com/%s", rm.RepoName), "."); err != nil {
+	if err := rm.fetchShared(ctx, rm.RepoName); err != nil {
 		return err
 	}
 
-	return rm.Run("git", "config", "--add", "advice.detachedHead", "false")
+	return fetchFailed(rm.backend.Clone(ctx, rm, rm.repoURL(rm.RepoName)))
+}
+
+// BranchName returns the branch name of a ref name as given by the queuesvc,
+// e.g. "main" for "refs/heads/main", "heads/main" or "main". It returns an
+// empty string for refs which are not branches, such as "refs/tags/v1.0",
+// "tags/v1.0" or "refs/pull/1/head"; refs other than tags must be given in
+// full to be told apart from branches.
+func BranchName(ref string) string {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "heads/"):
+		return strings.TrimPrefix(ref, "heads/")
+	case strings.HasPrefix(ref, "refs/"), strings.HasPrefix(ref, "tags/"):
+		return ""
+	default:
+		return ref
+	}
 }
 
-func (rm *RepoManager) fetch(remote string, pull bool) error {
-	verb := "fetch"
-	if pull {
-		verb = "pull"
+// refSpec returns the refspec fetching the ref from the remote, if it is not
+// a branch; branches are fetched along with the rest of the remote. Tags and
+// other refs are stored under the refs of the remote, e.g. refs/pull/1/head
+// of the remote "fork" as refs/remotes/fork/pull/1/head, so those of forks do
+// not clash.
+func refSpec(remote, ref string) (string, bool) {
+	if ref == "" || BranchName(ref) != "" {
+		return "", false
+	}
+
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/" + ref
 	}
 
-	return rm.Run("git", verb, remote)
+	return fmt.Sprintf("+%s:refs/remotes/%s/%s", ref, remote, strings.TrimPrefix(ref, "refs/")), true
 }
 
-func (rm *RepoManager) reset() error {
-	if err := rm.Run("git", "clean", "-fdx"); err != nil {
+// FetchRef fetches the ref from the remote, if it is not a branch, so that
+// commits only reachable from tags or refs such as refs/pull/1/head can be
+// checked out. Branches are already fetched by CloneOrFetch and
+// AddOrFetchFork. The repository is locked meanwhile.
+func (rm *RepoManager) FetchRef(ctx context.Context, remote, ref string) error {
+	spec, ok := refSpec(remote, ref)
+	if !ok {
+		return nil
+	}
+
+	unlock, err := rm.lock(ctx)
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	return rm.Run("git", "reset", "--hard", "HEAD")
+	return rm.backend.Fetch(ctx, rm, remote, spec)
 }
 
-// CloneOrFetch either clones a new repository, or fetches from an existing origin.
+// resolveDefaultBranch sets the default branch of the repository: the branch
+// given, that of the configuration, or failing those the HEAD of origin. The
+// repository must have been cloned.
+func (rm *RepoManager) resolveDefaultBranch(ctx context.Context, branch string) error {
+	branch = BranchName(branch)
+	if branch == "" {
+		branch = rm.Config.DefaultBranch
+	}
+
+	if branch == "" {
+		head, err := rm.backend.RemoteHead(ctx, rm)
+		if err != nil {
+			return fetchFailed(fmt.Errorf("detecting HEAD of origin: %w", err))
+		}
+
+		branch = head
+	}
+
+	rm.DefaultBranch = branch
+	return nil
+}
+
+// CloneOrFetch either clones a new repository, or fetches from an existing
+// origin, and brings the default branch up to date. If defaultBranch is empty
+// the default branch is resolved as described in the configuration; see
+// Config.DefaultBranch. With mirrors configured, only the mirror is updated.
+// Repositories are evicted from the cache first if it exceeds its limits. The
+// repository is locked meanwhile.
 func (rm *RepoManager) CloneOrFetch(ctx context.Context, defaultBranch string) error {
 	wf := rm.Logger.WithFields(log.FieldMap{"repo_name": rm.RepoName})
 
+	if err := rm.ensureSpace(ctx); err != nil {
+		wf.Errorf(ctx, "making space in the repository cache: %v", err)
+		return err
+	}
+
+	unlock, err := rm.lock(ctx)
+	if err != nil {
+		wf.Errorf(ctx, "locking repository: %v", err)
+		return err
+	}
+	defer unlock()
+
+	defer func() {
+		if err := rm.markUsed(); err != nil {
+			wf.Errorf(ctx, "recording use of repository: %v", err)
+		}
+	}()
+
+	if rm.Config.Mirrors {
+		return rm.updateMirror(ctx, wf, defaultBranch)
+	}
+
+	start := time.Now()
+
 	fi, err := os.Stat(rm.RepoPath)
 	if err != nil {
 		wf.Infof(ctx, "New repository %v; cloning fresh", rm.RepoName)
-		return rm.clone()
+		defer func() { metrics.CloneDuration.Observe(metrics.Since(start), "clone") }()
+		return rm.cloneDefaultBranch(ctx, wf, defaultBranch)
 	}
 
 	if !fi.IsDir() {
@@ -199,25 +469,48 @@ func (rm *RepoManager) CloneOrFetch(ctx context.Context, defaultBranch string) e
 		if err := os.Remove(rm.RepoPath); err != nil {
 			return err
 		}
-		return rm.clone()
+		defer func() { metrics.CloneDuration.Observe(metrics.Since(start), "clone") }()
+		return rm.cloneDefaultBranch(ctx, wf, defaultBranch)
 	}
 
-	if err := rm.reset(); err != nil {
+	defer func() { metrics.CloneDuration.Observe(metrics.Since(start), "fetch") }()
+
+	if err := rm.backend.Reset(ctx, rm); err != nil {
 		wf.Errorf(ctx, "resetting repository: %v", err)
 		return err
 	}
 
-	if err := rm.Checkout(defaultBranch); err != nil {
-		wf.Errorf(ctx, "checking out default branch %q: %v", defaultBranch, err)
+	if err := rm.resolveDefaultBranch(ctx, defaultBranch); err != nil {
+		wf.Errorf(ctx, "resolving default branch: %v", err)
 		return err
 	}
 
-	if err := rm.fetch("origin", false); err != nil {
-		wf.Errorf(ctx, "fetching origin: %v", err)
+	if err := rm.Checkout(ctx, rm.DefaultBranch); err != nil {
+		wf.Errorf(ctx, "checking out default branch %q: %v", rm.DefaultBranch, err)
+		return err
+	}
+
+	if err := rm.linkSharedObjects(); err != nil {
+		wf.Errorf(ctx, "linking shared objects: %v", err)
+		return err
+	}
+
+	if err := rm.fetchShared(ctx, rm.RepoName); err != nil {
+		wf.Errorf(ctx, "fetching into shared objects: %v", err)
+		return err
+	}
+
+	if err := rm.backend.SetRemoteURL(ctx, rm, "origin", rm.repoURL(rm.RepoName)); err != nil {
+		wf.Errorf(ctx, "updating url of origin: %v", err)
 		return err
 	}
 
-	if err := rm.Rebase(path.Join("origin", defaultBranch)); err != nil {
+	if err := rm.backend.Fetch(ctx, rm, "origin"); err != nil {
+		wf.Errorf(ctx, "fetching origin: %v", err)
+		return fetchFailed(err)
+	}
+
+	if err := rm.backend.Rebase(ctx, rm, path.Join("origin", rm.DefaultBranch)); err != nil {
 		wf.Errorf(ctx, "rebasing: %v", err)
 		return err
 	}
@@ -225,93 +518,202 @@ func (rm *RepoManager) CloneOrFetch(ctx context.Context, defaultBranch string) e
 	return nil
 }
 
+// cloneDefaultBranch clones the repository and checks out its default
+// branch, if it is not the HEAD of origin checked out by the clone.
+func (rm *RepoManager) cloneDefaultBranch(ctx context.Context, wf *log.SubLogger, defaultBranch string) error {
+	if err := rm.clone(ctx); err != nil {
+		return err
+	}
+
+	if err := rm.resolveDefaultBranch(ctx, defaultBranch); err != nil {
+		wf.Errorf(ctx, "resolving default branch: %v", err)
+		return err
+	}
+
+	if err := rm.Checkout(ctx, rm.DefaultBranch); err != nil {
+		wf.Errorf(ctx, "checking out default branch %q: %v", rm.DefaultBranch, err)
+		return err
+	}
+
+	return nil
+}
+
 // AddOrFetchFork retrieves the fork's contents, or adds the fork as a remote, and then does that.
-func (rm *RepoManager) AddOrFetchFork() error {
-	// use normal exec.Command for this as we need to capture
-	cmd := exec.Command("git", "remote", "show") // #nosec
-	cmd.Dir = rm.RepoPath
+func (rm *RepoManager) AddOrFetchFork(ctx context.Context) error {
+	unlock, err := rm.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	out, err := cmd.Output()
+	remotes, err := rm.backend.Remotes(ctx, rm)
 	if err != nil {
 		return err
 	}
 
 	var added bool
 
-	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
-		if strings.TrimSpace(line) == rm.ForkRemote {
+	for _, remote := range remotes {
+		if remote == rm.ForkRemote {
 			added = true
 			break
 		}
 	}
 
 	if !added {
-		err := rm.Run("git", "remote", "add", rm.ForkRemote, fmt.Sprintf("https://github.com/%s", rm.ForkRepoName))
-		if err != nil {
+		if err := rm.backend.AddRemote(ctx, rm, rm.ForkRemote, rm.repoURL(rm.ForkRepoName)); err != nil {
 			return err
 		}
+
+		if err := rm.fetchMirror(ctx, rm.ForkRepoName, rm.ForkRemote); err != nil {
+			return err
+		}
+	} else if err := rm.backend.SetRemoteURL(ctx, rm, rm.ForkRemote, rm.repoURL(rm.ForkRepoName)); err != nil {
+		return err
 	}
 
-	return rm.fetch(rm.ForkRemote, false)
+	if err := rm.fetchShared(ctx, rm.ForkRepoName); err != nil {
+		return err
+	}
+
+	return fetchFailed(rm.backend.Fetch(ctx, rm, rm.ForkRemote))
 }
 
 // Checkout sets the working copy to the ref provided.
-func (rm *RepoManager) Checkout(ref string) error {
-	if err := rm.Run("git", "checkout", ref); err != nil {
-		return err
+func (rm *RepoManager) Checkout(ctx context.Context, ref string) error {
+	return rm.backend.Checkout(ctx, rm, ref)
+}
+
+// Rebase is similar to merge with rollback capability. Otherwise it's plain rebase.
+func (rm *RepoManager) Rebase(ctx context.Context, ref string) error {
+	return rm.backend.Rebase(ctx, rm, ref)
+}
+
+// Merge merges the ref into the currently checked out ref.
+func (rm *RepoManager) Merge(ctx context.Context, ref string) error {
+	return rm.backend.Merge(ctx, rm, ref)
+}
+
+// commandContext applies the command timeout of the configuration, if any,
+// to ctx.
+func (rm *RepoManager) commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if rm.Config.CommandTimeout == 0 {
+		return context.WithCancel(ctx)
 	}
 
-	return rm.Run("git", "submodule", "update", "--init", "--recursive")
+	return context.WithTimeout(ctx, rm.Config.CommandTimeout)
 }
 
-// Rebase is similar to merge with rollback capability. Otherwise it's plain rebase.
-func (rm *RepoManager) Rebase(ref string) (retErr error) {
-	defer func() {
-		if retErr != nil {
-			io.WriteString(rm.Log, "rebase error; trying to roll back")
-			if err := rm.Run("git", "rebase", "--abort"); err != nil {
-				io.WriteString(rm.Log, fmt.Sprintf("while attempting to roll back: %v", err))
-			}
+// wait waits for the started command, which must lead its own process group.
+// If ctx is done first, the whole process group is killed, so helpers such as
+// ssh and git-remote-https do not outlive git.
+func wait(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
 		}
 	}()
 
-	return rm.Run("git", "rebase", ref)
+	err := cmd.Wait()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%v: %w", strings.Join(cmd.Args, " "), ctx.Err())
+	}
+
+	return err
 }
 
-// Merge merges the ref into the currently checked out ref.
-func (rm *RepoManager) Merge(ref string) (retErr error) {
-	defer func() {
-		if retErr != nil {
-			io.WriteString(rm.Log, "merge error; trying to roll back")
-			if err := rm.Run("git", "merge", "--abort"); err != nil {
-				io.WriteString(rm.Log, fmt.Sprintf("while attempting to roll back: %v", err))
-			}
-		}
-	}()
+// output runs a local command in the repository, returning its trimmed
+// standard output.
+func (rm *RepoManager) output(ctx context.Context, command ...string) (string, error) {
+	ctx, cancel := rm.commandContext(ctx)
+	defer cancel()
+
+	var out bytes.Buffer
+
+	cmd := exec.Command(command[0], command[1:]...) // #nosec
+	cmd.Env = append(os.Environ(), rm.Env...)
+	cmd.Dir = rm.WorkDir()
+	cmd.Stdout = &out
+	newProcessGroup(cmd)
 
-	return rm.Run("git", "merge", "--no-ff", "-m", "CI merge", ref)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	if err := wait(ctx, cmd); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
 }
 
-// Run runs a command, piping output to the log.
-func (rm *RepoManager) Run(command ...string) error {
-	if err := rm.createLoginScript(); err != nil {
+// Run runs a command, piping output to the log. The command, along with any
+// processes it starts, is killed when ctx is done or the command timeout of
+// the configuration passes.
+func (rm *RepoManager) Run(ctx context.Context, command ...string) error {
+	ctx, cancel := rm.commandContext(ctx)
+	defer cancel()
+
+	askpassEnv, stopAskpass, err := rm.startAskpass()
+	if err != nil {
 		return err
 	}
-	defer rm.removeLoginScript()
+	defer stopAskpass()
+
+	env := append(append(os.Environ(), askpassEnv...), "EDITOR=/bin/true")
+
+	if rm.useSSH() {
+		sshEnv, stop, err := rm.startAgent()
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		env = append(env, sshEnv...)
+	}
+
+	// git joins the cgroup before it executes, so nothing it starts escapes.
+	if rm.Cgroup != nil {
+		command = rm.Cgroup.Wrap(command)
+	}
 
 	cmd := exec.Command(command[0], command[1:]...) // #nosec
-	cmd.Env = append(
-		append(os.Environ(), fmt.Sprintf("GIT_ASKPASS=%s", rm.Config.LoginScriptPath), "EDITOR=/bin/true"),
-		rm.Env...)
-	cmd.Dir = rm.RepoPath
+	cmd.Env = append(env, rm.Env...)
+	cmd.Dir = rm.WorkDir()
 
-	tty, err := pty.Start(cmd)
+	out, err := rm.startOutput(cmd)
 	if err != nil {
 		return err
 	}
-	defer tty.Close()
+	defer out.Close()
 
-	go io.Copy(rm.Log, tty)
+	copied := make(chan struct{})
+
+	go func() {
+		defer close(copied)
+
+		pw := rm.outputWriter()
+		io.Copy(pw, out)
+		pw.Flush()
+	}()
+
+	err = wait(ctx, cmd)
+
+	// the output reports EOF once git and the processes it started are gone.
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+	}
+
+	var exitErr *exec.ExitError
+	if rm.Cgroup != nil && errors.As(err, &exitErr) && exitErr.ExitCode() == cgroup.JoinFailed {
+		return fmt.Errorf("adding git to cgroup: %w", err)
+	}
 
-	return cmd.Wait()
+	return err
 }
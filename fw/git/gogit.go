@@ -0,0 +1,406 @@
+//go:build gogit
+// +build gogit
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+func init() {
+	backends["go-git"] = func() Backend { return goGitBackend{} }
+}
+
+// errNotFastForward is returned by the go-git backend for operations which
+// would need a true merge or rebase, which go-git does not implement.
+var errNotFastForward = errors.New("the go-git backend can only fast-forward; use the exec backend to merge diverged histories")
+
+// goGitBackend works on the repository in-process with go-git, so network
+// operations honor their context and no git binary is needed. Ignored files
+// are left in place by Reset, and histories which have diverged cannot be
+// merged or rebased: Rebase and Merge only fast-forward, which is enough to
+// bring the cached default branch up to date, and the configuration only
+// allows the merge strategies which do not combine commits with it.
+type goGitBackend struct{}
+
+func (goGitBackend) auth(rm *RepoManager) (transport.AuthMethod, error) {
+	if rm.useSSH() {
+		auth, err := gitssh.NewPublicKeys("git", rm.SSHKey, "")
+		if err != nil {
+			return nil, err
+		}
+
+		auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(rm.Config.KnownHostsPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return auth, nil
+	}
+
+	// like the askpass server, present the token as the host expects.
+	return &http.BasicAuth{Username: rm.host(rm.RepoName).provider.Username(rm.AccessToken), Password: rm.AccessToken}, nil
+}
+
+func (b goGitBackend) Clone(ctx context.Context, rm *RepoManager, url string) error {
+	ctx, cancel := rm.commandContext(ctx)
+	defer cancel()
+
+	auth, err := b.auth(rm)
+	if err != nil {
+		return err
+	}
+
+	_, err = gogit.PlainCloneContext(ctx, rm.RepoPath, false, &gogit.CloneOptions{
+		URL:               url,
+		Auth:              auth,
+		Progress:          rm.Log,
+		RecurseSubmodules: gogit.DefaultSubmoduleRecursionDepth,
+	})
+
+	return err
+}
+
+func (b goGitBackend) Fetch(ctx context.Context, rm *RepoManager, remote string, refspecs ...string) error {
+	ctx, cancel := rm.commandContext(ctx)
+	defer cancel()
+
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	auth, err := b.auth(rm)
+	if err != nil {
+		return err
+	}
+
+	specs := []gitconfig.RefSpec{}
+	for _, spec := range refspecs {
+		specs = append(specs, gitconfig.RefSpec(spec))
+	}
+
+	err = repo.FetchContext(ctx, &gogit.FetchOptions{RemoteName: remote, RefSpecs: specs, Auth: auth, Progress: rm.Log})
+	if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return nil
+	}
+
+	return err
+}
+
+func (goGitBackend) Remotes(ctx context.Context, rm *RepoManager) ([]string, error) {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes, err := repo.Remotes()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, remote := range remotes {
+		names = append(names, remote.Config().Name)
+	}
+
+	return names, nil
+}
+
+func (goGitBackend) AddRemote(ctx context.Context, rm *RepoManager, name, url string) error {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: name, URLs: []string{url}})
+	return err
+}
+
+func (goGitBackend) SetRemoteURL(ctx context.Context, rm *RepoManager, name, url string) error {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	remote, ok := cfg.Remotes[name]
+	if !ok {
+		return fmt.Errorf("no remote %q", name)
+	}
+
+	remote.URLs = []string{url}
+	return repo.SetConfig(cfg)
+}
+
+func (b goGitBackend) Checkout(ctx context.Context, rm *RepoManager, ref string) error {
+	ctx, cancel := rm.commandContext(ctx)
+	defer cancel()
+
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	opts := &gogit.CheckoutOptions{Force: true}
+	branch := plumbing.NewBranchReferenceName(ref)
+
+	if _, err := repo.Reference(branch, true); err == nil {
+		opts.Branch = branch
+	} else if remote, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", ref), true); err == nil {
+		// like git checkout, create a local branch from that of origin.
+		opts.Branch = branch
+		opts.Hash = remote.Hash()
+		opts.Create = true
+	} else {
+		hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+		if err != nil {
+			return fmt.Errorf("resolving %q: %w", ref, err)
+		}
+
+		opts.Hash = *hash
+	}
+
+	if err := wt.Checkout(opts); err != nil {
+		return err
+	}
+
+	submodules, err := wt.Submodules()
+	if err != nil {
+		return err
+	}
+
+	auth, err := b.auth(rm)
+	if err != nil {
+		return err
+	}
+
+	return submodules.UpdateContext(ctx, &gogit.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: gogit.DefaultSubmoduleRecursionDepth,
+		Auth:              auth,
+	})
+}
+
+func (goGitBackend) Reset(ctx context.Context, rm *RepoManager) error {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if err := wt.Clean(&gogit.CleanOptions{Dir: true}); err != nil {
+		return err
+	}
+
+	return wt.Reset(&gogit.ResetOptions{Mode: gogit.HardReset})
+}
+
+// Rebase fast-forwards the current branch to ref, which is all that is needed
+// to bring an unmodified default branch up to date. It is not a rebase: it
+// fails with errNotFastForward if the current branch has commits of its own.
+func (goGitBackend) Rebase(ctx context.Context, rm *RepoManager, ref string) error {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	head, target, err := resolveHeadAndRef(repo, ref)
+	if err != nil {
+		return err
+	}
+
+	ff, err := head.IsAncestor(target)
+	if err != nil {
+		return err
+	}
+
+	if !ff {
+		return errNotFastForward
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return wt.Reset(&gogit.ResetOptions{Commit: target.Hash, Mode: gogit.HardReset})
+}
+
+// Merge succeeds only if ref is already merged into the current branch.
+func (goGitBackend) Merge(ctx context.Context, rm *RepoManager, ref string) error {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	head, target, err := resolveHeadAndRef(repo, ref)
+	if err != nil {
+		return err
+	}
+
+	merged, err := target.IsAncestor(head)
+	if err != nil {
+		return err
+	}
+
+	if !merged {
+		return errNotFastForward
+	}
+
+	return nil
+}
+
+// Squash is not supported by the go-git backend.
+func (goGitBackend) Squash(ctx context.Context, rm *RepoManager, ref string) error {
+	return errors.New("the go-git backend cannot squash; use the exec backend")
+}
+
+func (goGitBackend) MergeBase(ctx context.Context, rm *RepoManager, ref string) (string, error) {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return "", err
+	}
+
+	head, target, err := resolveHeadAndRef(repo, ref)
+	if err != nil {
+		return "", err
+	}
+
+	bases, err := head.MergeBase(target)
+	if err != nil {
+		return "", err
+	}
+
+	if len(bases) == 0 {
+		return "", fmt.Errorf("HEAD and %q have no common ancestor", ref)
+	}
+
+	return bases[0].Hash.String(), nil
+}
+
+func (goGitBackend) Commit(ctx context.Context, rm *RepoManager, base string) (*Commit, error) {
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	head, target, err := resolveHeadAndRef(repo, base)
+	if err != nil {
+		return nil, err
+	}
+
+	commit := &Commit{
+		SHA:         head.Hash.String(),
+		Author:      head.Author.Name,
+		AuthorEmail: head.Author.Email,
+		Time:        head.Author.When,
+		Message:     strings.TrimSpace(head.Message),
+	}
+
+	bases, err := head.MergeBase(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bases) == 0 {
+		return nil, fmt.Errorf("HEAD and %q have no common ancestor", base)
+	}
+
+	patch, err := bases[0].PatchContext(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fp := range patch.FilePatches() {
+		from, to := fp.Files()
+		if to != nil {
+			commit.ChangedFiles = append(commit.ChangedFiles, to.Path())
+		} else if from != nil {
+			commit.ChangedFiles = append(commit.ChangedFiles, from.Path())
+		}
+	}
+
+	return commit, nil
+}
+
+func (b goGitBackend) RemoteHead(ctx context.Context, rm *RepoManager) (string, error) {
+	ctx, cancel := rm.commandContext(ctx)
+	defer cancel()
+
+	repo, err := gogit.PlainOpen(rm.RepoPath)
+	if err != nil {
+		return "", err
+	}
+
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := b.auth(rm)
+	if err != nil {
+		return "", err
+	}
+
+	refs, err := remote.ListContext(ctx, &gogit.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference && ref.Target().IsBranch() {
+			return ref.Target().Short(), nil
+		}
+	}
+
+	return "", errors.New("HEAD of origin is not a branch")
+}
+
+func resolveHeadAndRef(repo *gogit.Repository, ref string) (*object.Commit, *object.Commit, error) {
+	headRef, err := repo.Head()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	head, err := repo.CommitObject(headRef.Hash())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolving %q: %w", ref, err)
+	}
+
+	target, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return head, target, nil
+}
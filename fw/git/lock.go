@@ -0,0 +1,115 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/flock"
+)
+
+// lockDir is the directory under the base repo path holding lock files.
+const lockDir = ".locks"
+
+const lockPollInterval = 100 * time.Millisecond
+
+var (
+	// repoLocks are semaphores rather than mutexes, so waiting on them can be
+	// canceled.
+	repoLocks      = map[string]chan struct{}{}
+	repoLocksMutex sync.Mutex
+)
+
+// lockPath takes an exclusive lock on the path, for operations which modify
+// the repository there, such as clones and fetches. It is held against other
+// goroutines with a semaphore and against other processes with flock(2) on a lock
+// file under the base repo path. The returned func releases the lock.
+func (rm *RepoManager) lockPath(ctx context.Context, path string) (func(), error) {
+	repoLocksMutex.Lock()
+	sem, ok := repoLocks[path]
+	if !ok {
+		sem = make(chan struct{}, 1)
+		repoLocks[path] = sem
+	}
+	repoLocksMutex.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	release := func() { <-sem }
+
+	name, err := lockName(path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	lockfile := filepath.Join(rm.Config.BaseRepoPath, lockDir, name)
+	if err := os.MkdirAll(filepath.Dir(lockfile), 0700); err != nil {
+		release()
+		return nil, err
+	}
+
+	f, err := os.OpenFile(lockfile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	for {
+		err := flock.TryLock(f)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, flock.ErrLocked) {
+			f.Close()
+			release()
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			release()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	return func() {
+		flock.Unlock(f)
+		f.Close()
+		release()
+	}, nil
+}
+
+// lockName returns the name of the lock file of the path, under the lock
+// directory: the absolute path, relative to the root of its volume, under the
+// volume name, such as C on windows. There is none on linux.
+func lockName(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	volume := filepath.VolumeName(abs)
+	rel := strings.TrimLeft(abs[len(volume):], string(filepath.Separator))
+
+	// C: or \\host\share
+	volume = strings.NewReplacer(":", "", `\`, "_").Replace(strings.TrimLeft(volume, `\`))
+
+	return filepath.Join(volume, rel) + ".lock", nil
+}
+
+// lock takes the lock of the repository. See lockPath.
+func (rm *RepoManager) lock(ctx context.Context) (func(), error) {
+	return rm.lockPath(ctx, rm.RepoPath)
+}
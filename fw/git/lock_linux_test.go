@@ -0,0 +1,20 @@
+package git
+
+import "testing"
+
+func TestLockName(t *testing.T) {
+	for path, want := range map[string]string{
+		"/var/lib/tinyci/repos/owner/repo": "var/lib/tinyci/repos/owner/repo.lock",
+		"/repos//owner/./repo/":            "repos/owner/repo.lock",
+		"/":                                ".lock",
+	} {
+		got, err := lockName(path)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+
+		if got != want {
+			t.Errorf("%v: got %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinyci-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rm := &RepoManager{Config: Config{BaseRepoPath: dir}}
+	path := filepath.Join(dir, "owner", "repo")
+
+	unlock, err := rm.lockPath(context.Background(), path)
+	if err != nil {
+		t.Fatalf("taking the lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*lockPollInterval)
+	defer cancel()
+
+	if _, err := rm.lockPath(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("taking the lock twice: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	unlock, err = rm.lockPath(ctx, path)
+	if err != nil {
+		t.Fatalf("taking the lock once released: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,21 @@
+package git
+
+import "testing"
+
+func TestLockName(t *testing.T) {
+	for path, want := range map[string]string{
+		`C:\repos\owner\repo`:       `C\repos\owner\repo.lock`,
+		`D:\repos\owner\repo`:       `D\repos\owner\repo.lock`,
+		`C:/repos/owner/repo`:       `C\repos\owner\repo.lock`,
+		`\\host\share\repos\o\repo`: `host_share\repos\o\repo.lock`,
+	} {
+		got, err := lockName(path)
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+
+		if got != want {
+			t.Errorf("%v: got %v, want %v", path, got, want)
+		}
+	}
+}
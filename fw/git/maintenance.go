@@ -0,0 +1,233 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw/disk"
+)
+
+const (
+	defaultMaintenanceInterval = 24 * time.Hour
+	defaultPruneExpire         = "2.weeks.ago"
+
+	// usedStamp is the file in the git directory of each repository whose
+	// modification time is the last time it was used by a run.
+	usedStamp = "tinyci-used"
+)
+
+// MaintenanceConfig configures the upkeep of the repositories cached under
+// the base repo path.
+type MaintenanceConfig struct {
+	// Interval is how often maintenance is done. Defaults to a day.
+	Interval time.Duration `yaml:"interval"`
+	// PruneExpire is the age, in git's approxidate format, of unreachable
+	// objects pruned by git gc. Defaults to "2.weeks.ago".
+	PruneExpire string `yaml:"prune_expire"`
+	// TTL, if set, evicts repositories not used by a run for that long.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (mc *MaintenanceConfig) Validate() error {
+	if mc.Interval < 0 || mc.TTL < 0 {
+		return errors.New("maintenance interval and ttl must not be negative")
+	}
+
+	if mc.Interval == 0 {
+		mc.Interval = defaultMaintenanceInterval
+	}
+
+	if mc.PruneExpire == "" {
+		mc.PruneExpire = defaultPruneExpire
+	}
+
+	return nil
+}
+
+type cachedRepo struct {
+	name     string
+	lastUsed time.Time
+	size     uint64
+}
+
+// markUsed records that the repository is being used by a run, for eviction.
+func (rm *RepoManager) markUsed() error {
+	stamp := filepath.Join(rm.gitDir(), usedStamp)
+
+	now := time.Now()
+	if err := os.Chtimes(stamp, now, now); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(stamp, nil, 0600)
+}
+
+// Maintain garbage collects the repositories cached under the base repo path
+// and the shared object store, and evicts repositories unused for longer than
+// the TTL of the maintenance configuration, then the least recently used
+// while the cache exceeds its limits; see Config.MaxCacheSize and
+// Config.MinFree. Each repository is locked while it is maintained, but runs
+// hold no lock while using their working copy: the caller must ensure no runs
+// are in progress. Repositories with worktrees are never evicted.
+func Maintain(ctx context.Context, config Config, logger *log.SubLogger) error {
+	if config.Maintenance == nil {
+		return nil
+	}
+
+	mc := config.Maintenance
+
+	repos, err := cachedRepos(config)
+	if err != nil {
+		return err
+	}
+
+	if mc.TTL != 0 {
+		kept := []cachedRepo{}
+
+		for _, repo := range repos {
+			if time.Since(repo.lastUsed) < mc.TTL || !evict(ctx, config, logger, repo, "unused since "+repo.lastUsed.Format(time.RFC3339)) {
+				kept = append(kept, repo)
+			}
+		}
+
+		repos = kept
+	}
+
+	for i, repo := range repos {
+		rm := maintenanceRepoManager(config, logger, repo.name)
+
+		if err := rm.gc(ctx, "--prune="+mc.PruneExpire); err != nil {
+			logger.Errorf(ctx, "Garbage collecting %v: %v", repo.name, err)
+		}
+
+		if size, err := disk.Size(rm.RepoPath); err == nil {
+			repos[i].size = size
+		}
+	}
+
+	if config.SharedObjectsPath != "" {
+		rm := maintenanceRepoManager(config, logger, "")
+		rm.RepoPath = config.SharedObjectsPath
+
+		// repositories borrow objects the store may not reach anymore, so
+		// nothing is pruned from it.
+		if err := rm.gc(ctx, "--prune=never"); err != nil {
+			logger.Errorf(ctx, "Garbage collecting shared objects: %v", err)
+		}
+	}
+
+	if err := enforceLimits(ctx, config, logger, repos, ""); err != nil {
+		logger.Errorf(ctx, "Maintaining the repository cache: %v", err)
+	}
+
+	return nil
+}
+
+func maintenanceRepoManager(config Config, logger *log.SubLogger, repoName string) *RepoManager {
+	return &RepoManager{
+		Config:   config,
+		Logger:   logger,
+		Log:      ioutil.Discard,
+		RepoName: repoName,
+		RepoPath: filepath.Join(config.BaseRepoPath, repoName),
+	}
+}
+
+// gc garbage collects the repository while holding its lock.
+func (rm *RepoManager) gc(ctx context.Context, prune string) error {
+	unlock, err := rm.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if rm.RepoName != "" {
+		if err := rm.Run(ctx, "git", "worktree", "prune"); err != nil {
+			return err
+		}
+	}
+
+	return rm.Run(ctx, "git", "--git-dir", rm.gitDir(), "gc", "--quiet", prune)
+}
+
+// evict removes the repository from the cache, returning true if it did.
+func evict(ctx context.Context, config Config, logger *log.SubLogger, repo cachedRepo, reason string) bool {
+	rm := maintenanceRepoManager(config, logger, repo.name)
+
+	worktrees, err := ioutil.ReadDir(filepath.Join(config.BaseRepoPath, worktreeDir, repo.name))
+	if err == nil && len(worktrees) != 0 {
+		return false
+	}
+
+	unlock, err := rm.lock(ctx)
+	if err != nil {
+		logger.Errorf(ctx, "Locking %v for eviction: %v", repo.name, err)
+		return false
+	}
+	defer unlock()
+
+	if err := os.RemoveAll(rm.RepoPath); err != nil {
+		logger.Errorf(ctx, "Evicting %v: %v", repo.name, err)
+		return false
+	}
+
+	// remove the owner directory, if this was its last repository.
+	os.Remove(filepath.Dir(rm.RepoPath))
+
+	logger.Infof(ctx, "Evicted %v from the repository cache: %v", repo.name, reason)
+	return true
+}
+
+// cachedRepos lists the repositories cloned under the base repo path.
+func cachedRepos(config Config) ([]cachedRepo, error) {
+	owners, err := ioutil.ReadDir(config.BaseRepoPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	repos := []cachedRepo{}
+
+	for _, owner := range owners {
+		// skip the lock and worktree directories
+		if !owner.IsDir() || strings.HasPrefix(owner.Name(), ".") {
+			continue
+		}
+
+		fis, err := ioutil.ReadDir(filepath.Join(config.BaseRepoPath, owner.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fi := range fis {
+			name := owner.Name() + "/" + fi.Name()
+			path := filepath.Join(config.BaseRepoPath, name)
+
+			if !fi.IsDir() || path == config.SharedObjectsPath {
+				continue
+			}
+
+			// repositories cloned before usage was recorded count as used when
+			// they were last modified.
+			lastUsed := fi.ModTime()
+			if st, err := os.Stat(filepath.Join(maintenanceRepoManager(config, nil, name).gitDir(), usedStamp)); err == nil {
+				lastUsed = st.ModTime()
+			}
+
+			repos = append(repos, cachedRepo{name: name, lastUsed: lastUsed})
+		}
+	}
+
+	return repos, nil
+}
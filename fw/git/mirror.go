@@ -0,0 +1,95 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw/metrics"
+)
+
+// updateMirror creates the bare mirror of the repository, or fetches it, and
+// resolves the default branch. Mirrors have no working copy to reset, check
+// out or rebase: runs work in worktrees of them, see AddWorktree. Clones made
+// before mirrors were configured are replaced.
+func (rm *RepoManager) updateMirror(ctx context.Context, wf *log.SubLogger, defaultBranch string) error {
+	start := time.Now()
+	phase := "fetch"
+
+	if _, err := os.Stat(filepath.Join(rm.RepoPath, "HEAD")); err != nil {
+		phase = "clone"
+		wf.Infof(ctx, "New repository %v; creating mirror", rm.RepoName)
+
+		if err := os.RemoveAll(rm.RepoPath); err != nil {
+			return err
+		}
+
+		if err := rm.initMirror(ctx); err != nil {
+			wf.Errorf(ctx, "creating mirror: %v", err)
+			os.RemoveAll(rm.RepoPath)
+			return err
+		}
+	}
+
+	defer func() { metrics.CloneDuration.Observe(metrics.Since(start), phase) }()
+
+	if err := rm.linkSharedObjects(); err != nil {
+		wf.Errorf(ctx, "linking shared objects: %v", err)
+		return err
+	}
+
+	if err := rm.fetchShared(ctx, rm.RepoName); err != nil {
+		wf.Errorf(ctx, "fetching into shared objects: %v", err)
+		return err
+	}
+
+	if err := rm.backend.SetRemoteURL(ctx, rm, "origin", rm.repoURL(rm.RepoName)); err != nil {
+		wf.Errorf(ctx, "updating url of origin: %v", err)
+		return err
+	}
+
+	if err := rm.backend.Fetch(ctx, rm, "origin"); err != nil {
+		wf.Errorf(ctx, "fetching origin: %v", err)
+		return fetchFailed(err)
+	}
+
+	if err := rm.resolveDefaultBranch(ctx, defaultBranch); err != nil {
+		wf.Errorf(ctx, "resolving default branch: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// initMirror creates an empty bare repository with origin as a remote. Its
+// branches are fetched to refs/remotes/origin/, as in a clone, so refs name
+// the same commits in both layouts.
+func (rm *RepoManager) initMirror(ctx context.Context) error {
+	if err := os.MkdirAll(rm.RepoPath, 0700); err != nil {
+		return err
+	}
+
+	if err := rm.Run(ctx, "git", "init", "--bare", "--quiet"); err != nil {
+		return err
+	}
+
+	if err := rm.backend.AddRemote(ctx, rm, "origin", rm.repoURL(rm.RepoName)); err != nil {
+		return err
+	}
+
+	return rm.fetchMirror(ctx, rm.RepoName, "origin")
+}
+
+// worktreeBase is the commit worktrees are added at: the HEAD of the clone,
+// or the default branch of origin for mirrors, which have no HEAD of their
+// own.
+func (rm *RepoManager) worktreeBase() string {
+	if rm.Config.Mirrors {
+		return path.Join("origin", rm.DefaultBranch)
+	}
+
+	return "HEAD"
+}
@@ -0,0 +1,90 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+)
+
+// Output modes of git commands.
+const (
+	// outputPTY runs git on a terminal, as it would be run interactively.
+	outputPTY = "pty"
+	// outputPipe runs git with its output on a plain pipe.
+	outputPipe = "pipe"
+)
+
+// ansiRegexp matches ANSI escape sequences, such as colors and line erasure.
+var ansiRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// startOutput starts the command in its own process group, returning the
+// stream of its combined standard output and error.
+func (rm *RepoManager) startOutput(cmd *exec.Cmd) (io.ReadCloser, error) {
+	// windows has no pty, so commands always write to a pipe there
+	if rm.Config.Output != outputPipe && hasPTY {
+		return startPTY(cmd)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Stdout = w
+	cmd.Stderr = w
+	newProcessGroup(cmd)
+
+	err = cmd.Start()
+	// the command holds its own copy of the write end, so the stream ends
+	// when it and the processes it started exit.
+	w.Close()
+
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// limitWriter passes at most max bytes through to w, then a notice that the
+// output was truncated. Later writes are discarded but reported as written, so
+// the command is not disturbed.
+type limitWriter struct {
+	w       io.Writer
+	max     int64
+	written int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.written >= lw.max {
+		return len(p), nil
+	}
+
+	n := int64(len(p))
+	if remaining := lw.max - lw.written; n > remaining {
+		n = remaining
+	}
+
+	lw.w.Write(p[:n])
+	lw.written += n
+
+	if lw.written >= lw.max {
+		fmt.Fprintf(lw.w, "\n[output truncated after %d bytes]\n", lw.max)
+	}
+
+	return len(p), nil
+}
+
+// outputWriter returns the writer the output of a command is copied to.
+func (rm *RepoManager) outputWriter() *progressWriter {
+	var w io.Writer = rm.Log
+
+	if rm.Config.MaxOutputBytes > 0 {
+		w = &limitWriter{w: w, max: rm.Config.MaxOutputBytes}
+	}
+
+	return newProgressWriter(w, rm.Config.StripANSI)
+}
@@ -0,0 +1,132 @@
+package git
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathsKey and PathsIgnoreKey are the task or run metadata keys holding the
+// path filters of a run, as lists of patterns. A run is only executed if the
+// commit under test changes a file matching PathsKey, if given, and not
+// matching PathsIgnoreKey. Patterns are those of path.Match, where a "**"
+// element also matches any number of directories.
+//
+// e.g., {"paths": ["services/api/**", "lib/**"], "paths_ignore": ["**/*.md"]}
+const (
+	PathsKey       = "paths"
+	PathsIgnoreKey = "paths_ignore"
+)
+
+// PathFilter selects the runs to execute by the files their commit changes.
+type PathFilter struct {
+	Paths  []string
+	Ignore []string
+}
+
+// PathFilterFrom returns the filter under PathsKey and PathsIgnoreKey in the
+// metadata, or nil if there is none.
+func PathFilterFrom(md map[string]interface{}) (*PathFilter, error) {
+	paths, err := patterns(md, PathsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := patterns(md, PathsIgnoreKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if paths == nil && ignore == nil {
+		return nil, nil
+	}
+
+	return &PathFilter{Paths: paths, Ignore: ignore}, nil
+}
+
+func patterns(md map[string]interface{}, key string) ([]string, error) {
+	value, ok := md[key]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a list of patterns", key)
+	}
+
+	patterns := []string{}
+
+	for _, item := range list {
+		pattern, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a list of patterns", key)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %v: %w", pattern, key, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// Affected returns true if any of the files is selected by the filter. A nil
+// filter selects everything.
+func (f *PathFilter) Affected(files []string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, file := range files {
+		if len(f.Paths) != 0 && !matchAny(f.Paths, file) {
+			continue
+		}
+
+		if !matchAny(f.Ignore, file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPath(strings.Split(pattern, "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPath matches the elements of a path against those of a pattern. "**"
+// matches zero or more elements; any other element is matched by path.Match.
+func matchPath(pattern, name []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchPath(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,47 @@
+package git
+
+import "testing"
+
+func TestPathFilterAffected(t *testing.T) {
+	table := []struct {
+		name   string
+		filter *PathFilter
+		files  []string
+		result bool
+	}{
+		{name: "nil filter", filter: nil, files: []string{"README.md"}, result: true},
+		{name: "no files", filter: &PathFilter{Paths: []string{"**"}}, files: nil, result: false},
+		{name: "matching path", filter: &PathFilter{Paths: []string{"services/api/**"}}, files: []string{"services/api/main.go"}, result: true},
+		{name: "double star matches no directories", filter: &PathFilter{Paths: []string{"lib/**/*.go"}}, files: []string{"lib/util.go"}, result: true},
+		{name: "double star matches directories", filter: &PathFilter{Paths: []string{"lib/**/*.go"}}, files: []string{"lib/a/b/util.go"}, result: true},
+		{name: "leading double star", filter: &PathFilter{Paths: []string{"**/Makefile"}}, files: []string{"a/b/Makefile"}, result: true},
+		{name: "star stays within a directory", filter: &PathFilter{Paths: []string{"lib/*.go"}}, files: []string{"lib/a/util.go"}, result: false},
+		{name: "no matching path", filter: &PathFilter{Paths: []string{"services/api/**"}}, files: []string{"services/web/main.go"}, result: false},
+		{name: "ignored", filter: &PathFilter{Ignore: []string{"**/*.md"}}, files: []string{"README.md", "docs/guide.md"}, result: false},
+		{name: "not all ignored", filter: &PathFilter{Ignore: []string{"**/*.md"}}, files: []string{"README.md", "main.go"}, result: true},
+		{
+			name:   "matching path ignored",
+			filter: &PathFilter{Paths: []string{"services/**"}, Ignore: []string{"**/*.md"}},
+			files:  []string{"services/api/README.md"},
+			result: false,
+		},
+		{
+			name:   "matching path not ignored",
+			filter: &PathFilter{Paths: []string{"services/**"}, Ignore: []string{"**/*.md"}},
+			files:  []string{"services/api/README.md", "services/api/main.go"},
+			result: true,
+		},
+		{
+			name:   "unmatched path not ignored",
+			filter: &PathFilter{Paths: []string{"services/**"}, Ignore: []string{"**/*.md"}},
+			files:  []string{"main.go"},
+			result: false,
+		},
+	}
+
+	for _, test := range table {
+		if result := test.filter.Affected(test.files); result != test.result {
+			t.Fatalf("%v: got %v, want %v", test.name, result, test.result)
+		}
+	}
+}
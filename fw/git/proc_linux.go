@@ -0,0 +1,30 @@
+package git
+
+import (
+	"io"
+	"os/exec"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// hasPTY is true where commands may run on a pty.
+const hasPTY = true
+
+// startPTY starts the command on a pty, which makes it the leader of a new
+// session, and so of its own process group, returning the stream of its
+// output.
+func startPTY(cmd *exec.Cmd) (io.ReadCloser, error) {
+	return pty.Start(cmd)
+}
+
+// newProcessGroup makes the command lead its own process group once started.
+func newProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the started command along with the processes of its
+// group.
+func killProcessGroup(cmd *exec.Cmd) {
+	unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+}
@@ -0,0 +1,29 @@
+package git
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// hasPTY is true where commands may run on a pty.
+const hasPTY = false
+
+func startPTY(cmd *exec.Cmd) (io.ReadCloser, error) {
+	return nil, errors.New("windows has no pty")
+}
+
+// newProcessGroup makes the command lead its own process group once started.
+func newProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup kills the started command along with the processes it
+// started, which windows only tracks by their parent.
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil { // #nosec
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,132 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress of each phase of a git command,
+// such as "Receiving objects", is updated in the log.
+const progressInterval = time.Second
+
+// eraseLine is the escape sequence clearing the rest of the terminal line.
+const eraseLine = "\x1b[K"
+
+// progressRegexp matches the progress meter lines of git, e.g.
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 3.00 MiB/s", capturing the
+// phase.
+var progressRegexp = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+\d+%`)
+
+// progressWriter condenses the progress meter git redraws on the terminal
+// into a readable job log: each phase is redrawn in place at most once per
+// progressInterval, with the object counts and transfer rates reported by
+// git, and finishes on its own line. Other output passes through unchanged,
+// except for ANSI escape sequences if stripping them.
+type progressWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+	strip bool
+
+	line       []byte
+	pendingCR  bool
+	inProgress bool
+	lastPhase  string
+	lastUpdate time.Time
+}
+
+func newProgressWriter(w io.Writer, strip bool) *progressWriter {
+	return &progressWriter{w: w, strip: strip}
+}
+
+// Write splits the output into lines terminated by "\n", or "\r" for redrawn
+// progress lines. The pty git runs on turns "\n" into "\r\n".
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	for _, b := range p {
+		if pw.pendingCR {
+			pw.pendingCR = false
+
+			if b == '\n' {
+				pw.handle(true)
+				continue
+			}
+
+			pw.handle(false)
+		}
+
+		switch b {
+		case '\r':
+			pw.pendingCR = true
+		case '\n':
+			pw.handle(true)
+		default:
+			pw.line = append(pw.line, b)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out any partial line.
+func (pw *progressWriter) Flush() {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	pw.handle(true)
+	pw.pendingCR = false
+}
+
+func (pw *progressWriter) handle(final bool) {
+	// remote progress ends with an escape clearing the rest of the line.
+	line := string(bytes.TrimSpace(bytes.ReplaceAll(pw.line, []byte(eraseLine), nil)))
+	pw.line = pw.line[:0]
+
+	if pw.strip {
+		line = ansiRegexp.ReplaceAllString(line, "")
+	}
+
+	if line == "" {
+		return
+	}
+
+	match := progressRegexp.FindStringSubmatch(line)
+	if match == nil {
+		if pw.inProgress {
+			fmt.Fprintln(pw.w)
+			pw.inProgress = false
+		}
+
+		fmt.Fprintln(pw.w, line)
+		return
+	}
+
+	phase := match[1]
+	done := final || strings.Contains(line, "done")
+
+	if !done && phase == pw.lastPhase && time.Since(pw.lastUpdate) < progressInterval {
+		return
+	}
+
+	if pw.inProgress && phase != pw.lastPhase {
+		fmt.Fprintln(pw.w)
+	}
+
+	fmt.Fprintf(pw.w, "\r%s", line)
+	pw.inProgress = !done
+	pw.lastPhase = phase
+	pw.lastUpdate = time.Now()
+
+	if done {
+		fmt.Fprintln(pw.w)
+		// a phase may report done more than once, e.g. with the final
+		// transfer rate.
+		pw.lastPhase = ""
+	}
+}
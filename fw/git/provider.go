@@ -0,0 +1,207 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Provider knows how to reach the repositories of a kind of git host.
+type Provider interface {
+	// DefaultBaseURL is the base URL of the public instance of the host, if
+	// there is one.
+	DefaultBaseURL() string
+	// HTTPSURL returns the url of the repository, in owner/repo format, on the
+	// host at the base URL.
+	HTTPSURL(base *url.URL, repoName string) string
+	// Username is the username presented with the access token over https.
+	Username(token string) string
+}
+
+// Providers are the kinds of git hosts that may be configured.
+var Providers = map[string]Provider{
+	"github":    githubProvider{},
+	"gitlab":    gitlabProvider{},
+	"gitea":     giteaProvider{},
+	"bitbucket": bitbucketProvider{},
+}
+
+type githubProvider struct{}
+
+func (githubProvider) DefaultBaseURL() string { return "https://github.com" }
+
+func (githubProvider) HTTPSURL(base *url.URL, repoName string) string {
+	return joinURL(base, repoName)
+}
+
+// Username is the token itself; github accepts any password alongside it.
+func (githubProvider) Username(token string) string { return token }
+
+type gitlabProvider struct{}
+
+func (gitlabProvider) DefaultBaseURL() string { return "https://gitlab.com" }
+
+func (gitlabProvider) HTTPSURL(base *url.URL, repoName string) string {
+	return joinURL(base, repoName+".git")
+}
+
+func (gitlabProvider) Username(token string) string { return "oauth2" }
+
+type giteaProvider struct{}
+
+// DefaultBaseURL is empty, as gitea is only self-hosted.
+func (giteaProvider) DefaultBaseURL() string { return "" }
+
+func (giteaProvider) HTTPSURL(base *url.URL, repoName string) string {
+	return joinURL(base, repoName+".git")
+}
+
+func (giteaProvider) Username(token string) string { return token }
+
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) DefaultBaseURL() string { return "https://bitbucket.org" }
+
+func (bitbucketProvider) HTTPSURL(base *url.URL, repoName string) string {
+	return joinURL(base, repoName+".git")
+}
+
+func (bitbucketProvider) Username(token string) string { return "x-token-auth" }
+
+func joinURL(base *url.URL, p string) string {
+	u := *base
+	u.Path = path.Join(u.Path, p)
+	return u.String()
+}
+
+// HostConfig is a git host repositories are cloned from.
+type HostConfig struct {
+	// Match is a pattern of the owner/repo names of the repositories on the
+	// host, in path.Match syntax, e.g. "myorg/*". If empty, all repositories
+	// match.
+	Match string `yaml:"match"`
+	// Provider is the kind of host: github, gitlab, gitea or bitbucket.
+	Provider string `yaml:"provider"`
+	// BaseURL is the https url of the host, e.g.
+	// "https://gitlab.example.org". Defaults to the public instance of the
+	// provider.
+	BaseURL string `yaml:"base_url"`
+	// SSHHost is the host, and optionally port, of the host for the ssh
+	// transport. Defaults to the host of the base URL.
+	SSHHost string `yaml:"ssh_host"`
+
+	provider Provider
+	baseURL  *url.URL
+}
+
+// Validate checks the host configuration and fills in defaults.
+func (hc *HostConfig) Validate() error {
+	if hc.Provider == "" {
+		hc.Provider = "github"
+	}
+
+	provider, ok := Providers[hc.Provider]
+	if !ok {
+		return fmt.Errorf("unknown git provider %q", hc.Provider)
+	}
+	hc.provider = provider
+
+	if hc.Match != "" {
+		if _, err := path.Match(hc.Match, ""); err != nil {
+			return fmt.Errorf("invalid host match %q: %w", hc.Match, err)
+		}
+	}
+
+	if hc.BaseURL == "" {
+		hc.BaseURL = provider.DefaultBaseURL()
+	}
+
+	if hc.BaseURL == "" {
+		return fmt.Errorf("a base_url is required for %v hosts", hc.Provider)
+	}
+
+	u, err := url.Parse(hc.BaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid base_url: %w", err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return errors.New("base_url must be an absolute url")
+	}
+	hc.baseURL = u
+
+	if hc.SSHHost == "" {
+		hc.SSHHost = u.Hostname()
+	}
+
+	return nil
+}
+
+// matches returns true if the repository is on the host.
+func (hc *HostConfig) matches(repoName string) bool {
+	if hc.Match == "" {
+		return true
+	}
+
+	ok, _ := path.Match(hc.Match, repoName)
+	return ok
+}
+
+// repoURL returns the url of the repository on the host for the transport.
+func (hc *HostConfig) repoURL(repoName string, ssh bool) string {
+	if ssh {
+		return fmt.Sprintf("ssh://git@%s/%s.git", hc.SSHHost, strings.TrimSuffix(repoName, ".git"))
+	}
+
+	return hc.provider.HTTPSURL(hc.baseURL, repoName)
+}
+
+// insteadOf returns the git configuration rewriting the ssh urls of
+// repositories on the host to their https urls, as "-c" arguments of git.
+func (hc *HostConfig) insteadOf() []string {
+	base := strings.TrimSuffix(hc.BaseURL, "/") + "/"
+
+	return []string{
+		"-c", fmt.Sprintf("url.%s.insteadOf=git@%s:", base, hc.SSHHost),
+		"-c", fmt.Sprintf("url.%s.insteadOf=ssh://git@%s/", base, hc.SSHHost),
+	}
+}
+
+var defaultHost = func() *HostConfig {
+	hc := &HostConfig{}
+	if err := hc.Validate(); err != nil {
+		panic(err)
+	}
+
+	return hc
+}()
+
+// host returns the host of the repository: the first configured one which
+// matches, or github.
+func (rm *RepoManager) host(repoName string) *HostConfig {
+	for i := range rm.Config.Hosts {
+		if rm.Config.Hosts[i].matches(repoName) {
+			return &rm.Config.Hosts[i]
+		}
+	}
+
+	return defaultHost
+}
+
+// submoduleConfig returns the git configuration for updating submodules, as
+// "-c" arguments of git: if configured, ssh submodule urls on known hosts are
+// rewritten to https, so they can be cloned with the token.
+func (rm *RepoManager) submoduleConfig() []string {
+	if !rm.Config.SubmoduleHTTPS {
+		return nil
+	}
+
+	args := []string{}
+	for i := range rm.Config.Hosts {
+		args = append(args, rm.Config.Hosts[i].insteadOf()...)
+	}
+
+	return append(args, defaultHost.insteadOf()...)
+}
@@ -0,0 +1,134 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw/disk"
+)
+
+// ErrCacheFull is returned when the limits of the repository cache cannot be
+// met by evicting repositories.
+var ErrCacheFull = errors.New("not enough space for the repository cache")
+
+// ensureSpace evicts the least recently used repositories other than that of
+// the RepoManager, if needed for the cache to fit its limits before the
+// repository is cloned or fetched. It returns ErrCacheFull if they cannot be
+// met. Repositories in use by concurrent runs without a worktree may be
+// evicted from under them; configure worktrees for concurrent runs.
+func (rm *RepoManager) ensureSpace(ctx context.Context) error {
+	if rm.Config.MaxCacheSize == 0 && rm.Config.MinFree == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(rm.Config.BaseRepoPath, 0700); err != nil {
+		return err
+	}
+
+	repos, err := cachedRepos(rm.Config)
+	if err != nil {
+		return err
+	}
+
+	sizeRepos(rm.Config, repos)
+
+	return enforceLimits(ctx, rm.Config, rm.Logger, repos, rm.RepoName)
+}
+
+// Reclaim evicts the least recently used repositories from the cache until
+// the filesystem of the base repo path has minFree bytes free, and the cache
+// fits its own limits. As with Maintain, the caller must ensure no runs are
+// in progress. It returns ErrCacheFull if evicting every repository without
+// worktrees is not enough.
+func Reclaim(ctx context.Context, config Config, logger *log.SubLogger, minFree uint64) error {
+	if minFree > config.MinFree {
+		config.MinFree = minFree
+	}
+
+	repos, err := cachedRepos(config)
+	if err != nil {
+		return err
+	}
+
+	sizeRepos(config, repos)
+
+	return enforceLimits(ctx, config, logger, repos, "")
+}
+
+// sizeRepos measures the repositories, if the cache size is limited.
+func sizeRepos(config Config, repos []cachedRepo) {
+	if config.MaxCacheSize == 0 {
+		return
+	}
+
+	for i, repo := range repos {
+		if size, err := disk.Size(maintenanceRepoManager(config, nil, repo.name).RepoPath); err == nil {
+			repos[i].size = size
+		}
+	}
+}
+
+// enforceLimits evicts the least recently used of the repositories, whose
+// sizes must be known if the cache size is limited, until the cache fits its
+// limits. The repository named keep is never evicted.
+func enforceLimits(ctx context.Context, config Config, logger *log.SubLogger, repos []cachedRepo, keep string) error {
+	var total uint64
+	for _, repo := range repos {
+		total += repo.size
+	}
+
+	sort.Slice(repos, func(i, j int) bool { return repos[i].lastUsed.Before(repos[j].lastUsed) })
+
+	for _, repo := range repos {
+		reason, err := overLimits(config, total)
+		if err != nil {
+			return err
+		}
+
+		if reason == "" {
+			return nil
+		}
+
+		if repo.name != keep && evict(ctx, config, logger, repo, reason) {
+			total -= repo.size
+		}
+	}
+
+	reason, err := overLimits(config, total)
+	if err != nil {
+		return err
+	}
+
+	if reason != "" {
+		return fmt.Errorf("%w: %v", ErrCacheFull, reason)
+	}
+
+	return nil
+}
+
+// overLimits returns why the cache, of the total size, exceeds its limits, or
+// an empty string if it does not.
+func overLimits(config Config, total uint64) (string, error) {
+	if config.MaxCacheSize != 0 && total > config.MaxCacheSize {
+		return fmt.Sprintf("the repository cache is over its size limit (%d > %d bytes)", total, config.MaxCacheSize), nil
+	}
+
+	if config.MinFree == 0 {
+		return "", nil
+	}
+
+	free, _, err := disk.Free(config.BaseRepoPath)
+	if err != nil {
+		return "", err
+	}
+
+	if free < config.MinFree {
+		return fmt.Sprintf("the filesystem of the repository cache is low on space (%d < %d bytes free)", free, config.MinFree), nil
+	}
+
+	return "", nil
+}
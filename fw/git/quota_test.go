@@ -0,0 +1,81 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tinyci/ci-agents/clients/log"
+)
+
+func TestEnforceLimits(t *testing.T) {
+	names := []string{"owner/a", "owner/b", "owner/c", "owner/d"}
+
+	table := []struct {
+		name      string
+		maxSize   uint64
+		keep      string
+		worktrees []string
+		evicted   []string
+		full      bool
+	}{
+		{name: "within limits", maxSize: 400},
+		{name: "unlimited", maxSize: 0},
+		{name: "least recently used first", maxSize: 250, evicted: []string{"owner/a", "owner/b"}},
+		{name: "kept repository", maxSize: 250, keep: "owner/a", evicted: []string{"owner/b", "owner/c"}},
+		{name: "repository with worktrees", maxSize: 250, worktrees: []string{"owner/b"}, evicted: []string{"owner/a", "owner/c"}},
+		{name: "cache full", maxSize: 50, keep: "owner/d", evicted: []string{"owner/a", "owner/b", "owner/c"}, full: true},
+	}
+
+	for _, test := range table {
+		dir := t.TempDir()
+		config := Config{BaseRepoPath: dir, MaxCacheSize: test.maxSize}
+		repos := []cachedRepo{}
+		start := time.Now()
+
+		// listed most recently used first, to be sorted
+		for i := len(names) - 1; i >= 0; i-- {
+			if err := os.MkdirAll(filepath.Join(dir, names[i]), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			repos = append(repos, cachedRepo{name: names[i], lastUsed: start.Add(time.Duration(i) * time.Minute), size: 100})
+		}
+
+		for _, name := range test.worktrees {
+			if err := os.MkdirAll(filepath.Join(dir, worktreeDir, name, "run"), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := enforceLimits(context.Background(), config, log.New(), repos, test.keep)
+		if test.full != errors.Is(err, ErrCacheFull) {
+			t.Fatalf("%v: unexpected error %v", test.name, err)
+		}
+
+		if !test.full && err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		evicted := []string{}
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+				evicted = append(evicted, name)
+			}
+		}
+		sort.Strings(evicted)
+
+		if len(test.evicted) == 0 {
+			test.evicted = []string{}
+		}
+
+		if !reflect.DeepEqual(evicted, test.evicted) {
+			t.Fatalf("%v: evicted %v, want %v", test.name, evicted, test.evicted)
+		}
+	}
+}
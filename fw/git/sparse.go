@@ -0,0 +1,91 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SparseCheckoutKey is the task or run metadata key holding the directories
+// of the repository a run needs, as a list. Only those, and the files at the
+// root of the repository, are checked out.
+//
+// e.g., {"sparse_checkout": ["services/api", "lib"]}
+const SparseCheckoutKey = "sparse_checkout"
+
+// SparsePaths returns the directories listed under SparseCheckoutKey in the
+// metadata, if any.
+func SparsePaths(md map[string]interface{}) ([]string, error) {
+	value, ok := md[SparseCheckoutKey]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a list of directories", SparseCheckoutKey)
+	}
+
+	paths := []string{}
+
+	for _, item := range list {
+		p, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a list of directories", SparseCheckoutKey)
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths, validateSparsePaths(paths)
+}
+
+func validateSparsePaths(paths []string) error {
+	for _, p := range paths {
+		clean := path.Clean(p)
+		if p == "" || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("invalid sparse checkout directory %q: must be relative to the root of the repository", p)
+		}
+	}
+
+	return nil
+}
+
+// SparseCheckout restricts the working copy to the directories given, in
+// cone mode, or restores a full working copy if there are none. If no
+// directories are given, those of the configuration are used. It is applied
+// by the next checkout, so call it before Checkout.
+func (rm *RepoManager) SparseCheckout(ctx context.Context, paths []string) error {
+	if len(paths) == 0 {
+		paths = rm.Config.SparsePaths
+	}
+
+	if err := validateSparsePaths(paths); err != nil {
+		return err
+	}
+
+	if _, ok := rm.backend.(execBackend); !ok {
+		if len(paths) == 0 {
+			return nil
+		}
+
+		return errors.New("sparse checkout requires the exec backend")
+	}
+
+	if len(paths) == 0 {
+		sparse, _ := rm.output(ctx, "git", "config", "--bool", "core.sparseCheckout")
+		if sparse != "true" {
+			return nil
+		}
+
+		return rm.Run(ctx, "git", "sparse-checkout", "disable")
+	}
+
+	if err := rm.Run(ctx, "git", "sparse-checkout", "init", "--cone"); err != nil {
+		return err
+	}
+
+	return rm.Run(ctx, append([]string{"git", "sparse-checkout", "set"}, paths...)...)
+}
@@ -0,0 +1,104 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	transportHTTPS = "https"
+	transportSSH   = "ssh"
+)
+
+// useSSH returns true if the repositories are cloned over SSH.
+func (rm *RepoManager) useSSH() bool {
+	return rm.Config.Transport == transportSSH
+}
+
+// loadSSHKey reads the key from the configured path, unless the runner
+// provided one.
+func (rm *RepoManager) loadSSHKey() error {
+	if !rm.useSSH() || len(rm.SSHKey) != 0 {
+		return nil
+	}
+
+	if rm.Config.SSHKeyPath == "" {
+		return fmt.Errorf("ssh transport requires ssh_key_path, or a key from the runner")
+	}
+
+	key, err := ioutil.ReadFile(rm.Config.SSHKeyPath)
+	if err != nil {
+		return fmt.Errorf("reading ssh key: %w", err)
+	}
+
+	rm.SSHKey = key
+	return nil
+}
+
+// startAgent serves the SSH key from an in-process agent on a socket private
+// to a single git call, so the key is never handed to git on disk. It returns
+// the environment pointing ssh at the agent, with strict host key checking
+// against the configured known_hosts file, and a func stopping the agent.
+func (rm *RepoManager) startAgent() ([]string, func(), error) {
+	key, err := ssh.ParseRawPrivateKey(rm.SSHKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing ssh key: %w", err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "tinyci-ssh-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	sshCommand := strings.Join([]string{
+		"ssh", "-F", "/dev/null",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", fmt.Sprintf("UserKnownHostsFile=%s", rm.Config.KnownHostsPath),
+	}, " ")
+
+	env := []string{
+		fmt.Sprintf("SSH_AUTH_SOCK=%s", sock),
+		fmt.Sprintf("GIT_SSH_COMMAND=%s", sshCommand),
+	}
+
+	return env, func() {
+		l.Close()
+		keyring.RemoveAll()
+		os.RemoveAll(dir)
+	}, nil
+}
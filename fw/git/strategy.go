@@ -0,0 +1,111 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Merge strategies, selecting how the commit under test is combined with the
+// default branch.
+const (
+	// MergeStrategyMerge merges the default branch into the commit with a
+	// merge commit. It is the default.
+	MergeStrategyMerge = "merge"
+	// MergeStrategyRebase rebases the commit onto the default branch, for
+	// projects requiring linear history.
+	MergeStrategyRebase = "rebase"
+	// MergeStrategySquash tests the commit squashed onto the default branch.
+	MergeStrategySquash = "squash"
+	// MergeStrategyNone tests exactly the commit.
+	MergeStrategyNone = "none"
+	// MergeStrategyMergeBase tests the common ancestor of the commit and the
+	// default branch, i.e. the base the commit was made against.
+	MergeStrategyMergeBase = "merge-base"
+)
+
+// MergeStrategyKey is the task or run metadata key holding the merge strategy
+// of a run, overriding that of the configuration.
+//
+// e.g., {"merge_strategy": "rebase"}
+const MergeStrategyKey = "merge_strategy"
+
+// ErrMergeConflict is returned when the commit under test conflicts with the
+// default branch. The author must resolve the conflict; retrying will not.
+var ErrMergeConflict = errors.New("merge conflict")
+
+func validateMergeStrategy(strategy string) error {
+	switch strategy {
+	case MergeStrategyMerge, MergeStrategyRebase, MergeStrategySquash, MergeStrategyNone, MergeStrategyMergeBase:
+		return nil
+	default:
+		return fmt.Errorf("unknown merge strategy %q", strategy)
+	}
+}
+
+// checkBackendStrategy returns an error if the backend cannot integrate
+// commits with the strategy. Merging, rebasing and squashing require the exec
+// backend, as the go-git backend can only fast-forward, which would fail for
+// every commit whose default branch has moved on since it was made.
+func checkBackendStrategy(backend, strategy string) error {
+	if backend == "" || backend == defaultBackend {
+		return nil
+	}
+
+	switch strategy {
+	case "", MergeStrategyMerge, MergeStrategyRebase, MergeStrategySquash:
+		return fmt.Errorf("the %v backend cannot integrate commits with the %q merge strategy; use %q or %q, or the exec backend", backend, strategy, MergeStrategyNone, MergeStrategyMergeBase)
+	default:
+		return nil
+	}
+}
+
+// MergeStrategy returns the merge strategy under MergeStrategyKey in the
+// metadata, or an empty string if there is none.
+func MergeStrategy(md map[string]interface{}) (string, error) {
+	value, ok := md[MergeStrategyKey]
+	if !ok {
+		return "", nil
+	}
+
+	strategy, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%v must be a string", MergeStrategyKey)
+	}
+
+	return strategy, validateMergeStrategy(strategy)
+}
+
+// Integrate combines the checked out commit with ref, typically the default
+// branch, according to the strategy, or that of the configuration if empty.
+// Conflicts are reported as ErrMergeConflict.
+func (rm *RepoManager) Integrate(ctx context.Context, strategy, ref string) error {
+	if strategy == "" {
+		strategy = rm.Config.MergeStrategy
+	}
+
+	// the configuration was checked, but the metadata may ask for another
+	if err := checkBackendStrategy(rm.Config.Backend, strategy); err != nil {
+		return err
+	}
+
+	switch strategy {
+	case "", MergeStrategyMerge:
+		return rm.Merge(ctx, ref)
+	case MergeStrategyRebase:
+		return rm.Rebase(ctx, ref)
+	case MergeStrategySquash:
+		return rm.backend.Squash(ctx, rm, ref)
+	case MergeStrategyNone:
+		return nil
+	case MergeStrategyMergeBase:
+		base, err := rm.backend.MergeBase(ctx, rm, ref)
+		if err != nil {
+			return err
+		}
+
+		return rm.Checkout(ctx, base)
+	default:
+		return fmt.Errorf("unknown merge strategy %q", strategy)
+	}
+}
@@ -0,0 +1,32 @@
+package git
+
+import "testing"
+
+func TestCheckBackendStrategy(t *testing.T) {
+	table := []struct {
+		backend  string
+		strategy string
+		invalid  bool
+	}{
+		{backend: "", strategy: MergeStrategyMerge},
+		{backend: "exec", strategy: MergeStrategySquash},
+		{backend: "exec", strategy: MergeStrategyRebase},
+		{backend: "go-git", strategy: "", invalid: true},
+		{backend: "go-git", strategy: MergeStrategyMerge, invalid: true},
+		{backend: "go-git", strategy: MergeStrategyRebase, invalid: true},
+		{backend: "go-git", strategy: MergeStrategySquash, invalid: true},
+		{backend: "go-git", strategy: MergeStrategyNone},
+		{backend: "go-git", strategy: MergeStrategyMergeBase},
+	}
+
+	for _, test := range table {
+		err := checkBackendStrategy(test.backend, test.strategy)
+		if test.invalid && err == nil {
+			t.Fatalf("%q with %q: strategy was not rejected", test.backend, test.strategy)
+		}
+
+		if !test.invalid && err != nil {
+			t.Fatalf("%q with %q: %v", test.backend, test.strategy, err)
+		}
+	}
+}
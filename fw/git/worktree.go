@@ -0,0 +1,87 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// worktreeDir is the directory under the base repo path holding worktrees.
+// Repository owners cannot start with a dot, so it cannot clash with a clone.
+const worktreeDir = ".worktrees"
+
+// AddWorktree creates a worktree of the repository for the run, and makes it
+// the working copy of the RepoManager: checkouts and merges happen in it,
+// leaving the clone untouched for other runs. The worktree is detached at the
+// current HEAD of the clone, or at the default branch for mirrors. Call RemoveWorktree once the run is done with it.
+func (rm *RepoManager) AddWorktree(ctx context.Context, name string) error {
+	if rm.WorkPath != "" {
+		return errors.New("a worktree was already added")
+	}
+
+	unlock, err := rm.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir := filepath.Join(rm.Config.BaseRepoPath, worktreeDir, rm.RepoName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// drop the metadata of worktrees whose directory is gone, e.g. after a
+	// crash.
+	if err := rm.Run(ctx, "git", "worktree", "prune"); err != nil {
+		return err
+	}
+
+	path, err := ioutil.TempDir(dir, name+"-")
+	if err != nil {
+		return err
+	}
+
+	if err := rm.Run(ctx, "git", "worktree", "add", "--force", "--detach", path, rm.worktreeBase()); err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+
+	rm.WorkPath = path
+	return nil
+}
+
+// RemoveWorktree removes the worktree added by AddWorktree, if any, and makes
+// the clone the working copy again.
+func (rm *RepoManager) RemoveWorktree(ctx context.Context) error {
+	if rm.WorkPath == "" {
+		return nil
+	}
+
+	path := rm.WorkPath
+	rm.WorkPath = ""
+
+	unlock, err := rm.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := rm.Run(ctx, "git", "worktree", "remove", "--force", path); err != nil {
+		os.RemoveAll(path)
+		return rm.Run(ctx, "git", "worktree", "prune")
+	}
+
+	return nil
+}
+
+// WorkDir is the directory of the working copy: the worktree, if one was
+// added, or the clone.
+func (rm *RepoManager) WorkDir() string {
+	if rm.WorkPath != "" {
+		return rm.WorkPath
+	}
+
+	return rm.RepoPath
+}
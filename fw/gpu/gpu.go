@@ -0,0 +1,110 @@
+// Package gpu hands GPUs of the host to the containers of runs which request
+// them, such as the test jobs of machine learning projects.
+package gpu
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	defaultDriver = "nvidia"
+
+	// All requests every GPU of the runner.
+	All = -1
+)
+
+// GPUsKey is the task or run metadata key holding the amount of GPUs the run
+// needs, or "all". Runs requesting GPUs should also require the gpu label so
+// they land on runners which have them.
+//
+// e.g., {"gpus": 2, "labels": {"gpu": "nvidia"}}
+const GPUsKey = "gpus"
+
+// Config is the GPUs a runner hands to runs.
+type Config struct {
+	// Driver is the device driver of the GPUs, which docker must be set up
+	// for, e.g. with the NVIDIA container toolkit. Defaults to "nvidia". It is
+	// advertised as the gpu label.
+	Driver string `yaml:"driver"`
+	// Devices are the ids, or UUIDs, of the GPUs runs may use, handed out in
+	// order. Defaults to all the GPUs of the host; their count is then
+	// unknown, so runs requesting a count get them all.
+	Devices []string `yaml:"devices"`
+	// Capabilities are those of the driver runs are given. Defaults to
+	// "gpu", e.g. "compute" and "utility" limit NVIDIA GPUs to CUDA and
+	// nvidia-smi.
+	Capabilities []string `yaml:"capabilities"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	if c.Driver == "" {
+		c.Driver = defaultDriver
+	}
+
+	if len(c.Capabilities) == 0 {
+		c.Capabilities = []string{"gpu"}
+	}
+
+	for _, device := range c.Devices {
+		if device == "" {
+			return errors.New("gpu devices must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// Labels returns the labels advertising the GPUs: the driver, and their
+// count if known.
+func (c *Config) Labels() map[string]string {
+	labels := map[string]string{"gpu": c.Driver}
+	if len(c.Devices) != 0 {
+		labels["gpus"] = strconv.Itoa(len(c.Devices))
+	}
+
+	return labels
+}
+
+// Select returns the ids of the GPUs to hand to a run requesting count, or
+// nil for all those of the host.
+func (c *Config) Select(count int) ([]string, error) {
+	if len(c.Devices) == 0 {
+		return nil, nil
+	}
+
+	if count == All {
+		return c.Devices, nil
+	}
+
+	if count > len(c.Devices) {
+		return nil, fmt.Errorf("%d gpus requested, but the runner has %d", count, len(c.Devices))
+	}
+
+	return c.Devices[:count], nil
+}
+
+// FromMetadata returns the amount of GPUs under GPUsKey in the metadata, All,
+// or 0 if none are requested.
+func FromMetadata(md map[string]interface{}) (int, error) {
+	value, ok := md[GPUsKey]
+	if !ok {
+		return 0, nil
+	}
+
+	switch value := value.(type) {
+	case string:
+		if value == "all" {
+			return All, nil
+		}
+	case float64:
+		if value >= 0 && value == float64(int(value)) {
+			return int(value), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%v must be a count of gpus or \"all\"", GPUsKey)
+}
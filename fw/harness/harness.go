@@ -0,0 +1,372 @@
+// Package harness provides an integration test harness for runners.
+//
+// The harness boots the tinyCI control plane (datasvc, queuesvc, assetsvc and
+// logsvc) inside a docker container, lets the test seed it with queue items,
+// and then launches a runner binary against it. This gives changes to fw, the
+// git layer and the docker path real end-to-end coverage.
+//
+// Tests using the harness should call SkipUnlessEnabled first; integration
+// tests only run when TINYCI_INTEGRATION is set in the environment, as they
+// require a working docker daemon and a control plane image.
+//
+// Example:
+//
+//		func TestOverlayRunner(t *testing.T) {
+//			harness.SkipUnlessEnabled(t)
+//
+//			cp := harness.StartControlPlane(t, harness.ControlPlane{})
+//			items := cp.Seed(t, myQueueItems)
+//
+//			cfg := cp.WriteConfig(t, "default", map[string]interface{}{
+//				"overlay_tempdir": t.TempDir(),
+//			})
+//
+//			cp.StartRunner(t, "overlay-runner", cfg)
+//
+//			if !cp.WaitForStatus(t, items[0].Run.Id, time.Minute) {
+//				t.Fatal("run failed")
+//			}
+//		}
+//
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	dtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"github.com/tinyci/ci-agents/clients/asset"
+	"github.com/tinyci/ci-agents/clients/data"
+	"github.com/tinyci/ci-agents/clients/queue"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// EnableEnv is the environment variable that must be set for integration
+	// tests to run.
+	EnableEnv = "TINYCI_INTEGRATION"
+	// ImageEnv may be set to override the default control plane image.
+	ImageEnv = "TINYCI_INTEGRATION_IMAGE"
+
+	defaultImage        = "tinyci-agents"
+	defaultStartTimeout = 2 * time.Minute
+)
+
+var (
+	defaultCmd = []string{"make", "start-services"}
+	defaultEnv = []string{"CREATE_DB=1"}
+
+	// service name -> container port
+	servicePorts = map[string]string{
+		"datasvc":  "6000/tcp",
+		"queuesvc": "6001/tcp",
+		"assetsvc": "6002/tcp",
+		"logsvc":   "6005/tcp",
+	}
+)
+
+// SkipUnlessEnabled skips the test unless integration testing has been
+// requested through the environment.
+func SkipUnlessEnabled(t testing.TB) {
+	t.Helper()
+
+	if os.Getenv(EnableEnv) == "" {
+		t.Skipf("integration tests disabled; set %s to enable them", EnableEnv)
+	}
+}
+
+// ControlPlane is a dockerized instance of the tinyCI services a runner talks
+// to. Fill in the exported settings (all optional) and pass it to
+// StartControlPlane.
+type ControlPlane struct {
+	// Image is the docker image containing the tinyCI services. Defaults to the
+	// value of TINYCI_INTEGRATION_IMAGE, or "tinyci-agents".
+	Image string
+	// Cmd is the command used to start the services inside the image.
+	Cmd []string
+	// Env is a list of environ(7)-style variables passed to the container.
+	Env []string
+	// Binds are docker-style bind mounts (host:container) for the container.
+	Binds []string
+	// StartTimeout is how long to wait for the services to accept connections.
+	StartTimeout time.Duration
+
+	// Addrs is a map of service name to host:port, populated at start time.
+	Addrs map[string]string
+	// Data is a datasvc client, used for seeding and inspecting results.
+	Data *data.Client
+	// Queue is a queuesvc client.
+	Queue *queue.Client
+	// Asset is an assetsvc client, used for reading run logs.
+	Asset *asset.Client
+
+	docker      *client.Client
+	containerID string
+}
+
+// StartControlPlane boots the control plane container and waits for all
+// services to come up. The container is torn down when the test completes.
+func StartControlPlane(t testing.TB, cp ControlPlane) *ControlPlane {
+	t.Helper()
+
+	if cp.Image == "" {
+		cp.Image = os.Getenv(ImageEnv)
+	}
+
+	if cp.Image == "" {
+		cp.Image = defaultImage
+	}
+
+	if cp.Cmd == nil {
+		cp.Cmd = defaultCmd
+	}
+
+	if cp.Env == nil {
+		cp.Env = defaultEnv
+	}
+
+	if cp.StartTimeout == 0 {
+		cp.StartTimeout = defaultStartTimeout
+	}
+
+	var err error
+	cp.docker, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Fatalf("could not connect to docker: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cp.StartTimeout)
+	defer cancel()
+
+	if err := cp.boot(ctx); err != nil {
+		cp.teardown()
+		t.Fatalf("could not boot control plane: %v", err)
+	}
+
+	t.Cleanup(cp.teardown)
+
+	if err := cp.connect(ctx); err != nil {
+		t.Fatalf("control plane did not come up: %v", err)
+	}
+
+	return &cp
+}
+
+func (cp *ControlPlane) boot(ctx context.Context) error {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+
+	for _, port := range servicePorts {
+		p := nat.Port(port)
+		exposed[p] = struct{}{}
+		bindings[p] = []nat.PortBinding{{HostIP: "127.0.0.1"}}
+	}
+
+	resp, err := cp.docker.ContainerCreate(ctx, &container.Config{
+		Image:        cp.Image,
+		Cmd:          cp.Cmd,
+		Env:          cp.Env,
+		ExposedPorts: exposed,
+	}, &container.HostConfig{
+		Binds:        cp.Binds,
+		PortBindings: bindings,
+		AutoRemove:   true,
+	}, nil, nil, "")
+	if err != nil {
+		return err
+	}
+
+	cp.containerID = resp.ID
+
+	if err := cp.docker.ContainerStart(ctx, cp.containerID, dtypes.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	inspect, err := cp.docker.ContainerInspect(ctx, cp.containerID)
+	if err != nil {
+		return err
+	}
+
+	cp.Addrs = map[string]string{}
+
+	for svc, port := range servicePorts {
+		b := inspect.NetworkSettings.Ports[nat.Port(port)]
+		if len(b) == 0 {
+			return fmt.Errorf("port for %v was not published", svc)
+		}
+
+		cp.Addrs[svc] = net.JoinHostPort(b[0].HostIP, b[0].HostPort)
+	}
+
+	return nil
+}
+
+func (cp *ControlPlane) connect(ctx context.Context) error {
+	for svc, addr := range cp.Addrs {
+		if err := waitForPort(ctx, addr); err != nil {
+			return fmt.Errorf("%v: %w", svc, err)
+		}
+	}
+
+	var err error
+
+	cp.Data, err = data.New(cp.Addrs["datasvc"], nil, false)
+	if err != nil {
+		return err
+	}
+
+	cp.Queue, err = queue.New(cp.Addrs["queuesvc"], nil, false)
+	if err != nil {
+		return err
+	}
+
+	cp.Asset, err = asset.NewClient(cp.Addrs["assetsvc"], nil, false)
+	return err
+}
+
+func waitForPort(ctx context.Context, addr string) error {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (cp *ControlPlane) teardown() {
+	if cp.containerID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cp.docker.ContainerRemove(ctx, cp.containerID, dtypes.ContainerRemoveOptions{Force: true})
+	cp.containerID = ""
+}
+
+// Seed adds the queue items to the queue and returns them as stored by the
+// datasvc, with their ids populated.
+func (cp *ControlPlane) Seed(t testing.TB, items []*types.QueueItem) []*types.QueueItem {
+	t.Helper()
+
+	ret, err := cp.Data.PutQueue(context.Background(), items)
+	if err != nil {
+		t.Fatalf("could not seed queue: %v", err)
+	}
+
+	return ret
+}
+
+// WriteConfig writes a runner configuration pointing at the control plane
+// for the given queue and returns its path. Extra top-level keys, such as
+// runner-specific settings, may be passed in extra.
+func (cp *ControlPlane) WriteConfig(t testing.TB, queueName string, extra map[string]interface{}) string {
+	t.Helper()
+
+	cfg := map[string]interface{}{
+		"hostname": "tinyci-harness",
+		"queue":    queueName,
+		"clients": map[string]string{
+			"assetsvc": cp.Addrs["assetsvc"],
+			"logsvc":   cp.Addrs["logsvc"],
+			"queuesvc": cp.Addrs["queuesvc"],
+		},
+	}
+
+	for key, value := range extra {
+		cfg[key] = value
+	}
+
+	content, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("could not marshal runner config: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "tinyci-harness")
+	if err != nil {
+		t.Fatalf("could not create config dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	filename := filepath.Join(dir, "runner.yml")
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		t.Fatalf("could not write runner config: %v", err)
+	}
+
+	return filename
+}
+
+// StartRunner launches the runner binary with the configuration file. Output
+// from the runner is sent to the test log. The runner is sent SIGTERM when
+// the test completes, or killed where there are no signals.
+func (cp *ControlPlane) StartRunner(t testing.TB, binary, configFile string, args ...string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command(binary, append([]string{"-c", configFile}, args...)...) // #nosec
+	cmd.Stdout = testWriter{t}
+	cmd.Stderr = testWriter{t}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("could not start runner %v: %v", binary, err)
+	}
+
+	t.Cleanup(func() {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+	})
+
+	return cmd
+}
+
+// WaitForStatus waits for the run to have its status reported and returns
+// it. The test fails if the status is not set within the timeout.
+func (cp *ControlPlane) WaitForStatus(t testing.TB, runID int64, timeout time.Duration) bool {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		run, err := cp.Data.GetRun(ctx, runID)
+		if err == nil && run.StatusSet {
+			return run.Status
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("run %d did not complete in %v (last error: %v)", runID, timeout, err)
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+type testWriter struct {
+	t testing.TB
+}
+
+func (tw testWriter) Write(p []byte) (int, error) {
+	tw.t.Log(string(p))
+	return len(p), nil
+}
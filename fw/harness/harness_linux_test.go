@@ -0,0 +1,59 @@
+package harness
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runnerScript stands in for a runner binary, recording the arguments it was
+// started with and the SIGTERM it is sent.
+const runnerScript = `#!/bin/sh
+trap 'touch "$0.terminated"; exit 0' TERM
+echo "$@" > "$0.args"
+while :; do sleep 0.1; done
+`
+
+func TestStartRunner(t *testing.T) {
+	dir := t.TempDir()
+
+	binary := filepath.Join(dir, "runner")
+	if err := ioutil.WriteFile(binary, []byte(runnerScript), 0700); err != nil { // #nosec
+		t.Fatal(err)
+	}
+
+	cp := &ControlPlane{}
+
+	t.Run("runner", func(t *testing.T) {
+		cp.StartRunner(t, binary, "runner.yml", "--debug")
+
+		// wait for the trap to be in place
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(binary + ".args"); err == nil {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("runner did not start")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	args, err := ioutil.ReadFile(binary + ".args")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(args) != "-c runner.yml --debug\n" {
+		t.Fatalf("runner was started with arguments %q", args)
+	}
+
+	if _, err := os.Stat(binary + ".terminated"); err != nil {
+		t.Fatalf("runner was not sent SIGTERM: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package harness
+
+import (
+	"io/ioutil"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestWriteConfig(t *testing.T) {
+	cp := &ControlPlane{Addrs: map[string]string{
+		"assetsvc": "127.0.0.1:6002",
+		"logsvc":   "127.0.0.1:6005",
+		"queuesvc": "127.0.0.1:6001",
+	}}
+
+	filename := cp.WriteConfig(t, "default", map[string]interface{}{"overlay_tempdir": "/tmp/overlay"})
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg struct {
+		Queue          string            `yaml:"queue"`
+		Clients        map[string]string `yaml:"clients"`
+		OverlayTempdir string            `yaml:"overlay_tempdir"`
+	}
+
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Queue != "default" {
+		t.Fatalf("unexpected queue %q", cfg.Queue)
+	}
+
+	for svc, addr := range cp.Addrs {
+		if cfg.Clients[svc] != addr {
+			t.Fatalf("client %v is %q, expected %q", svc, cfg.Clients[svc], addr)
+		}
+	}
+
+	if cfg.OverlayTempdir != "/tmp/overlay" {
+		t.Fatalf("extra settings were not written: %q", content)
+	}
+}
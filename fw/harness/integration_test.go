@@ -0,0 +1,73 @@
+package harness
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	runner "github.com/tinyci/ci-runners/runners/null-runner"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// buildRunner builds the runner command, e.g. "null-runner", into a temporary
+// directory and returns the path to the binary.
+func buildRunner(t *testing.T, name string) string {
+	t.Helper()
+
+	binary := filepath.Join(t.TempDir(), name)
+
+	out, err := exec.Command("go", "build", "-o", binary, "github.com/tinyci/ci-runners/cmd/"+name).CombinedOutput() // #nosec
+	if err != nil {
+		t.Fatalf("could not build %v: %v\n%s", name, err, out)
+	}
+
+	return binary
+}
+
+// nullItem returns a queue item for the null-runner which reports the status.
+func nullItem(t *testing.T, name string, status bool) *types.QueueItem {
+	t.Helper()
+
+	md, err := structpb.NewStruct(map[string]interface{}{runner.StatusKey: status})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := &types.Ref{Repository: &types.Repository{Name: "tinyci/harness"}, RefName: "heads/master", Sha: "be3d26c478991039e951097f2c99f56b55396940"}
+
+	return &types.QueueItem{
+		QueueName: "default",
+		Run: &types.Run{
+			Name:     name,
+			Settings: &types.RunSettings{Image: "busybox", Command: []string{"true"}, Metadata: md},
+			Task: &types.Task{
+				Settings:   &types.TaskSettings{},
+				Submission: &types.Submission{BaseRef: ref, HeadRef: ref},
+			},
+		},
+	}
+}
+
+func TestNullRunner(t *testing.T) {
+	SkipUnlessEnabled(t)
+
+	binary := buildRunner(t, "null-runner")
+
+	cp := StartControlPlane(t, ControlPlane{})
+	items := cp.Seed(t, []*types.QueueItem{
+		nullItem(t, "pass", true),
+		nullItem(t, "fail", false),
+	})
+
+	cp.StartRunner(t, binary, cp.WriteConfig(t, "default", nil))
+
+	for _, item := range items {
+		want := item.Run.Name == "pass"
+
+		if status := cp.WaitForStatus(t, item.Run.Id, time.Minute); status != want {
+			t.Fatalf("run %v (%d) reported status %v, expected %v", item.Run.Name, item.Run.Id, status, want)
+		}
+	}
+}
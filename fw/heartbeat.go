@@ -0,0 +1,159 @@
+package fw
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultHeartbeatInterval = 30 * time.Second
+
+// ErrLeaseLost is returned by a Heartbeater when the run is no longer held by
+// this runner.
+var ErrLeaseLost = errors.New("lease on run was lost")
+
+// Heartbeater renews the lease of the runner on an in-flight run. It should
+// return ErrLeaseLost if the run is no longer held by the runner; any other
+// error is considered transient.
+type Heartbeater interface {
+	Heartbeat(ctx context.Context, runner Runner, runID int64) error
+}
+
+// LeasedRun is implemented by runs which handle the loss of their lease
+// themselves. Runs which do not implement it are canceled when their lease is
+// lost.
+type LeasedRun interface {
+	Run
+
+	// LeaseLost is called when the lease on the run is lost; the run should
+	// stop as soon as possible. Its status will not be reported.
+	LeaseLost()
+}
+
+// QueueHeartbeater is a liveness probe rather than a lease: the queuesvc has
+// no lease API yet, so it queries the run through GetCancel, and considers the
+// lease lost only if the run no longer exists. Nothing stops the queuesvc from
+// handing the run to another runner while this one holds it, and a runner
+// unable to reach the queuesvc for LeaseTimeout stops its runs. Set it as the
+// Heartbeater of the Entrypoint to opt in.
+type QueueHeartbeater struct{}
+
+// Heartbeat satisfies the Heartbeater interface.
+func (QueueHeartbeater) Heartbeat(ctx context.Context, runner Runner, runID int64) error {
+	_, err := runner.QueueClient().GetCancel(ctx, runID)
+	if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+		return ErrLeaseLost
+	}
+
+	return err
+}
+
+func (e *Entrypoint) heartbeatInterval() time.Duration {
+	if e.HeartbeatInterval == 0 {
+		return defaultHeartbeatInterval
+	}
+
+	return e.HeartbeatInterval
+}
+
+func (e *Entrypoint) leaseTimeout() time.Duration {
+	if e.LeaseTimeout == 0 {
+		return 3 * e.heartbeatInterval()
+	}
+
+	return e.LeaseTimeout
+}
+
+// startHeartbeat heartbeats the run until the returned func is called, which
+// should happen after its status has been reported.
+func (e *Entrypoint) startHeartbeat(runner Runner, runnerCtx *fwcontext.RunContext) func() {
+	runID := runnerCtx.QueueItem.Run.Id
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		e.heartbeat(ctx, runner, runnerCtx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+
+		e.runMapMutex.Lock()
+		delete(e.leaseLost, runID)
+		e.runMapMutex.Unlock()
+	}
+}
+
+func (e *Entrypoint) heartbeat(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext) {
+	interval := e.heartbeatInterval()
+	hb := e.Heartbeater
+	if interval < 0 || hb == nil {
+		return
+	}
+
+	runLogger := runner.LogsvcClient(runnerCtx)
+	lastOK := time.Now()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := hb.Heartbeat(ctx, runner, runnerCtx.QueueItem.Run.Id)
+		switch {
+		case err == nil:
+			lastOK = time.Now()
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, ErrLeaseLost):
+			runLogger.Error(ctx, "Lease on run was lost; stopping it")
+			e.loseLease(ctx, runnerCtx.QueueItem.Run.Id)
+			return
+		case time.Since(lastOK) > e.leaseTimeout():
+			runLogger.Errorf(ctx, "No successful heartbeat in %v; considering the lease lost: %v", e.leaseTimeout(), err)
+			e.loseLease(ctx, runnerCtx.QueueItem.Run.Id)
+			return
+		default:
+			runLogger.Errorf(ctx, "Heartbeat failed: %v", err)
+		}
+	}
+}
+
+// loseLease stops all runs of the queue item.
+func (e *Entrypoint) loseLease(ctx context.Context, runID int64) {
+	e.runMapMutex.Lock()
+	e.leaseLost[runID] = true
+	runs := e.runsOfID(runID)
+	e.runMapMutex.Unlock()
+
+	for run, runnerCtx := range runs {
+		lr, ok := run.(LeasedRun)
+		if !ok {
+			runnerCtx.CancelFunc()
+			continue
+		}
+
+		if err := protect(func() error { lr.LeaseLost(); return nil }); err != nil {
+			e.Launch.LogsvcClient(runnerCtx).Errorf(ctx, "LeaseLost hook %v", err)
+			runnerCtx.CancelFunc()
+		}
+	}
+}
+
+// hasLease returns false if the lease on the run was lost.
+func (e *Entrypoint) hasLease(runID int64) bool {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return !e.leaseLost[runID]
+}
@@ -0,0 +1,233 @@
+// Package host hands jobs the paths and devices of the host the runner
+// allows, such as a shared toolchain or /dev/kvm, by name, so they need not
+// run privileged to reach them.
+package host
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// HostKey is the task or run metadata key holding the names of the host
+// mounts and devices a run asks for, among those allowed by the runner.
+//
+// e.g., {"host": {"mounts": ["toolchain"], "devices": ["kvm"]}}
+const HostKey = "host"
+
+const defaultPermissions = "rwm"
+
+// Config is what the runner allows jobs to request of its host.
+type Config struct {
+	Mounts  []Mount  `yaml:"mounts"`
+	Devices []Device `yaml:"devices"`
+}
+
+// Mount is a path of the host mounted in the container.
+type Mount struct {
+	// Name is what runs request the mount by.
+	Name string `yaml:"name"`
+	// Source is the path on the host.
+	Source string `yaml:"source"`
+	// Target is the path in the container. Defaults to Source.
+	Target string `yaml:"target"`
+	// Writable, if set, lets jobs write to the mount, and to the host through
+	// it. Mounts are read-only otherwise.
+	Writable bool `yaml:"writable"`
+}
+
+// Device is a device of the host made available in the container.
+type Device struct {
+	// Name is what runs request the device by.
+	Name string `yaml:"name"`
+	// Path is the device on the host, e.g. /dev/kvm.
+	Path string `yaml:"path"`
+	// Target is the path of the device in the container. Defaults to Path.
+	Target string `yaml:"target"`
+	// Permissions are those of the container on the device in the cgroup,
+	// out of "rwm": read, write and mknod. Defaults to "rwm".
+	Permissions string `yaml:"permissions"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	names := map[string]bool{}
+
+	for i := range c.Mounts {
+		m := &c.Mounts[i]
+
+		if err := checkName(names, "mount", m.Name); err != nil {
+			return err
+		}
+
+		if m.Target == "" {
+			m.Target = m.Source
+		}
+
+		if !filepath.IsAbs(m.Source) || !filepath.IsAbs(m.Target) {
+			return fmt.Errorf("host mount %q: source and target must be absolute", m.Name)
+		}
+	}
+
+	names = map[string]bool{}
+
+	for i := range c.Devices {
+		d := &c.Devices[i]
+
+		if err := checkName(names, "device", d.Name); err != nil {
+			return err
+		}
+
+		if d.Target == "" {
+			d.Target = d.Path
+		}
+
+		if !filepath.IsAbs(d.Path) || !filepath.IsAbs(d.Target) {
+			return fmt.Errorf("host device %q: path and target must be absolute", d.Name)
+		}
+
+		if d.Permissions == "" {
+			d.Permissions = defaultPermissions
+		}
+
+		if strings.Trim(d.Permissions, defaultPermissions) != "" {
+			return fmt.Errorf("host device %q: invalid permissions %q: must be out of %q", d.Name, d.Permissions, defaultPermissions)
+		}
+	}
+
+	return nil
+}
+
+func checkName(names map[string]bool, kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("host %vs must have a name", kind)
+	}
+
+	if names[name] {
+		return fmt.Errorf("host %v %q is defined more than once", kind, name)
+	}
+	names[name] = true
+
+	return nil
+}
+
+// Request is the names of the host mounts and devices requested by a run.
+type Request struct {
+	Mounts  []string
+	Devices []string
+}
+
+// Empty returns true if nothing is requested.
+func (r Request) Empty() bool {
+	return len(r.Mounts) == 0 && len(r.Devices) == 0
+}
+
+// Resolve returns the mounts and devices of the request, erroring out on
+// those the configuration does not allow. A nil configuration allows none.
+func (c *Config) Resolve(req Request) ([]Mount, []Device, error) {
+	var (
+		mounts  []Mount
+		devices []Device
+	)
+
+	for _, name := range req.Mounts {
+		m, ok := c.mount(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("host mount %q is not allowed by the runner", name)
+		}
+		mounts = append(mounts, m)
+	}
+
+	for _, name := range req.Devices {
+		d, ok := c.device(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("host device %q is not allowed by the runner", name)
+		}
+		devices = append(devices, d)
+	}
+
+	return mounts, devices, nil
+}
+
+func (c *Config) mount(name string) (Mount, bool) {
+	if c != nil {
+		for _, m := range c.Mounts {
+			if m.Name == name {
+				return m, true
+			}
+		}
+	}
+
+	return Mount{}, false
+}
+
+func (c *Config) device(name string) (Device, bool) {
+	if c != nil {
+		for _, d := range c.Devices {
+			if d.Name == name {
+				return d, true
+			}
+		}
+	}
+
+	return Device{}, false
+}
+
+// FromMetadata returns the request under HostKey in the metadata, if any.
+func FromMetadata(md map[string]interface{}) (Request, error) {
+	var req Request
+
+	value, ok := md[HostKey]
+	if !ok {
+		return req, nil
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return req, fmt.Errorf("%v must be a map of mounts and devices", HostKey)
+	}
+
+	for key := range m {
+		if key != "mounts" && key != "devices" {
+			return req, fmt.Errorf("%v: unknown key %q: must be mounts or devices", HostKey, key)
+		}
+	}
+
+	var err error
+
+	if req.Mounts, err = stringList(m, "mounts"); err != nil {
+		return req, err
+	}
+
+	if req.Devices, err = stringList(m, "devices"); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+func stringList(m map[string]interface{}, key string) ([]string, error) {
+	value, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: %v must be a list of names", HostKey, key)
+	}
+
+	res := []string{}
+
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("%v: %v must be a list of names", HostKey, key)
+		}
+
+		res = append(res, s)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,78 @@
+package fw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/metrics"
+)
+
+// listenHTTP starts the HTTP server, if an address is configured. It serves:
+//
+//		/healthz: 200 as long as the runner is up.
+//		/readyz: 200 if the runner would pull new work: it is ready, not
+//		         draining or in a maintenance window, and the queuesvc
+//		         answered the last poll. 503 otherwise.
+//		/runs: a JSON list of the runs in flight.
+//		/metrics: metrics in the Prometheus text format; see fw/metrics.
+//
+func (e *Entrypoint) listenHTTP(ctx context.Context, runner Runner) error {
+	addr := runner.FrameworkConfig().HTTPAddr
+	if addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case e.getDraining():
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+		case e.getPaused():
+			http.Error(w, "paused", http.StatusServiceUnavailable)
+		case e.getMaintenance():
+			http.Error(w, "in maintenance window", http.StatusServiceUnavailable)
+		case !runner.Ready():
+			http.Error(w, "runner not ready", http.StatusServiceUnavailable)
+		case e.getQueueErr() != nil:
+			http.Error(w, fmt.Sprintf("queuesvc: %v", e.getQueueErr()), http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+
+	mux.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {
+		e.runMapMutex.RLock()
+		runs := e.runStatuses()
+		e.runMapMutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runs)
+	})
+
+	mux.Handle("/metrics", metrics.Default.Handler())
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	go srv.Serve(l)
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package journal persists the state of in-flight runs to disk, so that runs
+// interrupted by a crash of the runner process can be recovered or reported
+// on the next start.
+//
+// Each run is stored as a JSON file named after its run id in the journal
+// directory. Files are written atomically, so a crash never leaves a partial
+// entry behind. All methods are safe to call on a nil *Journal, which
+// records nothing.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Journal is a directory of in-flight run entries.
+type Journal struct {
+	dir string
+}
+
+// Entry is the journaled state of a single run.
+type Entry struct {
+	// Name is the name of the run.
+	Name string `json:"name"`
+	// Start is the time the run was received.
+	Start time.Time `json:"start"`
+	// PID is the process id of the runner which was executing the run.
+	PID int `json:"pid"`
+	// ProcStart is when the process of PID started, which tells it apart
+	// from later processes reusing the pid.
+	ProcStart string `json:"proc_start,omitempty"`
+	// Deferred is set for queue items the runner set aside and never
+	// started; see fw.Prioritizer.
+	Deferred bool `json:"deferred,omitempty"`
+	// QueueItem is the queue item being run.
+	QueueItem *types.QueueItem `json:"-"`
+}
+
+type entryJSON struct {
+	Entry
+	QueueItem json.RawMessage `json:"queue_item"`
+}
+
+// Open opens the journal in the directory, creating it if necessary.
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Journal{dir: dir}, nil
+}
+
+func (j *Journal) filename(runID int64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%d.json", runID))
+}
+
+// Add records the run as in flight.
+func (j *Journal) Add(e *Entry) error {
+	if j == nil {
+		return nil
+	}
+
+	qi, err := protojson.Marshal(e.QueueItem)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(entryJSON{Entry: *e, QueueItem: qi})
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(j.dir, ".entry")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), j.filename(e.QueueItem.Run.Id))
+}
+
+// Remove removes the run from the journal once it has completed.
+func (j *Journal) Remove(runID int64) error {
+	if j == nil {
+		return nil
+	}
+
+	if err := os.Remove(j.filename(runID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// List returns all runs recorded as in flight.
+func (j *Journal) List() ([]*Entry, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	fis, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*Entry{}
+
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(j.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var ej entryJSON
+		if err := json.Unmarshal(content, &ej); err != nil {
+			return nil, fmt.Errorf("journal entry %v: %w", fi.Name(), err)
+		}
+
+		e := ej.Entry
+		e.QueueItem = &types.QueueItem{}
+
+		if err := protojson.Unmarshal(ej.QueueItem, e.QueueItem); err != nil {
+			return nil, fmt.Errorf("journal entry %v: %w", fi.Name(), err)
+		}
+
+		entries = append(entries, &e)
+	}
+
+	return entries, nil
+}
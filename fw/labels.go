@@ -0,0 +1,110 @@
+package fw
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+)
+
+// LabelsKey is the run metadata key holding the labels the run requires of
+// its runner: a map of label names to a value, or a list of acceptable values.
+// The value "*" only requires the label to be set.
+//
+// e.g., {"os": "linux", "arch": ["amd64", "arm64"], "gpu": "*"}
+const LabelsKey = "labels"
+
+// Labeler is implemented by runners which advertise labels they detect, such
+// as the version of docker they run against. These are merged over the "os"
+// and "arch" labels of the host, and under the labels in the framework
+// configuration.
+type Labeler interface {
+	Labels() map[string]string
+}
+
+// Labels returns the labels advertised by the runner.
+func (e *Entrypoint) Labels() map[string]string {
+	labels := map[string]string{
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	}
+
+	if l, ok := e.Launch.(Labeler); ok {
+		for key, value := range l.Labels() {
+			labels[key] = value
+		}
+	}
+
+	for key, value := range e.Launch.FrameworkConfig().Labels {
+		labels[key] = value
+	}
+
+	return labels
+}
+
+// checkLabels rejects queue items requiring labels that the runner does not
+// advertise. Runners cannot hand queue items back to the queuesvc, so such
+// items would otherwise never run; they should be routed to queues served by
+// runners that match.
+func (e *Entrypoint) checkLabels(qi *types.QueueItem) (Decision, string) {
+	required, ok := qi.GetRun().GetSettings().GetMetadata().AsMap()[LabelsKey]
+	if !ok {
+		return Accept, ""
+	}
+
+	requiredMap, ok := required.(map[string]interface{})
+	if !ok {
+		return Reject, "labels must be a map of names to values"
+	}
+
+	labels := e.Labels()
+	mismatched := []string{}
+
+	for key, want := range requiredMap {
+		value, ok := labels[key]
+		if !ok || !matchLabel(value, want) {
+			mismatched = append(mismatched, fmt.Sprintf("%s=%v", key, want))
+		}
+	}
+
+	if len(mismatched) != 0 {
+		sort.Strings(mismatched)
+		return Reject, fmt.Sprintf("runner %q does not match labels: %s", e.Launch.Hostname(), strings.Join(mismatched, ", "))
+	}
+
+	return Accept, ""
+}
+
+// checkRepositories rejects queue items for repositories, or from forks, which
+// the repository policy of the configuration does not permit.
+func (e *Entrypoint) checkRepositories(qi *types.QueueItem) (Decision, string) {
+	policy := e.Launch.FrameworkConfig().Repositories
+	sub := qi.GetRun().GetTask().GetSubmission()
+
+	for _, ref := range []*types.Ref{sub.GetBaseRef(), sub.GetHeadRef()} {
+		if err := policy.Permits(ref.GetRepository().GetName()); err != nil {
+			return Reject, err.Error()
+		}
+	}
+
+	return Accept, ""
+}
+
+func matchLabel(value string, want interface{}) bool {
+	switch want := want.(type) {
+	case []interface{}:
+		for _, w := range want {
+			if matchLabel(value, w) {
+				return true
+			}
+		}
+
+		return false
+	case string:
+		return want == "*" || want == value
+	default:
+		return fmt.Sprint(want) == value
+	}
+}
@@ -0,0 +1,267 @@
+// Package limits configures the ulimits and sysctls of the containers of
+// runs, for test suites needing more open files or processes than the
+// defaults of the docker daemon, or tuned network settings.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// LimitsKey is the task or run metadata key holding the ulimits and sysctls
+// of the container of a run. Ulimits are a number, setting both the soft and
+// hard limits, or a map of both; they may only be raised up to the maximum
+// the runner allows. Sysctls must be safe, or allowed by the runner.
+//
+// e.g., {"limits": {"ulimits": {"nofile": 65536, "core": {"soft": 0,
+// "hard": -1}}, "sysctls": {"net.ipv4.ip_local_port_range": "1024 65535"}}}
+const LimitsKey = "limits"
+
+// Unlimited is the value of ulimits without a limit.
+const Unlimited = -1
+
+// safeSysctls are the sysctls runs may always set, as they are namespaced
+// and cannot affect other containers or the host; they are those Kubernetes
+// deems safe.
+var safeSysctls = map[string]bool{
+	"kernel.shm_rmid_forced":              true,
+	"net.ipv4.ip_local_port_range":        true,
+	"net.ipv4.ip_unprivileged_port_start": true,
+	"net.ipv4.tcp_syncookies":             true,
+	"net.ipv4.ping_group_range":           true,
+}
+
+// validUlimits are the ulimits docker sets.
+var validUlimits = map[string]bool{
+	"core": true, "cpu": true, "data": true, "fsize": true, "locks": true,
+	"memlock": true, "msgqueue": true, "nice": true, "nofile": true,
+	"nproc": true, "rss": true, "rtprio": true, "rttime": true,
+	"sigpending": true, "stack": true,
+}
+
+// Ulimit is a soft and hard limit; -1 is unlimited.
+type Ulimit struct {
+	Soft int64 `yaml:"soft"`
+	Hard int64 `yaml:"hard"`
+}
+
+func (u Ulimit) validate(name string) error {
+	if !validUlimits[name] {
+		return fmt.Errorf("invalid ulimit %q", name)
+	}
+
+	if u.Soft < Unlimited || u.Hard < Unlimited {
+		return fmt.Errorf("ulimit %v: limits must be positive, or -1 for unlimited", name)
+	}
+
+	if u.Hard != Unlimited && (u.Soft == Unlimited || u.Soft > u.Hard) {
+		return fmt.Errorf("ulimit %v: the soft limit exceeds the hard limit", name)
+	}
+
+	return nil
+}
+
+// exceeds returns true if the limit is higher than max.
+func exceeds(limit, max int64) bool {
+	if max == Unlimited {
+		return false
+	}
+
+	return limit == Unlimited || limit > max
+}
+
+// Config is the ulimits and sysctls of the containers of runs.
+type Config struct {
+	// Ulimits are the ulimits of containers by name, e.g. nofile, nproc or
+	// core. Others are those of the docker daemon.
+	Ulimits map[string]Ulimit `yaml:"ulimits"`
+	// MaxUlimits are the highest hard limits runs may ask for, by name. Runs
+	// may lower the ulimits set above, but only raise them, or set others,
+	// up to their maximum.
+	MaxUlimits map[string]int64 `yaml:"max_ulimits"`
+	// Sysctls are set in containers, e.g. {"net.core.somaxconn": "1024"}.
+	// docker only allows those namespaced by the container.
+	Sysctls map[string]string `yaml:"sysctls"`
+	// AllowSysctls are the sysctls runs may set besides the safe ones, such
+	// as kernel.shm_rmid_forced or net.ipv4.ip_local_port_range.
+	AllowSysctls []string `yaml:"allow_sysctls"`
+}
+
+// Validate errors out when the configuration doesn't match expectations.
+func (c *Config) Validate() error {
+	for name, u := range c.Ulimits {
+		if err := u.validate(name); err != nil {
+			return err
+		}
+	}
+
+	for name, max := range c.MaxUlimits {
+		if !validUlimits[name] {
+			return fmt.Errorf("invalid max_ulimits %q", name)
+		}
+
+		if max < Unlimited {
+			return fmt.Errorf("max_ulimits %v must be positive, or -1 for unlimited", name)
+		}
+
+		if u, ok := c.Ulimits[name]; ok && exceeds(u.Hard, max) {
+			return fmt.Errorf("ulimit %v exceeds its max_ulimits", name)
+		}
+	}
+
+	for name := range c.Sysctls {
+		if name == "" || strings.ContainsAny(name, " /") {
+			return fmt.Errorf("invalid sysctl %q", name)
+		}
+	}
+
+	for _, name := range c.AllowSysctls {
+		if name == "" {
+			return errors.New("allow_sysctls must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// Options are the ulimits and sysctls a run asks for.
+type Options struct {
+	Ulimits map[string]Ulimit
+	Sysctls map[string]string
+}
+
+// FromMetadata returns the options under LimitsKey in the metadata, if any.
+func FromMetadata(md map[string]interface{}) (*Options, error) {
+	value, ok := md[LimitsKey]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a map of ulimits and sysctls", LimitsKey)
+	}
+
+	opts := &Options{Ulimits: map[string]Ulimit{}, Sysctls: map[string]string{}}
+
+	for key, value := range m {
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v.%v must be a map", LimitsKey, key)
+		}
+
+		switch key {
+		case "ulimits":
+			for name, value := range entries {
+				u, err := parseUlimit(value)
+				if err != nil {
+					return nil, fmt.Errorf("%v.ulimits.%v: %w", LimitsKey, name, err)
+				}
+
+				if err := u.validate(name); err != nil {
+					return nil, err
+				}
+
+				opts.Ulimits[name] = u
+			}
+		case "sysctls":
+			for name, value := range entries {
+				s, ok := value.(string)
+				if !ok {
+					return nil, fmt.Errorf("%v.sysctls.%v must be a string", LimitsKey, name)
+				}
+
+				opts.Sysctls[name] = s
+			}
+		default:
+			return nil, fmt.Errorf("%v: unknown key %q: must be ulimits or sysctls", LimitsKey, key)
+		}
+	}
+
+	return opts, nil
+}
+
+func parseUlimit(value interface{}) (Ulimit, error) {
+	switch value := value.(type) {
+	case float64:
+		return Ulimit{Soft: int64(value), Hard: int64(value)}, nil
+	case map[string]interface{}:
+		var u Ulimit
+
+		for key, target := range map[string]*int64{"soft": &u.Soft, "hard": &u.Hard} {
+			n, ok := value[key].(float64)
+			if !ok {
+				return u, errors.New("must have a numeric soft and hard limit")
+			}
+			*target = int64(n)
+		}
+
+		return u, nil
+	}
+
+	return Ulimit{}, errors.New("must be a number or a map of a soft and hard limit")
+}
+
+// Apply returns the configuration with the options of a run, which may be
+// nil. Runs raising ulimits above the maximum of the runner, or setting
+// sysctls which are neither safe nor allowed, are refused.
+func (c Config) Apply(opts *Options) (Config, error) {
+	if opts == nil {
+		return c, nil
+	}
+
+	ulimits := map[string]Ulimit{}
+	for name, u := range c.Ulimits {
+		ulimits[name] = u
+	}
+
+	for name, u := range opts.Ulimits {
+		current, set := c.Ulimits[name]
+		lowered := set && !exceeds(u.Hard, current.Hard)
+
+		if max, ok := c.MaxUlimits[name]; !lowered && (!ok || exceeds(u.Hard, max)) {
+			return c, fmt.Errorf("ulimit %v may not be raised to %v: the runner does not allow it", name, u.Hard)
+		}
+
+		ulimits[name] = u
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range c.AllowSysctls {
+		allowed[name] = true
+	}
+
+	sysctls := map[string]string{}
+	for name, value := range c.Sysctls {
+		sysctls[name] = value
+	}
+
+	for name, value := range opts.Sysctls {
+		if !safeSysctls[name] && !allowed[name] {
+			return c, fmt.Errorf("sysctl %v may not be set: it is not safe and the runner does not allow it", name)
+		}
+
+		sysctls[name] = value
+	}
+
+	c.Ulimits = ulimits
+	c.Sysctls = sysctls
+
+	return c, nil
+}
+
+// DockerUlimits returns the ulimits as docker takes them, sorted by name.
+func (c Config) DockerUlimits() []*units.Ulimit {
+	list := []*units.Ulimit{}
+	for name, u := range c.Ulimits {
+		list = append(list, &units.Ulimit{Name: name, Soft: u.Soft, Hard: u.Hard})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
@@ -0,0 +1,94 @@
+package fw
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/trace"
+	"github.com/urfave/cli"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// localRun executes the queue item in the JSON file once, without the
+// queuesvc, writing the job output to stdout. The runner exits with a non-zero
+// status if the run fails. This is meant for debugging runners and job
+// definitions; cancellation, retries and status reporting are not available.
+//
+// The file holds a QueueItem in the protobuf JSON mapping, e.g.:
+//
+//		{
+//			"queueName": "default",
+//			"run": {
+//				"id": "1",
+//				"settings": {"image": "golang", "command": ["go", "test", "./..."]},
+//				"task": {...}
+//			}
+//		}
+//
+func (e *Entrypoint) localRun(ctx context.Context, baseContext *fwcontext.Context, runner Runner, filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	qi := &types.QueueItem{}
+	if err := protojson.Unmarshal(content, qi); err != nil {
+		return fmt.Errorf("parsing queue item in %v: %w", filename, err)
+	}
+
+	if qi.Run == nil || qi.Run.Settings == nil || qi.Run.Task == nil {
+		return fmt.Errorf("queue item in %v must have a run with settings and a task", filename)
+	}
+
+	if _, ok := qi.Run.Settings.Metadata.AsMap()[MatrixKey]; ok {
+		fmt.Fprintln(os.Stderr, "matrix specifications are ignored in local runs; executing as a single run")
+	}
+
+	runnerCtx := &fwcontext.RunContext{
+		Context:   baseContext,
+		QueueItem: qi,
+		Start:     time.Now(),
+		Trace:     trace.New(qi.Run.Id),
+		Output:    os.Stdout,
+	}
+
+	timeout := runner.FrameworkConfig().Timeout(time.Duration(qi.Run.Settings.Timeout))
+	if timeout == 0 {
+		runnerCtx.Ctx, runnerCtx.CancelFunc = context.WithCancel(ctx)
+	} else {
+		runnerCtx.Ctx, runnerCtx.CancelFunc = context.WithTimeout(ctx, timeout)
+	}
+	defer runnerCtx.CancelFunc()
+
+	runName := fmt.Sprintf("local.%d", qi.Run.Id)
+
+	run, err := runner.MakeRun(runName, runnerCtx)
+	if err != nil {
+		return err
+	}
+
+	status, runErr, err := e.execute(ctx, runner, run)
+	runner.AfterRun(runName, runnerCtx)
+	e.writeTrace(ctx, runner, runnerCtx)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrun finished in %v; passed: %v\n", time.Since(runnerCtx.Start), status)
+
+	if runErr != nil {
+		return cli.NewExitError(fmt.Sprintf("run errored: %v", runErr), 1)
+	}
+
+	if !status {
+		return cli.NewExitError("run failed", 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package logbuffer implements a bounded, non-blocking buffer for shipping
+// job output.
+//
+// Writes to a Buffer never block: if the reader (typically the assetsvc
+// upload) falls behind and the buffer fills, the oldest output is discarded
+// to make room. The reader is told about discarded output with a marker line
+// inserted into the stream, so job execution is never throttled by log
+// shipping.
+package logbuffer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultSize is the default capacity of a Buffer, in bytes.
+const DefaultSize = 4 * 1024 * 1024
+
+// Buffer is a ring buffer which satisfies io.ReadWriteCloser. Create one with
+// New.
+type Buffer struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	buf    []byte
+	start  int
+	length int
+	closed bool
+
+	pendingDrop uint64
+	dropped     uint64
+	marker      []byte
+}
+
+// New creates a Buffer with the capacity in bytes. If size is not positive,
+// DefaultSize is used.
+func New(size int) *Buffer {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	b := &Buffer{buf: make([]byte, size)}
+	b.cond = sync.NewCond(&b.mutex)
+
+	return b
+}
+
+// Write appends p to the buffer, discarding the oldest output if there is not
+// enough room. It never blocks and only fails if the buffer is closed.
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := len(p)
+
+	// if the write alone exceeds our capacity, only its tail will fit.
+	if len(p) > len(b.buf) {
+		b.drop(uint64(len(p) - len(b.buf)))
+		p = p[len(p)-len(b.buf):]
+	}
+
+	if overflow := b.length + len(p) - len(b.buf); overflow > 0 {
+		b.start = (b.start + overflow) % len(b.buf)
+		b.length -= overflow
+		b.drop(uint64(overflow))
+	}
+
+	end := (b.start + b.length) % len(b.buf)
+	copied := copy(b.buf[end:], p)
+	copy(b.buf, p[copied:])
+	b.length += len(p)
+
+	b.cond.Broadcast()
+
+	return n, nil
+}
+
+func (b *Buffer) drop(n uint64) {
+	b.pendingDrop += n
+	b.dropped += n
+}
+
+// Read reads buffered output, blocking until some is available. Once the
+// buffer is closed and drained, io.EOF is returned.
+func (b *Buffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for b.length == 0 && b.pendingDrop == 0 && len(b.marker) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+
+	if len(b.marker) == 0 && b.pendingDrop != 0 {
+		b.marker = []byte(fmt.Sprintf("\r\n[tinyCI: %d bytes of output were dropped; log shipping fell behind]\r\n", b.pendingDrop))
+		b.pendingDrop = 0
+	}
+
+	if len(b.marker) != 0 {
+		n := copy(p, b.marker)
+		b.marker = b.marker[n:]
+		return n, nil
+	}
+
+	if b.length == 0 {
+		return 0, io.EOF
+	}
+
+	n := len(p)
+	if n > b.length {
+		n = b.length
+	}
+
+	copied := copy(p[:n], b.buf[b.start:min(b.start+n, len(b.buf))])
+	copy(p[copied:n], b.buf)
+
+	b.start = (b.start + n) % len(b.buf)
+	b.length -= n
+
+	return n, nil
+}
+
+// Close closes the buffer for writing. Readers may drain any remaining output
+// before receiving io.EOF.
+func (b *Buffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+
+	return nil
+}
+
+// Dropped returns the total amount of bytes discarded over the lifetime of
+// the buffer.
+func (b *Buffer) Dropped() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.dropped
+}
+
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+
+	return y
+}
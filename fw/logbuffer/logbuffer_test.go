@@ -0,0 +1,165 @@
+package logbuffer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func marker(n int) string {
+	return fmt.Sprintf("\r\n[tinyCI: %d bytes of output were dropped; log shipping fell behind]\r\n", n)
+}
+
+func TestBuffer(t *testing.T) {
+	table := []struct {
+		name    string
+		size    int
+		writes  []string
+		reads   []int // sizes of reads made before the rest is drained
+		output  string
+		dropped uint64
+	}{
+		{name: "empty", size: 8},
+		{name: "fits", size: 8, writes: []string{"abc", "def"}, output: "abcdef"},
+		{name: "exactly full", size: 8, writes: []string{"abcd", "efgh"}, output: "abcdefgh"},
+		{name: "drops oldest", size: 8, writes: []string{"abcdef", "ghij"}, output: marker(2) + "cdefghij", dropped: 2},
+		{name: "write larger than buffer", size: 4, writes: []string{"abcdefgh"}, output: marker(4) + "efgh", dropped: 4},
+		{name: "drops accumulate", size: 4, writes: []string{"abcd", "ef", "gh"}, output: marker(4) + "efgh", dropped: 4},
+		{name: "partial read", size: 8, writes: []string{"abcdef"}, reads: []int{4}, output: "abcdef"},
+	}
+
+	for _, test := range table {
+		b := New(test.size)
+
+		for _, w := range test.writes {
+			n, err := b.Write([]byte(w))
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+
+			if n != len(w) {
+				t.Fatalf("%v: wrote %d bytes, want %d", test.name, n, len(w))
+			}
+		}
+
+		var output []byte
+
+		for _, size := range test.reads {
+			p := make([]byte, size)
+			n, err := b.Read(p)
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			output = append(output, p[:n]...)
+		}
+
+		if err := b.Close(); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		rest, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		output = append(output, rest...)
+
+		if string(output) != test.output {
+			t.Fatalf("%v: got %q, want %q", test.name, output, test.output)
+		}
+
+		if b.Dropped() != test.dropped {
+			t.Fatalf("%v: dropped %d bytes, want %d", test.name, b.Dropped(), test.dropped)
+		}
+	}
+}
+
+func TestBufferWrapAroundAfterRead(t *testing.T) {
+	b := New(8)
+
+	b.Write([]byte("abcdef"))
+
+	p := make([]byte, 4)
+	if n, _ := b.Read(p); string(p[:n]) != "abcd" {
+		t.Fatalf("got %q, want %q", p[:n], "abcd")
+	}
+
+	// "ef" is at the end of the ring; this write wraps to its start.
+	b.Write([]byte("ghijkl"))
+	b.Close()
+
+	output, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(output) != "efghijkl" || b.Dropped() != 0 {
+		t.Fatalf("got %q with %d bytes dropped, want %q with none", output, b.Dropped(), "efghijkl")
+	}
+}
+
+func TestBufferMarkerShortReads(t *testing.T) {
+	b := New(4)
+
+	b.Write([]byte("abcdef"))
+
+	// the marker may be read a byte at a time, and is followed by the output.
+	var output []byte
+
+	p := make([]byte, 1)
+	for len(output) < len(marker(2)) {
+		n, err := b.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output = append(output, p[:n]...)
+	}
+
+	if string(output) != marker(2) {
+		t.Fatalf("got %q, want %q", output, marker(2))
+	}
+
+	b.Close()
+
+	rest, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rest) != "cdef" {
+		t.Fatalf("got %q, want %q", rest, "cdef")
+	}
+}
+
+func TestBufferCloseWakesReader(t *testing.T) {
+	b := New(8)
+
+	errChan := make(chan error, 1)
+
+	go func() {
+		_, err := b.Read(make([]byte, 8))
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		t.Fatalf("read did not block on an empty buffer: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Close()
+
+	select {
+	case err := <-errChan:
+		if err != io.EOF {
+			t.Fatalf("got %v, want EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read was not woken up by close")
+	}
+
+	if _, err := b.Write([]byte("abc")); err != io.ErrClosedPipe {
+		t.Fatalf("write after close: got %v, want %v", err, io.ErrClosedPipe)
+	}
+}
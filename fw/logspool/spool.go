@@ -0,0 +1,187 @@
+// Package logspool implements a bounded, non-blocking spool on disk for
+// shipping job output.
+//
+// Unlike a logbuffer.Buffer, a Spool keeps all the output of a job, up to its
+// maximum size, until it is released, so the upload may wait out an outage
+// of the assetsvc, or start over, without losing any of it. Once the maximum
+// is reached, a marker line is written and further output is discarded.
+package logspool
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DefaultMaxSize is the default maximum size of a Spool, in bytes.
+const DefaultMaxSize = 256 * 1024 * 1024
+
+// markerSize is reserved at the end of the spool for the truncation marker.
+const markerSize = 256
+
+// Spool is a file-backed log which satisfies io.WriteCloser. Any number of
+// readers may read it from the start with NewReader, while it is written.
+// Create one with New.
+type Spool struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	file      *os.File
+	size      int64
+	max       int64
+	closed    bool
+	truncated bool
+	dropped   uint64
+	done      chan struct{}
+}
+
+// New creates a Spool of the maximum size in bytes in dir, or the system temp
+// dir. If max is not positive, DefaultMaxSize is used. The file is removed at
+// once, so its space is reclaimed when the spool is released, or the process
+// exits.
+func New(dir string, max int64) (*Spool, error) {
+	if max <= 0 {
+		max = DefaultMaxSize
+	}
+
+	f, err := ioutil.TempFile(dir, "tinyci-log-")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &Spool{file: f, max: max, done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mutex)
+
+	return s, nil
+}
+
+// Write appends p to the spool, discarding what does not fit. It never
+// blocks on readers, and only fails if the spool is closed; output which
+// could not be written to disk is counted as dropped.
+func (s *Spool) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := len(p)
+	room := s.max - markerSize - s.size
+
+	switch {
+	case s.truncated:
+		s.dropped += uint64(len(p))
+		return n, nil
+	case int64(len(p)) <= room:
+		s.append(p)
+		return n, nil
+	}
+
+	if room < 0 {
+		room = 0
+	}
+
+	s.append(p[:room])
+	s.dropped += uint64(int64(len(p)) - room)
+
+	s.truncated = true
+	s.append([]byte(fmt.Sprintf("\r\n[tinyCI: the log reached its maximum size of %d bytes; further output was dropped]\r\n", s.max)))
+
+	return n, nil
+}
+
+// append writes p at the end of the file. The mutex must be held.
+func (s *Spool) append(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	written, err := s.file.WriteAt(p, s.size)
+	s.size += int64(written)
+	if err != nil {
+		s.dropped += uint64(len(p) - written)
+	}
+
+	s.cond.Broadcast()
+}
+
+// Close closes the spool for writing. Readers may read the remaining output
+// before receiving io.EOF.
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		s.cond.Broadcast()
+	}
+
+	return nil
+}
+
+// Done is closed once the spool is closed for writing.
+func (s *Spool) Done() <-chan struct{} {
+	return s.done
+}
+
+// Release closes the spool and frees its file. Readers must be done.
+func (s *Spool) Release() error {
+	s.Close()
+	return s.file.Close()
+}
+
+// Dropped returns the total amount of bytes discarded.
+func (s *Spool) Dropped() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.dropped
+}
+
+// NewReader returns a reader of the spool from its start. Reads block until
+// more output is written, or the spool is closed.
+func (s *Spool) NewReader() io.Reader {
+	return &reader{spool: s}
+}
+
+type reader struct {
+	spool  *Spool
+	offset int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	s := r.spool
+
+	s.mutex.Lock()
+	for r.offset == s.size && !s.closed {
+		s.cond.Wait()
+	}
+	size := s.size
+	s.mutex.Unlock()
+
+	if r.offset == size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > size-r.offset {
+		p = p[:size-r.offset]
+	}
+
+	n, err := s.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
@@ -0,0 +1,127 @@
+// Package logtail caps the size of job logs, protecting the assetsvc from
+// runaway output, while keeping their end, which usually tells why a job
+// failed.
+//
+// Once the maximum size is reached, a Writer stops passing on output and
+// only keeps its tail, which it writes after a truncation notice once
+// closed.
+package logtail
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultTailSize is the default amount of output kept past the maximum
+// size, in bytes.
+const DefaultTailSize = 1024 * 1024
+
+// Sink is where the output goes, such as a logbuffer.Buffer or a
+// logspool.Spool.
+type Sink interface {
+	io.WriteCloser
+	// Dropped returns the amount of bytes the sink dropped.
+	Dropped() uint64
+}
+
+// Writer passes on output to its sink until the maximum size, then keeps the
+// tail of the rest. Create one with New.
+type Writer struct {
+	sink     Sink
+	max      int64
+	tailSize int
+
+	mutex   sync.Mutex
+	written int64
+	tail    []byte
+	cut     uint64
+	closed  bool
+}
+
+// New returns a Writer passing on up to max bytes to the sink, then keeping
+// the last tailSize bytes. If tailSize is not positive, DefaultTailSize is
+// used.
+func New(sink Sink, max int64, tailSize int) *Writer {
+	if tailSize <= 0 {
+		tailSize = DefaultTailSize
+	}
+
+	return &Writer{sink: sink, max: max, tailSize: tailSize}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n := len(p)
+
+	if room := w.max - w.written; room > 0 {
+		head := p
+		if int64(len(head)) > room {
+			head = head[:room]
+		}
+
+		if _, err := w.sink.Write(head); err != nil {
+			return 0, err
+		}
+
+		w.written += int64(len(head))
+		p = p[len(head):]
+
+		if len(p) != 0 {
+			fmt.Fprintf(w.sink, "\r\n[tinyCI: the log reached its maximum size of %d bytes; its end follows once the job is done]\r\n", w.max)
+		}
+	}
+
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	w.tail = append(w.tail, p...)
+
+	if excess := len(w.tail) - w.tailSize; excess > 0 {
+		w.cut += uint64(excess)
+		w.tail = w.tail[excess:]
+	}
+
+	return n, nil
+}
+
+// Close writes the tail, if output was truncated, and closes the sink.
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if len(w.tail) != 0 {
+		fmt.Fprintf(w.sink, "\r\n[tinyCI: %d bytes of output were cut from the log; the last %d bytes follow]\r\n", w.cut, len(w.tail))
+		w.sink.Write(w.tail)
+		w.tail = nil
+	}
+
+	return w.sink.Close()
+}
+
+// Dropped returns the amount of bytes the sink dropped, not counting those
+// truncated.
+func (w *Writer) Dropped() uint64 {
+	return w.sink.Dropped()
+}
+
+// Cut returns the amount of bytes cut from the log, between its maximum size
+// and its tail.
+func (w *Writer) Cut() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.cut
+}
@@ -0,0 +1,94 @@
+package fw
+
+import (
+	"context"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// LongPollHeader is the gRPC metadata key of NextQueueItem requests
+	// telling the queuesvc how long it may hold the request, as a Go
+	// duration, e.g. "30s".
+	LongPollHeader = "tinyci-long-poll"
+
+	// longPollMargin is how much longer than the queuesvc is asked to hold a
+	// request the runner waits for its answer, so a queue item dequeued just
+	// before the hold ends is not lost in transit.
+	longPollMargin = 5 * time.Second
+)
+
+// longPollContext returns the context of a NextQueueItem request held by the
+// queuesvc for up to timeout: the timeout is sent as a hint under
+// LongPollHeader, and the request is given longPollMargin more to complete.
+func longPollContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx = metadata.AppendToOutgoingContext(ctx, LongPollHeader, timeout.String())
+	return context.WithTimeout(ctx, timeout+longPollMargin)
+}
+
+// pollTimeout returns the deadline of a NextQueueItem request when long
+// polling, split evenly among the queues polled. Zero if the runner is not
+// long polling.
+func (e *Entrypoint) pollTimeout(runner Runner, queues int) time.Duration {
+	longPoll := runner.FrameworkConfig().LongPoll
+	if longPoll <= 0 || queues == 0 {
+		return 0
+	}
+
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+
+	if e.longPollUnsupported {
+		return 0
+	}
+
+	return longPoll / time.Duration(queues)
+}
+
+// longPollResult interprets the result of a long-polled NextQueueItem request.
+// The queuesvc is assumed not to support long polls if it reports an empty
+// queue well before the timeout, and the runner falls back to polling.
+//
+// A request outliving its deadline is not taken to mean the queue is empty:
+// the queuesvc did not answer within longPollMargin of the hold it was asked
+// for, and may have dequeued a queue item whose answer never arrived. Such an
+// item cannot be recovered by the runner; it is logged and the error is
+// returned like any other failure of the queuesvc.
+func (e *Entrypoint) longPollResult(ctx context.Context, runner Runner, timeout, elapsed time.Duration, err error) error {
+	if timeout == 0 {
+		return err
+	}
+
+	if stat, ok := status.FromError(err); ok && stat.Code() == codes.DeadlineExceeded && ctx.Err() == nil {
+		runner.LogsvcClient(&fwcontext.RunContext{}).Errorf(ctx, "queuesvc did not answer within %v of the %v long poll; a queue item it dequeued meanwhile, if any, was lost", longPollMargin, timeout)
+		return err
+	}
+
+	if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+		if elapsed >= timeout/2 {
+			e.wakeup()
+			return err
+		}
+
+		e.runMapMutex.Lock()
+		e.longPollUnsupported = true
+		e.runMapMutex.Unlock()
+
+		runner.LogsvcClient(&fwcontext.RunContext{}).Info(ctx, "queuesvc does not hold NextQueueItem requests; falling back to polling")
+	}
+
+	return err
+}
+
+// wakeup makes the runner look for work right away, instead of at its next
+// poll.
+func (e *Entrypoint) wakeup() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,53 @@
+package fw
+
+import (
+	"context"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// maintenance returns true if a maintenance window is active, logging when
+// windows start and end. When a window configured to drain starts, the runner
+// is drained and exits once its runs complete.
+func (e *Entrypoint) maintenance(ctx context.Context, runner Runner) bool {
+	var active, drain bool
+
+	now := time.Now()
+	for _, mw := range runner.FrameworkConfig().MaintenanceWindows {
+		if mw.Active(now) {
+			active = true
+			drain = drain || mw.Drain
+		}
+	}
+
+	e.runMapMutex.Lock()
+	changed := active != e.inMaintenance
+	e.inMaintenance = active
+	e.runMapMutex.Unlock()
+
+	if !changed {
+		return active
+	}
+
+	log := runner.LogsvcClient(&fwcontext.RunContext{})
+	if !active {
+		log.Info(ctx, "Maintenance window ended; accepting new work")
+		return false
+	}
+
+	if drain {
+		e.Drain(true)
+		e.logDrain(log, true)
+	} else {
+		log.Info(ctx, "Maintenance window started; not accepting new work")
+	}
+
+	return true
+}
+
+func (e *Entrypoint) getMaintenance() bool {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return e.inMaintenance
+}
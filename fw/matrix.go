@@ -0,0 +1,356 @@
+package fw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"github.com/tinyci/ci-agents/clients/log"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// MatrixKey is the run metadata key holding the matrix specification: a
+	// map of names to lists of values. Each combination of values is executed
+	// as a separate cell, with the values exported as MATRIX_<NAME>
+	// environment variables; see matrixEnvName.
+	MatrixKey = "matrix"
+	// MatrixParallelKey is the run metadata key holding the amount of cells to
+	// execute concurrently. Defaults to 1, and is ignored by runners which
+	// are not a ParallelMatrixRunner.
+	MatrixParallelKey = "matrix_parallel"
+
+	maxMatrixCells = 256
+
+	// maxPartialLine is the amount of output of a cell without a newline held
+	// back before it is written anyway.
+	maxPartialLine = 4096
+)
+
+// MatrixRunner is implemented by runners supporting matrix fan-out. Runners
+// which do not implement it execute matrix queue items as a single run.
+type MatrixRunner interface {
+	Runner
+
+	// MatrixOutput returns the writer that the job output of all cells is
+	// written to, typically the log of the queue item. It is closed once all
+	// cells have completed.
+	MatrixOutput(*fwcontext.RunContext) io.WriteCloser
+}
+
+// ParallelMatrixRunner is implemented by matrix runners which may execute
+// cells concurrently. Cells of other runners execute one at a time, whatever
+// the matrix_parallel metadata asks for.
+type ParallelMatrixRunner interface {
+	MatrixRunner
+
+	// ParallelMatrix returns true if each cell gets its own workspace, so
+	// cells may execute concurrently.
+	ParallelMatrix() bool
+}
+
+// matrixCells expands the matrix specification of the queue item into its
+// cells, returning them with the requested parallelism. No cells are returned
+// if the queue item has no matrix.
+func matrixCells(qi *types.QueueItem) ([]*fwcontext.MatrixCell, int, error) {
+	md := qi.Run.Settings.GetMetadata().AsMap()
+
+	spec, ok := md[MatrixKey]
+	if !ok {
+		return nil, 0, nil
+	}
+
+	specMap, ok := spec.(map[string]interface{})
+	if !ok || len(specMap) == 0 {
+		return nil, 0, errors.New("matrix must be a map of names to lists of values")
+	}
+
+	keys := []string{}
+	for key := range specMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	envNames := map[string]string{}
+	for _, key := range keys {
+		name := matrixEnvName(key)
+		if other, ok := envNames[name]; ok {
+			return nil, 0, fmt.Errorf("matrix %q and %q would both be exported as %s", other, key, name)
+		}
+		envNames[name] = key
+	}
+
+	cells := []*fwcontext.MatrixCell{{Values: map[string]string{}}}
+
+	for _, key := range keys {
+		values, ok := specMap[key].([]interface{})
+		if !ok || len(values) == 0 {
+			return nil, 0, fmt.Errorf("matrix %q must be a non-empty list of values", key)
+		}
+
+		if len(cells)*len(values) > maxMatrixCells {
+			return nil, 0, fmt.Errorf("matrix exceeds %d cells", maxMatrixCells)
+		}
+
+		expanded := []*fwcontext.MatrixCell{}
+
+		for _, cell := range cells {
+			for _, value := range values {
+				newCell := &fwcontext.MatrixCell{Values: map[string]string{}}
+				for k, v := range cell.Values {
+					newCell.Values[k] = v
+				}
+				newCell.Values[key] = fmt.Sprint(value)
+				expanded = append(expanded, newCell)
+			}
+		}
+
+		cells = expanded
+	}
+
+	for i, cell := range cells {
+		cell.Index = i
+
+		parts := []string{}
+		for _, key := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%s", key, cell.Values[key]))
+		}
+		cell.Name = strings.Join(parts, ",")
+	}
+
+	parallel := 1
+	if p, ok := md[MatrixParallelKey].(float64); ok && p >= 1 {
+		parallel = int(p)
+	}
+
+	return cells, parallel, nil
+}
+
+// matrixEnvName returns the name of the environment variable exporting the
+// values of the matrix key: MATRIX_ followed by the key in upper case, with
+// any character which is not a letter, digit or underscore replaced by an
+// underscore, so that shells may reference it; "go-version" becomes
+// MATRIX_GO_VERSION.
+func matrixEnvName(key string) string {
+	return "MATRIX_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+// cellContext creates the run context for a cell. The queue item is copied
+// with the matrix values added to its environment, and the cell gets its own
+// cancellation context beneath the parent's. Its output is written to the
+// shared output line by line.
+func cellContext(parent *fwcontext.RunContext, cell *fwcontext.MatrixCell, output *lockedWriter) *fwcontext.RunContext {
+	qi := proto.Clone(parent.QueueItem).(*types.QueueItem)
+
+	keys := []string{}
+	for key := range cell.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		qi.Run.Settings.Env = append(qi.Run.Settings.Env, fmt.Sprintf("%s=%s", matrixEnvName(key), cell.Values[key]))
+	}
+
+	cellCtx := &fwcontext.RunContext{
+		Context:   parent.Context,
+		QueueItem: qi,
+		Start:     parent.Start,
+		Trace:     parent.Trace.Sub(cell.Name),
+		Cell:      cell,
+		Output:    &prefixWriter{w: output, prefix: []byte(fmt.Sprintf("[%s] ", cell.Name))},
+	}
+
+	cellCtx.Ctx, cellCtx.CancelFunc = context.WithCancel(parent.Ctx)
+
+	return cellCtx
+}
+
+// runMatrix executes all cells of the matrix, returning true only if all of
+// them succeeded.
+func (e *Entrypoint) runMatrix(ctx context.Context, runner MatrixRunner, runName string, runnerCtx *fwcontext.RunContext, cells []*fwcontext.MatrixCell, parallel int) bool {
+	parent := &matrixRun{name: runName, runCtx: runnerCtx}
+
+	e.runMapMutex.Lock()
+	e.runMap[parent] = runnerCtx
+	e.runMapMutex.Unlock()
+
+	defer func() {
+		e.runMapMutex.Lock()
+		delete(e.runMap, parent)
+		e.runMapMutex.Unlock()
+	}()
+
+	matrixOutput := runner.MatrixOutput(runnerCtx)
+	defer matrixOutput.Close()
+
+	output := &lockedWriter{w: matrixOutput}
+
+	runLogger := runner.LogsvcClient(runnerCtx)
+
+	if pr, ok := runner.(ParallelMatrixRunner); parallel > 1 && (!ok || !pr.ParallelMatrix()) {
+		runLogger.Infof(ctx, "Runner cannot execute matrix cells concurrently; ignoring %v of %d", MatrixParallelKey, parallel)
+		parallel = 1
+	}
+
+	runLogger.Infof(ctx, "Expanding matrix into %d cells, %d at a time", len(cells), parallel)
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		allPass  = true
+		throttle = make(chan struct{}, parallel)
+	)
+
+	for i, cell := range cells {
+		throttle <- struct{}{}
+
+		// cells in flight are stopped on their own when the run times out or
+		// its lease is lost; those left are not started.
+		if runID := runnerCtx.QueueItem.Run.Id; e.isTimedOut(runID) || !e.hasLease(runID) {
+			runLogger.Infof(ctx, "Run is stopping; skipping the %d cells left", len(cells)-i)
+
+			mutex.Lock()
+			allPass = false
+			mutex.Unlock()
+			break
+		}
+
+		wg.Add(1)
+
+		go func(i int, cell *fwcontext.MatrixCell) {
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+
+			cellCtx := cellContext(runnerCtx, cell, output)
+			defer cellCtx.CancelFunc()
+
+			cellLogger := runner.LogsvcClient(cellCtx).WithFields(log.FieldMap{"matrix_cell": cell.Name})
+
+			status := e.runCell(ctx, runnerCtx.Ctx, runner, fmt.Sprintf("%s.%d", runName, i), cellCtx)
+			cellLogger.Infof(ctx, "Matrix cell %v finished with status %v", cell.Name, status)
+			// also ends any line the cell left unfinished
+			fmt.Fprintf(cellCtx.Output, "\r\nmatrix cell finished; passed: %v\r\n", status)
+
+			mutex.Lock()
+			allPass = allPass && status
+			mutex.Unlock()
+		}(i, cell)
+	}
+
+	wg.Wait()
+
+	return allPass
+}
+
+func (e *Entrypoint) runCell(ctx, parent context.Context, runner Runner, runName string, cellCtx *fwcontext.RunContext) bool {
+	var run Run
+
+	err := protect(func() (err error) {
+		run, err = runner.MakeRun(runName, cellCtx)
+		return err
+	})
+	if err != nil {
+		runner.LogsvcClient(cellCtx).Errorf(ctx, "Could not create run for matrix cell %v: %v", cellCtx.Cell.Name, err)
+		return false
+	}
+
+	defer func() {
+		if err := protect(func() error { runner.AfterRun(runName, cellCtx); return nil }); err != nil {
+			runner.LogsvcClient(cellCtx).Errorf(ctx, "Runner AfterRun hook %v", err)
+		}
+	}()
+
+	_, status, _, err := e.runAttempts(ctx, parent, runner, runName, run)
+	if err != nil {
+		runner.LogsvcClient(cellCtx).Errorf(ctx, "Run configuration errored for matrix cell %v: %v", cellCtx.Cell.Name, err)
+		return false
+	}
+
+	return status
+}
+
+// matrixRun stands in for a matrix run as a whole in the run map, so that it
+// is considered in flight between cells. It is never executed, nor stopped
+// itself on timeout or loss of the lease; see runsOf.
+type matrixRun struct {
+	name   string
+	runCtx *fwcontext.RunContext
+}
+
+func (mr *matrixRun) Name() string                      { return mr.name }
+func (mr *matrixRun) String() string                    { return mr.name }
+func (mr *matrixRun) RunContext() *fwcontext.RunContext { return mr.runCtx }
+func (mr *matrixRun) BeforeRun() error                  { return nil }
+func (mr *matrixRun) Run() (bool, error)                { return false, nil }
+func (mr *matrixRun) AfterRun() error                   { return nil }
+
+// lockedWriter serializes the writes of the cells to their shared output.
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	return lw.w.Write(p)
+}
+
+// prefixWriter prefixes every line written with a fixed prefix. Only whole
+// lines are written through, so the lines of cells sharing the writer do not
+// interleave; a partial line is held back until it ends, or grows past
+// maxPartialLine.
+type prefixWriter struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	prefix []byte
+	line   bytes.Buffer
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	for _, b := range p {
+		if pw.line.Len() == 0 {
+			pw.line.Write(pw.prefix)
+		}
+
+		pw.line.WriteByte(b)
+
+		if b == '\n' || pw.line.Len() >= len(pw.prefix)+maxPartialLine {
+			pw.line.WriteTo(buf)
+		}
+	}
+
+	if buf.Len() == 0 {
+		return len(p), nil
+	}
+
+	if _, err := pw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
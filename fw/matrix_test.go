@@ -0,0 +1,173 @@
+package fw
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMatrixCells(t *testing.T) {
+	big := []interface{}{}
+	for i := 0; i < 17; i++ {
+		big = append(big, i)
+	}
+
+	table := []struct {
+		name     string
+		metadata map[string]interface{}
+		cells    []string
+		parallel int
+		invalid  bool
+	}{
+		{name: "no matrix", metadata: map[string]interface{}{}},
+		{
+			name:     "one key",
+			metadata: map[string]interface{}{"matrix": map[string]interface{}{"go": []interface{}{"1.15", "1.16"}}},
+			cells:    []string{"go=1.15", "go=1.16"},
+			parallel: 1,
+		},
+		{
+			name: "keys in order",
+			metadata: map[string]interface{}{
+				"matrix":          map[string]interface{}{"os": []interface{}{"linux", "windows"}, "go": []interface{}{1.16}},
+				"matrix_parallel": 2,
+			},
+			cells:    []string{"go=1.16,os=linux", "go=1.16,os=windows"},
+			parallel: 2,
+		},
+		{
+			name:     "parallel below one",
+			metadata: map[string]interface{}{"matrix": map[string]interface{}{"go": []interface{}{"1.16"}}, "matrix_parallel": 0},
+			cells:    []string{"go=1.16"},
+			parallel: 1,
+		},
+		{
+			name:     "keys with punctuation",
+			metadata: map[string]interface{}{"matrix": map[string]interface{}{"go-version": []interface{}{"1.16"}, "node.js": []interface{}{"14"}}},
+			cells:    []string{"go-version=1.16,node.js=14"},
+			parallel: 1,
+		},
+		{name: "colliding keys", metadata: map[string]interface{}{"matrix": map[string]interface{}{"go-version": []interface{}{"1.16"}, "go_version": []interface{}{"1.15"}}}, invalid: true},
+		{name: "colliding case", metadata: map[string]interface{}{"matrix": map[string]interface{}{"os": []interface{}{"linux"}, "OS": []interface{}{"windows"}}}, invalid: true},
+		{name: "not a map", metadata: map[string]interface{}{"matrix": []interface{}{"go"}}, invalid: true},
+		{name: "empty map", metadata: map[string]interface{}{"matrix": map[string]interface{}{}}, invalid: true},
+		{name: "empty values", metadata: map[string]interface{}{"matrix": map[string]interface{}{"go": []interface{}{}}}, invalid: true},
+		{name: "not a list", metadata: map[string]interface{}{"matrix": map[string]interface{}{"go": "1.16"}}, invalid: true},
+		{name: "too many cells", metadata: map[string]interface{}{"matrix": map[string]interface{}{"a": big, "b": big}}, invalid: true},
+	}
+
+	for _, test := range table {
+		md, err := structpb.NewStruct(test.metadata)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		cells, parallel, err := matrixCells(&types.QueueItem{Run: &types.Run{Settings: &types.RunSettings{Metadata: md}}})
+		if test.invalid {
+			if err == nil {
+				t.Fatalf("%v: matrix was not rejected", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		names := []string{}
+		for i, cell := range cells {
+			if cell.Index != i {
+				t.Fatalf("%v: cell %v has index %d, want %d", test.name, cell.Name, cell.Index, i)
+			}
+
+			names = append(names, cell.Name)
+		}
+
+		if len(test.cells) == 0 {
+			test.cells = []string{}
+		}
+
+		if !reflect.DeepEqual(names, test.cells) || parallel != test.parallel {
+			t.Fatalf("%v: got cells %v, %d at a time; want %v, %d at a time", test.name, names, parallel, test.cells, test.parallel)
+		}
+	}
+}
+
+func TestMatrixEnvName(t *testing.T) {
+	table := map[string]string{
+		"go":          "MATRIX_GO",
+		"go-version":  "MATRIX_GO_VERSION",
+		"node.js":     "MATRIX_NODE_JS",
+		"Python_3":    "MATRIX_PYTHON_3",
+		"os arch":     "MATRIX_OS_ARCH",
+		"r\u00e9gion": "MATRIX_R_GION",
+	}
+
+	for key, want := range table {
+		if name := matrixEnvName(key); name != want {
+			t.Fatalf("%q: got %v, want %v", key, name, want)
+		}
+	}
+}
+
+func TestPrefixWriterWholeLines(t *testing.T) {
+	out := &lockedWriter{w: &bytes.Buffer{}}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			pw := &prefixWriter{w: out, prefix: []byte(fmt.Sprintf("[%d] ", i))}
+			for j := 0; j < 100; j++ {
+				// each line is written in pieces
+				fmt.Fprintf(pw, "line %d ", j)
+				fmt.Fprintf(pw, "of cell %d\n", i)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.w.(*bytes.Buffer).String(), "\n"), "\n")
+	if len(lines) != 400 {
+		t.Fatalf("expected 400 lines, got %d", len(lines))
+	}
+
+	for _, line := range lines {
+		var prefix, cell, j int
+		if _, err := fmt.Sscanf(line, "[%d] line %d of cell %d", &prefix, &j, &cell); err != nil || prefix != cell {
+			t.Fatalf("interleaved line %q", line)
+		}
+	}
+}
+
+func TestPrefixWriterPartialLine(t *testing.T) {
+	buf := &bytes.Buffer{}
+	pw := &prefixWriter{w: buf, prefix: []byte("> ")}
+
+	fmt.Fprint(pw, "no newline yet")
+	if buf.Len() != 0 {
+		t.Fatalf("partial line was written: %q", buf.String())
+	}
+
+	fmt.Fprint(pw, "\nnext")
+	if buf.String() != "> no newline yet\n" {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+
+	buf.Reset()
+	fmt.Fprint(pw, strings.Repeat("x", maxPartialLine))
+	if buf.Len() != len("> next")+maxPartialLine-len("next") {
+		t.Fatalf("long partial line was held back: %d bytes written", buf.Len())
+	}
+}
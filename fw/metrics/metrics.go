@@ -0,0 +1,301 @@
+// Package metrics exports runner metrics in the Prometheus text exposition
+// format.
+//
+// The framework records the standard metrics below for every runner; they are
+// served at /metrics on the framework's HTTP server (see http_addr in the
+// configuration). Runners may register their own metrics in Default as well.
+//
+// Only counters and histograms are supported, which is all the framework
+// needs, so no client library is required.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets used for durations, in seconds.
+var DefaultBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// SizeBuckets are the histogram buckets used for sizes, in bytes, from 1MiB
+// to 64GiB.
+var SizeBuckets = []float64{1 << 20, 16 << 20, 128 << 20, 512 << 20, 1 << 30, 4 << 30, 16 << 30, 64 << 30}
+
+// Default is the registry the framework's metrics are registered in.
+var Default = NewRegistry()
+
+// Standard framework metrics.
+var (
+	// RunsStarted counts queue items started, by queue.
+	RunsStarted = Default.NewCounter("tinyci_runner_runs_started_total", "Queue items started by the runner.", "queue")
+	// RunsCompleted counts queue items completed, by queue and outcome (see
+	// fw.Outcome).
+	RunsCompleted = Default.NewCounter("tinyci_runner_runs_completed_total", "Queue items completed by the runner.", "queue", "outcome")
+	// RunDuration observes the duration of queue items, by queue.
+	RunDuration = Default.NewHistogram("tinyci_runner_run_duration_seconds", "Duration of queue items.", DefaultBuckets, "queue")
+	// QueuePollDuration observes the latency of polling a queue for work.
+	QueuePollDuration = Default.NewHistogram("tinyci_runner_queue_poll_duration_seconds", "Latency of polling the queuesvc for work.", DefaultBuckets, "queue")
+	// CloneDuration observes the time spent cloning or fetching repositories,
+	// by operation ("clone" or "fetch").
+	CloneDuration = Default.NewHistogram("tinyci_runner_clone_duration_seconds", "Time spent cloning or fetching repositories.", DefaultBuckets, "operation")
+	// WorkspaceWritten observes the bytes runs wrote to their workspace, by
+	// queue, where the runner can measure it.
+	WorkspaceWritten = Default.NewHistogram("tinyci_runner_workspace_written_bytes", "Bytes written by runs to their workspace.", SizeBuckets, "queue")
+	// RunCPUTime observes the CPU time consumed by the containers of runs, by
+	// queue, where the runner can measure it.
+	RunCPUTime = Default.NewHistogram("tinyci_runner_run_cpu_seconds", "CPU time consumed by the containers of runs.", DefaultBuckets, "queue")
+	// RunMemoryPeak observes the peak memory usage of the containers of runs,
+	// by queue, where the runner can measure it.
+	RunMemoryPeak = Default.NewHistogram("tinyci_runner_run_memory_peak_bytes", "Peak memory usage of the containers of runs.", SizeBuckets, "queue")
+	// RunIO observes the bytes the containers of runs read from and wrote to
+	// block devices, by queue and direction ("read" or "write"), where the
+	// runner can measure it.
+	RunIO = Default.NewHistogram("tinyci_runner_run_io_bytes", "Bytes read from and written to block devices by the containers of runs.", SizeBuckets, "queue", "direction")
+)
+
+// Registry is a set of metrics.
+type Registry struct {
+	metrics []metric
+	mutex   sync.Mutex
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics = append(r.metrics, m)
+	sort.Slice(r.metrics, func(i, j int) bool { return r.metrics[i].name() < r.metrics[j].name() })
+}
+
+// WriteTo writes all metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, m := range r.metrics {
+		m.write(cw)
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+// Handler returns an HTTP handler serving the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteTo(w)
+	})
+}
+
+// Since returns the seconds elapsed since t, for observing durations.
+func Since(t time.Time) float64 {
+	return time.Since(t).Seconds()
+}
+
+type countWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// family holds the label sets of a metric.
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	mutex      sync.Mutex
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %v: %d label values given for %d labels", f.metricName, len(values), len(f.labels)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+func (f *family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, f.help, f.metricName, f.kind)
+}
+
+// labelString formats the label pairs for the given label values, plus any
+// extra pairs.
+func (f *family) labelString(key string, extra ...string) string {
+	pairs := []string{}
+
+	if len(f.labels) != 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", f.labels[i], value))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return fmt.Sprintf("%g", f)
+}
+
+// Counter is a monotonically increasing value, partitioned by labels.
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: family{metricName: name, help: help, kind: "counter", labels: labels}, values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter for the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.header(w)
+
+	keys := map[string]bool{}
+	for key := range c.values {
+		keys[key] = true
+	}
+
+	for _, key := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations into buckets, partitioned by labels.
+type Histogram struct {
+	family
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper
+// bounds, which must be sorted, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  family{metricName: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records the value for the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.header(w)
+
+	keys := map[string]bool{}
+	for key := range h.series {
+		keys[key] = true
+	}
+
+	for _, key := range sortedKeys(keys) {
+		s := h.series[key]
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", formatFloat(bound)), s.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key), s.count)
+	}
+}
@@ -0,0 +1,85 @@
+package fw
+
+// Phase identifies one of the lifecycle hooks of a Run.
+type Phase string
+
+// Phases of a run, in the order they are executed.
+const (
+	PhaseBeforeRun Phase = "before_run"
+	PhaseRun       Phase = "run"
+	PhaseAfterRun  Phase = "after_run"
+)
+
+// RunHandler executes a phase of the run. The status is only meaningful for
+// PhaseRun; the other phases return false.
+type RunHandler func(run Run, phase Phase) (bool, error)
+
+// RunMiddleware wraps the execution of each phase of a run, much like HTTP
+// middleware. It can act before and after calling next, alter its result, or
+// not call it at all. This allows features such as timing, retries or secret
+// injection to be composed onto any runner.
+//
+// Example:
+//
+//		func logPhases(next fw.RunHandler) fw.RunHandler {
+//			return func(run fw.Run, phase fw.Phase) (bool, error) {
+//				log.Printf("%v: starting %v", run.Name(), phase)
+//				return next(run, phase)
+//			}
+//		}
+//
+type RunMiddleware func(next RunHandler) RunHandler
+
+// runPhase is the innermost handler, calling the hook of the run itself.
+func runPhase(run Run, phase Phase) (bool, error) {
+	switch phase {
+	case PhaseBeforeRun:
+		return false, run.BeforeRun()
+	case PhaseRun:
+		return run.Run()
+	case PhaseAfterRun:
+		return false, run.AfterRun()
+	}
+
+	return false, nil
+}
+
+// traceMiddleware records each phase in the timing trace of the run.
+func traceMiddleware(next RunHandler) RunHandler {
+	return func(run Run, phase Phase) (bool, error) {
+		defer run.RunContext().Trace.Phase(string(phase))()
+		return next(run, phase)
+	}
+}
+
+// protectMiddleware converts panics, including those raised by middleware,
+// into errors. See protect.
+func protectMiddleware(next RunHandler) RunHandler {
+	return func(run Run, phase Phase) (status bool, err error) {
+		err = protect(func() (err error) {
+			status, err = next(run, phase)
+			return err
+		})
+
+		return status, err
+	}
+}
+
+// handler builds the chain of middleware for executing runs. Middleware
+// supplied in the Entrypoint are applied in order, the first being the
+// outermost.
+func (e *Entrypoint) handler() RunHandler {
+	chain := []RunMiddleware{protectMiddleware, traceMiddleware}
+	chain = append(chain, e.Middleware...)
+
+	if e.dryRun {
+		chain = append(chain, dryRunMiddleware)
+	}
+
+	h := RunHandler(runPhase)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+
+	return h
+}
@@ -0,0 +1,305 @@
+// Package namedcache keeps caches declared by tasks, such as build caches,
+// on the host between runs.
+//
+// A task names its caches and the path each is mounted at in its container.
+// The runner keeps them in a directory of its own, apart for each repository,
+// and gives each run a copy, shared through reflinks where the filesystem
+// supports them. Once the run is over its copy is saved in place of the
+// cache, so a run which fails half way through writing cannot leave the cache
+// half written. Caches not used for the longest are evicted when the total
+// size exceeds the limit.
+package namedcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/disk"
+	"github.com/tinyci/ci-runners/fw/flock"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// CachesKey is the task or run metadata key holding the caches of a run, as
+// a map of names to the absolute paths they are mounted at in the container.
+//
+// e.g., {"caches": {"go-build": "/root/.cache/go-build"}}
+const CachesKey = "caches"
+
+// workDir is the directory of Dir holding the copies of caches in use.
+const workDir = ".work"
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Config configures the store of named caches.
+type Config struct {
+	// Dir holds the caches. Copies are made in it, so it should be on a
+	// filesystem supporting reflinks, such as btrfs or xfs.
+	Dir string `yaml:"dir"`
+	// MaxSize, if set, is the total size of the caches, in bytes, above which
+	// the least recently used are evicted.
+	MaxSize uint64 `yaml:"max_size"`
+}
+
+// Validate errors out when the configuration doesn't match expectations.
+func (c *Config) Validate() error {
+	if !filepath.IsAbs(c.Dir) {
+		return errors.New("named cache dir must be absolute")
+	}
+
+	return nil
+}
+
+// Cache is a cache declared by a task.
+type Cache struct {
+	Name string
+	// Target is the path the cache is mounted at in the container.
+	Target string
+}
+
+// FromMetadata returns the caches under CachesKey in the metadata, sorted by
+// name, if any.
+func FromMetadata(md map[string]interface{}) ([]Cache, error) {
+	value, ok := md[CachesKey]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a map of names to paths", CachesKey)
+	}
+
+	caches := []Cache{}
+
+	for name, value := range m {
+		target, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a map of names to paths", CachesKey)
+		}
+
+		if !validName.MatchString(name) || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid cache name %q: only letters, digits, '.', '_' and '-' are allowed", name)
+		}
+
+		if !path.IsAbs(target) {
+			return nil, fmt.Errorf("cache %q: path %q must be absolute", name, target)
+		}
+
+		caches = append(caches, Cache{Name: name, Target: target})
+	}
+
+	sort.Slice(caches, func(i, j int) bool { return caches[i].Name < caches[j].Name })
+
+	return caches, nil
+}
+
+// Volume is the copy of a cache used by a run.
+type Volume struct {
+	cache string
+	lock  *os.File
+	ws    workspace.Workspace
+}
+
+// Checkout makes a copy of the cache of the name for the repository (or any
+// other scope caches are kept apart by), creating the cache if needed, for
+// the run of the name. Should the cache be in use by another run, the copy
+// starts empty and is not saved.
+func (c *Config) Checkout(scope, name, run string) (*Volume, error) {
+	sum := sha256.Sum256([]byte(scope))
+	cache := filepath.Join(c.Dir, hex.EncodeToString(sum[:16]), name)
+
+	if err := os.MkdirAll(cache, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.Dir, workDir), 0700); err != nil {
+		return nil, err
+	}
+
+	v := &Volume{cache: cache}
+
+	lock, err := lockCache(cache)
+	switch {
+	case errors.Is(err, flock.ErrLocked):
+		// copying an empty dir gives an empty workspace of the same kind
+		empty, err := ioutil.TempDir(filepath.Join(c.Dir, workDir), "empty-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(empty)
+
+		cache = empty
+	case err != nil:
+		return nil, err
+	default:
+		v.lock = lock
+	}
+
+	v.ws, err = (&workspace.Copy{Dir: filepath.Join(c.Dir, workDir)}).Snapshot(cache, run+"-"+name)
+	if err != nil {
+		if v.ws != nil {
+			v.ws.Release()
+		}
+		v.unlock()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Path is the directory holding the copy, to be mounted in the container.
+func (v *Volume) Path() string {
+	return v.ws.Path()
+}
+
+// Save replaces the cache with the copy, unless another run held the cache.
+// The volume is released either way.
+func (v *Volume) Save() error {
+	if v.lock == nil {
+		return v.Discard()
+	}
+	defer v.unlock()
+
+	old := v.cache + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		v.ws.Release()
+		return err
+	}
+
+	if err := os.Rename(v.cache, old); err != nil {
+		v.ws.Release()
+		return err
+	}
+
+	if err := os.Rename(v.ws.Path(), v.cache); err != nil {
+		os.Rename(old, v.cache)
+		v.ws.Release()
+		return err
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(v.cache, now, now); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// Discard releases the copy without saving it.
+func (v *Volume) Discard() error {
+	defer v.unlock()
+	return v.ws.Release()
+}
+
+func (v *Volume) unlock() {
+	if v.lock != nil {
+		v.lock.Close()
+		v.lock = nil
+	}
+}
+
+// lockCache takes the lock on the cache, without waiting for it.
+func lockCache(cache string) (*os.File, error) {
+	f, err := os.OpenFile(cache+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock.TryLock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reap removes the copies left behind by runs which did not finish, as when
+// the runner crashes, but for those of the live runs of this process.
+func (c *Config) Reap(live []string) ([]string, error) {
+	return workspace.Reap(filepath.Join(c.Dir, workDir), live)
+}
+
+type cacheDir struct {
+	path     string
+	lastUsed time.Time
+	size     uint64
+}
+
+// Evict removes the least recently used caches, of any repository, until the
+// total size is below MaxSize. Caches in use are kept. It returns the caches
+// removed.
+func (c *Config) Evict() ([]string, error) {
+	evicted := []string{}
+
+	if c.MaxSize == 0 {
+		return evicted, nil
+	}
+
+	scopes, err := filepath.Glob(filepath.Join(c.Dir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		caches []cacheDir
+		total  uint64
+	)
+
+	for _, p := range scopes {
+		fi, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		if !fi.IsDir() || filepath.Ext(p) == ".old" || filepath.Base(filepath.Dir(p)) == workDir {
+			continue
+		}
+
+		size, err := disk.Size(p)
+		if err != nil {
+			return nil, err
+		}
+
+		caches = append(caches, cacheDir{path: p, lastUsed: fi.ModTime(), size: size})
+		total += size
+	}
+
+	sort.Slice(caches, func(i, j int) bool { return caches[i].lastUsed.Before(caches[j].lastUsed) })
+
+	for _, cache := range caches {
+		if total <= c.MaxSize {
+			break
+		}
+
+		lock, err := lockCache(cache.path)
+		if errors.Is(err, flock.ErrLocked) {
+			continue
+		} else if err != nil {
+			return evicted, err
+		}
+
+		// the lock file stays, as another process may be about to lock it
+		err = os.RemoveAll(cache.path)
+		lock.Close()
+		if err != nil {
+			return evicted, err
+		}
+
+		evicted = append(evicted, cache.path)
+		total -= cache.size
+	}
+
+	return evicted, nil
+}
@@ -0,0 +1,175 @@
+// Package netpolicy restricts the network access of jobs, so runners
+// processing untrusted code, such as pull requests from forks, may deny it
+// the network, or only let it reach an allowlist through an egress proxy.
+package netpolicy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// NetworkKey is the task or run metadata key holding the network mode of a
+// run. Runs may only tighten the mode the runner gives them.
+//
+// e.g., {"network": "none"}
+const NetworkKey = "network"
+
+// Network modes, from the loosest to the strictest.
+const (
+	// ModeFull gives jobs the network of the docker daemon.
+	ModeFull = "full"
+	// ModeRestricted puts jobs on an internal network, whose only way out is
+	// the egress proxy of the runner, which enforces its own allowlist.
+	// HTTP_PROXY and HTTPS_PROXY point jobs to it.
+	ModeRestricted = "restricted"
+	// ModeNone denies jobs the network, but for the services of their run.
+	ModeNone = "none"
+)
+
+const (
+	defaultProxyAlias = "proxy"
+	defaultProxyPort  = 3128
+)
+
+var strictness = map[string]int{ModeFull: 0, ModeRestricted: 1, ModeNone: 2}
+
+// Validate errors out when the mode is not one of ModeFull, ModeRestricted
+// or ModeNone.
+func Validate(mode string) error {
+	if _, ok := strictness[mode]; !ok {
+		return fmt.Errorf("invalid network mode %q: must be %v, %v or %v", mode, ModeFull, ModeRestricted, ModeNone)
+	}
+
+	return nil
+}
+
+// Stricter returns the strictest of the modes, which must be valid.
+func Stricter(a, b string) string {
+	if strictness[b] > strictness[a] {
+		return b
+	}
+
+	return a
+}
+
+// Config is the network access the runner gives jobs.
+type Config struct {
+	// Default is the mode of runs. Defaults to "full".
+	Default string `yaml:"default"`
+	// Queues are the modes of runs by queue, in place of the default, e.g.
+	// to isolate the runs of a queue of untrusted repositories.
+	Queues map[string]string `yaml:"queues"`
+	// Forks, if set, is the mode of runs of pull requests from forks, when
+	// stricter than that of their queue.
+	Forks string `yaml:"forks"`
+	// Proxy is the egress proxy of restricted runs, which are refused without
+	// it.
+	Proxy *Proxy `yaml:"proxy"`
+}
+
+// Proxy is an HTTP proxy container which the runner connects to the network
+// of restricted runs, e.g. squid with an allowlist of domains. It must be
+// attached to a network with access to the outside on its own.
+type Proxy struct {
+	// Container is the name or id of the proxy container, on the docker
+	// daemon of the runner.
+	Container string `yaml:"container"`
+	// Alias is the host name of the proxy on the network of runs. Defaults to
+	// "proxy".
+	Alias string `yaml:"alias"`
+	// Port is the port the proxy listens on. Defaults to 3128.
+	Port int `yaml:"port"`
+	// NoProxy are hosts jobs reach without the proxy, besides localhost and
+	// the services of the run; they must be on the network of the run.
+	NoProxy []string `yaml:"no_proxy"`
+}
+
+// URL returns the URL of the proxy, as jobs reach it.
+func (p *Proxy) URL() string {
+	return "http://" + net.JoinHostPort(p.Alias, strconv.Itoa(p.Port))
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	if c.Default == "" {
+		c.Default = ModeFull
+	}
+
+	if err := Validate(c.Default); err != nil {
+		return fmt.Errorf("network default: %w", err)
+	}
+
+	for name, mode := range c.Queues {
+		if err := Validate(mode); err != nil {
+			return fmt.Errorf("network queue %v: %w", name, err)
+		}
+	}
+
+	if c.Forks != "" {
+		if err := Validate(c.Forks); err != nil {
+			return fmt.Errorf("network forks: %w", err)
+		}
+	}
+
+	if c.Proxy != nil {
+		if c.Proxy.Container == "" {
+			return errors.New("network proxy requires a container")
+		}
+
+		if c.Proxy.Alias == "" {
+			c.Proxy.Alias = defaultProxyAlias
+		}
+
+		if c.Proxy.Port == 0 {
+			c.Proxy.Port = defaultProxyPort
+		}
+
+		if c.Proxy.Port < 0 || c.Proxy.Port > 65535 {
+			return fmt.Errorf("invalid network proxy port %d", c.Proxy.Port)
+		}
+	}
+
+	return nil
+}
+
+// Mode returns the mode of runs of the queue, and of forks if fork is set.
+// A nil configuration gives full access.
+func (c *Config) Mode(queue string, fork bool) string {
+	if c == nil {
+		return ModeFull
+	}
+
+	mode := c.Default
+	if m, ok := c.Queues[queue]; ok {
+		mode = m
+	}
+
+	if fork && c.Forks != "" {
+		mode = Stricter(mode, c.Forks)
+	}
+
+	return mode
+}
+
+// FromMetadata returns the mode under NetworkKey in the metadata, or "" if
+// there is none.
+func FromMetadata(md map[string]interface{}) (string, error) {
+	value, ok := md[NetworkKey]
+	if !ok {
+		return "", nil
+	}
+
+	mode, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%v must be a string", NetworkKey)
+	}
+
+	if err := Validate(mode); err != nil {
+		return "", err
+	}
+
+	return mode, nil
+}
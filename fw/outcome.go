@@ -0,0 +1,69 @@
+package fw
+
+// Outcome is the result of a queue item.
+//
+// The queuesvc only records whether a run passed, so the outcome is reported
+// to it as a boolean (see Passed); the outcome itself is logged with the
+// "outcome" field, recorded in the timing trace and counted in the
+// runs_completed metric, so infrastructure failures can be told apart from
+// genuine test failures.
+type Outcome string
+
+// Outcomes of queue items.
+const (
+	// OutcomePassed is a run that succeeded.
+	OutcomePassed Outcome = "passed"
+	// OutcomeFailed is a run that failed.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeCanceled is a run that was canceled by a user.
+	OutcomeCanceled Outcome = "canceled"
+	// OutcomeTimedOut is a run that exceeded its timeout.
+	OutcomeTimedOut Outcome = "timed_out"
+	// OutcomeInfraError is a run that failed due to an infrastructure error
+	// (ErrInfra), after exhausting its retries.
+	OutcomeInfraError Outcome = "infra_error"
+	// OutcomeMergeConflict is a run whose commit could not be combined with
+	// the default branch because they conflict (ErrMergeConflict).
+	OutcomeMergeConflict Outcome = "merge_conflict"
+	// OutcomeLost is a run whose lease was lost, or whose status could not be
+	// reported.
+	OutcomeLost Outcome = "lost"
+	// OutcomeSkipped is a run that was prepared but not executed, as the
+	// runner is in dry-run mode. Dry runs are not reported to the queuesvc;
+	// should it be, it is as a failure, so that it is not mistaken for a
+	// pass.
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeUnaffected is a run that was not executed as it does not apply
+	// to the commit under test (ErrSkipped). It is reported as a pass.
+	OutcomeUnaffected Outcome = "unaffected"
+)
+
+// Passed returns true if the outcome is reported to the queuesvc as a pass.
+func (o Outcome) Passed() bool {
+	return o == OutcomePassed || o == OutcomeUnaffected
+}
+
+// outcome determines the outcome of a run from its status, the error
+// returned by Run, and what the framework knows about it.
+func (e *Entrypoint) outcome(runID int64, status bool, runErr error, canceled bool) Outcome {
+	switch {
+	case !e.hasLease(runID):
+		return OutcomeLost
+	case canceled:
+		return OutcomeCanceled
+	case e.isTimedOut(runID):
+		return OutcomeTimedOut
+	case Classify(runErr) == ErrSkipped:
+		return OutcomeUnaffected
+	case e.dryRun && runErr == nil:
+		return OutcomeSkipped
+	case Classify(runErr) == ErrInfra:
+		return OutcomeInfraError
+	case Classify(runErr) == ErrMergeConflict:
+		return OutcomeMergeConflict
+	case status:
+		return OutcomePassed
+	default:
+		return OutcomeFailed
+	}
+}
@@ -0,0 +1,64 @@
+package fw
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOutcome(t *testing.T) {
+	const (
+		runID     = 1
+		lostID    = 2
+		timeoutID = 3
+	)
+
+	failure := errors.New("failure")
+
+	table := []struct {
+		name     string
+		runID    int64
+		status   bool
+		err      error
+		canceled bool
+		dryRun   bool
+		outcome  Outcome
+	}{
+		{name: "passed", runID: runID, status: true, outcome: OutcomePassed},
+		{name: "failed", runID: runID, outcome: OutcomeFailed},
+		{name: "job error", runID: runID, err: failure, outcome: OutcomeFailed},
+		{name: "infra error", runID: runID, err: Classed(ErrInfra, failure), outcome: OutcomeInfraError},
+		{name: "merge conflict", runID: runID, err: Classed(ErrMergeConflict, failure), outcome: OutcomeMergeConflict},
+		{name: "unaffected", runID: runID, status: true, err: Classed(ErrSkipped, failure), outcome: OutcomeUnaffected},
+		{name: "canceled", runID: runID, err: Classed(ErrInfra, failure), canceled: true, outcome: OutcomeCanceled},
+		{name: "timed out", runID: timeoutID, outcome: OutcomeTimedOut},
+		{name: "canceled before timed out", runID: timeoutID, canceled: true, outcome: OutcomeCanceled},
+		{name: "lost", runID: lostID, status: true, canceled: true, outcome: OutcomeLost},
+		{name: "dry run", runID: runID, status: true, dryRun: true, outcome: OutcomeSkipped},
+		{name: "dry run infra error", runID: runID, err: Classed(ErrInfra, failure), dryRun: true, outcome: OutcomeInfraError},
+		{name: "dry run unaffected", runID: runID, err: Classed(ErrSkipped, failure), dryRun: true, outcome: OutcomeUnaffected},
+	}
+
+	for _, test := range table {
+		e := &Entrypoint{
+			leaseLost: map[int64]bool{lostID: true},
+			timedOut:  map[int64]bool{timeoutID: true},
+			dryRun:    test.dryRun,
+		}
+
+		if outcome := e.outcome(test.runID, test.status, test.err, test.canceled); outcome != test.outcome {
+			t.Fatalf("%v: got outcome %v, want %v", test.name, outcome, test.outcome)
+		}
+	}
+
+	for _, outcome := range []Outcome{OutcomePassed, OutcomeUnaffected} {
+		if !outcome.Passed() {
+			t.Fatalf("outcome %v is not reported as a pass", outcome)
+		}
+	}
+
+	for _, outcome := range []Outcome{OutcomeFailed, OutcomeCanceled, OutcomeTimedOut, OutcomeInfraError, OutcomeMergeConflict, OutcomeLost, OutcomeSkipped} {
+		if outcome.Passed() {
+			t.Fatalf("outcome %v is reported as a pass", outcome)
+		}
+	}
+}
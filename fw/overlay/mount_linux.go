@@ -0,0 +1,19 @@
+package overlay
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+func mountOverlay(lower, upper, work, target string) error {
+	return unix.Mount("overlay", target, "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work))
+}
+
+func mountTmpfs(target string, size int64) error {
+	return unix.Mount("tmpfs", target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, fmt.Sprintf("size=%d,mode=0700", size))
+}
+
+func unmount(target string) error {
+	return unix.Unmount(target, unix.UMOUNT_NOFOLLOW)
+}
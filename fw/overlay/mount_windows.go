@@ -0,0 +1,18 @@
+package overlay
+
+import "errors"
+
+// errUnsupported is returned by mounts, as windows has no overlayfs.
+var errUnsupported = errors.New("overlayfs is not supported on windows")
+
+func mountOverlay(lower, upper, work, target string) error {
+	return errUnsupported
+}
+
+func mountTmpfs(target string, size int64) error {
+	return errUnsupported
+}
+
+func unmount(target string) error {
+	return errUnsupported
+}
@@ -44,19 +44,57 @@
 //		}
 //
 //
+// Set Scratch to place Upper and Work on a dedicated filesystem of limited
+// size, a tmpfs or a loopback image, so whatever writes to Target cannot fill
+// the disk holding them.
+//
 // Your program must have the *CAP_SYS_ADMIN* linux capability (see
 // capabilities(7)) or be root to use this library without permissions issues.
 package overlay
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+)
 
-	"golang.org/x/sys/unix"
+// Types of scratch filesystems.
+const (
+	// ScratchTmpfs keeps the writes in memory, counting against the memory of
+	// the host.
+	ScratchTmpfs = "tmpfs"
+	// ScratchLoop keeps the writes in an ext4 image file, allocated as it is
+	// written to. Requires mkfs.ext4 and mount(8).
+	ScratchLoop = "loop"
 )
 
+// ScratchConfig is the configuration of the filesystem holding the writable
+// layer of a mount.
+type ScratchConfig struct {
+	// Type is the kind of filesystem: "tmpfs" or "loop".
+	Type string `yaml:"type"`
+	// Size is the size of the filesystem, in bytes.
+	Size int64 `yaml:"size"`
+}
+
+// Validate errors out when the configuration doesn't match expectations.
+func (c *ScratchConfig) Validate() error {
+	switch c.Type {
+	case ScratchTmpfs, ScratchLoop:
+	default:
+		return fmt.Errorf("unknown scratch filesystem type %q: must be %q or %q", c.Type, ScratchTmpfs, ScratchLoop)
+	}
+
+	if c.Size <= 0 {
+		return errors.New("scratch filesystem size must be positive")
+	}
+
+	return nil
+}
+
 // Mount is the struct containing the mount information required to establish
 // the union.
 type Mount struct {
@@ -64,10 +102,22 @@ type Mount struct {
 	Work   string
 	Upper  string
 	Target string
+
+	// Scratch, if set, is the filesystem mounted at ScratchDir to hold Upper
+	// and Work, which are then created within it by Mount.
+	Scratch    *ScratchConfig
+	ScratchDir string
 }
 
 func (m *Mount) validate() error {
-	for _, dir := range []string{m.Lower, m.Work, m.Upper, m.Target} {
+	dirs := []string{m.Lower, m.Target}
+	if m.Scratch != nil {
+		dirs = append(dirs, m.ScratchDir)
+	} else {
+		dirs = append(dirs, m.Work, m.Upper)
+	}
+
+	for _, dir := range dirs {
 		if !filepath.IsAbs(dir) {
 			return fmt.Errorf("%q must be an absolute path", dir)
 		}
@@ -81,7 +131,16 @@ func (m *Mount) validate() error {
 
 // Cleanup cleans up the work directories.
 func (m *Mount) Cleanup() error {
-	for _, dir := range []string{m.Work, m.Upper, m.Target} {
+	dirs := []string{m.Work, m.Upper, m.Target}
+	if m.Scratch != nil {
+		dirs = append(dirs, m.ScratchDir, m.scratchImage())
+	}
+
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
 		if err := os.RemoveAll(dir); err != nil {
 			return err
 		}
@@ -90,12 +149,21 @@ func (m *Mount) Cleanup() error {
 	return nil
 }
 
-// Unmount unmounts the overlayfs.
+// Unmount unmounts the overlayfs, and the scratch filesystem if any.
 func (m *Mount) Unmount() error {
 	if err := m.validate(); err != nil {
 		return err
 	}
-	return unix.Unmount(m.Target, unix.UMOUNT_NOFOLLOW)
+
+	if err := unmount(m.Target); err != nil {
+		return err
+	}
+
+	if m.Scratch != nil {
+		return unmount(m.ScratchDir)
+	}
+
+	return nil
 }
 
 // Mount mounts the overlayfs, creating any dirs necessary
@@ -103,5 +171,92 @@ func (m *Mount) Mount() error {
 	if err := m.validate(); err != nil {
 		return err
 	}
-	return unix.Mount("overlay", m.Target, "overlay", 0, fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", m.Lower, m.Upper, m.Work))
+
+	if m.Scratch != nil {
+		if err := m.mountScratch(); err != nil {
+			return fmt.Errorf("mounting scratch filesystem: %w", err)
+		}
+	}
+
+	err := mountOverlay(m.Lower, m.Upper, m.Work, m.Target)
+	if err != nil && m.Scratch != nil {
+		// Unmount will not get past the overlay, so release the scratch now.
+		unmount(m.ScratchDir)
+	}
+
+	return err
+}
+
+// scratchImage is the path of the image file of a loop scratch filesystem.
+// It lives beside ScratchDir, as it cannot be within it.
+func (m *Mount) scratchImage() string {
+	if m.Scratch == nil || m.Scratch.Type != ScratchLoop {
+		return ""
+	}
+
+	return m.ScratchDir + ".img"
+}
+
+// mountScratch mounts the scratch filesystem at ScratchDir, and creates Upper
+// and Work within it.
+func (m *Mount) mountScratch() error {
+	if err := m.Scratch.Validate(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.ScratchDir, 0700); err != nil {
+		return err
+	}
+
+	switch m.Scratch.Type {
+	case ScratchTmpfs:
+		if err := mountTmpfs(m.ScratchDir, m.Scratch.Size); err != nil {
+			return err
+		}
+	case ScratchLoop:
+		if err := m.mountLoop(); err != nil {
+			return err
+		}
+	}
+
+	m.Upper = filepath.Join(m.ScratchDir, "upper")
+	m.Work = filepath.Join(m.ScratchDir, "work")
+
+	for _, dir := range []string{m.Upper, m.Work} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			unmount(m.ScratchDir)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mountLoop creates a sparse ext4 image of the configured size and mounts it
+// at ScratchDir. The loop device is released when it is unmounted.
+func (m *Mount) mountLoop() error {
+	image := m.scratchImage()
+
+	f, err := os.OpenFile(image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(m.Scratch.Size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-m", "0", image).CombinedOutput(); err != nil { // #nosec
+		return fmt.Errorf("mkfs.ext4: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	if out, err := exec.Command("mount", "-o", "loop,nosuid,nodev", image, m.ScratchDir).CombinedOutput(); err != nil { // #nosec
+		return fmt.Errorf("mount: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
 }
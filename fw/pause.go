@@ -0,0 +1,78 @@
+package fw
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// Pause stops the runner from pulling new work until Resume is called. Unlike
+// Drain, pausing is meant to be short-lived, such as while an operator
+// inspects the host, and is not reported as draining.
+func (e *Entrypoint) Pause() {
+	e.terminateMutex.Lock()
+	e.paused = true
+	e.terminateMutex.Unlock()
+}
+
+// Resume resumes pulling new work after a Pause.
+func (e *Entrypoint) Resume() {
+	e.terminateMutex.Lock()
+	e.paused = false
+	e.terminateMutex.Unlock()
+}
+
+func (e *Entrypoint) getPaused() bool {
+	e.terminateMutex.RLock()
+	defer e.terminateMutex.RUnlock()
+
+	return e.paused
+}
+
+// CancelRun cancels the run with the given ID, if it is in flight on this
+// runner. The cancellation is recorded in the queuesvc, so the run is reported
+// as canceled like any other.
+func (e *Entrypoint) CancelRun(ctx context.Context, runID int64) error {
+	var runs []*fwcontext.RunContext
+
+	e.runMapMutex.RLock()
+	for _, runnerCtx := range e.runMap {
+		if runnerCtx.QueueItem.Run.Id == runID {
+			runs = append(runs, runnerCtx)
+		}
+	}
+	e.runMapMutex.RUnlock()
+
+	if len(runs) == 0 {
+		return fmt.Errorf("run %d is not in flight on this runner", runID)
+	}
+
+	if err := e.Launch.QueueClient().SetCancel(ctx, runID); err != nil {
+		return fmt.Errorf("canceling run %d: %w", runID, err)
+	}
+
+	e.Launch.LogsvcClient(runs[0]).Info(ctx, "Run canceled by an operator")
+
+	for _, runnerCtx := range runs {
+		if runnerCtx.CancelFunc != nil {
+			runnerCtx.CancelFunc()
+		}
+	}
+
+	return nil
+}
+
+func parseRunID(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("a run id is required")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid run id %q", args[0])
+	}
+
+	return id, nil
+}
@@ -0,0 +1,53 @@
+package fw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Signals of the entrypoint: SIGINT and SIGTERM cancel the runs and exit,
+// SIGHUP drains the runner, SIGUSR2 undrains it and SIGUSR1 reloads it.
+var (
+	shutdownSignals           = []os.Signal{unix.SIGINT, unix.SIGTERM}
+	drainSignal     os.Signal = unix.SIGHUP
+	undrainSignal   os.Signal = unix.SIGUSR2
+	reloadSignal    os.Signal = unix.SIGUSR1
+)
+
+// processAlive returns true if the process of the pid exists.
+func processAlive(pid int) bool {
+	return unix.Kill(pid, 0) == nil
+}
+
+// processStart returns the boot id of the system and the start time of the
+// process, in clock ticks since boot, which together tell it apart from any
+// process reusing its pid.
+func processStart(pid int) (string, error) {
+	bootID, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", err
+	}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+
+	// the command name may contain spaces and parentheses; the fields after
+	// it start with the state, the third field.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return "", fmt.Errorf("malformed stat of process %d", pid)
+	}
+
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return "", fmt.Errorf("malformed stat of process %d", pid)
+	}
+
+	return strings.TrimSpace(string(bootID)) + ":" + fields[19], nil
+}
@@ -0,0 +1,46 @@
+package fw
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// Signals of the entrypoint: Ctrl-C and the close, logoff and shutdown events
+// of the console cancel the runs and exit. Windows has no signals to drain or
+// reload the runner; restart it instead.
+var (
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+	drainSignal, undrainSignal, reloadSignal os.Signal
+)
+
+// processAlive returns true if the process of the pid exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+
+	return true
+}
+
+// processStart returns the creation time of the process, which tells it
+// apart from any process reusing its pid.
+func processStart(pid int) (string, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(h)
+
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(creation.Nanoseconds(), 10), nil
+}
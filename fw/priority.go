@@ -0,0 +1,212 @@
+package fw
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/journal"
+	"github.com/tinyci/ci-runners/fw/retry"
+)
+
+// Decision is the verdict of a Prioritizer on a queue item.
+type Decision int
+
+const (
+	// Accept starts the queue item now.
+	Accept Decision = iota
+	// Defer sets the queue item aside to be considered again later.
+	Defer
+	// Reject reports the queue item as failed without running it.
+	Reject
+)
+
+// Prioritizer is implemented by runners which decide, based on local
+// conditions, whether to run a queue item now. For example, a runner on an
+// untrusted host may reject privileged runs, or a runner may defer runs with
+// large resource requirements during business hours.
+//
+// The queuesvc cannot take a queue item back once it has been handed out, so
+// deferred items are held by the runner, and recorded in the state journal if
+// any. They are considered again, in the order they were deferred, before any
+// new work is pulled; new work is not pulled while as many items are deferred
+// as the runner may run concurrently. Deferred items which are canceled are
+// dropped. Those still deferred when the runner exits, or crashes, are left
+// in the state journal for the next runner process to consider again;
+// without a journal, they are reported as infrastructure errors on exit.
+type Prioritizer interface {
+	Runner
+
+	// Prioritize returns the decision for the queue item and a human-readable
+	// reason for it, which is logged.
+	Prioritize(*types.QueueItem) (Decision, string)
+}
+
+// prioritize returns the decision on the queue item: that of the repository
+// policy, the labels and the resource quota first, then that of the runner.
+func (e *Entrypoint) prioritize(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext) Decision {
+	decision, reason := e.checkRepositories(runnerCtx.QueueItem)
+	if decision == Accept {
+		decision, reason = e.checkLabels(runnerCtx.QueueItem)
+	}
+
+	if decision == Accept {
+		decision, reason = e.checkQuota(runner, runnerCtx.QueueItem)
+	}
+
+	if p, ok := runner.(Prioritizer); ok && decision == Accept {
+		err := protect(func() error {
+			decision, reason = p.Prioritize(runnerCtx.QueueItem)
+			return nil
+		})
+		if err != nil {
+			runner.LogsvcClient(runnerCtx).Errorf(ctx, "Prioritize %v", err)
+			return Defer
+		}
+	}
+
+	switch decision {
+	case Defer:
+		runner.LogsvcClient(runnerCtx).Infof(ctx, "Deferring run: %v", reason)
+	case Reject:
+		runner.LogsvcClient(runnerCtx).Errorf(ctx, "Rejecting run: %v", reason)
+	}
+
+	return decision
+}
+
+// admit decides whether a newly pulled queue item should be started now,
+// deferring or rejecting it otherwise.
+func (e *Entrypoint) admit(ctx context.Context, baseContext *fwcontext.Context, runner Runner, qi *types.QueueItem) bool {
+	runnerCtx := &fwcontext.RunContext{Context: baseContext, QueueItem: qi, Start: time.Now()}
+
+	switch e.prioritize(ctx, runner, runnerCtx) {
+	case Defer:
+		e.runMapMutex.Lock()
+		e.deferred = append(e.deferred, qi)
+		e.runMapMutex.Unlock()
+		e.journalDefer(ctx, runner, runnerCtx)
+		return false
+	case Reject:
+		e.reportStatus(ctx, runner, runnerCtx, false, nil)
+		return false
+	}
+
+	return true
+}
+
+// journalDefer records the queue item as deferred in the state journal, if
+// any. Starting the run replaces the entry.
+func (e *Entrypoint) journalDefer(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext) {
+	err := e.journal.Add(&journal.Entry{
+		Start:     runnerCtx.Start,
+		PID:       os.Getpid(),
+		ProcStart: ownProcessStart(),
+		Deferred:  true,
+		QueueItem: runnerCtx.QueueItem,
+	})
+	if err != nil {
+		runner.LogsvcClient(runnerCtx).Errorf(ctx, "Could not record deferred run in state journal: %v", err)
+	}
+}
+
+// takeDeferred considers the deferred queue items again, returning the first
+// one that may be started now, if any.
+func (e *Entrypoint) takeDeferred(ctx context.Context, baseContext *fwcontext.Context, runner Runner) *types.QueueItem {
+	e.runMapMutex.RLock()
+	deferred := append([]*types.QueueItem{}, e.deferred...)
+	e.runMapMutex.RUnlock()
+
+	for _, qi := range deferred {
+		runnerCtx := &fwcontext.RunContext{Context: baseContext, QueueItem: qi, Start: time.Now()}
+
+		if canceled, err := runner.QueueClient().GetCancel(ctx, qi.Run.Id); err == nil && canceled {
+			runner.LogsvcClient(runnerCtx).Info(ctx, "Deferred run was canceled; dropping it")
+			e.removeDeferred(qi)
+			e.journalRemove(ctx, runner, runnerCtx)
+			continue
+		}
+
+		switch e.prioritize(ctx, runner, runnerCtx) {
+		case Accept:
+			e.removeDeferred(qi)
+			return qi
+		case Reject:
+			e.removeDeferred(qi)
+			e.reportStatus(ctx, runner, runnerCtx, false, nil)
+			e.journalRemove(ctx, runner, runnerCtx)
+		}
+	}
+
+	return nil
+}
+
+func (e *Entrypoint) removeDeferred(qi *types.QueueItem) {
+	e.runMapMutex.Lock()
+	defer e.runMapMutex.Unlock()
+
+	for i, item := range e.deferred {
+		if item == qi {
+			e.deferred = append(e.deferred[:i], e.deferred[i+1:]...)
+			return
+		}
+	}
+}
+
+// deferredFull returns true if no more queue items may be deferred.
+func (e *Entrypoint) deferredFull(runner Runner) bool {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return len(e.deferred) >= e.maxConcurrentRuns(runner)
+}
+
+// takeAllDeferred empties the deferred queue items, returning them. The
+// caller must hold runMapMutex.
+func (e *Entrypoint) takeAllDeferred() []*types.QueueItem {
+	deferred := e.deferred
+	e.deferred = nil
+	return deferred
+}
+
+// handOverDeferred disposes of the deferred queue items as the runner exits.
+// They are left in the state journal, if any, for the next runner process to
+// consider again. Without one, they are reported as infrastructure errors, as
+// they were never executed. It takes no lock, so that it may be called while
+// the runner shuts down.
+func (e *Entrypoint) handOverDeferred(ctx context.Context, baseContext *fwcontext.Context, runner Runner, deferred []*types.QueueItem) {
+	for _, qi := range deferred {
+		runnerCtx := &fwcontext.RunContext{Context: baseContext, QueueItem: qi, Start: time.Now()}
+		runLogger := runner.LogsvcClient(runnerCtx)
+
+		if e.journal != nil {
+			runLogger.Info(ctx, "Runner is exiting with the run still deferred; leaving it in the state journal for the next runner process")
+			continue
+		}
+
+		if e.dryRun {
+			e.recordOutcome(ctx, runner, runnerCtx, OutcomeSkipped)
+			continue
+		}
+
+		runLogger.Error(ctx, "Runner is exiting with the run still deferred; reporting an infrastructure error")
+
+		outcome := OutcomeInfraError
+
+		err := retry.Do(ctx, queueRetry(runLogger, "Status report"), func(ctx context.Context) error {
+			if err := queueError(runner.QueueClient().SetStatus(ctx, qi.Run.Id, false)); err != nil && !errors.Is(err, ErrStatusAlreadySet) {
+				return err
+			}
+
+			return nil
+		})
+		if err != nil {
+			runLogger.Errorf(ctx, "Could not report status: %v", err)
+			outcome = OutcomeLost
+		}
+
+		e.recordOutcome(ctx, runner, runnerCtx, outcome)
+	}
+}
@@ -0,0 +1,145 @@
+package fw
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"github.com/tinyci/ci-runners/fw/config"
+	"github.com/tinyci/ci-runners/fw/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// queueScheduler decides the order in which queues are polled, using smooth
+// weighted round robin: over time each queue is polled first in proportion
+// to its weight, without long streaks of the same queue.
+type queueScheduler struct {
+	queues  []config.QueueConfig
+	current []int
+	mutex   sync.Mutex
+}
+
+// newQueueScheduler schedules the queues of the runner, or only dryRunQueue if
+// set.
+func newQueueScheduler(runner Runner, dryRunQueue string) *queueScheduler {
+	if dryRunQueue != "" {
+		return scheduleQueues([]config.QueueConfig{{Name: dryRunQueue}})
+	}
+
+	queues := runner.FrameworkConfig().Queues
+	if len(queues) == 0 {
+		queues = []config.QueueConfig{{Name: runner.QueueName()}}
+	}
+
+	return scheduleQueues(queues)
+}
+
+// scheduleQueues schedules the queues, defaulting their weights to 1.
+func scheduleQueues(queues []config.QueueConfig) *queueScheduler {
+	qs := &queueScheduler{current: make([]int, len(queues))}
+
+	for _, q := range queues {
+		if q.Weight <= 0 {
+			q.Weight = 1
+		}
+
+		qs.queues = append(qs.queues, q)
+	}
+
+	return qs
+}
+
+// order returns the names of the queues in the order they should be polled
+// for the next queue item.
+func (qs *queueScheduler) order() []string {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+
+	var total, best int
+
+	for i, q := range qs.queues {
+		qs.current[i] += q.Weight
+		total += q.Weight
+
+		if qs.current[i] > qs.current[best] {
+			best = i
+		}
+	}
+
+	qs.current[best] -= total
+
+	// the remaining queues are polled in queue order, in case the chosen queue
+	// is empty.
+	names := []string{qs.queues[best].Name}
+	for i, q := range qs.queues {
+		if i != best {
+			names = append(names, q.Name)
+		}
+	}
+
+	return names
+}
+
+// nextQueueItem polls the queues of the runner for the next queue item. A
+// NotFound error is returned if all of them are empty.
+func (e *Entrypoint) nextQueueItem(ctx context.Context, runner Runner) (*types.QueueItem, error) {
+	var err error
+
+	e.runMapMutex.RLock()
+	queues := e.queues
+	e.runMapMutex.RUnlock()
+
+	order := queues.order()
+	timeout := e.pollTimeout(runner, len(order))
+
+	for _, name := range order {
+		var qi *types.QueueItem
+
+		pollCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			pollCtx, cancel = longPollContext(ctx, timeout)
+		}
+
+		start := time.Now()
+		qi, err = runner.QueueClient().NextQueueItem(pollCtx, name, runner.Hostname())
+		cancel()
+		metrics.QueuePollDuration.Observe(metrics.Since(start), name)
+		err = e.longPollResult(ctx, runner, timeout, time.Since(start), err)
+		e.setQueueErr(err)
+
+		if err == nil {
+			if qi.QueueName == "" {
+				qi.QueueName = name
+			}
+
+			return qi, nil
+		}
+
+		if stat, ok := status.FromError(err); !ok || stat.Code() != codes.NotFound {
+			return nil, queueError(err)
+		}
+	}
+
+	return nil, err
+}
+
+// setQueueErr records the result of the last poll of the queuesvc. NotFound
+// errors mean the queue was empty, not that the queuesvc is unreachable.
+func (e *Entrypoint) setQueueErr(err error) {
+	if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+		err = nil
+	}
+
+	e.runMapMutex.Lock()
+	defer e.runMapMutex.Unlock()
+	e.queueErr = err
+}
+
+// getQueueErr returns the error from the last poll of the queuesvc.
+func (e *Entrypoint) getQueueErr() error {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return e.queueErr
+}
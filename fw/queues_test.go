@@ -0,0 +1,91 @@
+package fw
+
+import (
+	"testing"
+
+	"github.com/tinyci/ci-runners/fw/config"
+)
+
+func TestQueueSchedulerOrder(t *testing.T) {
+	table := []struct {
+		name   string
+		queues []config.QueueConfig
+		// polls is the amount of times each queue is polled first over a
+		// full round, i.e. the sum of the weights.
+		polls map[string]int
+		// streak is the longest run of the same queue polled first, across
+		// rounds.
+		streak int
+	}{
+		{
+			name:   "single",
+			queues: []config.QueueConfig{{Name: "default"}},
+			polls:  map[string]int{"default": 1},
+			streak: 1,
+		},
+		{
+			name:   "equal weights",
+			queues: []config.QueueConfig{{Name: "a", Weight: 2}, {Name: "b", Weight: 2}},
+			polls:  map[string]int{"a": 2, "b": 2},
+			streak: 1,
+		},
+		{
+			name:   "weighted",
+			queues: []config.QueueConfig{{Name: "a", Weight: 5}, {Name: "b", Weight: 1}, {Name: "c", Weight: 1}},
+			polls:  map[string]int{"a": 5, "b": 1, "c": 1},
+			// a a b a c a a, so a spans rounds 4 times in a row, rather than
+			// 5 in a row for polling queues in turn by weight
+			streak: 4,
+		},
+		{
+			name:   "default weights",
+			queues: []config.QueueConfig{{Name: "a", Weight: 0}, {Name: "b", Weight: -3}, {Name: "c", Weight: 2}},
+			polls:  map[string]int{"a": 1, "b": 1, "c": 2},
+			// c a b c
+			streak: 2,
+		},
+	}
+
+	for _, test := range table {
+		qs := scheduleQueues(test.queues)
+
+		var total int
+		for _, q := range qs.queues {
+			total += q.Weight
+		}
+
+		// several rounds, as the schedule repeats every round
+		polls := map[string]int{}
+		var last string
+		var streak, longest int
+
+		for i := 0; i < 3*total; i++ {
+			order := qs.order()
+			if len(order) != len(test.queues) {
+				t.Fatalf("%v: order %v does not list all queues", test.name, order)
+			}
+
+			polls[order[0]]++
+
+			if order[0] == last {
+				streak++
+			} else {
+				last, streak = order[0], 1
+			}
+
+			if streak > longest {
+				longest = streak
+			}
+		}
+
+		for name, count := range test.polls {
+			if polls[name] != 3*count {
+				t.Fatalf("%v: %v was polled first %d times in 3 rounds, want %d", test.name, name, polls[name], 3*count)
+			}
+		}
+
+		if longest > test.streak && len(test.queues) > 1 {
+			t.Fatalf("%v: a queue was polled first %d times in a row, want at most %d", test.name, longest, test.streak)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package fw
+
+import (
+	"fmt"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	"github.com/tinyci/ci-runners/fw/config"
+)
+
+// checkQuota decides whether the queue item fits in the capacity of the host
+// (see config.Capacity) given the resources of the runs in flight. Items which
+// could never fit are rejected; those which do not fit now are deferred until
+// runs complete.
+func (e *Entrypoint) checkQuota(runner Runner, qi *types.QueueItem) (Decision, string) {
+	capacity := runner.FrameworkConfig().Capacity
+	if capacity == nil {
+		return Accept, ""
+	}
+
+	requested, err := config.ParseResources(qi.GetRun().GetSettings().GetResources())
+	if err != nil {
+		return Reject, err.Error()
+	}
+
+	if !requested.Fits(capacity.Resources()) {
+		return Reject, fmt.Sprintf("requested resources (%v) exceed the capacity of the host (%v)", requested, capacity.Resources())
+	}
+
+	e.runMapMutex.RLock()
+	used := e.quotaUsed
+	e.runMapMutex.RUnlock()
+
+	if !requested.Add(used).Fits(capacity.Resources()) {
+		return Defer, fmt.Sprintf("requested resources (%v) exceed the remaining capacity of the host (%v in use)", requested, used)
+	}
+
+	return Accept, ""
+}
+
+// reserveQuota accounts for the resources of the queue item until the
+// returned func is called.
+func (e *Entrypoint) reserveQuota(runner Runner, qi *types.QueueItem) func() {
+	if runner.FrameworkConfig().Capacity == nil {
+		return func() {}
+	}
+
+	requested, err := config.ParseResources(qi.GetRun().GetSettings().GetResources())
+	if err != nil {
+		return func() {}
+	}
+
+	e.runMapMutex.Lock()
+	e.quotaUsed = e.quotaUsed.Add(requested)
+	e.runMapMutex.Unlock()
+
+	return func() {
+		e.runMapMutex.Lock()
+		e.quotaUsed = e.quotaUsed.Sub(requested)
+		e.runMapMutex.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package fw
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/config"
+)
+
+// tokenBucket limits the rate at which queue items are pulled. A nil
+// *tokenBucket is unlimited.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// newTokenBucket creates a bucket from the configuration, starting full. It
+// returns nil if no rate limit is configured.
+func newTokenBucket(rl config.RateLimitConfig) *tokenBucket {
+	if rl.RunsPerMinute <= 0 {
+		return nil
+	}
+
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rl.RunsPerMinute / 60, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes a token, returning false if none are available.
+func (tb *tokenBucket) take() bool {
+	if tb == nil {
+		return true
+	}
+
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	tb.last = now
+
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+
+	if tb.tokens < 1 {
+		return false
+	}
+
+	tb.tokens--
+	return true
+}
+
+// refund returns a token which was taken but not used.
+func (tb *tokenBucket) refund() {
+	if tb == nil {
+		return
+	}
+
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if tb.tokens++; tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+func (e *Entrypoint) rateLimiter() *tokenBucket {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return e.limiter
+}
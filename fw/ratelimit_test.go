@@ -0,0 +1,59 @@
+package fw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if tb := newTokenBucket(config.RateLimitConfig{}); tb != nil || !tb.take() {
+		t.Fatal("a bucket without a rate does not leave pulls unlimited")
+	}
+
+	tb := newTokenBucket(config.RateLimitConfig{RunsPerMinute: 60, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if !tb.take() {
+			t.Fatalf("token %d of the burst was not available", i)
+		}
+	}
+
+	if tb.take() {
+		t.Fatal("token available past the burst")
+	}
+
+	// a token is added every second
+	tb.last = tb.last.Add(-time.Second)
+
+	if !tb.take() {
+		t.Fatal("token was not refilled")
+	}
+
+	// refunds do not fill the bucket past its burst
+	for i := 0; i < 5; i++ {
+		tb.refund()
+	}
+
+	if tb.tokens != tb.burst {
+		t.Fatalf("bucket holds %v tokens after refunds, want its burst of %v", tb.tokens, tb.burst)
+	}
+
+	// nor does the time passing
+	tb.last = tb.last.Add(-time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if !tb.take() {
+			t.Fatalf("token %d of the burst was not available", i)
+		}
+	}
+
+	if tb.take() {
+		t.Fatal("token available past the burst after an hour")
+	}
+
+	if tb := newTokenBucket(config.RateLimitConfig{RunsPerMinute: 1}); tb.burst != 1 {
+		t.Fatalf("burst defaults to %v, want 1", tb.burst)
+	}
+}
@@ -0,0 +1,203 @@
+package fw
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/journal"
+	"github.com/tinyci/ci-runners/fw/trace"
+)
+
+// RecoveringRunner is implemented by runners which can re-attach to runs left
+// in flight by a previous runner process that crashed. Recovered runs take a
+// slot like any other, ahead of new work, and time out as they would have
+// from their original start.
+type RecoveringRunner interface {
+	Runner
+
+	// Recover re-attaches to the run and returns its status once it completes.
+	// If an error is returned, the run is reported as failed.
+	Recover(*fwcontext.RunContext) (bool, error)
+}
+
+var (
+	ownStart     string
+	ownStartOnce sync.Once
+)
+
+// ownProcessStart returns the start of this process, as recorded in the
+// journal entries it writes.
+func ownProcessStart() string {
+	ownStartOnce.Do(func() {
+		ownStart, _ = processStart(os.Getpid())
+	})
+
+	return ownStart
+}
+
+// ownedElsewhere returns true if the journal entry was written by a process
+// other than this one which is still running. The pid alone is not enough, as
+// it may have been reused since; entries written before the start of
+// processes was recorded are trusted on the pid.
+func ownedElsewhere(entry *journal.Entry) bool {
+	if entry.PID == os.Getpid() || !processAlive(entry.PID) {
+		return false
+	}
+
+	if entry.ProcStart == "" {
+		return true
+	}
+
+	start, err := processStart(entry.PID)
+	return err == nil && start == entry.ProcStart
+}
+
+func (e *Entrypoint) openJournal(runner Runner) error {
+	dir := runner.FrameworkConfig().StateDir
+	if dir == "" {
+		return nil
+	}
+
+	var err error
+	e.journal, err = journal.Open(dir)
+	return err
+}
+
+func (e *Entrypoint) journalAdd(ctx context.Context, runner Runner, name string, runnerCtx *fwcontext.RunContext) {
+	err := e.journal.Add(&journal.Entry{
+		Name:      name,
+		Start:     runnerCtx.Start,
+		PID:       os.Getpid(),
+		ProcStart: ownProcessStart(),
+		QueueItem: runnerCtx.QueueItem,
+	})
+	if err != nil {
+		runner.LogsvcClient(runnerCtx).Errorf(ctx, "Could not record run in state journal: %v", err)
+	}
+}
+
+func (e *Entrypoint) journalRemove(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext) {
+	if err := e.journal.Remove(runnerCtx.QueueItem.Run.Id); err != nil {
+		runner.LogsvcClient(runnerCtx).Errorf(ctx, "Could not remove run from state journal: %v", err)
+	}
+}
+
+// recoverRuns handles runs recorded in the journal by a previous process.
+// Runs are recovered by the runner if it supports it, as slots become free;
+// otherwise they are reported as failed, so they do not stay running forever.
+// Queue items it had deferred are deferred again.
+func (e *Entrypoint) recoverRuns(ctx context.Context, baseContext *fwcontext.Context, runner Runner) error {
+	entries, err := e.journal.List()
+	if err != nil {
+		return err
+	}
+
+	log := runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext})
+
+	for _, entry := range entries {
+		if ownedElsewhere(entry) {
+			log.Errorf(ctx, "Run %d in state journal belongs to running process %d; skipping", entry.QueueItem.Run.Id, entry.PID)
+			continue
+		}
+
+		if entry.Deferred {
+			runnerCtx := &fwcontext.RunContext{Context: baseContext, QueueItem: entry.QueueItem, Start: entry.Start}
+			runner.LogsvcClient(runnerCtx).Info(ctx, "Deferring run left deferred by a previous runner process")
+
+			e.runMapMutex.Lock()
+			e.deferred = append(e.deferred, entry.QueueItem)
+			e.runMapMutex.Unlock()
+			e.journalDefer(ctx, runner, runnerCtx)
+			continue
+		}
+
+		if _, ok := runner.(RecoveringRunner); !ok {
+			go e.reportLost(ctx, runner, entry, recoveredContext(baseContext, entry))
+			continue
+		}
+
+		e.runMapMutex.Lock()
+		e.recovering = append(e.recovering, entry)
+		e.runMapMutex.Unlock()
+	}
+
+	return nil
+}
+
+// recoveredContext returns the run context of a run recorded in the journal,
+// started when the run was. Its Ctx is left to the caller.
+func recoveredContext(baseContext *fwcontext.Context, entry *journal.Entry) *fwcontext.RunContext {
+	return &fwcontext.RunContext{
+		Context:   baseContext,
+		QueueItem: entry.QueueItem,
+		Start:     entry.Start,
+		Trace:     trace.New(entry.QueueItem.Run.Id),
+	}
+}
+
+// reportLost reports the run recorded in the journal as failed, as the runner
+// cannot recover it.
+func (e *Entrypoint) reportLost(ctx context.Context, runner Runner, entry *journal.Entry, runnerCtx *fwcontext.RunContext) {
+	runnerCtx.Ctx, runnerCtx.CancelFunc = context.WithCancel(context.Background())
+	defer runnerCtx.CancelFunc()
+
+	runner.LogsvcClient(runnerCtx).Errorf(ctx, "Run %v was interrupted by a runner crash; reporting failure", entry.Name)
+	e.reportStatus(ctx, runner, runnerCtx, false, nil)
+	e.journalRemove(ctx, runner, runnerCtx)
+}
+
+// hasRecovering returns true if runs left by a previous runner process are
+// waiting for a slot to be recovered.
+func (e *Entrypoint) hasRecovering() bool {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return len(e.recovering) != 0
+}
+
+// startRecovered starts recovering the next run left by a previous runner
+// process. The caller must hold a slot, which is released by the run when it
+// completes. The timeout of the run is counted from its original start.
+func (e *Entrypoint) startRecovered(ctx context.Context, baseContext *fwcontext.Context, runner Runner) {
+	e.runMapMutex.Lock()
+	entry := e.recovering[0]
+	e.recovering = e.recovering[1:]
+	e.runMapMutex.Unlock()
+
+	runnerCtx := recoveredContext(baseContext, entry)
+	stopTimeout := e.startTimeout(ctx, runner, runnerCtx)
+
+	go func() {
+		defer e.releaseSlot()
+		defer stopTimeout()
+
+		e.recoverRun(ctx, runner.(RecoveringRunner), entry, runnerCtx)
+	}()
+}
+
+func (e *Entrypoint) recoverRun(ctx context.Context, runner RecoveringRunner, entry *journal.Entry, runnerCtx *fwcontext.RunContext) {
+	defer runnerCtx.CancelFunc()
+
+	runLogger := runner.LogsvcClient(runnerCtx)
+
+	runLogger.Infof(ctx, "Recovering run %v interrupted by a runner crash", entry.Name)
+	e.watchCancel(runnerCtx)
+	defer e.startHeartbeat(runner, runnerCtx)()
+
+	var status bool
+
+	err := protect(func() (err error) {
+		status, err = runner.Recover(runnerCtx)
+		return err
+	})
+	if err != nil {
+		runLogger.Errorf(ctx, "Could not recover run %v; reporting failure: %v", entry.Name, err)
+		status = false
+	}
+
+	runLogger.Infof(ctx, "Recovered run finished in %v", time.Since(runnerCtx.Start))
+	e.reportStatus(ctx, runner, runnerCtx, status, nil)
+	e.journalRemove(ctx, runner, runnerCtx)
+}
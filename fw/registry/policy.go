@@ -0,0 +1,42 @@
+package registry
+
+import "fmt"
+
+// PullPolicy decides when images are pulled before they are used.
+type PullPolicy string
+
+// Pull policies. Images pinned by digest are immutable, so they are only
+// pulled when not present, whatever the policy.
+const (
+	// PullAlways pulls images each time they are used, so tags follow the
+	// registry. It is the default.
+	PullAlways PullPolicy = "always"
+	// PullIfNotPresent only pulls images which are not present locally.
+	PullIfNotPresent PullPolicy = "if-not-present"
+	// PullNever never pulls images; they must have been pulled beforehand,
+	// as on hosts with pre-baked images.
+	PullNever PullPolicy = "never"
+)
+
+// Validate corrects or errors out when the policy isn't known.
+func (p *PullPolicy) Validate() error {
+	switch *p {
+	case "":
+		*p = PullAlways
+	case PullAlways, PullIfNotPresent, PullNever:
+	default:
+		return fmt.Errorf("invalid pull policy %q: must be one of %v, %v or %v", *p, PullAlways, PullIfNotPresent, PullNever)
+	}
+
+	return nil
+}
+
+// Pull returns true if an image which is, or is not, present locally should
+// be pulled.
+func (p PullPolicy) Pull(ref string, present bool) bool {
+	if present {
+		return p == PullAlways && !HasDigest(ref)
+	}
+
+	return p != PullNever
+}
@@ -0,0 +1,150 @@
+// Package registry normalizes docker image references and redirects their
+// pulls to mirrors, so installs without access to the public registries can
+// pull from their own.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultRegistry is the registry of references which do not name one,
+	// as with docker itself.
+	DefaultRegistry = "docker.io"
+	// officialNamespace holds the images of DefaultRegistry referenced by a
+	// single name, e.g. "golang".
+	officialNamespace = "library"
+	defaultTag        = "latest"
+)
+
+// Config configures how image references are resolved.
+type Config struct {
+	// Default is the registry of references which do not name one. Defaults
+	// to docker.io.
+	Default string `yaml:"default"`
+	// Mirrors are the mirrors of each registry, tried in order before the
+	// registry itself, e.g. {"docker.io": ["mirror.internal:5000"]}.
+	Mirrors map[string][]string `yaml:"mirrors"`
+	// MirrorsOnly, if set, never falls back to the registries themselves when
+	// they have mirrors, as when they cannot be reached.
+	MirrorsOnly bool `yaml:"mirrors_only"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	if c.Default == "" {
+		c.Default = DefaultRegistry
+	}
+
+	if strings.Contains(c.Default, "/") {
+		return fmt.Errorf("invalid default registry %q: must be a host name", c.Default)
+	}
+
+	for registry, mirrors := range c.Mirrors {
+		if len(mirrors) == 0 {
+			return fmt.Errorf("registry %v: no mirrors", registry)
+		}
+
+		for _, mirror := range mirrors {
+			if mirror == "" || strings.Contains(mirror, "/") {
+				return fmt.Errorf("registry %v: invalid mirror %q: must be a host name", registry, mirror)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Normalize returns the fully qualified form of the reference, naming its
+// registry and tag, e.g. "golang" is "docker.io/library/golang:latest". A nil
+// config resolves references as docker does.
+func (c *Config) Normalize(ref string) (string, error) {
+	if ref == "" {
+		return "", errors.New("empty image reference")
+	}
+
+	domain, remainder := c.split(ref)
+
+	if domain == DefaultRegistry && !strings.Contains(remainder, "/") {
+		remainder = officialNamespace + "/" + remainder
+	}
+
+	if !hasTagOrDigest(remainder) {
+		remainder += ":" + defaultTag
+	}
+
+	return domain + "/" + remainder, nil
+}
+
+// Candidates returns the references to pull the image from in order: the
+// reference redirected to each mirror of its registry, then the reference
+// itself unless MirrorsOnly is set.
+func (c *Config) Candidates(ref string) ([]string, error) {
+	normalized, err := c.Normalize(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return []string{normalized}, nil
+	}
+
+	domain, remainder := c.split(normalized)
+	mirrors := c.Mirrors[domain]
+
+	candidates := []string{}
+	for _, mirror := range mirrors {
+		candidates = append(candidates, mirror+"/"+remainder)
+	}
+
+	if len(mirrors) == 0 || !c.MirrorsOnly {
+		candidates = append(candidates, normalized)
+	}
+
+	return candidates, nil
+}
+
+// split returns the registry of the reference and the rest of it. As with
+// docker, the first component of the reference is a registry if it looks
+// like a host name: it holds a dot or a port, or is localhost.
+func (c *Config) split(ref string) (string, string) {
+	def := DefaultRegistry
+	if c != nil && c.Default != "" {
+		def = c.Default
+	}
+
+	i := strings.IndexRune(ref, '/')
+	if i == -1 {
+		return def, ref
+	}
+
+	first := ref[:i]
+	if !strings.ContainsAny(first, ".:") && first != "localhost" && strings.ToLower(first) == first {
+		return def, ref
+	}
+
+	// docker's own aliases of the hub
+	if first == "index.docker.io" {
+		first = DefaultRegistry
+	}
+
+	return first, ref[i+1:]
+}
+
+func hasTagOrDigest(remainder string) bool {
+	if strings.Contains(remainder, "@") {
+		return true
+	}
+
+	last := remainder[strings.LastIndex(remainder, "/")+1:]
+	return strings.Contains(last, ":")
+}
+
+// HasDigest returns true if the reference pins the image by digest, e.g.
+// "golang@sha256:...", so it always resolves to the same image.
+func HasDigest(ref string) bool {
+	return strings.Contains(ref, "@")
+}
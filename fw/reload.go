@@ -0,0 +1,50 @@
+package fw
+
+import (
+	"context"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// Reloader is implemented by runners which can reload their configuration
+// without restarting, which is done on SIGUSR1.
+type Reloader interface {
+	Runner
+
+	// Reload loads and validates the configuration, rebuilding any clients,
+	// and swaps it in only if it is valid. In-flight runs must not be
+	// interrupted. If an error is returned, the previous configuration stays
+	// in use.
+	Reload(*fwcontext.Context) error
+}
+
+// reload reloads the configuration of the runner, if it supports it. The
+// queues polled and the rate limit are updated; settings of the framework's
+// listeners and state directory only apply after a restart.
+func (e *Entrypoint) reload(baseContext *fwcontext.Context, runner Runner) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rl, ok := runner.(Reloader)
+	if !ok {
+		runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext}).Error(ctx, "Runner does not support reloading its configuration; restart it instead")
+		return
+	}
+
+	if err := protect(func() error { return rl.Reload(baseContext) }); err != nil {
+		runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext}).Errorf(ctx, "Could not reload configuration; keeping the current one: %v", err)
+		return
+	}
+
+	queues := newQueueScheduler(runner, e.dryRunQueue)
+	limiter := newTokenBucket(runner.FrameworkConfig().RateLimit)
+
+	e.runMapMutex.Lock()
+	e.queues = queues
+	e.limiter = limiter
+	e.runMapMutex.Unlock()
+
+	// log with the new client, in case logsvc settings changed
+	runner.LogsvcClient(&fwcontext.RunContext{Context: baseContext}).Info(ctx, "Configuration reloaded")
+}
@@ -0,0 +1,409 @@
+// Package reports reads the test reports a run leaves in its workspace, JUnit
+// XML or the output of go test -json, into a summary of the tests run, so
+// failures can be reported without digging through the job log.
+package reports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReportsKey is the task or run metadata key holding the paths of the test
+// reports of a run, as a list of patterns relative to the workspace, in the
+// syntax of path.Match.
+//
+// e.g., {"reports": ["build/test-results/*/*.xml", "test.json"]}
+const ReportsKey = "reports"
+
+const (
+	// maxFailures bounds the failures listed in a summary.
+	maxFailures = 50
+	// maxReportSize bounds the size of a report file which is read.
+	maxReportSize = 64 * 1024 * 1024
+)
+
+// Failure is a test which failed.
+type Failure struct {
+	Name    string `json:"name"`
+	Suite   string `json:"suite,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Summary is the outcome of the tests of a run.
+type Summary struct {
+	Total    int           `json:"total"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Duration time.Duration `json:"duration"`
+	// Failures are the failed tests, up to a limit; Failed has the count.
+	Failures []Failure `json:"failures,omitempty"`
+	// Files are the report files read, relative to the workspace.
+	Files []string `json:"files"`
+}
+
+// Patterns returns the patterns under ReportsKey in the metadata, if any.
+func Patterns(md map[string]interface{}) ([]string, error) {
+	value, ok := md[ReportsKey]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a list of patterns", ReportsKey)
+	}
+
+	patterns := []string{}
+
+	for _, item := range list {
+		pattern, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a list of patterns", ReportsKey)
+		}
+
+		clean := path.Clean(pattern)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("invalid report pattern %q: must be relative to the workspace", pattern)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid report pattern %q: %w", pattern, err)
+		}
+
+		patterns = append(patterns, clean)
+	}
+
+	return patterns, nil
+}
+
+// Collect reads the reports matching the patterns under root. Files which
+// are neither JUnit XML nor go test -json output are skipped. It returns nil
+// if no reports were found.
+func Collect(root string, patterns []string) (*Summary, error) {
+	var (
+		summary *Summary
+		seen    = map[string]bool{}
+	)
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			if seen[match] {
+				continue
+			}
+			seen[match] = true
+
+			s, err := parseFile(root, match)
+			if errors.Is(err, errUnknownFormat) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			if summary == nil {
+				summary = &Summary{Files: []string{}}
+			}
+			summary.add(s)
+		}
+	}
+
+	return summary, nil
+}
+
+var errUnknownFormat = errors.New("unknown report format")
+
+func parseFile(root, name string) (*Summary, error) {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the run controls the workspace; do not follow it out of there
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return nil, err
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+		return nil, errUnknownFormat
+	}
+
+	fi, err := os.Lstat(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, errUnknownFormat
+	}
+
+	if fi.Size() > maxReportSize {
+		return nil, fmt.Errorf("report %v is larger than %d bytes", rel, maxReportSize)
+	}
+
+	f, err := os.Open(resolved) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := Parse(f)
+	if err != nil {
+		if errors.Is(err, errUnknownFormat) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("parsing report %v: %w", rel, err)
+	}
+
+	s.Files = []string{filepath.ToSlash(rel)}
+	return s, nil
+}
+
+// Parse reads a report, in JUnit XML or go test -json format.
+func Parse(r io.Reader) (*Summary, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(1)
+	if err == io.EOF {
+		return nil, errUnknownFormat
+	} else if err != nil {
+		return nil, err
+	}
+
+	for len(head) == 1 && (head[0] == ' ' || head[0] == '\t' || head[0] == '\r' || head[0] == '\n') {
+		br.ReadByte()
+		if head, err = br.Peek(1); err != nil {
+			return nil, errUnknownFormat
+		}
+	}
+
+	switch head[0] {
+	case '<':
+		return parseJUnit(br)
+	case '{':
+		return parseGoTest(br)
+	default:
+		return nil, errUnknownFormat
+	}
+}
+
+type junitSuites struct {
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+func parseJUnit(r io.Reader) (*Summary, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var root struct {
+		XMLName xml.Name
+	}
+
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	var suites []junitSuite
+
+	switch root.XMLName.Local {
+	case "testsuites":
+		var ts junitSuites
+		if err := xml.Unmarshal(data, &ts); err != nil {
+			return nil, err
+		}
+		suites = ts.Suites
+	case "testsuite":
+		var suite junitSuite
+		if err := xml.Unmarshal(data, &suite); err != nil {
+			return nil, err
+		}
+		suites = []junitSuite{suite}
+	default:
+		return nil, errUnknownFormat
+	}
+
+	s := &Summary{}
+	for _, suite := range suites {
+		s.addSuite(suite)
+	}
+
+	return s, nil
+}
+
+func (s *Summary) addSuite(suite junitSuite) {
+	for _, nested := range suite.Suites {
+		s.addSuite(nested)
+	}
+
+	for _, tc := range suite.Cases {
+		s.Total++
+
+		// times are in seconds, as decimals
+		if secs, err := strconv.ParseFloat(tc.Time, 64); err == nil {
+			s.Duration += time.Duration(secs * float64(time.Second))
+		}
+
+		failure := tc.Failure
+		if failure == nil {
+			failure = tc.Error
+		}
+
+		switch {
+		case failure != nil:
+			suiteName := tc.Classname
+			if suiteName == "" {
+				suiteName = suite.Name
+			}
+
+			s.fail(Failure{Name: tc.Name, Suite: suiteName, Message: failure.Message})
+		case tc.Skipped != nil:
+			s.Skipped++
+		default:
+			s.Passed++
+		}
+	}
+}
+
+// goTestEvent is a line of go test -json output; see go doc test2json.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+}
+
+func parseGoTest(r io.Reader) (*Summary, error) {
+	s := &Summary{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var event goTestEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, err
+		}
+
+		if event.Test == "" {
+			// package results carry the time of the whole package
+			if event.Action == "pass" || event.Action == "fail" {
+				s.Duration += time.Duration(event.Elapsed * float64(time.Second))
+			}
+			continue
+		}
+
+		switch event.Action {
+		case "pass":
+			s.Total++
+			s.Passed++
+		case "fail":
+			s.Total++
+			s.fail(Failure{Name: event.Test, Suite: event.Package})
+		case "skip":
+			s.Total++
+			s.Skipped++
+		}
+	}
+
+	return s, scanner.Err()
+}
+
+func (s *Summary) fail(f Failure) {
+	s.Failed++
+
+	if len(s.Failures) < maxFailures {
+		s.Failures = append(s.Failures, f)
+	}
+}
+
+func (s *Summary) add(other *Summary) {
+	s.Total += other.Total
+	s.Passed += other.Passed
+	s.Failed += other.Failed
+	s.Skipped += other.Skipped
+	s.Duration += other.Duration
+	s.Files = append(s.Files, other.Files...)
+
+	for _, f := range other.Failures {
+		if len(s.Failures) < maxFailures {
+			s.Failures = append(s.Failures, f)
+		}
+	}
+
+	sort.Strings(s.Files)
+}
+
+// String summarizes the tests for the job log, listing the failures.
+func (s *Summary) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Tests: %d total, %d passed, %d failed, %d skipped in %v", s.Total, s.Passed, s.Failed, s.Skipped, s.Duration.Round(time.Millisecond))
+
+	for _, f := range s.Failures {
+		name := f.Name
+		if f.Suite != "" {
+			name = f.Suite + ": " + name
+		}
+
+		if f.Message != "" {
+			fmt.Fprintf(&b, "\n  FAIL %v: %v", name, f.Message)
+		} else {
+			fmt.Fprintf(&b, "\n  FAIL %v", name)
+		}
+	}
+
+	if more := s.Failed - len(s.Failures); more > 0 {
+		fmt.Fprintf(&b, "\n  ... and %d more", more)
+	}
+
+	return b.String()
+}
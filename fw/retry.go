@@ -0,0 +1,129 @@
+package fw
+
+import (
+	"context"
+	"time"
+
+	"github.com/tinyci/ci-agents/clients/log"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/retry"
+)
+
+// queueRetryAttempts is the amount of times calls to the queuesvc which must
+// not be lost, such as status reports, are made before giving up. With the
+// default backoff this rides out an outage of several minutes.
+const queueRetryAttempts = 10
+
+// queueRetry is the retry policy of calls to the queuesvc which must not be
+// lost. Each failure is logged, prefixed with what was being done.
+func queueRetry(logger *log.SubLogger, what string) retry.Policy {
+	return retry.Policy{
+		Attempts: queueRetryAttempts,
+		OnError: func(err error, delay time.Duration) {
+			logger.Errorf(context.Background(), "%s resulted in error, retrying in %v: %v", what, delay.Round(time.Millisecond), err)
+		},
+	}
+}
+
+// Retryable marks err as a transient infrastructure failure, such as a failed
+// image pull, rather than a failure of the job itself; it is the same as
+// Classed(ErrInfra, err). If Run returns such an error the framework makes and
+// executes the run again, following the retry policy in the configuration,
+// before any failure is reported.
+func Retryable(err error) error {
+	return Classed(ErrInfra, err)
+}
+
+// IsRetryable returns true if err is classified as ErrInfra.
+func IsRetryable(err error) bool {
+	return Classify(err) == ErrInfra
+}
+
+// runAttempts executes the run, remaking and executing it again with a fresh
+// context if it fails with a retryable error and the retry policy allows it.
+// Each attempt is registered in the run map while it executes, and its
+// context is canceled once it completes. The contexts of retries are derived
+// from parent. The context, status and error of the last attempt executed are
+// returned, as its context holds what the run recorded, such as its exit and
+// test report.
+func (e *Entrypoint) runAttempts(ctx, parent context.Context, runner Runner, runName string, run Run) (last *fwcontext.RunContext, status bool, runErr, err error) {
+	policy := runner.FrameworkConfig().Retry
+
+	for attempt := 1; ; attempt++ {
+		runnerCtx := run.RunContext()
+		last = runnerCtx
+
+		e.runMapMutex.Lock()
+		e.runMap[run] = runnerCtx
+		e.runMapMutex.Unlock()
+
+		status, runErr, err = e.execute(ctx, runner, run)
+		runnerCtx.CancelFunc()
+
+		e.runMapMutex.Lock()
+		delete(e.runMap, run)
+		e.runMapMutex.Unlock()
+
+		if err != nil || attempt >= policy.MaxAttempts || !e.shouldRetry(ctx, runner, runnerCtx, runErr) {
+			return last, status, runErr, err
+		}
+
+		delay := policy.Backoff.Delay(attempt - 1)
+		runner.LogsvcClient(runnerCtx).Infof(ctx, "Attempt %d of %d failed with a retryable error; retrying in %v", attempt, policy.MaxAttempts, delay)
+
+		select {
+		case <-ctx.Done():
+			return last, status, runErr, nil
+		case <-time.After(delay):
+		}
+
+		runnerCtx = retryContext(parent, runnerCtx)
+		if runnerCtx.Cell == nil {
+			e.watchCancel(runnerCtx)
+		}
+
+		err = protect(func() (err error) {
+			run, err = runner.MakeRun(runName, runnerCtx)
+			return err
+		})
+		if err != nil {
+			runnerCtx.CancelFunc()
+			runner.LogsvcClient(runnerCtx).Errorf(ctx, "Could not remake run for retry: %v", err)
+			return last, false, runErr, nil
+		}
+	}
+}
+
+// shouldRetry returns true if the run failed with a retryable error, and was
+// neither canceled nor timed out, and its lease is still held.
+func (e *Entrypoint) shouldRetry(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext, runErr error) bool {
+	if !e.hasLease(runnerCtx.QueueItem.Run.Id) || !IsRetryable(runErr) {
+		return false
+	}
+
+	if e.isTimedOut(runnerCtx.QueueItem.Run.Id) {
+		return false
+	}
+
+	canceled, err := runner.QueueClient().GetCancel(ctx, runnerCtx.QueueItem.Run.Id)
+	return err == nil && !canceled
+}
+
+// retryContext returns a copy of the run context for another attempt. The
+// context of the previous attempt has usually been canceled by the run, so a
+// new one is made from parent. The timeout of the run does not come with it:
+// startTimeout enforces it with timers rather than a deadline, terminating or
+// canceling each attempt in the run map when they fire, and runs which timed
+// out are not retried. Only a deadline set on the previous context by other
+// means is kept.
+func retryContext(parent context.Context, runnerCtx *fwcontext.RunContext) *fwcontext.RunContext {
+	retryCtx := *runnerCtx
+
+	if deadline, ok := runnerCtx.Ctx.Deadline(); ok {
+		retryCtx.Ctx, retryCtx.CancelFunc = context.WithDeadline(parent, deadline)
+	} else {
+		retryCtx.Ctx, retryCtx.CancelFunc = context.WithCancel(parent)
+	}
+
+	return &retryCtx
+}
@@ -0,0 +1,83 @@
+// Package retry retries calls to flaky services, such as the queuesvc or
+// docker, with backoff. Retries stop when the context is done, so a partial
+// outage cannot keep a caller spinning forever.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/config"
+)
+
+// permanentError stops retries.
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe *permanentError) Unwrap() error {
+	return pe.err
+}
+
+// Permanent marks an error which should not be retried. Do returns the
+// underlying error.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// Policy is how a call is retried.
+type Policy struct {
+	// Attempts is the amount of times the call is made before giving up. If
+	// zero, the call is retried until the context is done.
+	Attempts int
+	// Backoff controls the delay between attempts.
+	Backoff config.PollConfig
+	// OnError, if set, is called with each error which will be retried, and
+	// the delay before the next attempt. It is typically used for logging.
+	OnError func(err error, delay time.Duration)
+}
+
+// Do calls fn until it succeeds, returns a Permanent error, the attempts of
+// the policy are exhausted, or ctx is done. The last error is returned.
+func Do(ctx context.Context, policy Policy, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var pe *permanentError
+		if errors.As(err, &pe) {
+			return pe.err
+		}
+
+		if policy.Attempts > 0 && attempt >= policy.Attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		delay := policy.Backoff.Delay(attempt - 1)
+
+		if policy.OnError != nil {
+			policy.OnError(err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%v: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package runenv describes runs to their jobs through environment variables,
+// and expands references to them in the environment of tasks and runs, so
+// jobs can use build metadata without parsing logs.
+package runenv
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+)
+
+// Environment variables describing the run, as returned by Vars.
+const (
+	EnvSHA      = "TINYCI_SHA"
+	EnvBranch   = "TINYCI_BRANCH"
+	EnvRepo     = "TINYCI_REPO"
+	EnvHeadRepo = "TINYCI_HEAD_REPO"
+	EnvRunID    = "TINYCI_RUN_ID"
+	EnvRunName  = "TINYCI_RUN_NAME"
+	EnvTaskID   = "TINYCI_TASK_ID"
+	EnvQueue    = "TINYCI_QUEUE"
+	EnvRunner   = "TINYCI_RUNNER"
+)
+
+// Vars returns the variables describing the run of the queue item, run by
+// the runner of the host name: the commit and branch under test, from the
+// head of the submission and its repository, the repository it is submitted
+// to, which differs for pull requests from forks, and the ids of the run and
+// its task.
+func Vars(qi *types.QueueItem, hostname string) map[string]string {
+	sub := qi.Run.Task.Submission
+
+	return map[string]string{
+		EnvSHA:      sub.HeadRef.Sha,
+		EnvBranch:   sub.HeadRef.RefName,
+		EnvRepo:     sub.BaseRef.Repository.Name,
+		EnvHeadRepo: sub.HeadRef.Repository.Name,
+		EnvRunID:    strconv.FormatInt(qi.Run.Id, 10),
+		EnvRunName:  qi.Run.Name,
+		EnvTaskID:   strconv.FormatInt(qi.Run.Task.Id, 10),
+		EnvQueue:    qi.QueueName,
+		EnvRunner:   hostname,
+	}
+}
+
+// Env returns the variables as environment variables, sorted by name.
+func Env(vars map[string]string) []string {
+	env := []string{}
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+
+	sort.Strings(env)
+
+	return env
+}
+
+// Expand replaces the references to the variables, as ${NAME}, in the values
+// of the environment variables. References to other names are left as they
+// are, as are $NAME references, so values meant for a shell keep working.
+// $${NAME} is a literal ${NAME}.
+func Expand(env []string, vars map[string]string) []string {
+	expanded := make([]string, 0, len(env))
+
+	for _, e := range env {
+		i := strings.IndexByte(e, '=')
+		if i == -1 {
+			expanded = append(expanded, e)
+			continue
+		}
+
+		expanded = append(expanded, e[:i+1]+expand(e[i+1:], vars))
+	}
+
+	return expanded
+}
+
+func expand(s string, vars map[string]string) string {
+	var b strings.Builder
+
+	for {
+		i := strings.Index(s, "${")
+		if i == -1 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		if i > 0 && s[i-1] == '$' {
+			// escaped: drop the first $ and keep the reference
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end += i
+
+		b.WriteString(s[:i])
+
+		if value, ok := vars[s[i+2:end]]; ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(s[i : end+1])
+		}
+
+		s = s[end+1:]
+	}
+}
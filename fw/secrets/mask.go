@@ -0,0 +1,118 @@
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Mask replaces secret values in the job log.
+const Mask = "***"
+
+// Masker is a writer replacing the values of secrets with Mask before
+// passing on what is written to it. As a value may be split between writes,
+// the end of a write which could start a value is held back until the next
+// one, or Flush.
+type Masker struct {
+	w      io.Writer
+	values [][]byte
+	mutex  sync.Mutex
+	held   []byte
+}
+
+// NewMasker returns a Masker of the values writing to w. Empty values are
+// ignored.
+func NewMasker(w io.Writer, values []string) *Masker {
+	m := &Masker{w: w}
+
+	for _, v := range values {
+		if v != "" {
+			m.values = append(m.values, []byte(v))
+		}
+	}
+
+	// the longest first, should a value contain another
+	sort.Slice(m.values, func(i, j int) bool { return len(m.values[i]) > len(m.values[j]) })
+
+	return m
+}
+
+func (m *Masker) Write(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out, held := m.mask(append(m.held, p...), false)
+	m.held = append([]byte(nil), held...)
+
+	if _, err := m.w.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Flush writes what is held back.
+func (m *Masker) Flush() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.held) == 0 {
+		return nil
+	}
+
+	out, _ := m.mask(m.held, true)
+	m.held = nil
+
+	_, err := m.w.Write(out)
+	return err
+}
+
+// mask returns buf with the values replaced by Mask. Unless final, the end
+// of buf from the first position which could start a value, cut short by the
+// end of buf, is returned apart, to be masked along with the next write. This
+// holds back the start of a value even if a shorter value it begins with is
+// complete, lest the rest of the longer one be written unmasked.
+func (m *Masker) mask(buf []byte, final bool) ([]byte, []byte) {
+	out := make([]byte, 0, len(buf))
+
+	for i := 0; i < len(buf); {
+		if !final && m.partial(buf[i:]) {
+			return out, buf[i:]
+		}
+
+		if n := m.match(buf[i:]); n != 0 {
+			out = append(out, Mask...)
+			i += n
+			continue
+		}
+
+		out = append(out, buf[i])
+		i++
+	}
+
+	return out, nil
+}
+
+// match returns the length of the longest value buf starts with, or 0.
+func (m *Masker) match(buf []byte) int {
+	// values are sorted longest first
+	for _, v := range m.values {
+		if bytes.HasPrefix(buf, v) {
+			return len(v)
+		}
+	}
+
+	return 0
+}
+
+// partial returns true if buf is the start of a value, but not all of it.
+func (m *Masker) partial(buf []byte) bool {
+	for _, v := range m.values {
+		if len(buf) < len(v) && bytes.HasPrefix(v, buf) {
+			return true
+		}
+	}
+
+	return false
+}
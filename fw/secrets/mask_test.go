@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMasker(t *testing.T) {
+	table := []struct {
+		name   string
+		values []string
+		writes []string
+		// held is what is written before Flush
+		held   string
+		output string
+	}{
+		{
+			name:   "whole value",
+			values: []string{"hunter2"},
+			writes: []string{"password: hunter2\n"},
+			held:   "password: ***\n",
+			output: "password: ***\n",
+		},
+		{
+			name:   "split between writes",
+			values: []string{"hunter2"},
+			writes: []string{"password: hun", "ter2\n"},
+			held:   "password: ***\n",
+			output: "password: ***\n",
+		},
+		{
+			name:   "split into single bytes",
+			values: []string{"hunter2"},
+			writes: []string{"h", "u", "n", "t", "e", "r", "2", "!"},
+			held:   "***!",
+			output: "***!",
+		},
+		{
+			name:   "partial value at the end",
+			values: []string{"hunter2"},
+			writes: []string{"hunt", "er"},
+			held:   "",
+			output: "hunter",
+		},
+		{
+			name:   "partial value resolved",
+			values: []string{"hunter2"},
+			writes: []string{"hunt", "ing"},
+			held:   "hunting",
+			output: "hunting",
+		},
+		{
+			name:   "value containing another",
+			values: []string{"abc", "abcdef"},
+			writes: []string{"xabcd", "efy abc"},
+			held:   "x***y ",
+			output: "x***y ***",
+		},
+		{
+			name:   "value repeating its start",
+			values: []string{"abab"},
+			writes: []string{"xab", "ab"},
+			held:   "x***",
+			output: "x***",
+		},
+		{
+			name:   "several values",
+			values: []string{"one", "two"},
+			writes: []string{"one t", "wo three"},
+			held:   "*** *** three",
+			output: "*** *** three",
+		},
+		{
+			name:   "empty values ignored",
+			values: []string{""},
+			writes: []string{"nothing to hide"},
+			held:   "nothing to hide",
+			output: "nothing to hide",
+		},
+	}
+
+	for _, test := range table {
+		buf := &bytes.Buffer{}
+		m := NewMasker(buf, test.values)
+
+		for _, w := range test.writes {
+			n, err := m.Write([]byte(w))
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+
+			if n != len(w) {
+				t.Fatalf("%v: wrote %d bytes of %d", test.name, n, len(w))
+			}
+		}
+
+		if buf.String() != test.held {
+			t.Fatalf("%v: before flush: got %q, want %q", test.name, buf.String(), test.held)
+		}
+
+		if err := m.Flush(); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		if buf.String() != test.output {
+			t.Fatalf("%v: got %q, want %q", test.name, buf.String(), test.output)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Package secrets hands the secrets of repositories, such as deploy tokens,
+// to their runs, and keeps them out of job logs.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultFilesTarget = "/run/secrets"
+
+var (
+	validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	validRepo = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+)
+
+// Config configures the secrets store: a directory holding a YAML file per
+// repository, <owner>/<repo>.yml, mapping the names of its secrets to their
+// values, or a path in Vault holding a secret per repository.
+//
+// e.g., /etc/tinyci/secrets/tinyci/ci-runners.yml: {"DEPLOY_TOKEN": "..."}
+type Config struct {
+	// Dir holds the secrets. It should only be readable by the runner.
+	Dir string `yaml:"dir"`
+	// VaultPath, if set, is the path of the secrets of each repository in
+	// Vault instead, where {repo} is replaced by its owner/repo name, e.g.
+	// "tinyci/repos/{repo}". Which repositories the runner may read is up
+	// to its Vault policies.
+	VaultPath string `yaml:"vault_path"`
+	// Forks, if set, also hands secrets to runs of pull requests from forks,
+	// whose authors may not be trusted with them.
+	Forks bool `yaml:"forks"`
+	// FilesTarget is the directory secrets are also mounted in as files, in
+	// the container. Defaults to /run/secrets.
+	FilesTarget string `yaml:"files_target"`
+
+	// Vault reads the secrets under VaultPath. It must be set by the runner.
+	Vault Reader `yaml:"-"`
+}
+
+// Reader reads secrets from a store such as Vault, as a map of names to
+// values.
+type Reader interface {
+	Read(path string) (map[string]string, error)
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (c *Config) Validate() error {
+	if c.VaultPath != "" {
+		if !strings.Contains(c.VaultPath, "{repo}") {
+			return errors.New("secrets vault_path must contain {repo}")
+		}
+	} else if !filepath.IsAbs(c.Dir) {
+		return errors.New("secrets dir must be absolute")
+	}
+
+	if c.FilesTarget == "" {
+		c.FilesTarget = defaultFilesTarget
+	}
+
+	if !filepath.IsAbs(c.FilesTarget) {
+		return errors.New("secrets files_target must be absolute")
+	}
+
+	return nil
+}
+
+// Secret is a named secret value.
+type Secret struct {
+	Name  string
+	Value string
+}
+
+// Load returns the secrets of the repository, named owner/repo, sorted by
+// name. Repositories without a file, or secret in Vault, have none.
+func (c *Config) Load(repo string) ([]Secret, error) {
+	if !validRepo.MatchString(repo) || strings.Contains(repo, "..") {
+		return nil, fmt.Errorf("invalid repository name %q", repo)
+	}
+
+	m, err := c.read(repo)
+	if err != nil {
+		return nil, fmt.Errorf("secrets of %v: %w", repo, err)
+	}
+
+	secrets := []Secret{}
+
+	for name, value := range m {
+		if !validName.MatchString(name) {
+			return nil, fmt.Errorf("secrets of %v: invalid name %q: must be an environment variable name", repo, name)
+		}
+
+		secrets = append(secrets, Secret{Name: name, Value: value})
+	}
+
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+
+	return secrets, nil
+}
+
+func (c *Config) read(repo string) (map[string]string, error) {
+	if c.VaultPath != "" {
+		if c.Vault == nil {
+			return nil, errors.New("vault is not configured")
+		}
+
+		return c.Vault.Read(strings.ReplaceAll(c.VaultPath, "{repo}", repo))
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(c.Dir, filepath.FromSlash(repo)+".yml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := map[string]string{}
+	if err := yaml.Unmarshal(content, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Env returns the secrets as environment variables.
+func Env(secrets []Secret) []string {
+	env := []string{}
+	for _, s := range secrets {
+		env = append(env, s.Name+"="+s.Value)
+	}
+
+	return env
+}
+
+// WriteFiles writes each secret to a file of its name in dir, readable by
+// any user of the container.
+func WriteFiles(dir string, secrets []Secret) error {
+	for _, s := range secrets {
+		if err := ioutil.WriteFile(filepath.Join(dir, s.Name), []byte(s.Value), 0444); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Values returns the values of the secrets, to mask.
+func Values(secrets []Secret) []string {
+	values := []string{}
+	for _, s := range secrets {
+		values = append(values, s.Value)
+	}
+
+	return values
+}
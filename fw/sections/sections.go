@@ -0,0 +1,69 @@
+// Package sections marks sections of job logs, such as the clone of the
+// repository or each step, which the tinyCI UI renders as collapsible.
+//
+// Sections are delimited by markers, which are OSC escape sequences, so
+// terminals and plain-text viewers of the log ignore them:
+//
+//	ESC ] tinyci;section_start;<unix time>;<id>;<title> BEL
+//	ESC ] tinyci;section_end;<unix time>;<id> BEL
+//
+// The id is made of letters, digits, '.', '_' and '-', and ends the section
+// of the same id; sections may nest. The title is free text, without control
+// characters. Ids starting with "tinyci-" are those of the runner.
+//
+// Jobs may mark their own sections, e.g. from a shell:
+//
+//	printf '\033]tinyci;section_start;%d;deps;Installing dependencies\007' "$(date +%s)"
+//	make deps
+//	printf '\033]tinyci;section_end;%d;deps\007' "$(date +%s)"
+package sections
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RunnerPrefix starts the ids of the sections of the runner.
+const RunnerPrefix = "tinyci-"
+
+var (
+	unsafeID    = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+	controlChar = regexp.MustCompile(`[\x00-\x1f\x7f]`)
+)
+
+// ID returns the id made safe for a marker.
+func ID(id string) string {
+	return unsafeID.ReplaceAllString(id, "_")
+}
+
+// StartMarker returns the marker starting the section of the id and title.
+func StartMarker(id, title string) string {
+	return fmt.Sprintf("\x1b]tinyci;section_start;%d;%v;%v\x07", time.Now().Unix(), ID(id), controlChar.ReplaceAllString(title, " "))
+}
+
+// EndMarker returns the marker ending the section of the id.
+func EndMarker(id string) string {
+	return fmt.Sprintf("\x1b]tinyci;section_end;%d;%v\x07", time.Now().Unix(), ID(id))
+}
+
+// Start writes the marker starting the section to w, and returns a func
+// writing the marker ending it.
+func Start(w io.Writer, id, title string) func() {
+	io.WriteString(w, StartMarker(id, title))
+
+	return func() {
+		io.WriteString(w, EndMarker(id))
+	}
+}
+
+// Runner starts a section of the runner, prefixing its id with RunnerPrefix.
+func Runner(w io.Writer, id, title string) func() {
+	if !strings.HasPrefix(id, RunnerPrefix) {
+		id = RunnerPrefix + id
+	}
+
+	return Start(w, id, title)
+}
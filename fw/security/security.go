@@ -0,0 +1,226 @@
+// Package security configures the confinement of the containers of runs:
+// their seccomp and AppArmor profiles, capabilities, root filesystem and
+// user. Runs may tighten the configuration of the runner, never loosen it.
+package security
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SecurityKey is the task or run metadata key tightening the security of the
+// container of a run, as a map which may hold capabilities to add, among
+// those the runner allows, and to drop, whether the root filesystem is
+// read-only, whether processes may gain privileges, and the user to run as,
+// unless the runner sets one.
+//
+// e.g., {"security": {"cap_drop": ["ALL"], "read_only_rootfs": true,
+// "no_new_privileges": true, "user": "1000:1000"}}
+const SecurityKey = "security"
+
+// Config is the security configuration of the containers of runs. It does
+// not apply to privileged runs, which docker does not confine.
+type Config struct {
+	// SeccompProfile is a file holding the seccomp profile of containers, as
+	// JSON, or "unconfined". Defaults to that of docker.
+	SeccompProfile string `yaml:"seccomp_profile"`
+	// AppArmorProfile is the AppArmor profile of containers, which must be
+	// loaded on the host. Defaults to that of docker.
+	AppArmorProfile string `yaml:"apparmor_profile"`
+	// CapAdd and CapDrop are the capabilities added to, and dropped from,
+	// those docker grants, e.g. "NET_ADMIN" or "ALL".
+	CapAdd  []string `yaml:"cap_add"`
+	CapDrop []string `yaml:"cap_drop"`
+	// AllowCapAdd are the capabilities runs may add besides CapAdd.
+	AllowCapAdd []string `yaml:"allow_cap_add"`
+	// ReadOnlyRootfs mounts the root filesystem of containers read-only, with
+	// a tmpfs on /tmp. The workspace and caches are mounted as usual.
+	ReadOnlyRootfs bool `yaml:"read_only_rootfs"`
+	// NoNewPrivileges keeps the processes of containers from gaining
+	// privileges, e.g. through setuid binaries.
+	NoNewPrivileges bool `yaml:"no_new_privileges"`
+	// User is the user, and optionally group, jobs run as, as a name or
+	// uid[:gid]. Defaults to that of the image, which runs may then set.
+	User string `yaml:"user"`
+	// UsernsMode is the user namespace mode of containers: "host" opts out of
+	// the user namespace remapping of the docker daemon, if enabled.
+	UsernsMode string `yaml:"userns_mode"`
+
+	seccomp string
+}
+
+// Validate loads the seccomp profile, and errors out when the configuration
+// doesn't match expectations.
+func (c *Config) Validate() error {
+	switch c.SeccompProfile {
+	case "":
+	case "unconfined":
+		c.seccomp = c.SeccompProfile
+	default:
+		content, err := ioutil.ReadFile(c.SeccompProfile)
+		if err != nil {
+			return fmt.Errorf("reading seccomp profile: %w", err)
+		}
+		c.seccomp = string(content)
+	}
+
+	if c.UsernsMode != "" && c.UsernsMode != "host" {
+		return fmt.Errorf("invalid userns_mode %q: only \"host\" is supported", c.UsernsMode)
+	}
+
+	for _, list := range [][]string{c.CapAdd, c.CapDrop, c.AllowCapAdd} {
+		for _, capability := range list {
+			if strings.TrimSpace(capability) == "" {
+				return errors.New("capabilities must not be empty")
+			}
+		}
+	}
+
+	return nil
+}
+
+// SecurityOpt returns the security options of containers, as docker takes
+// them.
+func (c *Config) SecurityOpt() []string {
+	opts := []string{}
+
+	if c.seccomp != "" {
+		opts = append(opts, "seccomp="+c.seccomp)
+	}
+
+	if c.AppArmorProfile != "" {
+		opts = append(opts, "apparmor="+c.AppArmorProfile)
+	}
+
+	if c.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges:true")
+	}
+
+	return opts
+}
+
+// Options are the security options a run asks for.
+type Options struct {
+	CapAdd          []string
+	CapDrop         []string
+	ReadOnlyRootfs  bool
+	NoNewPrivileges bool
+	User            string
+}
+
+// FromMetadata returns the options under SecurityKey in the metadata, if
+// any.
+func FromMetadata(md map[string]interface{}) (*Options, error) {
+	value, ok := md[SecurityKey]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a map", SecurityKey)
+	}
+
+	var (
+		opts Options
+		err  error
+	)
+
+	if opts.CapAdd, err = stringList(m, "cap_add"); err != nil {
+		return nil, err
+	}
+
+	if opts.CapDrop, err = stringList(m, "cap_drop"); err != nil {
+		return nil, err
+	}
+
+	for _, field := range []struct {
+		key    string
+		target *bool
+	}{
+		{"read_only_rootfs", &opts.ReadOnlyRootfs},
+		{"no_new_privileges", &opts.NoNewPrivileges},
+	} {
+		if value, ok := m[field.key]; ok {
+			if *field.target, ok = value.(bool); !ok {
+				return nil, fmt.Errorf("%v.%v must be a boolean", SecurityKey, field.key)
+			}
+		}
+	}
+
+	if value, ok := m["user"]; ok {
+		if opts.User, ok = value.(string); !ok || opts.User == "" {
+			return nil, fmt.Errorf("%v.user must be a non-empty string", SecurityKey)
+		}
+	}
+
+	return &opts, nil
+}
+
+func stringList(m map[string]interface{}, key string) ([]string, error) {
+	value, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v.%v must be a list of strings", SecurityKey, key)
+	}
+
+	res := []string{}
+
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("%v.%v must be a list of strings", SecurityKey, key)
+		}
+
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+// Apply returns the configuration tightened by the options of a run, which
+// may be nil. Runs adding capabilities the runner does not allow, or setting
+// a user when the runner sets one, are refused.
+func (c Config) Apply(opts *Options) (Config, error) {
+	if opts == nil {
+		return c, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, capability := range append(append([]string{}, c.CapAdd...), c.AllowCapAdd...) {
+		allowed[normalizeCap(capability)] = true
+	}
+
+	for _, capability := range opts.CapAdd {
+		if !allowed[normalizeCap(capability)] {
+			return c, fmt.Errorf("capability %v may not be added: the runner does not allow it", capability)
+		}
+	}
+
+	if opts.User != "" && c.User != "" && opts.User != c.User {
+		return c, fmt.Errorf("user may not be set: the runner runs jobs as %v", c.User)
+	}
+
+	c.CapAdd = append(append([]string{}, c.CapAdd...), opts.CapAdd...)
+	c.CapDrop = append(append([]string{}, c.CapDrop...), opts.CapDrop...)
+	c.ReadOnlyRootfs = c.ReadOnlyRootfs || opts.ReadOnlyRootfs
+	c.NoNewPrivileges = c.NoNewPrivileges || opts.NoNewPrivileges
+
+	if opts.User != "" {
+		c.User = opts.User
+	}
+
+	return c, nil
+}
+
+// normalizeCap returns the capability as docker spells it, e.g. NET_ADMIN
+// for cap_net_admin.
+func normalizeCap(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
@@ -0,0 +1,124 @@
+// Package services reads the service containers of a run, such as databases,
+// started alongside it for integration tests.
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ServicesKey is the task or run metadata key holding the services of a run,
+// as a list of services with a name, which is also their host name, an image,
+// and optionally environment variables, a command in execv() form and a
+// health check command. Services are ready once their health check, or that
+// of their image, passes.
+//
+// e.g., {"services": [{"name": "db", "image": "postgres:13",
+// "env": ["POSTGRES_PASSWORD=test"], "healthcheck": ["pg_isready"]}]}
+const ServicesKey = "services"
+
+// validName is a DNS label, so the name may be used as a host name.
+var validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Service is a container started for a run.
+type Service struct {
+	Name        string
+	Image       string
+	Env         []string
+	Command     []string
+	Healthcheck []string
+}
+
+// FromMetadata returns the services under ServicesKey in the metadata, if
+// any.
+func FromMetadata(md map[string]interface{}) ([]Service, error) {
+	value, ok := md[ServicesKey]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a list of services", ServicesKey)
+	}
+
+	services := []Service{}
+	names := map[string]bool{}
+
+	for i, item := range list {
+		svc, err := parseService(item)
+		if err != nil {
+			return nil, fmt.Errorf("service %d: %w", i+1, err)
+		}
+
+		if names[svc.Name] {
+			return nil, fmt.Errorf("service %d: duplicate name %q", i+1, svc.Name)
+		}
+		names[svc.Name] = true
+
+		services = append(services, svc)
+	}
+
+	return services, nil
+}
+
+func parseService(item interface{}) (Service, error) {
+	var (
+		svc Service
+		err error
+	)
+
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return svc, errors.New("must be a map with a name and an image")
+	}
+
+	if svc.Name, ok = m["name"].(string); !ok || !validName.MatchString(svc.Name) {
+		return svc, errors.New("name must be a host name: lowercase letters, digits and '-'")
+	}
+
+	if svc.Image, ok = m["image"].(string); !ok || svc.Image == "" {
+		return svc, fmt.Errorf("%v: image must be a non-empty string", svc.Name)
+	}
+
+	for _, field := range []struct {
+		key    string
+		target *[]string
+	}{
+		{"env", &svc.Env},
+		{"command", &svc.Command},
+		{"healthcheck", &svc.Healthcheck},
+	} {
+		if *field.target, err = stringList(m, field.key); err != nil {
+			return svc, fmt.Errorf("%v: %w", svc.Name, err)
+		}
+	}
+
+	return svc, nil
+}
+
+func stringList(m map[string]interface{}, key string) ([]string, error) {
+	value, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a list of strings", key)
+	}
+
+	res := []string{}
+
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v must be a list of strings", key)
+		}
+
+		res = append(res, s)
+	}
+
+	return res, nil
+}
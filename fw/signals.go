@@ -0,0 +1,28 @@
+package fw
+
+import "os"
+
+// handledSignals returns the signals the entrypoint handles on this platform.
+func handledSignals() []os.Signal {
+	sigs := append([]os.Signal{}, shutdownSignals...)
+
+	for _, sig := range []os.Signal{drainSignal, undrainSignal, reloadSignal} {
+		if sig != nil {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
+
+// isShutdownSignal returns true if the signal asks the runner to cancel its
+// runs and exit.
+func isShutdownSignal(sig os.Signal) bool {
+	for _, s := range shutdownSignals {
+		if sig == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+// Package steps reads the steps of a run: commands executed in order in the
+// same container, each reported on its own, instead of the single command of
+// the run.
+package steps
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StepsKey is the task or run metadata key holding the steps of a run, as a
+// list of steps with a name, a command in execv() form, and whether the run
+// goes on should the step fail. When set, the command of the run is ignored.
+//
+// e.g., {"steps": [{"name": "build", "command": ["make"]},
+// {"name": "lint", "command": ["make", "lint"], "continue_on_error": true}]}
+const StepsKey = "steps"
+
+// FailFastKey is the task or run metadata key saying whether the steps after
+// a failed step are skipped, which is the default. If false, they execute,
+// though the run still fails.
+const FailFastKey = "fail_fast"
+
+// Step is a command of a run.
+type Step struct {
+	Name    string
+	Command []string
+	// ContinueOnError doesn't fail the run should the step fail.
+	ContinueOnError bool
+}
+
+// Plan is the steps of a run.
+type Plan struct {
+	Steps    []Step
+	FailFast bool
+}
+
+// FromMetadata returns the plan under StepsKey and FailFastKey in the
+// metadata, or nil if there are no steps.
+func FromMetadata(md map[string]interface{}) (*Plan, error) {
+	value, ok := md[StepsKey]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%v must be a list of steps", StepsKey)
+	}
+
+	plan := &Plan{FailFast: true}
+
+	if value, ok := md[FailFastKey]; ok {
+		if plan.FailFast, ok = value.(bool); !ok {
+			return nil, fmt.Errorf("%v must be a boolean", FailFastKey)
+		}
+	}
+
+	names := map[string]bool{}
+
+	for i, item := range list {
+		step, err := parseStep(item)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+
+		if names[step.Name] {
+			return nil, fmt.Errorf("step %d: duplicate name %q", i+1, step.Name)
+		}
+		names[step.Name] = true
+
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	return plan, nil
+}
+
+func parseStep(item interface{}) (Step, error) {
+	var step Step
+
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return step, errors.New("must be a map with a name and a command")
+	}
+
+	if step.Name, ok = m["name"].(string); !ok || strings.TrimSpace(step.Name) == "" {
+		return step, errors.New("name must be a non-empty string")
+	}
+
+	command, ok := m["command"].([]interface{})
+	if !ok || len(command) == 0 {
+		return step, fmt.Errorf("%v: command must be a non-empty list of strings", step.Name)
+	}
+
+	for _, arg := range command {
+		s, ok := arg.(string)
+		if !ok {
+			return step, fmt.Errorf("%v: command must be a non-empty list of strings", step.Name)
+		}
+
+		step.Command = append(step.Command, s)
+	}
+
+	if value, ok := m["continue_on_error"]; ok {
+		if step.ContinueOnError, ok = value.(bool); !ok {
+			return step, fmt.Errorf("%v: continue_on_error must be a boolean", step.Name)
+		}
+	}
+
+	return step, nil
+}
+
+// Status is the outcome of a step.
+type Status string
+
+// Step statuses.
+const (
+	StatusPassed  Status = "passed"
+	StatusFailed  Status = "failed"
+	StatusSkipped Status = "skipped"
+)
+
+// Result is the outcome of a step.
+type Result struct {
+	Step     Step
+	Status   Status
+	ExitCode int
+	Duration time.Duration
+}
+
+// Passed returns true if none of the results fails the run.
+func Passed(results []Result) bool {
+	for _, res := range results {
+		if res.Status == StatusFailed && !res.Step.ContinueOnError {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Summary lists the results for the job log.
+func Summary(results []Result) string {
+	var b strings.Builder
+
+	b.WriteString("Steps:")
+
+	for _, res := range results {
+		switch res.Status {
+		case StatusSkipped:
+			fmt.Fprintf(&b, "\n  %-8v %v", res.Status, res.Step.Name)
+		case StatusFailed:
+			note := ""
+			if res.Step.ContinueOnError {
+				note = ", ignored"
+			}
+			fmt.Fprintf(&b, "\n  %-8v %v (exit code %d%v) in %v", res.Status, res.Step.Name, res.ExitCode, note, res.Duration.Round(time.Millisecond))
+		default:
+			fmt.Fprintf(&b, "\n  %-8v %v in %v", res.Status, res.Step.Name, res.Duration.Round(time.Millisecond))
+		}
+	}
+
+	return b.String()
+}
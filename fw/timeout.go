@@ -0,0 +1,195 @@
+package fw
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// Terminator is implemented by runs which can be stopped gracefully, e.g. by
+// sending SIGTERM to their processes. When a run times out, Terminate is
+// called and the run is given the grace period from the configuration
+// (timeout_grace) to stop before its context is canceled. Runs which do not
+// implement it are canceled as soon as they time out.
+type Terminator interface {
+	Run
+
+	// Terminate asks the run to stop. It must not block.
+	Terminate()
+}
+
+// deadline tracks the timeout of a run, which may be extended while it runs.
+type deadline struct {
+	mutex sync.Mutex
+
+	at    time.Time
+	max   time.Time
+	grace time.Duration
+
+	expire *time.Timer
+	kill   *time.Timer
+}
+
+// extend pushes the deadline back by d, capped to the maximum extension.
+func (dl *deadline) extend(d time.Duration) (time.Time, error) {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+
+	now := time.Now()
+
+	if !now.Before(dl.at) {
+		return dl.at, errors.New("run has already timed out")
+	}
+
+	at := dl.at.Add(d)
+	if at.After(dl.max) {
+		at = dl.max
+	}
+
+	if !at.After(dl.at) {
+		return dl.at, errors.New("run has reached its maximum timeout extension")
+	}
+
+	dl.at = at
+	dl.expire.Reset(at.Sub(now))
+	dl.kill.Reset(at.Add(dl.grace).Sub(now))
+
+	return at, nil
+}
+
+func (dl *deadline) stop() {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+
+	dl.expire.Stop()
+	dl.kill.Stop()
+}
+
+// startTimeout sets up the context of the run with its timeout, returning a
+// func that must be called once its status has been reported.
+func (e *Entrypoint) startTimeout(ctx context.Context, runner Runner, runnerCtx *fwcontext.RunContext) func() {
+	qi := runnerCtx.QueueItem
+	runLogger := runner.LogsvcClient(runnerCtx)
+	timeout := runner.FrameworkConfig().Timeout(time.Duration(qi.Run.Settings.Timeout))
+
+	runnerCtx.Ctx, runnerCtx.CancelFunc = context.WithCancel(context.Background())
+
+	if timeout == 0 {
+		runLogger.Info(ctx, "Run has no timeout")
+		return func() {}
+	}
+
+	grace := runner.FrameworkConfig().TimeoutGrace
+
+	runLogger.Infof(ctx, "Run timeout is %v (requested: %v, grace period: %v)", timeout, time.Duration(qi.Run.Settings.Timeout), grace)
+
+	dl := &deadline{grace: grace}
+	dl.at = runnerCtx.Start.Add(timeout)
+	dl.max = dl.at.Add(runner.FrameworkConfig().MaxTimeoutExtension)
+
+	dl.expire = time.AfterFunc(time.Until(dl.at), func() {
+		runLogger.Errorf(context.Background(), "Run timed out after %v", time.Since(runnerCtx.Start))
+		e.expire(runnerCtx, grace)
+	})
+
+	// the kill timer backs up the grace period of runs implementing
+	// Terminator, and any retries of the run not canceled by expire.
+	dl.kill = time.AfterFunc(time.Until(dl.at.Add(grace)), func() {
+		e.cancelRuns(runnerCtx)
+	})
+
+	runnerCtx.ExtendDeadline = func(d time.Duration) (time.Time, error) {
+		at, err := dl.extend(d)
+		if err != nil {
+			return at, err
+		}
+
+		runLogger.Infof(context.Background(), "Run timeout extended by %v; now times out at %v", d, at.Format(time.RFC3339))
+		return at, nil
+	}
+
+	return func() {
+		dl.stop()
+
+		e.runMapMutex.Lock()
+		delete(e.timedOut, qi.Run.Id)
+		e.runMapMutex.Unlock()
+	}
+}
+
+// expire terminates the runs of a queue item which timed out; matrix runs
+// have each of their cells in flight terminated. Without a grace period, or
+// any run in the run map to terminate, such as a recovered run or a matrix run
+// between cells, they are canceled outright.
+func (e *Entrypoint) expire(runnerCtx *fwcontext.RunContext, grace time.Duration) {
+	e.runMapMutex.Lock()
+	e.timedOut[runnerCtx.QueueItem.Run.Id] = true
+	e.runMapMutex.Unlock()
+
+	runs := e.runsOf(runnerCtx)
+
+	if grace <= 0 || len(runs) == 0 {
+		e.cancelRuns(runnerCtx)
+		return
+	}
+
+	for run, rc := range runs {
+		t, ok := run.(Terminator)
+		if !ok {
+			rc.CancelFunc()
+			continue
+		}
+
+		if err := protect(func() error { t.Terminate(); return nil }); err != nil {
+			e.Launch.LogsvcClient(rc).Errorf(context.Background(), "Terminate hook %v", err)
+			rc.CancelFunc()
+		}
+	}
+}
+
+// cancelRuns cancels the queue item and all of its runs in flight.
+func (e *Entrypoint) cancelRuns(runnerCtx *fwcontext.RunContext) {
+	runnerCtx.CancelFunc()
+
+	for _, rc := range e.runsOf(runnerCtx) {
+		rc.CancelFunc()
+	}
+}
+
+// runsOf returns the runs in flight for the queue item: its matrix cells or
+// retries. The stand-in of a matrix run is left out, as canceling it would
+// cancel all of its cells at once; they are stopped on their own instead.
+func (e *Entrypoint) runsOf(runnerCtx *fwcontext.RunContext) map[Run]*fwcontext.RunContext {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+
+	return e.runsOfID(runnerCtx.QueueItem.Run.Id)
+}
+
+// runsOfID returns the runs in flight for the queue item of the run id, as
+// runsOf does. The lock must be held.
+func (e *Entrypoint) runsOfID(runID int64) map[Run]*fwcontext.RunContext {
+	runs := map[Run]*fwcontext.RunContext{}
+
+	for run, rc := range e.runMap {
+		if _, ok := run.(*matrixRun); ok {
+			continue
+		}
+
+		if rc.QueueItem.Run.Id == runID {
+			runs[run] = rc
+		}
+	}
+
+	return runs
+}
+
+// isTimedOut returns true if the run timed out.
+func (e *Entrypoint) isTimedOut(runID int64) bool {
+	e.runMapMutex.RLock()
+	defer e.runMapMutex.RUnlock()
+	return e.timedOut[runID]
+}
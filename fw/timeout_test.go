@@ -0,0 +1,98 @@
+package fw
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tinyci/ci-agents/ci-gen/grpc/types"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// testRun is a run of the timeout tests; see terminableRun.
+type testRun struct {
+	name       string
+	runCtx     *fwcontext.RunContext
+	terminated bool
+}
+
+func (tr *testRun) Name() string                      { return tr.name }
+func (tr *testRun) String() string                    { return tr.name }
+func (tr *testRun) RunContext() *fwcontext.RunContext { return tr.runCtx }
+func (tr *testRun) BeforeRun() error                  { return nil }
+func (tr *testRun) Run() (bool, error)                { return false, nil }
+func (tr *testRun) AfterRun() error                   { return nil }
+
+// terminableRun is a testRun implementing Terminator.
+type terminableRun struct {
+	*testRun
+}
+
+func (tr *terminableRun) Terminate() { tr.terminated = true }
+
+func TestExpire(t *testing.T) {
+	table := []struct {
+		name   string
+		matrix bool
+		// cells are the runs in flight, terminable or not
+		cells          []bool
+		grace          time.Duration
+		parentCanceled bool
+		cellsCanceled  []bool
+	}{
+		{name: "terminable", cells: []bool{true}, grace: time.Minute, cellsCanceled: []bool{false}},
+		{name: "not terminable", cells: []bool{false}, grace: time.Minute, cellsCanceled: []bool{true}},
+		{name: "no grace", cells: []bool{true}, parentCanceled: true, cellsCanceled: []bool{true}},
+		{name: "no run", grace: time.Minute, parentCanceled: true},
+		{name: "matrix", matrix: true, cells: []bool{true, false}, grace: time.Minute, cellsCanceled: []bool{false, true}},
+		{name: "matrix between cells", matrix: true, grace: time.Minute, parentCanceled: true},
+	}
+
+	for _, test := range table {
+		e := &Entrypoint{runMap: runMap{}, timedOut: map[int64]bool{}}
+
+		qi := &types.QueueItem{Run: &types.Run{Id: 1}}
+		parent := &fwcontext.RunContext{QueueItem: qi}
+		parent.Ctx, parent.CancelFunc = context.WithCancel(context.Background())
+
+		if test.matrix {
+			e.runMap[&matrixRun{name: "matrix", runCtx: parent}] = parent
+		}
+
+		runs := []*testRun{}
+
+		for _, terminable := range test.cells {
+			rc := &fwcontext.RunContext{QueueItem: qi}
+			rc.Ctx, rc.CancelFunc = context.WithCancel(parent.Ctx)
+
+			tr := &testRun{name: "run", runCtx: rc}
+			runs = append(runs, tr)
+
+			if terminable {
+				e.runMap[&terminableRun{tr}] = rc
+			} else {
+				e.runMap[tr] = rc
+			}
+		}
+
+		e.expire(parent, test.grace)
+
+		if !e.isTimedOut(qi.Run.Id) {
+			t.Fatalf("%v: run was not marked timed out", test.name)
+		}
+
+		if canceled := parent.Ctx.Err() != nil; canceled != test.parentCanceled {
+			t.Fatalf("%v: parent canceled: %v, want %v", test.name, canceled, test.parentCanceled)
+		}
+
+		for i, tr := range runs {
+			if canceled := tr.runCtx.Ctx.Err() != nil; canceled != test.cellsCanceled[i] {
+				t.Fatalf("%v: run %d canceled: %v, want %v", test.name, i, canceled, test.cellsCanceled[i])
+			}
+
+			if terminated := test.cells[i] && !test.cellsCanceled[i]; tr.terminated != terminated {
+				t.Fatalf("%v: run %d terminated: %v, want %v", test.name, i, tr.terminated, terminated)
+			}
+		}
+	}
+}
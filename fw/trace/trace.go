@@ -0,0 +1,202 @@
+// Package trace records the timing of the phases and steps of a run.
+//
+// The framework creates a Trace for each run and records its lifecycle phases
+// (before_run, run, after_run, report). Runners may record finer-grained
+// steps within those phases, e.g.:
+//
+//		done := runCtx.Trace.Step("pull image")
+//		defer done()
+//
+// When the run completes the trace is attached, as JSON, to the event of its
+// outcome, and optionally written to a file, suitable for rendering a per-run
+// waterfall or comparing phase timings across runs. All methods are safe to
+// call on a nil *Trace, which records nothing.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Trace is the timing trace of a single run.
+type Trace struct {
+	RunID int64     `json:"run_id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Spans []*Span   `json:"spans"`
+	// Outcome is the outcome of the run, once reported.
+	Outcome string `json:"outcome,omitempty"`
+
+	mutex  sync.Mutex
+	phase  string
+	root   *Trace
+	prefix string
+}
+
+// Span is a single timed phase or step.
+type Span struct {
+	// Name is the name of the phase or step.
+	Name string `json:"name"`
+	// Phase is the phase a step belongs to; empty for phases themselves.
+	Phase string    `json:"phase,omitempty"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// New creates a trace for the run, starting now.
+func New(runID int64) *Trace {
+	return &Trace{RunID: runID, Start: time.Now(), Spans: []*Span{}}
+}
+
+// Sub returns a trace which records its spans into t, prefixed with the name,
+// but tracks its own current phase. It is used for work executing in
+// parallel within a run, such as matrix cells.
+func (t *Trace) Sub(name string) *Trace {
+	if t == nil {
+		return nil
+	}
+
+	return &Trace{RunID: t.RunID, Start: t.Start, root: t.rootTrace(), prefix: t.prefix + name + ": "}
+}
+
+func (t *Trace) rootTrace() *Trace {
+	if t.root != nil {
+		return t.root
+	}
+
+	return t
+}
+
+// Phase records a lifecycle phase of the run, which steps recorded until the
+// returned function is called belong to.
+func (t *Trace) Phase(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mutex.Lock()
+	t.phase = name
+	t.mutex.Unlock()
+
+	end := t.record(&Span{Name: name})
+
+	return func() {
+		end()
+
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if t.phase == name {
+			t.phase = ""
+		}
+	}
+}
+
+// Step records a step within the current phase, ending when the returned
+// function is called.
+func (t *Trace) Step(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mutex.Lock()
+	phase := t.phase
+	t.mutex.Unlock()
+
+	return t.record(&Span{Name: name, Phase: phase})
+}
+
+func (t *Trace) record(span *Span) func() {
+	root := t.rootTrace()
+
+	span.Name = t.prefix + span.Name
+	if span.Phase != "" {
+		span.Phase = t.prefix + span.Phase
+	}
+	span.Start = time.Now()
+
+	root.mutex.Lock()
+	root.Spans = append(root.Spans, span)
+	root.mutex.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			root.mutex.Lock()
+			defer root.mutex.Unlock()
+
+			if span.End.IsZero() {
+				span.End = time.Now()
+			}
+		})
+	}
+}
+
+// Finish marks the end of the run, ending the spans still open. Once finished,
+// calling it again has no effect.
+func (t *Trace) Finish() {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.End.IsZero() {
+		return
+	}
+
+	t.End = time.Now()
+
+	for _, span := range t.Spans {
+		if span.End.IsZero() {
+			span.End = t.End
+		}
+	}
+}
+
+// SetOutcome records the outcome of the run.
+func (t *Trace) SetOutcome(outcome string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Outcome = outcome
+}
+
+// MarshalJSON marshals the trace while holding its lock.
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	type trace Trace // avoid recursing into this method
+	return json.Marshal((*trace)(t))
+}
+
+// WriteFile writes the trace as JSON into the directory, named after the run
+// id, returning the path written.
+func (t *Trace) WriteFile(dir string) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+
+	content, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dir, fmt.Sprintf("%d.json", t.RunID))
+	return filename, ioutil.WriteFile(filename, content, 0640)
+}
@@ -0,0 +1,46 @@
+package trace
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFinish(t *testing.T) {
+	tr := New(1)
+
+	endRun := tr.Phase("run")
+	endStep := tr.Step("pull image")
+	endStep()
+	endRun()
+
+	endReport := tr.Phase("report")
+
+	tr.SetOutcome("passed")
+	tr.Finish()
+
+	if tr.End.IsZero() {
+		t.Fatal("trace was not finished")
+	}
+
+	for _, span := range tr.Spans {
+		if span.End.IsZero() || span.End.After(tr.End) {
+			t.Fatalf("span %v ends at %v, after the trace at %v", span.Name, span.End, tr.End)
+		}
+	}
+
+	end := tr.End
+	time.Sleep(time.Millisecond)
+
+	// the report phase ends after the trace was finished, e.g. once the
+	// outcome was emitted; the trace is left as it was.
+	endReport()
+	tr.Finish()
+
+	if !tr.End.Equal(end) {
+		t.Fatalf("trace end moved from %v to %v", end, tr.End)
+	}
+
+	if report := tr.Spans[len(tr.Spans)-1]; !report.End.Equal(end) {
+		t.Fatalf("report phase ends at %v, want %v", report.End, end)
+	}
+}
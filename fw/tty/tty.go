@@ -0,0 +1,80 @@
+// Package tty reads the size of the terminal jobs run in, so the output of
+// tools laying it out for the terminal isn't wrapped.
+package tty
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TTYKey is the task or run metadata key holding the size of the terminal of
+// the run, in columns and rows. Either may be left to the runner.
+//
+// e.g., {"tty": {"width": 200, "height": 50}}
+const TTYKey = "tty"
+
+const (
+	// DefaultWidth and DefaultHeight are the size of terminals unless
+	// configured otherwise.
+	DefaultWidth  = 80
+	DefaultHeight = 25
+
+	// MaxSize is the largest width or height of a terminal.
+	MaxSize = 1000
+)
+
+// Size is the size of a terminal. Zero values are left to the runner.
+type Size struct {
+	Width  uint `yaml:"width"`
+	Height uint `yaml:"height"`
+}
+
+// Validate errors out when the size isn't that of a usable terminal.
+func (s Size) Validate() error {
+	if s.Width > MaxSize || s.Height > MaxSize {
+		return fmt.Errorf("tty width and height must be at most %d", MaxSize)
+	}
+
+	return nil
+}
+
+// FromMetadata returns the size under TTYKey in the metadata, if any.
+func FromMetadata(md map[string]interface{}) (*Size, error) {
+	value, ok := md[TTYKey]
+	if !ok {
+		return nil, nil
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v must be a map with a width and a height", TTYKey)
+	}
+
+	var size Size
+
+	for _, field := range []struct {
+		key    string
+		target *uint
+	}{
+		{"width", &size.Width},
+		{"height", &size.Height},
+	} {
+		value, ok := m[field.key]
+		if !ok {
+			continue
+		}
+
+		n, ok := value.(float64)
+		if !ok || n < 1 || n != float64(uint(n)) {
+			return nil, fmt.Errorf("%v.%v must be a positive integer", TTYKey, field.key)
+		}
+
+		*field.target = uint(n)
+	}
+
+	if size.Width == 0 && size.Height == 0 {
+		return nil, errors.New("tty must have a width or a height")
+	}
+
+	return &size, size.Validate()
+}
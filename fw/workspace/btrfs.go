@@ -0,0 +1,69 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// btrfsSubvolumeInode is the inode number of the root of every btrfs
+// subvolume.
+const btrfsSubvolumeInode = 256
+
+// Btrfs makes workspaces from snapshots of the btrfs subvolume holding the
+// source, made in Dir, which must be on the same filesystem. The whole
+// subvolume is snapshotted, which costs the same as a part of it would.
+// Requires the btrfs tool, and user_subvol_rm_allowed when not run as root.
+type Btrfs struct {
+	Dir string
+}
+
+// btrfsWorkspace is the source within a snapshot.
+type btrfsWorkspace struct {
+	dir      string
+	snapshot string
+	path     string
+}
+
+// Name is the type of the snapshotter.
+func (b *Btrfs) Name() string {
+	return TypeBtrfs
+}
+
+// Snapshot makes a writable copy of the source directory.
+func (b *Btrfs) Snapshot(source, name string) (Workspace, error) {
+	root, err := subvolumeRoot(source)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(root, source)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := workspaceDir(b.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := filepath.Join(dir, "snapshot")
+
+	if err := run("btrfs", "subvolume", "snapshot", root, snapshot); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &btrfsWorkspace{dir: dir, snapshot: snapshot, path: filepath.Join(snapshot, rel)}, nil
+}
+
+func (bw *btrfsWorkspace) Path() string {
+	return bw.path
+}
+
+func (bw *btrfsWorkspace) Release() error {
+	if err := run("btrfs", "subvolume", "delete", bw.snapshot); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(bw.dir)
+}
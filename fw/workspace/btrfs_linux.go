@@ -0,0 +1,47 @@
+package workspace
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// subvolumeRoot returns the root of the btrfs subvolume holding path.
+// Subvolumes have their own device numbers, so the search stops at the first
+// directory of another device.
+func subvolumeRoot(source string) (string, error) {
+	path, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	dev := st.Dev
+
+	for {
+		if st.Ino == btrfsSubvolumeInode {
+			return path, nil
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+
+		if err := unix.Stat(parent, &st); err != nil {
+			return "", err
+		}
+
+		if st.Dev != dev {
+			break
+		}
+
+		path = parent
+	}
+
+	return "", fmt.Errorf("%v is not within a btrfs subvolume", source)
+}
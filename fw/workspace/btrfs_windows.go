@@ -0,0 +1,5 @@
+package workspace
+
+func subvolumeRoot(source string) (string, error) {
+	return "", checkPlatform(TypeBtrfs)
+}
@@ -0,0 +1,43 @@
+package workspace
+
+import (
+	"os"
+)
+
+// Copy makes workspaces by copying the source into Dir. Where the filesystem
+// supports it, the copy shares its blocks with the source through reflinks
+// and is nearly free; elsewhere, and on windows, it costs a full copy, but
+// works anywhere.
+type Copy struct {
+	Dir string
+}
+
+// dirWorkspace is a workspace held in a plain directory.
+type dirWorkspace struct {
+	dir string
+}
+
+// Name is the type of the snapshotter.
+func (c *Copy) Name() string {
+	return TypeCopy
+}
+
+// Snapshot makes a writable copy of the source directory.
+func (c *Copy) Snapshot(source, name string) (Workspace, error) {
+	dir, err := workspaceDir(c.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := &dirWorkspace{dir: dir}
+
+	return ws, copyTree(source, dir)
+}
+
+func (dw *dirWorkspace) Path() string {
+	return dw.dir
+}
+
+func (dw *dirWorkspace) Release() error {
+	return os.RemoveAll(dw.dir)
+}
@@ -0,0 +1,8 @@
+package workspace
+
+// copyTree copies the contents of the source into the existing dir, keeping
+// their modes, owners and times.
+func copyTree(source, dir string) error {
+	// the trailing /. copies the contents of source into the existing dir
+	return run("cp", "-a", "--reflink=auto", source+"/.", dir)
+}
@@ -0,0 +1,68 @@
+package workspace
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// copyTree copies the contents of the source into the existing dir, keeping
+// their modes and times. Windows has no cp, nor reflinks outside of ReFS dev
+// drives, so each file is copied in full.
+func copyTree(source, dir string) error {
+	return filepath.Walk(source, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		target := filepath.Join(dir, rel)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			return os.Symlink(link, target)
+		case fi.IsDir():
+			if err := os.Mkdir(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if err := copyFile(path, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			// devices, sockets and pipes have no place in a checkout
+			return nil
+		}
+
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+func copyFile(source, target string, perm os.FileMode) error {
+	in, err := os.Open(source) // #nosec
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,85 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/tinyci/ci-runners/fw/disk"
+	"github.com/tinyci/ci-runners/fw/overlay"
+)
+
+// Overlay makes workspaces by mounting an overlayfs over the source, with the
+// upper layer in Dir or, if set, on a Scratch filesystem.
+type Overlay struct {
+	Dir     string
+	Scratch *overlay.ScratchConfig
+}
+
+// overlayWorkspace is the overlayfs mount of a workspace.
+type overlayWorkspace struct {
+	dir string
+	m   *overlay.Mount
+}
+
+// Name is the type of the snapshotter.
+func (o *Overlay) Name() string {
+	return TypeOverlay
+}
+
+// Snapshot makes a writable copy of the source directory. The workspace is
+// returned even on error if the mount was attempted, so it may be released.
+func (o *Overlay) Snapshot(source, name string) (Workspace, error) {
+	dir, err := workspaceDir(o.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ow := &overlayWorkspace{
+		dir: dir,
+		m: &overlay.Mount{
+			Lower:  source,
+			Target: filepath.Join(dir, "target"),
+		},
+	}
+
+	dirs := []string{ow.m.Target}
+
+	if o.Scratch != nil {
+		ow.m.Scratch = o.Scratch
+		ow.m.ScratchDir = filepath.Join(dir, "scratch")
+	} else {
+		ow.m.Upper = filepath.Join(dir, "upper")
+		ow.m.Work = filepath.Join(dir, "work")
+		dirs = append(dirs, ow.m.Upper, ow.m.Work)
+	}
+
+	for _, d := range dirs {
+		if err := os.Mkdir(d, 0700); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	return ow, ow.m.Mount()
+}
+
+func (ow *overlayWorkspace) Path() string {
+	return ow.m.Target
+}
+
+// Written returns the size of the upper layer.
+func (ow *overlayWorkspace) Written() (uint64, error) {
+	return disk.Size(ow.m.Upper)
+}
+
+func (ow *overlayWorkspace) Release() error {
+	if err := ow.m.Unmount(); err != nil {
+		return err
+	}
+
+	if err := ow.m.Cleanup(); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(ow.dir)
+}
@@ -0,0 +1,293 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/disk"
+	"github.com/tinyci/ci-runners/fw/flock"
+	"github.com/tinyci/ci-runners/fw/overlay"
+)
+
+const defaultPersistTTL = 7 * 24 * time.Hour
+
+// PersistKey is the task or run metadata key opting a run into a persistent
+// workspace, if the runner keeps them.
+//
+// e.g., {"persistent_workspace": true}
+const PersistKey = "persistent_workspace"
+
+// PersistConfig configures the store of persistent workspaces: overlay upper
+// layers kept between runs, so whatever a run leaves in its workspace, such
+// as build outputs, is there for the next run with the same key.
+//
+// The sources under the layers change between runs. Files a run modified or
+// deleted keep hiding those of later checkouts, so runs should only write
+// build outputs to their workspace.
+type PersistConfig struct {
+	// Dir holds the layers. It must support overlay upper layers.
+	Dir string `yaml:"dir"`
+	// TTL is how long layers which are not used are kept. Defaults to a week.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxSize, if set, is the total size of the layers, in bytes, above which
+	// the least recently used are removed.
+	MaxSize uint64 `yaml:"max_size"`
+}
+
+// Validate corrects or errors out when the configuration doesn't match
+// expectations.
+func (pc *PersistConfig) Validate() error {
+	if !filepath.IsAbs(pc.Dir) {
+		return errors.New("persistent workspace dir must be absolute")
+	}
+
+	if pc.TTL < 0 {
+		return errors.New("persistent workspace ttl must not be negative")
+	}
+
+	if pc.TTL == 0 {
+		pc.TTL = defaultPersistTTL
+	}
+
+	return nil
+}
+
+// Persistent makes overlay workspaces whose upper layer is kept in the store
+// under Key, mounted in Dir. Should the layer be in use by another run, a
+// throwaway overlay is made instead.
+type Persistent struct {
+	Config *PersistConfig
+	Dir    string
+	Key    string
+}
+
+// persistentWorkspace is the overlayfs mount of a persistent layer.
+type persistentWorkspace struct {
+	dir   string
+	layer string
+	lock  *os.File
+	m     *overlay.Mount
+}
+
+// Name is the type of the snapshotter.
+func (p *Persistent) Name() string {
+	return TypeOverlay
+}
+
+// Snapshot makes a writable copy of the source directory.
+func (p *Persistent) Snapshot(source, name string) (Workspace, error) {
+	sum := sha256.Sum256([]byte(p.Key))
+	layer := filepath.Join(p.Config.Dir, hex.EncodeToString(sum[:16]))
+
+	lock, err := lockLayer(layer)
+	if errors.Is(err, flock.ErrLocked) {
+		return (&Overlay{Dir: p.Dir}).Snapshot(source, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	pw := &persistentWorkspace{
+		layer: layer,
+		lock:  lock,
+		m: &overlay.Mount{
+			Lower: source,
+			Upper: filepath.Join(layer, "upper"),
+			Work:  filepath.Join(layer, "work"),
+		},
+	}
+
+	for _, dir := range []string{pw.m.Upper, pw.m.Work} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			pw.unlock()
+			return nil, err
+		}
+	}
+
+	// the key is hashed in the name of the layer; keep it at hand for
+	// debugging
+	if err := ioutil.WriteFile(filepath.Join(layer, "key"), []byte(p.Key+"\n"), 0600); err != nil {
+		pw.unlock()
+		return nil, err
+	}
+
+	pw.dir, err = workspaceDir(p.Dir, name)
+	if err != nil {
+		pw.unlock()
+		return nil, err
+	}
+
+	pw.m.Target = filepath.Join(pw.dir, "target")
+	if err := os.Mkdir(pw.m.Target, 0700); err != nil {
+		pw.unlock()
+		os.RemoveAll(pw.dir)
+		return nil, err
+	}
+
+	if err := pw.m.Mount(); err != nil {
+		pw.unlock()
+		os.RemoveAll(pw.dir)
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// lockLayer takes the lock on the layer, without waiting for it.
+func lockLayer(layer string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(layer), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(layer+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock.TryLock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (pw *persistentWorkspace) unlock() {
+	pw.lock.Close()
+}
+
+func (pw *persistentWorkspace) Path() string {
+	return pw.m.Target
+}
+
+// Written returns the size of the upper layer, including what earlier runs
+// left in it.
+func (pw *persistentWorkspace) Written() (uint64, error) {
+	return disk.Size(pw.m.Upper)
+}
+
+// Release unmounts the workspace, keeping its upper layer for the next run.
+func (pw *persistentWorkspace) Release() error {
+	if err := pw.m.Unmount(); err != nil {
+		return err
+	}
+	defer pw.unlock()
+
+	now := time.Now()
+	if err := os.Chtimes(pw.layer, now, now); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(pw.dir)
+}
+
+type layer struct {
+	path     string
+	lastUsed time.Time
+	size     uint64
+}
+
+// Prune removes the layers not used within the TTL, then the least recently
+// used until the total size is below MaxSize. Layers in use are kept. It
+// returns the layers removed.
+func (pc *PersistConfig) Prune() ([]string, error) {
+	entries, err := ioutil.ReadDir(pc.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var (
+		layers []layer
+		total  uint64
+		pruned = []string{}
+	)
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		l := layer{path: filepath.Join(pc.Dir, entry.Name()), lastUsed: entry.ModTime()}
+
+		if time.Since(l.lastUsed) > pc.TTL {
+			if ok, err := removeLayer(l.path); err != nil {
+				return pruned, err
+			} else if ok {
+				pruned = append(pruned, l.path)
+				continue
+			}
+		}
+
+		l.size, err = disk.Size(l.path)
+		if err != nil {
+			return pruned, err
+		}
+
+		layers = append(layers, l)
+		total += l.size
+	}
+
+	if pc.MaxSize == 0 {
+		return pruned, nil
+	}
+
+	sort.Slice(layers, func(i, j int) bool { return layers[i].lastUsed.Before(layers[j].lastUsed) })
+
+	for _, l := range layers {
+		if total <= pc.MaxSize {
+			break
+		}
+
+		ok, err := removeLayer(l.path)
+		if err != nil {
+			return pruned, err
+		}
+
+		if ok {
+			pruned = append(pruned, l.path)
+			total -= l.size
+		}
+	}
+
+	return pruned, nil
+}
+
+// removeLayer removes the layer, unless it is in use. It returns true if it
+// was removed.
+func removeLayer(path string) (bool, error) {
+	lock, err := lockLayer(path)
+	if errors.Is(err, flock.ErrLocked) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	// the lock file stays, as another process may be about to lock it
+	if err := os.RemoveAll(path); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// PersistRequested returns whether the metadata opts into a persistent
+// workspace under PersistKey, and whether it says at all.
+func PersistRequested(md map[string]interface{}) (bool, bool) {
+	value, ok := md[PersistKey].(bool)
+	return value, ok
+}
+
+// PersistKeyFor returns the key of the persistent workspace of a run from
+// the parts identifying it, such as the repository, branch and run name.
+func PersistKeyFor(parts ...string) string {
+	return strings.Join(parts, "\n")
+}
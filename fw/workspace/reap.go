@@ -0,0 +1,149 @@
+package workspace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Prefix starts the name of every directory, and zfs clone, made for a
+// workspace. It is followed by the pid of the process which made it, so
+// those left behind by processes which are gone may be found by Reap, then
+// by the name of the workspace, which starts with that of its run.
+const Prefix = "tinyci-"
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// workspaceDir makes the directory of the workspace of the name in dir,
+// named after it. Should it already exist, a random suffix is added.
+func workspaceDir(dir, name string) (string, error) {
+	base := fmt.Sprintf("%s%d-%s", Prefix, os.Getpid(), unsafeName.ReplaceAllString(name, "_"))
+
+	path := filepath.Join(tempDir(dir), base)
+
+	err := os.Mkdir(path, 0700)
+	if os.IsExist(err) {
+		return ioutil.TempDir(dir, base+"-")
+	}
+
+	return path, err
+}
+
+// MkdirTemp makes a directory named after the name in dir, or the system temp
+// dir, for files of a run other than its workspaces, such as those handed to
+// its container. Once left behind, Reap removes it like workspaces.
+func MkdirTemp(dir, name string) (string, error) {
+	return workspaceDir(dir, name)
+}
+
+// stale returns true if the workspace directory of the name was left behind,
+// as Orphaned tells.
+func stale(name string, live []string) bool {
+	if !strings.HasPrefix(name, Prefix) {
+		return false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(name, Prefix), "-", 2)
+
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 {
+		return false
+	}
+
+	return Orphaned(pid, parts[1], live)
+}
+
+// Orphaned returns true if what the process of the pid made for the run, or
+// workspace, of the name was left behind: the process no longer exists, or
+// it is this process and the name is not that of one of its live runs, nor
+// of a workspace of one of them, named after the run followed by "-".
+func Orphaned(pid int, name string, live []string) bool {
+	if pid != os.Getpid() {
+		return !processExists(pid)
+	}
+
+	name = unsafeName.ReplaceAllString(name, "_")
+
+	for _, run := range live {
+		run = unsafeName.ReplaceAllString(run, "_")
+
+		if name == run || strings.HasPrefix(name, run+"-") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reap unmounts and removes the workspaces in dir left behind by processes
+// which are gone, such as runners which crashed before releasing them, or by
+// this process for runs which are no longer live. Workspaces of other live
+// processes, and of the live runs of this one, are left alone. It returns the
+// directories removed.
+func Reap(dir string, live []string) ([]string, error) {
+	dir, err := filepath.Abs(tempDir(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := workspaceMounts(dir, live)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+
+	// in reverse order, so overlays go before the scratch filesystems they
+	// sit on
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if err := unmount(mounts[i]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reaped := []string{}
+
+	for _, entry := range entries {
+		if !stale(entry.Name(), live) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		if isSubvolume(filepath.Join(path, "snapshot")) {
+			if err := run("btrfs", "subvolume", "delete", filepath.Join(path, "snapshot")); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		reaped = append(reaped, path)
+	}
+
+	if len(errs) != 0 {
+		return reaped, fmt.Errorf("reaping workspaces: %v", strings.Join(errs, "; "))
+	}
+
+	return reaped, nil
+}
+
+// mountEntry is a mount of a workspace, a line of /proc/self/mounts.
+type mountEntry struct {
+	source string
+	target string
+	fstype string
+}
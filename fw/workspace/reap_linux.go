@@ -0,0 +1,109 @@
+package workspace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// processExists returns true if the process of the pid exists.
+func processExists(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+// workspaceMounts returns the stale workspace mounts in dir, in the order
+// they were mounted.
+func workspaceMounts(dir string, live []string) ([]mountEntry, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []mountEntry{}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		target := unescapeMount(fields[1])
+
+		rel, err := filepath.Rel(dir, target)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || !stale(strings.SplitN(rel, "/", 2)[0], live) {
+			continue
+		}
+
+		mounts = append(mounts, mountEntry{source: unescapeMount(fields[0]), target: target, fstype: fields[2]})
+	}
+
+	return mounts, s.Err()
+}
+
+// unescapeMount decodes the octal escapes, such as \040 for a space, of a
+// field of /proc/self/mounts.
+func unescapeMount(field string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(field[i])
+	}
+
+	return b.String()
+}
+
+// unmount unmounts a workspace mount. Zfs clones are destroyed along with
+// the snapshot they were made from.
+func unmount(m mountEntry) error {
+	if m.fstype == "zfs" {
+		out, err := exec.Command("zfs", "get", "-H", "-o", "value", "origin", m.source).Output() // #nosec
+		if err != nil {
+			return fmt.Errorf("finding the origin of %v: %w", m.source, err)
+		}
+
+		if err := run("zfs", "destroy", m.source); err != nil {
+			return err
+		}
+
+		if origin := strings.TrimSpace(string(out)); origin != "-" {
+			return run("zfs", "destroy", origin)
+		}
+
+		return nil
+	}
+
+	// detached, so whatever still holds it does not keep it from going
+	if err := unix.Unmount(m.target, unix.MNT_DETACH|unix.UMOUNT_NOFOLLOW); err != nil {
+		return fmt.Errorf("unmounting %v: %w", m.target, err)
+	}
+
+	return nil
+}
+
+func isSubvolume(path string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil || fs.Type != unix.BTRFS_SUPER_MAGIC {
+		return false
+	}
+
+	var st unix.Stat_t
+	return unix.Stat(path, &st) == nil && st.Ino == btrfsSubvolumeInode
+}
@@ -0,0 +1,27 @@
+package workspace
+
+import "os"
+
+// processExists returns true if the process of the pid exists.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+
+	return true
+}
+
+// workspaceMounts returns none, as workspaces are plain copies on windows.
+func workspaceMounts(dir string, live []string) ([]mountEntry, error) {
+	return nil, nil
+}
+
+func unmount(m mountEntry) error {
+	return nil
+}
+
+func isSubvolume(path string) bool {
+	return false
+}
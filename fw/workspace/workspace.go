@@ -0,0 +1,136 @@
+// Package workspace makes throwaway writable copies of directories, such as a
+// repository checkout, for a run to work in. Once the run is over the copy is
+// released, and whatever the run wrote with it.
+//
+// Several implementations, or snapshotters, are available, as what is
+// possible and cheap depends on the host:
+//
+//	overlay  an overlayfs mount over the directory (see fw/overlay)
+//	btrfs    a snapshot of the btrfs subvolume holding the directory
+//	zfs      a clone of a snapshot of the zfs dataset holding the directory
+//	copy     a plain copy, sharing blocks through reflinks where supported
+//
+// The default, auto, picks one per directory from the filesystems involved.
+// On windows, only copy is available, and auto picks it.
+// Overlay workspaces may also be kept between runs; see PersistConfig.
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tinyci/ci-runners/fw/overlay"
+)
+
+// Snapshotter types.
+const (
+	TypeAuto    = "auto"
+	TypeOverlay = "overlay"
+	TypeBtrfs   = "btrfs"
+	TypeZFS     = "zfs"
+	TypeCopy    = "copy"
+)
+
+// Workspace is a writable copy of a directory.
+type Workspace interface {
+	// Path is the directory holding the copy.
+	Path() string
+	// Release discards the copy and anything written to it.
+	Release() error
+}
+
+// Measurable is implemented by workspaces which can tell how much has been
+// written to them: overlays, persistent or not, and zfs clones.
+type Measurable interface {
+	// Written returns the size of what has been written to the workspace,
+	// in bytes.
+	Written() (uint64, error)
+}
+
+// Snapshotter makes workspaces.
+type Snapshotter interface {
+	// Name is the type of the snapshotter.
+	Name() string
+	// Snapshot makes a writable copy of the source directory. The name, such
+	// as that of the run, appears in the paths of the workspace to help
+	// debugging.
+	Snapshot(source, name string) (Workspace, error)
+}
+
+// ValidateType errors out if typ is not a known snapshotter type. Empty means
+// auto.
+func ValidateType(typ string) error {
+	switch typ {
+	case "", TypeAuto, TypeCopy:
+		return nil
+	case TypeOverlay, TypeBtrfs, TypeZFS:
+		return checkPlatform(typ)
+	default:
+		return fmt.Errorf("unknown workspace type %q", typ)
+	}
+}
+
+// New returns the snapshotter of the type. Workspaces, or for btrfs and zfs
+// the mount points of their snapshots, are created below dir, the system temp
+// dir if empty. scratch, if set, holds the writable layer of overlay
+// workspaces; the other types write to their own filesystem.
+func New(typ, dir string, scratch *overlay.ScratchConfig) (Snapshotter, error) {
+	switch typ {
+	case "", TypeAuto:
+		return &Auto{Dir: dir, Scratch: scratch}, nil
+	case TypeOverlay:
+		return &Overlay{Dir: dir, Scratch: scratch}, nil
+	case TypeBtrfs:
+		return &Btrfs{Dir: dir}, nil
+	case TypeZFS:
+		return &ZFS{Dir: dir}, nil
+	case TypeCopy:
+		return &Copy{Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown workspace type %q", typ)
+	}
+}
+
+// Auto picks the snapshotter for each source from the filesystems involved:
+// btrfs or zfs snapshots where the source lives on them, a copy where an
+// overlay cannot keep its upper layer in Dir (see CheckOverlayDir), and an
+// overlay otherwise.
+type Auto struct {
+	Dir     string
+	Scratch *overlay.ScratchConfig
+}
+
+// Name is the type of the snapshotter.
+func (a *Auto) Name() string {
+	return TypeAuto
+}
+
+// Snapshot makes a writable copy of the source directory.
+func (a *Auto) Snapshot(source, name string) (Workspace, error) {
+	s, err := a.Detect(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Snapshot(source, name)
+}
+
+// run runs the command, returning its output with any error.
+func run(command ...string) error {
+	out, err := exec.Command(command[0], command[1:]...).CombinedOutput() // #nosec
+	if err != nil {
+		return fmt.Errorf("%v: %w: %s", strings.Join(command, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func tempDir(dir string) string {
+	if dir == "" {
+		return os.TempDir()
+	}
+
+	return dir
+}
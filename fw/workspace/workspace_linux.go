@@ -0,0 +1,74 @@
+package workspace
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem types reported by statfs(2) which are missing from x/sys/unix.
+// zfs is not in the kernel headers at all.
+const (
+	zfsSuperMagic  = 0x2fc12fc1
+	cifsMagic      = 0xff534d42
+	fuseSuperMagic = 0x65735546
+)
+
+// unsupportedUpper are the filesystems overlayfs does not take upper layers
+// on, lacking the features it needs or being overlayfs themselves.
+var unsupportedUpper = map[int64]string{
+	unix.OVERLAYFS_SUPER_MAGIC: "overlayfs",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.SMB_SUPER_MAGIC:       "smb",
+	cifsMagic:                  "cifs",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	fuseSuperMagic:             "fuse",
+}
+
+// checkPlatform errors out if the snapshotter type is not available on
+// this platform.
+func checkPlatform(typ string) error {
+	return nil
+}
+
+// CheckOverlayDir errors out if overlays cannot keep their upper layers in
+// dir, the system temp dir if empty.
+func CheckOverlayDir(dir string) error {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(tempDir(dir), &st); err != nil {
+		return err
+	}
+
+	if fs, ok := unsupportedUpper[int64(st.Type)]; ok {
+		return fmt.Errorf("%v is on %v, which overlayfs does not support for upper layers; use another directory, a scratch filesystem or another workspace type", tempDir(dir), fs)
+	}
+
+	return nil
+}
+
+// Detect returns the snapshotter to use for the source directory.
+func (a *Auto) Detect(source string) (Snapshotter, error) {
+	var src, dst unix.Statfs_t
+
+	if err := unix.Statfs(source, &src); err != nil {
+		return nil, err
+	}
+
+	if err := unix.Statfs(tempDir(a.Dir), &dst); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case src.Type == unix.BTRFS_SUPER_MAGIC && src.Fsid == dst.Fsid:
+		// snapshots must be made within the same filesystem
+		return &Btrfs{Dir: a.Dir}, nil
+	case src.Type == zfsSuperMagic:
+		return &ZFS{Dir: a.Dir}, nil
+	case a.Scratch == nil && unsupportedUpper[int64(dst.Type)] != "":
+		// as when running in a container, where dir is on overlayfs
+		return &Copy{Dir: a.Dir}, nil
+	default:
+		return &Overlay{Dir: a.Dir, Scratch: a.Scratch}, nil
+	}
+}
@@ -0,0 +1,20 @@
+package workspace
+
+import "fmt"
+
+// checkPlatform errors out if the snapshotter type is not available on
+// this platform.
+func checkPlatform(typ string) error {
+	return fmt.Errorf("workspace type %q is not supported on windows: use %q", typ, TypeCopy)
+}
+
+// CheckOverlayDir errors out, as windows has no overlayfs.
+func CheckOverlayDir(dir string) error {
+	return checkPlatform(TypeOverlay)
+}
+
+// Detect returns the snapshotter to use for the source directory: always a
+// copy on windows.
+func (a *Auto) Detect(source string) (Snapshotter, error) {
+	return &Copy{Dir: a.Dir}, nil
+}
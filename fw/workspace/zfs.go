@@ -0,0 +1,104 @@
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ZFS makes workspaces from clones of a snapshot of the zfs dataset holding
+// the source, mounted in Dir. Clones are created at the top of the pool of
+// the dataset. Requires the zfs tool and permission to snapshot, clone, mount
+// and destroy in the pool.
+type ZFS struct {
+	Dir string
+}
+
+// zfsWorkspace is the source within a clone.
+type zfsWorkspace struct {
+	dir      string
+	snapshot string
+	clone    string
+	path     string
+}
+
+// Name is the type of the snapshotter.
+func (z *ZFS) Name() string {
+	return TypeZFS
+}
+
+// Snapshot makes a writable copy of the source directory.
+func (z *ZFS) Snapshot(source, name string) (Workspace, error) {
+	out, err := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint", source).Output() // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("finding the zfs dataset of %v: %w", source, err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), "\t")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected output from zfs list: %q", out)
+	}
+	dataset, mountpoint := fields[0], fields[1]
+
+	rel, err := filepath.Rel(mountpoint, source)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := workspaceDir(z.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := strings.SplitN(dataset, "/", 2)[0]
+
+	ws := &zfsWorkspace{
+		dir:      dir,
+		snapshot: dataset + "@" + filepath.Base(dir),
+		clone:    pool + "/" + filepath.Base(dir),
+		path:     filepath.Join(dir, rel),
+	}
+
+	if err := run("zfs", "snapshot", ws.snapshot); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if err := run("zfs", "clone", "-o", "mountpoint="+dir, ws.snapshot, ws.clone); err != nil {
+		run("zfs", "destroy", ws.snapshot)
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func (zw *zfsWorkspace) Path() string {
+	return zw.path
+}
+
+// Written returns the space referenced by the clone but not by the snapshot
+// it was made from.
+func (zw *zfsWorkspace) Written() (uint64, error) {
+	out, err := exec.Command("zfs", "get", "-H", "-p", "-o", "value", "written", zw.clone).Output() // #nosec
+	if err != nil {
+		return 0, fmt.Errorf("measuring %v: %w", zw.clone, err)
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+}
+
+func (zw *zfsWorkspace) Release() error {
+	if err := run("zfs", "destroy", zw.clone); err != nil {
+		return err
+	}
+
+	if err := run("zfs", "destroy", zw.snapshot); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(zw.dir)
+}
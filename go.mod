@@ -7,9 +7,11 @@ require (
 	github.com/containerd/containerd v1.5.2 // indirect
 	github.com/creack/pty v1.1.12
 	github.com/docker/docker v20.10.6+incompatible
-	github.com/docker/go-connections v0.4.0 // indirect
+	github.com/docker/go-connections v0.4.0
+	github.com/docker/go-units v0.4.0
 	github.com/fatih/color v1.12.0
 	github.com/gin-gonic/gin v1.7.2 // indirect
+	github.com/go-git/go-git/v5 v5.4.2
 	github.com/go-playground/validator/v10 v10.6.1 // indirect
 	github.com/json-iterator/go v1.1.11 // indirect
 	github.com/morikuni/aec v1.0.0 // indirect
@@ -18,10 +20,12 @@ require (
 	github.com/ugorji/go v1.2.6 // indirect
 	github.com/urfave/cli v1.22.5
 	go.mongodb.org/mongo-driver v1.5.2 // indirect
-	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
 	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
 	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c // indirect
 	golang.org/x/sys v0.0.0-20210525143221-35b2ab0089ea
 	google.golang.org/genproto v0.0.0-20210524171403-669157292da3 // indirect
 	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -15,11 +15,15 @@ import (
 	fwcontext "github.com/tinyci/ci-runners/fw/context"
 )
 
+// StatusKey is the key of the run metadata which, if set to a boolean, is the
+// status the run reports instead of a roll of the dice. Integration tests use
+// it to know what to expect.
+const StatusKey = "null_status"
+
 // Runner encapsulates an infinite lifecycle overlay-runner.
 type Runner struct {
 	sync.Mutex
-	Config    *config.Config
-	NextState bool
+	Config *config.Config
 }
 
 // Run is a single run
@@ -27,6 +31,9 @@ type Run struct {
 	runner *Runner
 	name   string
 	runCtx *fwcontext.RunContext
+	// status is the status the run reports, decided in BeforeRun; it is kept
+	// per run as runs execute concurrently.
+	status bool
 }
 
 // Name is the name of the run
@@ -63,40 +70,67 @@ func (r *Runner) AfterRun(string, *fwcontext.RunContext) {}
 // Init is the bootstrap of the runner.
 func (r *Runner) Init(ctx *fwcontext.Context) error {
 	rand.Seed(time.Now().UnixNano())
+
+	var err error
+
 	// we reload the clients on each run
-	r.Config = &config.Config{Clients: &config.Clients{}}
-	err := config.Load(ctx.CLIContext.GlobalString("config"), r.Config)
+	r.Config, err = loadConfig(ctx)
+	return err
+}
+
+// Reload loads the configuration again and swaps it in.
+func (r *Runner) Reload(ctx *fwcontext.Context) error {
+	cfg, err := loadConfig(ctx)
 	if err != nil {
 		return err
 	}
 
-	if r.Config.Hostname == "" {
+	r.Lock()
+	defer r.Unlock()
+	r.Config = cfg
+
+	return nil
+}
+
+func loadConfig(ctx *fwcontext.Context) (*config.Config, error) {
+	cfg := &config.Config{Clients: &config.Clients{}}
+	if err := config.Load(ctx.CLIContext.GlobalString("config"), cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Hostname == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
-			return utils.WrapError(err, "Could not retrieve hostname")
+			return nil, utils.WrapError(err, "Could not retrieve hostname")
 		}
-		r.Config.Hostname = hostname
+		cfg.Hostname = hostname
 	}
 
-	r.Config.Clients.Log = r.Config.Clients.Log.WithFields(log.FieldMap{"queue": r.Config.QueueName, "hostname": r.Config.Hostname})
-	return nil
+	cfg.Clients.Log = cfg.Clients.Log.WithFields(log.FieldMap{"queue": cfg.QueueName, "hostname": cfg.Hostname})
+
+	return cfg, nil
 }
 
 // BeforeRun is executed before the next run is started.
 func (r *Run) BeforeRun() error {
 	r.runner.Lock()
 	defer r.runner.Unlock()
-	r.runner.NextState = rand.Intn(2) == 0
-	r.runner.LogsvcClient(r.runCtx).Infof(r.runCtx.Ctx, "Run Commencing: Rolling the dice yielded %v", r.runner.NextState)
+
+	if status, ok := r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()[StatusKey].(bool); ok {
+		r.status = status
+		r.runner.LogsvcClient(r.runCtx).Infof(r.runCtx.Ctx, "Run Commencing: Status set to %v by the metadata", status)
+		return nil
+	}
+
+	r.status = rand.Intn(2) == 0
+	r.runner.LogsvcClient(r.runCtx).Infof(r.runCtx.Ctx, "Run Commencing: Rolling the dice yielded %v", r.status)
 
 	return nil
 }
 
 // Run runs the CI job.
 func (r *Run) Run() (bool, error) {
-	r.runner.Lock()
-	defer r.runner.Unlock()
-	return r.runner.NextState, nil
+	return r.status, nil
 }
 
 // AfterRun does nothing in the null-runner.
@@ -108,6 +142,11 @@ func (r *Runner) Hostname() string {
 	return r.Config.Hostname
 }
 
+// FrameworkConfig returns the framework configuration.
+func (r *Runner) FrameworkConfig() *config.Config {
+	return r.Config
+}
+
 // QueueName is the name of the queue this runner should be processing.
 func (r *Runner) QueueName() string {
 	return r.Config.QueueName
@@ -0,0 +1,274 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/build"
+	"github.com/tinyci/ci-runners/fw/netpolicy"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// buildRepo is the repository of the images built for runs, tagged after
+// their run, and matrix cell.
+const buildRepo = "tinyci/build"
+
+// buildSpec returns the build of the image of the run, if its metadata, or
+// failing that that of its task, asks for one.
+func (r *Run) buildSpec() (*build.Spec, error) {
+	md := r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()
+	if _, ok := md[build.BuildKey]; !ok {
+		md = r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap()
+	}
+
+	spec, err := build.FromMetadata(md)
+	if err != nil || spec == nil {
+		return nil, err
+	}
+
+	if r.config.Build == nil {
+		return nil, errors.New("an image build was requested, but the runner does not build images")
+	}
+
+	return spec, nil
+}
+
+// buildImage builds the image of the run from its workspace with BuildKit,
+// writing the progress to w, and returns its tag. With a cache repository,
+// the build reuses the layers of the last build of the repository, and
+// pushes its own for the next.
+func (r *Run) buildImage(ctx context.Context, w io.Writer, spec *build.Spec, ws workspace.Workspace) (string, error) {
+	dir, err := r.buildContext(ws, spec)
+	if err != nil {
+		return "", fw.Classed(fw.ErrUserJob, err)
+	}
+
+	body, err := build.Context(dir, spec.Dockerfile)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tag := fmt.Sprintf("%v:%v", buildRepo, r.instanceID())
+
+	args := map[string]*string{}
+	for name, value := range spec.Args {
+		value := value
+		args[name] = &value
+	}
+
+	opts := types.ImageBuildOptions{
+		Version:    types.BuilderBuildKit,
+		Tags:       []string{tag},
+		Dockerfile: spec.Dockerfile,
+		Target:     spec.Target,
+		BuildArgs:  args,
+	}
+
+	if r.netMode != netpolicy.ModeFull {
+		// BuildKit only knows of the default, host and none networks, so
+		// restricted builds get none
+		opts.NetworkMode = "none"
+	}
+
+	cache := r.cacheRef()
+	if cache != "" {
+		inline := "1"
+		// the layers are pushed within the image, for the next build to pull
+		args["BUILDKIT_INLINE_CACHE"] = &inline
+		opts.CacheFrom = []string{cache}
+		r.pullCache(ctx, cache)
+	}
+
+	fmt.Fprintf(w, "\nBuilding %v from %v\n", spec.Dockerfile, spec.Context)
+
+	resp, err := r.runner.Docker.ImageBuild(ctx, body, opts)
+	if err != nil {
+		return "", fw.Classed(fw.ErrInfra, err)
+	}
+	defer resp.Body.Close()
+
+	r.builtImage = tag
+
+	if err := outputBuild(w, resp.Body); err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(w, "\nBuilt image %v\n\n", tag)
+
+	if cache != "" {
+		r.pushCache(ctx, w, tag, cache)
+	}
+
+	return tag, nil
+}
+
+// buildContext returns the directory of the build context in the workspace,
+// which must not lead out of it through symbolic links.
+func (r *Run) buildContext(ws workspace.Workspace, spec *build.Spec) (string, error) {
+	root, err := filepath.EvalSymlinks(ws.Path())
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(spec.Context)))
+	if err != nil {
+		return "", fmt.Errorf("build context %v: %w", spec.Context, err)
+	}
+
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("build context %v is outside the repository", spec.Context)
+	}
+
+	return dir, nil
+}
+
+// cacheRef returns the cache image of the repository of the run, if the
+// runner has a cache repository.
+func (r *Run) cacheRef() string {
+	repo := r.config.Build.CacheRepo
+	if repo == "" {
+		return ""
+	}
+
+	name := r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Name
+	return repo + ":" + unsafeContainerName.ReplaceAllString(strings.ReplaceAll(name, "/", "-"), "_")
+}
+
+// registryAuth returns the credentials of the cache repository, encoded for
+// the docker API.
+func (r *Run) registryAuth() (string, error) {
+	cfg := r.config.Build
+	if cfg.Username == "" {
+		return "", nil
+	}
+
+	content, err := json.Marshal(types.AuthConfig{Username: cfg.Username, Password: cfg.Password})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(content), nil
+}
+
+// pullCache pulls the cache image, as the daemon cannot log in to the cache
+// repository while building. The first build of a repository has none.
+func (r *Run) pullCache(ctx context.Context, cache string) {
+	logger := r.runner.LogsvcClient(r.runCtx)
+
+	auth, err := r.registryAuth()
+	if err != nil {
+		logger.Errorf(ctx, "Could not encode the credentials of the cache repository: %v", err)
+		return
+	}
+
+	rc, err := r.runner.Docker.ImagePull(ctx, cache, types.ImagePullOptions{RegistryAuth: auth})
+	if err == nil {
+		defer rc.Close()
+		err = outputPullRead(ioutil.Discard, rc)
+	}
+
+	if err != nil && !errdefs.IsNotFound(err) {
+		logger.Errorf(ctx, "Could not pull build cache %v: %v", cache, err)
+	}
+}
+
+// pushCache pushes the image, with its inlined cache, as the cache image of
+// the repository. Pull requests from forks don't, unless configured
+// otherwise. A failed push only makes the next build slower, so it does not
+// fail the run.
+func (r *Run) pushCache(ctx context.Context, w io.Writer, tag, cache string) {
+	if r.fork() && !r.config.Build.Forks {
+		return
+	}
+
+	if err := r.push(ctx, tag, cache); err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(ctx, "Could not push build cache %v: %v", cache, err)
+		fmt.Fprintf(w, "Could not push the build cache: %v\n\n", err)
+	}
+}
+
+func (r *Run) push(ctx context.Context, tag, ref string) error {
+	if err := r.runner.Docker.ImageTag(ctx, tag, ref); err != nil {
+		return err
+	}
+
+	auth, err := r.registryAuth()
+	if err != nil {
+		return err
+	}
+
+	rc, err := r.runner.Docker.ImagePush(ctx, ref, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return outputPullRead(ioutil.Discard, rc)
+}
+
+// removeBuiltImage removes the image built for the run, if any. Its layers
+// stay in the cache image of the repository.
+func (r *Run) removeBuiltImage() {
+	if r.builtImage == "" {
+		return
+	}
+
+	if _, err := r.runner.Docker.ImageRemove(context.Background(), r.builtImage, types.ImageRemoveOptions{PruneChildren: true}); err != nil && !errdefs.IsNotFound(err) {
+		r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "Could not remove built image %v: %v", r.builtImage, err)
+	}
+	r.builtImage = ""
+}
+
+// buildMessage is a message of the stream of a build.
+type buildMessage struct {
+	Stream string          `json:"stream"`
+	Error  string          `json:"error"`
+	ID     string          `json:"id"`
+	Aux    json.RawMessage `json:"aux"`
+}
+
+// outputBuild writes the progress of the build to w, returning an error if
+// it failed. The progress of BuildKit comes as traces.
+func outputBuild(w io.Writer, rd io.Reader) error {
+	progress := build.NewProgress(w)
+
+	s := bufio.NewScanner(rd)
+	s.Buffer(nil, 1024*1024)
+
+	for s.Scan() {
+		var m buildMessage
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			return err
+		}
+
+		switch {
+		case m.Error != "":
+			return fw.Classed(fw.ErrUserJob, fmt.Errorf("build failed: %v", m.Error))
+		case m.ID == build.TraceID:
+			var trace []byte
+			if err := json.Unmarshal(m.Aux, &trace); err != nil {
+				return err
+			}
+
+			if err := progress.Write(trace); err != nil {
+				return err
+			}
+		case m.Stream != "":
+			fmt.Fprint(w, m.Stream)
+		}
+	}
+
+	return s.Err()
+}
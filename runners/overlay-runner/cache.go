@@ -0,0 +1,207 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/namedcache"
+	"github.com/tinyci/ci-runners/runners/overlay-runner/config"
+)
+
+// MountCaches prepares the configured dependency caches for mounting into the
+// container. Writable caches get a workspace which must be cleaned up with
+// CleanupCaches once the run is over.
+func (r *Run) MountCaches() ([]mount.Mount, error) {
+	mounts := []mount.Mount{}
+
+	for _, cache := range r.config.Caches {
+		if !cache.Writable {
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   cache.Source,
+				Target:   cache.Target,
+				ReadOnly: true,
+			})
+			continue
+		}
+
+		ws, err := r.snapshot(cache.Source, "cache-"+cache.Name, nil)
+		if ws != nil {
+			r.cacheMounts = append(r.cacheMounts, ws)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("mounting cache %q: %w", cache.Name, err)
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: ws.Path(),
+			Target: cache.Target,
+		})
+	}
+
+	named, err := r.namedCaches()
+	if err != nil {
+		return nil, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if len(named) != 0 && r.config.NamedCaches == nil {
+		r.runner.LogsvcClient(r.runCtx).Info(context.Background(), "Runner does not keep named caches; running without them")
+		return mounts, nil
+	}
+
+	scope := r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Name
+
+	for _, cache := range named {
+		v, err := r.config.NamedCaches.Checkout(scope, cache.Name, r.name)
+		if err != nil {
+			return nil, fmt.Errorf("preparing named cache %q: %w", cache.Name, err)
+		}
+		r.volumes = append(r.volumes, v)
+
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: v.Path(),
+			Target: cache.Target,
+		})
+	}
+
+	return mounts, nil
+}
+
+// namedCaches returns the named caches in the metadata of the run, or failing
+// that of its task.
+func (r *Run) namedCaches() ([]namedcache.Cache, error) {
+	caches, err := namedcache.FromMetadata(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || caches != nil {
+		return caches, err
+	}
+
+	return namedcache.FromMetadata(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// SaveCaches saves the named caches used by the run, for the next runs of
+// the repository.
+func (r *Run) SaveCaches() {
+	for _, v := range r.volumes {
+		if err := v.Save(); err != nil {
+			r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "saving named cache %v: %v", v.Path(), err)
+		}
+	}
+
+	r.volumes = nil
+
+	if _, err := r.config.NamedCaches.Evict(); err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "evicting named caches: %v", err)
+	}
+}
+
+// CleanupCaches removes any workspaces created by MountCaches, and discards
+// any named caches which were not saved.
+func (r *Run) CleanupCaches() {
+	for _, ws := range r.cacheMounts {
+		if err := r.MountCleanup(ws); err != nil {
+			r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "cleaning up cache mount %v: %v", ws.Path(), err)
+		}
+	}
+
+	r.cacheMounts = nil
+
+	for _, v := range r.volumes {
+		if err := v.Discard(); err != nil {
+			r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "discarding named cache %v: %v", v.Path(), err)
+		}
+	}
+
+	r.volumes = nil
+}
+
+// StartWarmups launches the periodic warm-up jobs for any caches that define
+// them. This function does not block.
+func (r *Runner) StartWarmups() {
+	for _, cache := range r.Config().Caches {
+		if cache.Warmup == nil {
+			continue
+		}
+
+		go func(cache config.Cache) {
+			for {
+				r.warmup(cache)
+				time.Sleep(cache.Warmup.Interval)
+			}
+		}(cache)
+	}
+}
+
+// warmup runs the warm-up job for the cache, if the runner is idle. The
+// runner is marked busy for the duration so no run sees the cache change
+// underneath it.
+func (r *Runner) warmup(cache config.Cache) {
+	if !r.acquire() {
+		return
+	}
+	defer r.release()
+
+	logger := r.Config().C.Clients.Log.WithFields(log.FieldMap{"cache": cache.Name})
+
+	ctx, cancel := context.WithTimeout(context.Background(), cache.Warmup.Interval)
+	defer cancel()
+
+	start := time.Now()
+	logger.Infof(ctx, "Warming up cache %v", cache.Name)
+
+	if err := r.runWarmup(ctx, cache); err != nil {
+		logger.Errorf(ctx, "Warm-up of cache %v failed: %v", cache.Name, err)
+		return
+	}
+
+	logger.Infof(ctx, "Warm-up of cache %v finished in %v", cache.Name, time.Since(start))
+}
+
+func (r *Runner) runWarmup(ctx context.Context, cache config.Cache) error {
+	img, err := r.pull(ctx, r.Config(), r.Config().C.Clients.Log.WithFields(log.FieldMap{"cache": cache.Name}), cache.Warmup.Image, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.Docker.ContainerCreate(ctx, &container.Config{
+		Image: img,
+		Cmd:   cache.Warmup.Command,
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: cache.Source,
+				Target: cache.Target,
+			},
+		},
+	}, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer r.Docker.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err := r.Docker.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	exit, waitErr := r.Docker.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+
+	select {
+	case res := <-exit:
+		if res.StatusCode != 0 {
+			return fmt.Errorf("warm-up command exited with status %d", res.StatusCode)
+		}
+		return nil
+	case err := <-waitErr:
+		return err
+	}
+}
@@ -1,15 +1,357 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/cgroup"
 	"github.com/tinyci/ci-runners/fw/config"
+	"github.com/tinyci/ci-runners/fw/dind"
 	"github.com/tinyci/ci-runners/fw/git"
+	"github.com/tinyci/ci-runners/fw/gpu"
+	"github.com/tinyci/ci-runners/fw/host"
+	"github.com/tinyci/ci-runners/fw/limits"
+	"github.com/tinyci/ci-runners/fw/logspool"
+	"github.com/tinyci/ci-runners/fw/logtail"
+	"github.com/tinyci/ci-runners/fw/namedcache"
+	"github.com/tinyci/ci-runners/fw/netpolicy"
+	"github.com/tinyci/ci-runners/fw/overlay"
+	"github.com/tinyci/ci-runners/fw/registry"
+	"github.com/tinyci/ci-runners/fw/secrets"
+	"github.com/tinyci/ci-runners/fw/security"
+	"github.com/tinyci/ci-runners/fw/tty"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+const (
+	defaultDiskMonitorInterval = 30 * time.Second
+	defaultDiskMinFree         = 5 * 1024 * 1024 * 1024
+	defaultDockerRoot          = "/var/lib/docker"
+	defaultReapInterval        = 10 * time.Minute
+	defaultUsageInterval       = 30 * time.Second
+	defaultServicesTimeout     = 2 * time.Minute
+	defaultPullTimeout         = 10 * time.Minute
+	defaultPullAttempts        = 3
+	defaultLogSpoolMaxWait     = time.Hour
+	defaultHealthInterval      = 10 * time.Second
+	defaultHealthTimeout       = 5 * time.Second
+	defaultContainerdAddress   = "/run/containerd/containerd.sock"
+	defaultContainerdNamespace = "tinyci"
+	defaultCtr                 = "ctr"
+
+	defaultWindowsDockerRoot    = `C:\ProgramData\docker`
+	defaultWindowsSecretsTarget = `C:\tinyci\secrets`
+)
+
+// Backends runs may be executed with.
+const (
+	BackendDocker     = "docker"
+	BackendContainerd = "containerd"
+)
+
+// Isolations of windows containers.
+const (
+	IsolationProcess = "process"
+	IsolationHyperV  = "hyperv"
 )
 
 // Config is the on-disk runner configuration
 type Config struct {
-	C              config.Config `yaml:"c,inline"`
-	Runner         git.Config    `yaml:"git"`
-	OverlayTempdir string        `yaml:"overlay_tempdir"`
+	C      config.Config `yaml:"c,inline"`
+	Runner git.Config    `yaml:"git"`
+	// OverlayTempdir is the directory the workspaces of runs are created in,
+	// named after the run. Defaults to the system temp dir.
+	OverlayTempdir string `yaml:"overlay_tempdir"`
+	// Backend is what runs are executed with: "docker", the default, or
+	// "containerd", for hosts without dockerd such as Kubernetes nodes. The
+	// containerd backend does not support services, steps, GPUs, cache
+	// warm-ups, image pruning, nor setting the user or capabilities of jobs.
+	Backend string `yaml:"backend"`
+	// Containerd configures the containerd backend.
+	Containerd *ContainerdConfig `yaml:"containerd"`
+	// Isolation is that of the containers of runs on windows hosts, which
+	// run windows containers with the docker backend: "process", sharing the
+	// kernel of the host, or "hyperv", in a utility VM of their own, which
+	// also runs images of older windows versions. Defaults to that of the
+	// docker daemon, which is reached over its named pipe unless DOCKER_HOST
+	// is set.
+	Isolation string `yaml:"isolation"`
+	// Workspace is how the writable copies of the repository and of writable
+	// caches are made for each run: "overlay", "btrfs", "zfs", "copy", or
+	// "auto", the default, to pick from the filesystems involved. They are
+	// created in OverlayTempdir.
+	Workspace string `yaml:"workspace"`
+	// HealthCheck is how the docker daemon, or containerd, is checked before
+	// runs are accepted. While it does not answer, no runs are accepted.
+	HealthCheck HealthCheck `yaml:"health_check"`
+	// ReapInterval is how often workspaces and containers left behind by
+	// crashed runs are cleaned up, besides at startup. Defaults to 10 minutes.
+	ReapInterval time.Duration `yaml:"reap_interval"`
+	// WorkspaceMaxSize, if set, is the amount of bytes a run may write to its
+	// workspace. Runs writing more are stopped and fail. Only applies to
+	// overlay and zfs workspaces, whose writes can be measured.
+	WorkspaceMaxSize uint64 `yaml:"workspace_max_size"`
+	// WorkspaceCheckInterval is how often the writes of a run are measured
+	// against WorkspaceMaxSize. Defaults to 30 seconds.
+	WorkspaceCheckInterval time.Duration `yaml:"workspace_check_interval"`
+	// PidsLimit, if set, is the amount of processes the container of each run
+	// may hold. CPU and memory are limited as requested by the run.
+	PidsLimit int64 `yaml:"pids_limit"`
+	// ServicesTimeout is how long the services of a run have to become
+	// healthy before the run fails. Defaults to 2 minutes.
+	ServicesTimeout time.Duration `yaml:"services_timeout"`
+	// GPUs, if set, are handed to the runs requesting them with the gpus
+	// metadata, and advertised with the gpu and gpus labels so GPU queues
+	// land on this runner.
+	GPUs *gpu.Config `yaml:"gpus"`
+	// Security confines the containers of runs: their seccomp and AppArmor
+	// profiles, capabilities, root filesystem and user. Runs may tighten it
+	// with the security metadata.
+	Security security.Config `yaml:"security"`
+	// Limits are the ulimits and sysctls of the containers of runs, which
+	// runs may set with the limits metadata within what the runner allows.
+	// Not supported by the containerd backend.
+	Limits limits.Config `yaml:"limits"`
+	// JobLog configures how the output of jobs is written to their log.
+	JobLog JobLog `yaml:"job_log"`
+	// LogBufferSize is the amount of job output, in bytes, held in memory while
+	// waiting to be shipped to the assetsvc. When exceeded, the oldest output
+	// is dropped rather than slowing down the job.
+	LogBufferSize int `yaml:"log_buffer_size"`
+	// LogLimit, if set, caps the size of the log of each run, keeping its
+	// tail.
+	LogLimit *LogLimit `yaml:"log_limit"`
+	// LogSpool, if set, holds the output of jobs on disk instead, so none of
+	// it is lost while the assetsvc is down: its upload is retried until it
+	// succeeds, or gives up MaxWait after the run.
+	LogSpool *LogSpool `yaml:"log_spool"`
+	// Caches are host-managed dependency caches mounted into each job container.
+	Caches []Cache `yaml:"caches"`
+	// NamedCaches, if set, keeps the caches tasks declare with the caches
+	// metadata between runs.
+	NamedCaches *namedcache.Config `yaml:"named_caches"`
+	// Cgroup, if set, confines the git and setup work done on the host for
+	// each run to its own cgroup with the configured limits.
+	Cgroup *cgroup.Config `yaml:"cgroup"`
+	// Registry, if set, configures the registry of images which do not name
+	// one and the mirrors images are pulled from.
+	Registry *registry.Config `yaml:"registry"`
+	// PullPolicy is when the images of runs and warm-ups are pulled: "always",
+	// the default, "if-not-present" or "never", for hosts with pre-baked
+	// images. Images pinned by digest are only pulled when not present.
+	PullPolicy registry.PullPolicy `yaml:"pull_policy"`
+	// PullTimeout bounds each attempt at pulling an image, so a stuck
+	// registry fails the pull rather than hanging the run until its timeout.
+	// Defaults to 10 minutes.
+	PullTimeout time.Duration `yaml:"pull_timeout"`
+	// PullRetry is how pulls failing for reasons other than the image not
+	// existing, or not being accessible, are retried.
+	PullRetry PullRetry `yaml:"pull_retry"`
+	// RequireDigest, if set, fails runs whose image is not pinned by digest,
+	// so each run of a task uses the same image.
+	RequireDigest bool `yaml:"require_digest"`
+	// ImagePrune, if set, removes the images runs have not used for a while
+	// every reap interval.
+	ImagePrune *ImagePrune `yaml:"image_prune"`
+	// Build, if set, builds the image of the runs asking for it with the
+	// build metadata from their repository with BuildKit, instead of pulling
+	// it. Not supported by the containerd backend.
+	Build *BuildConfig `yaml:"build"`
+	// Host lists the paths and devices of the host runs may ask for by name
+	// with the host metadata, such as a shared toolchain or /dev/kvm, rather
+	// than running privileged.
+	Host *host.Config `yaml:"host"`
+	// Network, if set, restricts the network access of runs by queue, or for
+	// pull requests from forks, such as to deny untrusted code the network.
+	// Runs may tighten it with the network metadata. The containerd backend
+	// only supports the full and none modes.
+	Network *netpolicy.Config `yaml:"network"`
+	// NestedDocker, if set, gives the runs asking for it with the docker
+	// metadata a docker daemon, e.g. to build images. Mind the isolation of
+	// each mode.
+	NestedDocker *dind.Config `yaml:"nested_docker"`
+	// Secrets, if set, hands the secrets of repositories to their runs, as
+	// environment variables and files, masking them in job logs.
+	Secrets *secrets.Config `yaml:"secrets"`
+	// DiskMonitor, if set, marks the runner unready and reclaims space when
+	// free disk space runs low.
+	DiskMonitor *DiskMonitor `yaml:"disk_monitor"`
+	// Scratch, if set, holds the writes made to the workspace of each run on
+	// a dedicated filesystem of limited size, so a runaway job fails with a
+	// full disk instead of filling the overlay temp dir. Only applies to
+	// overlay workspaces.
+	Scratch *overlay.ScratchConfig `yaml:"scratch"`
+	// PersistentWorkspaces, if set, keeps the workspaces of runs which opt in
+	// with the persistent_workspace metadata between runs of the same
+	// repository, branch and run, for incremental builds.
+	PersistentWorkspaces *workspace.PersistConfig `yaml:"persistent_workspaces"`
+}
+
+// DiskMonitor is the configuration of the disk pressure monitor. It watches
+// the filesystems holding the git repositories, the overlay temp dir and the
+// docker data root.
+type DiskMonitor struct {
+	// Interval is how often free space is checked. Defaults to 30 seconds.
+	Interval time.Duration `yaml:"interval"`
+	// MinFree is the amount of bytes that must be free on each filesystem for
+	// the runner to accept runs. Defaults to 5GiB.
+	MinFree uint64 `yaml:"min_free"`
+	// DockerRoot is the docker daemon's data root. Defaults to /var/lib/docker.
+	DockerRoot string `yaml:"docker_root"`
+}
+
+// HealthCheck is the configuration of the health check of the docker daemon,
+// or containerd. The docker client is made again while the daemon is down, in
+// case it comes back on another API version.
+type HealthCheck struct {
+	// Interval is how often the daemon is checked while it answers. Defaults
+	// to 10 seconds.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds each check. Defaults to 5 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+	// Backoff controls how often the daemon is checked while it does not
+	// answer.
+	Backoff config.PollConfig `yaml:"backoff"`
+}
+
+// ContainerdConfig is the configuration of the containerd backend, which
+// drives containerd with its ctr client.
+type ContainerdConfig struct {
+	// Address is the socket of containerd. Defaults to
+	// /run/containerd/containerd.sock.
+	Address string `yaml:"address"`
+	// Namespace is the containerd namespace of the images and containers of
+	// runs. Defaults to "tinyci".
+	Namespace string `yaml:"namespace"`
+	// Ctr is the path of the ctr client. Defaults to the ctr in PATH.
+	Ctr string `yaml:"ctr"`
+	// Snapshotter is the snapshotter images are unpacked with, and the root
+	// filesystems of containers made with. Defaults to that of containerd.
+	Snapshotter string `yaml:"snapshotter"`
+	// Runtime is the runtime of containers, e.g. io.containerd.runsc.v1 for
+	// gVisor. Defaults to that of containerd.
+	Runtime string `yaml:"runtime"`
+	// CNI networks containers with the CNI configuration of containerd
+	// instead of the network of the host.
+	CNI bool `yaml:"cni"`
+}
+
+// JobLog configures the output of jobs in their log.
+type JobLog struct {
+	// NoTTY runs jobs without a TTY, keeping stdout and stderr apart so what
+	// jobs write to stderr is colored. Jobs may behave differently without a
+	// TTY, e.g. not coloring their own output.
+	NoTTY bool `yaml:"no_tty"`
+	// Timestamps prefixes each line of output with the time it was written.
+	Timestamps bool `yaml:"timestamps"`
+	// StepNames prefixes each line of output of the steps of a run with the
+	// name of the step.
+	StepNames bool `yaml:"step_names"`
+	// TTY is the size of the terminal of jobs, which runs may change with the
+	// tty metadata. Defaults to 80 columns and 25 rows.
+	TTY tty.Size `yaml:"tty"`
+	// Term, if set, is the TERM of jobs run with a TTY, telling them which
+	// escape sequences the terminal emulation of the job log understands.
+	// Docker sets xterm otherwise.
+	Term string `yaml:"term"`
+}
+
+// PullRetry is the retry policy of image pulls.
+type PullRetry struct {
+	// Attempts is the amount of times each mirror, or the registry, is tried
+	// before moving on. Defaults to 3.
+	Attempts int `yaml:"attempts"`
+	// Backoff controls the delay between attempts.
+	Backoff config.PollConfig `yaml:"backoff"`
+}
+
+// BuildConfig is how the images of runs are built. With a CacheRepo, the
+// layers of the last build of each repository are pushed to it, inlined in
+// its image, and reused by the next build, on any runner.
+type BuildConfig struct {
+	// CacheRepo, if set, is the repository of the cache images, tagged after
+	// the repository of the run, e.g. "registry.internal/tinyci/cache".
+	CacheRepo string `yaml:"cache_repo"`
+	// Username and Password log in to the registry of CacheRepo, if it
+	// requires it. They may be references to Vault.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Forks, if set, also pushes the cache of pull requests from forks, whose
+	// Dockerfiles may not be trusted with the cache of the repository.
+	Forks bool `yaml:"forks"`
+}
+
+// LogLimit is the maximum size of job logs. Past it, output is no longer
+// shipped as it comes, but its tail is kept and added to the log once the
+// job is done, after a notice of how much was cut.
+type LogLimit struct {
+	// MaxSize is the size of the log, in bytes, past which output is cut.
+	MaxSize int64 `yaml:"max_size"`
+	// TailSize is the amount of output past MaxSize kept, in bytes. Defaults
+	// to 1MB.
+	TailSize int `yaml:"tail_size"`
+}
+
+// LogSpool is how the output of jobs is spooled to disk while it is shipped.
+// The assetsvc cannot resume a log, so an upload cut short is sent again
+// from the start, which it refuses if it kept what it got of the first; the
+// spool mostly helps with outages of the assetsvc at the start of runs.
+type LogSpool struct {
+	// Dir holds the spools, which are removed from it as soon as they are
+	// created and freed once shipped. Defaults to OverlayTempdir.
+	Dir string `yaml:"dir"`
+	// MaxSize is the size of the output, in bytes, past which the output of
+	// a job is dropped, with a marker in its log. Defaults to 256MB.
+	MaxSize int64 `yaml:"max_size"`
+	// MaxWait is how long the upload of a log is retried for once its run is
+	// over. Defaults to an hour.
+	MaxWait time.Duration `yaml:"max_wait"`
+	// Backoff controls the delay between attempts at uploading.
+	Backoff config.PollConfig `yaml:"backoff"`
+}
+
+// ImagePrune is the policy removing images no container uses. Images are
+// removed once unused by runs for MaxAge, then the least recently used until
+// the images total MaxSize.
+type ImagePrune struct {
+	// MaxAge is how long images are kept once runs no longer use them. The
+	// runner only knows of the use it made of images since it started.
+	MaxAge time.Duration `yaml:"max_age"`
+	// MaxSize is the total size of images, in bytes, above which the least
+	// recently used are removed.
+	MaxSize uint64 `yaml:"max_size"`
+}
+
+// Cache is a dependency cache (Go module cache, Maven repository, etc) kept
+// on the host and mounted into job containers. Jobs can never modify the
+// cache on the host; at most they write to a throwaway overlay on top of it.
+type Cache struct {
+	// Name identifies the cache in logs.
+	Name string `yaml:"name"`
+	// Source is the path to the cache on the host.
+	Source string `yaml:"source"`
+	// Target is the path the cache is mounted at inside the container.
+	Target string `yaml:"target"`
+	// Writable layers a per-run writable overlay over the cache, instead of
+	// mounting it read-only. Writes are discarded at the end of the run.
+	Writable bool `yaml:"writable"`
+	// Warmup is an optional job which periodically refreshes the cache.
+	Warmup *Warmup `yaml:"warmup"`
+}
+
+// Warmup is a periodic job run in a container with write access to a cache,
+// used to keep it populated. It only runs while the runner is idle.
+type Warmup struct {
+	// Image is the docker image to run the warm-up command in.
+	Image string `yaml:"image"`
+	// Command is the command to run, in execv() form.
+	Command []string `yaml:"command"`
+	// Interval is how often to run the warm-up job.
+	Interval time.Duration `yaml:"interval"`
 }
 
 // Config returns the configuration as a basic framework config so fw/config.Load() can work appropriately.
@@ -17,7 +359,360 @@ func (c *Config) Config() *config.Config {
 	return &c.C
 }
 
-// ExtraLoad does nothing and satisfies the fw/config.Config interface
+// ExtraLoad validates the overlay-runner specific portions of the configuration.
 func (c *Config) ExtraLoad() error {
+	if c.Cgroup != nil {
+		if err := c.Cgroup.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.OverlayTempdir != "" && !filepath.IsAbs(c.OverlayTempdir) {
+		return errors.New("overlay_tempdir must be absolute")
+	}
+
+	if err := workspace.ValidateType(c.Workspace); err != nil {
+		return err
+	}
+
+	switch c.Backend {
+	case "":
+		c.Backend = BackendDocker
+	case BackendDocker:
+	case BackendContainerd:
+		if err := c.validateContainerd(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid backend %q: must be %v or %v", c.Backend, BackendDocker, BackendContainerd)
+	}
+
+	if runtime.GOOS == "windows" {
+		if err := c.validateWindows(); err != nil {
+			return err
+		}
+	} else if c.Isolation != "" {
+		return errors.New("isolation is only supported on windows")
+	}
+
+	if c.JobLog.TTY.Width == 0 {
+		c.JobLog.TTY.Width = tty.DefaultWidth
+	}
+
+	if c.JobLog.TTY.Height == 0 {
+		c.JobLog.TTY.Height = tty.DefaultHeight
+	}
+
+	if err := c.JobLog.TTY.Validate(); err != nil {
+		return err
+	}
+
+	if c.HealthCheck.Interval <= 0 {
+		c.HealthCheck.Interval = defaultHealthInterval
+	}
+
+	if c.HealthCheck.Timeout <= 0 {
+		c.HealthCheck.Timeout = defaultHealthTimeout
+	}
+
+	if err := c.HealthCheck.Backoff.Validate(); err != nil {
+		return fmt.Errorf("health_check backoff: %w", err)
+	}
+
+	if c.ReapInterval <= 0 {
+		c.ReapInterval = defaultReapInterval
+	}
+
+	if c.PidsLimit < 0 {
+		return errors.New("pids_limit must not be negative")
+	}
+
+	if c.GPUs != nil {
+		if err := c.GPUs.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Security.Validate(); err != nil {
+		return err
+	}
+
+	if c.ServicesTimeout <= 0 {
+		c.ServicesTimeout = defaultServicesTimeout
+	}
+
+	if c.WorkspaceCheckInterval <= 0 {
+		c.WorkspaceCheckInterval = defaultUsageInterval
+	}
+
+	if c.NamedCaches != nil {
+		if err := c.NamedCaches.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.PersistentWorkspaces != nil {
+		if err := c.PersistentWorkspaces.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.PullPolicy.Validate(); err != nil {
+		return err
+	}
+
+	if c.PullTimeout <= 0 {
+		c.PullTimeout = defaultPullTimeout
+	}
+
+	if c.PullRetry.Attempts <= 0 {
+		c.PullRetry.Attempts = defaultPullAttempts
+	}
+
+	if err := c.PullRetry.Backoff.Validate(); err != nil {
+		return fmt.Errorf("pull_retry backoff: %w", err)
+	}
+
+	if c.ImagePrune != nil && c.ImagePrune.MaxAge <= 0 && c.ImagePrune.MaxSize == 0 {
+		return errors.New("image_prune needs a max_age or a max_size")
+	}
+
+	if c.Registry != nil {
+		if err := c.Registry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Build != nil {
+		// the tag is that of the repository of each run
+		if repo := c.Build.CacheRepo; strings.ContainsAny(repo[strings.LastIndex(repo, "/")+1:], ":@") {
+			return fmt.Errorf("invalid build cache_repo %q: must be a repository without a tag", repo)
+		}
+	}
+
+	if err := c.Limits.Validate(); err != nil {
+		return err
+	}
+
+	if c.Host != nil {
+		if err := c.Host.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Network != nil {
+		if err := c.Network.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.NestedDocker != nil {
+		if err := c.NestedDocker.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Secrets != nil {
+		if err := c.Secrets.Validate(); err != nil {
+			return err
+		}
+
+		if c.Secrets.VaultPath != "" {
+			if c.C.Clients.Vault == nil {
+				return errors.New("secrets vault_path requires vault to be configured")
+			}
+
+			c.Secrets.Vault = c.C.Clients.Vault
+		}
+	}
+
+	if c.LogLimit != nil {
+		if c.LogLimit.MaxSize <= 0 {
+			return errors.New("log_limit max_size must be positive")
+		}
+
+		if c.LogLimit.TailSize <= 0 {
+			c.LogLimit.TailSize = logtail.DefaultTailSize
+		}
+	}
+
+	if c.LogSpool != nil {
+		if c.LogSpool.Dir == "" {
+			c.LogSpool.Dir = c.OverlayTempdir
+		}
+
+		if c.LogSpool.Dir != "" && !filepath.IsAbs(c.LogSpool.Dir) {
+			return errors.New("log_spool dir must be absolute")
+		}
+
+		if c.LogSpool.MaxSize <= 0 {
+			c.LogSpool.MaxSize = logspool.DefaultMaxSize
+		}
+
+		if c.LogSpool.MaxWait <= 0 {
+			c.LogSpool.MaxWait = defaultLogSpoolMaxWait
+		}
+
+		if err := c.LogSpool.Backoff.Validate(); err != nil {
+			return fmt.Errorf("log_spool backoff: %w", err)
+		}
+	}
+
+	if c.Scratch != nil {
+		if err := c.Scratch.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.DiskMonitor != nil {
+		if c.DiskMonitor.Interval <= 0 {
+			c.DiskMonitor.Interval = defaultDiskMonitorInterval
+		}
+
+		if c.DiskMonitor.MinFree == 0 {
+			c.DiskMonitor.MinFree = defaultDiskMinFree
+		}
+
+		if c.DiskMonitor.DockerRoot == "" {
+			c.DiskMonitor.DockerRoot = defaultDockerRoot
+		}
+	}
+
+	names := map[string]struct{}{}
+
+	for _, cache := range c.Caches {
+		if cache.Name == "" {
+			return errors.New("caches must have a name")
+		}
+
+		if _, ok := names[cache.Name]; ok {
+			return fmt.Errorf("cache %q is defined more than once", cache.Name)
+		}
+		names[cache.Name] = struct{}{}
+
+		if !filepath.IsAbs(cache.Source) || !filepath.IsAbs(cache.Target) {
+			return fmt.Errorf("cache %q: source and target must be absolute", cache.Name)
+		}
+
+		if cache.Warmup != nil {
+			if cache.Warmup.Image == "" || len(cache.Warmup.Command) == 0 {
+				return fmt.Errorf("cache %q: warmup requires an image and a command", cache.Name)
+			}
+
+			if cache.Warmup.Interval <= 0 {
+				return fmt.Errorf("cache %q: warmup interval must be positive", cache.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateContainerd sets the defaults of the containerd backend, and errors
+// out on features it does not support.
+func (c *Config) validateContainerd() error {
+	if c.Containerd == nil {
+		c.Containerd = &ContainerdConfig{}
+	}
+
+	if c.Containerd.Address == "" {
+		c.Containerd.Address = defaultContainerdAddress
+	}
+
+	if c.Containerd.Namespace == "" {
+		c.Containerd.Namespace = defaultContainerdNamespace
+	}
+
+	if c.Containerd.Ctr == "" {
+		c.Containerd.Ctr = defaultCtr
+	}
+
+	if c.GPUs != nil {
+		return errors.New("gpus are not supported by the containerd backend")
+	}
+
+	if c.ImagePrune != nil {
+		return errors.New("image_prune is not supported by the containerd backend")
+	}
+
+	if c.PidsLimit != 0 {
+		return errors.New("pids_limit is not supported by the containerd backend")
+	}
+
+	if len(c.Limits.Ulimits) != 0 || len(c.Limits.Sysctls) != 0 {
+		return errors.New("limits are not supported by the containerd backend")
+	}
+
+	if c.Build != nil {
+		return errors.New("build is not supported by the containerd backend")
+	}
+
+	if c.Network != nil && c.Network.Proxy != nil {
+		return errors.New("network proxy is not supported by the containerd backend")
+	}
+
+	if c.NestedDocker != nil && c.NestedDocker.Mode == dind.ModeDinD {
+		return errors.New("nested_docker dind mode is not supported by the containerd backend")
+	}
+
+	if c.Security.User != "" || c.Security.UsernsMode != "" || len(c.Security.CapAdd) != 0 || len(c.Security.CapDrop) != 0 || len(c.Security.AllowCapAdd) != 0 {
+		return errors.New("security user, userns_mode and capabilities are not supported by the containerd backend")
+	}
+
+	for _, cache := range c.Caches {
+		if cache.Warmup != nil {
+			return fmt.Errorf("cache %q: warmups are not supported by the containerd backend", cache.Name)
+		}
+	}
+
+	return nil
+}
+
+// validateWindows sets the defaults of windows hosts, and errors out on
+// features windows containers, or the host, do not support.
+func (c *Config) validateWindows() error {
+	if c.Backend != BackendDocker {
+		return errors.New("only the docker backend is supported on windows")
+	}
+
+	switch c.Isolation {
+	case "", IsolationProcess, IsolationHyperV:
+	default:
+		return fmt.Errorf("invalid isolation %q: must be %v or %v", c.Isolation, IsolationProcess, IsolationHyperV)
+	}
+
+	if c.DiskMonitor != nil && c.DiskMonitor.DockerRoot == "" {
+		c.DiskMonitor.DockerRoot = defaultWindowsDockerRoot
+	}
+
+	if c.Secrets != nil && c.Secrets.FilesTarget == "" {
+		c.Secrets.FilesTarget = defaultWindowsSecretsTarget
+	}
+
+	if c.Cgroup != nil || c.Scratch != nil || c.PersistentWorkspaces != nil {
+		return errors.New("cgroup, scratch and persistent_workspaces are not supported on windows")
+	}
+
+	if c.GPUs != nil || (c.Host != nil && len(c.Host.Devices) != 0) {
+		return errors.New("gpus and host devices are not supported on windows")
+	}
+
+	if c.PidsLimit != 0 || len(c.Limits.Ulimits) != 0 || len(c.Limits.Sysctls) != 0 {
+		return errors.New("pids_limit and limits are not supported on windows")
+	}
+
+	if c.Build != nil || c.NestedDocker != nil {
+		return errors.New("build and nested_docker are not supported on windows")
+	}
+
+	if c.Network != nil && c.Network.Proxy != nil {
+		return errors.New("network proxy is not supported on windows")
+	}
+
+	sec := c.Security
+	if sec.SeccompProfile != "" || sec.AppArmorProfile != "" || len(sec.CapAdd) != 0 || len(sec.CapDrop) != 0 || len(sec.AllowCapAdd) != 0 || sec.ReadOnlyRootfs || sec.NoNewPrivileges || sec.UsernsMode != "" {
+		return errors.New("security options other than user are not supported on windows")
+	}
+
 	return nil
 }
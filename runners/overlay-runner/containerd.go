@@ -0,0 +1,448 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/fatih/color"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/netpolicy"
+	"github.com/tinyci/ci-runners/fw/workspace"
+	"github.com/tinyci/ci-runners/runners/overlay-runner/config"
+)
+
+// containerd returns true if runs are executed with containerd instead of
+// docker.
+func (r *Runner) containerd() bool {
+	return r.Config().Backend == config.BackendContainerd
+}
+
+// ctr returns the command running the ctr client with the arguments against
+// the configured containerd namespace.
+func (r *Runner) ctr(ctx context.Context, args ...string) *exec.Cmd {
+	cfg := r.Config().Containerd
+	return exec.CommandContext(ctx, cfg.Ctr, append([]string{"--address", cfg.Address, "--namespace", cfg.Namespace}, args...)...)
+}
+
+// ctrOutput runs ctr with the arguments and returns its output. Errors hold
+// what it wrote to stderr.
+func (r *Runner) ctrOutput(ctx context.Context, args ...string) (string, error) {
+	var stderr bytes.Buffer
+
+	cmd := r.ctr(ctx, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		name := args[0]
+		if len(args) > 1 {
+			name += " " + args[1]
+		}
+
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("ctr %v: %w: %v", name, err, msg)
+		}
+
+		return "", fmt.Errorf("ctr %v: %w", name, err)
+	}
+
+	return string(out), nil
+}
+
+// containerdServerVersion returns the version of containerd.
+func (r *Runner) containerdServerVersion(ctx context.Context) (string, error) {
+	out, err := r.ctrOutput(ctx, "version")
+	if err != nil {
+		return "", err
+	}
+
+	server := false
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "Server:" {
+			server = true
+		} else if server && strings.HasPrefix(line, "Version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Version:")), nil
+		}
+	}
+
+	return "", errors.New("ctr version: containerd did not report its version")
+}
+
+// ctrImagePresent returns true if the image is present in containerd.
+func (r *Runner) ctrImagePresent(ctx context.Context, ref string) (bool, error) {
+	out, err := r.ctrOutput(ctx, "images", "list", "-q")
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == ref {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ctrPullRef pulls and unpacks the image. ctr redraws its progress as on a
+// terminal, so it is only written to the job log should the pull fail.
+func (r *Runner) ctrPullRef(ctx context.Context, ref string, w io.Writer) error {
+	args := []string{"images", "pull"}
+	if snapshotter := r.Config().Containerd.Snapshotter; snapshotter != "" {
+		args = append(args, "--snapshotter", snapshotter)
+	}
+
+	fmt.Fprintf(w, "\nPulling image %v\n", ref)
+
+	var output bytes.Buffer
+
+	cmd := r.ctr(ctx, append(args, ref)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		w.Write(output.Bytes())
+		return fmt.Errorf("ctr images pull: %w", err)
+	}
+
+	fmt.Fprint(w, color.New(color.FgGreen).Sprint("Completed pull of image\n\n"))
+
+	return nil
+}
+
+// taskID is the id of the container of the run in containerd, which is
+// stricter than docker about ids.
+func (r *Run) taskID() string {
+	return "tinyci-" + r.instanceID()
+}
+
+// ctrArgs returns the arguments of ctr run creating the container of the run
+// from the image, with the workspace and caches mounted.
+func (r *Run) ctrArgs(img string, ws workspace.Workspace, caches []mount.Mount) ([]string, error) {
+	cfg := r.config.Containerd
+	settings := r.runCtx.QueueItem.Run.Settings
+	args := []string{"run"}
+
+	if cfg.Snapshotter != "" {
+		args = append(args, "--snapshotter", cfg.Snapshotter)
+	}
+
+	if cfg.Runtime != "" {
+		args = append(args, "--runtime", cfg.Runtime)
+	}
+
+	switch {
+	case r.netMode == netpolicy.ModeNone:
+		// a network namespace of its own, with only the loopback
+	case cfg.CNI:
+		args = append(args, "--cni")
+	default:
+		args = append(args, "--net-host")
+	}
+
+	for key, value := range r.labels() {
+		args = append(args, "--label", key+"="+value)
+	}
+
+	if workdir := r.runCtx.QueueItem.Run.Task.Settings.Workdir; workdir != "" {
+		args = append(args, "--cwd", workdir)
+	}
+
+	for _, env := range r.env() {
+		args = append(args, "--env", env)
+	}
+
+	resources, err := r.containerResources()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resources.DeviceRequests) != 0 {
+		return nil, fw.Classed(fw.ErrUserJob, errors.New("gpus are not supported by the containerd backend"))
+	}
+
+	for _, d := range resources.Devices {
+		// ctr hands devices at the same path, with all permissions
+		if d.PathInContainer != d.PathOnHost || d.CgroupPermissions != "rwm" {
+			return nil, fw.Classed(fw.ErrUserJob, fmt.Errorf("host device %v: a target or permissions are not supported by the containerd backend", d.PathOnHost))
+		}
+
+		args = append(args, "--device", d.PathOnHost)
+	}
+
+	if resources.NanoCPUs != 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(float64(resources.NanoCPUs)/1e9, 'f', -1, 64))
+	}
+
+	if resources.Memory != 0 {
+		args = append(args, "--memory-limit", strconv.FormatInt(resources.Memory, 10))
+	}
+
+	lim, err := r.limits()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lim.Ulimits) != 0 || len(lim.Sysctls) != 0 {
+		return nil, fw.Classed(fw.ErrUserJob, errors.New("ulimits and sysctls are not supported by the containerd backend"))
+	}
+
+	security, err := r.ctrSecurityArgs()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, security...)
+
+	mounts := append([]mount.Mount{
+		{
+			Type:   mount.TypeBind,
+			Source: ws.Path(),
+			Target: r.runCtx.QueueItem.Run.Task.Settings.Mountpoint,
+		},
+	}, caches...)
+
+	for _, m := range mounts {
+		options := "rbind:rw"
+		if m.ReadOnly {
+			options = "rbind:ro"
+		}
+
+		args = append(args, "--mount", fmt.Sprintf("type=bind,src=%v,dst=%v,options=%v", m.Source, m.Target, options))
+	}
+
+	return append(append(args, img, r.taskID()), settings.Command...), nil
+}
+
+// ctrSecurityArgs returns the arguments of ctr run confining the container of
+// the run as configured, tightened by the options of the run.
+func (r *Run) ctrSecurityArgs() ([]string, error) {
+	opts, err := r.securityOptions()
+	if err != nil {
+		return nil, fw.Classed(fw.ErrUserJob, fmt.Errorf("invalid security options: %w", err))
+	}
+
+	sec, err := r.config.Security.Apply(opts)
+	if err != nil {
+		return nil, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if sec.User != "" || len(sec.CapAdd) != 0 || len(sec.CapDrop) != 0 {
+		return nil, fw.Classed(fw.ErrUserJob, errors.New("setting the user or capabilities is not supported by the containerd backend"))
+	}
+
+	if r.runCtx.QueueItem.Run.Settings.Privileged {
+		return []string{"--privileged", "--allow-new-privs"}, nil
+	}
+
+	args := []string{}
+
+	// as docker does, confine containers with the default profile unless
+	// told otherwise
+	switch sec.SeccompProfile {
+	case "":
+		args = append(args, "--seccomp")
+	case "unconfined":
+	default:
+		args = append(args, "--seccomp", "--seccomp-profile", sec.SeccompProfile)
+	}
+
+	if sec.AppArmorProfile != "" {
+		args = append(args, "--apparmor-profile", sec.AppArmorProfile)
+	}
+
+	if sec.ReadOnlyRootfs {
+		args = append(args, "--read-only", "--mount", "type=tmpfs,src=tmpfs,dst=/tmp,options=nosuid:nodev")
+	}
+
+	// ctr denies new privileges by default, unlike docker
+	if !sec.NoNewPrivileges {
+		args = append(args, "--allow-new-privs")
+	}
+
+	return args, nil
+}
+
+// runTask runs the container of the run to completion, writing its output to
+// w, and returns whether the job succeeded.
+func (r *Run) runTask(w io.Writer, img string, ws workspace.Workspace, caches []mount.Mount) (bool, error) {
+	args, err := r.ctrArgs(img, ws, caches)
+	if err != nil {
+		r.mirrorLog(w, "%v", err)
+		return false, err
+	}
+
+	if err := r.removeOrphanTask(r.runCtx.Ctx); err != nil {
+		r.mirrorLog(w, "%v", err)
+		return false, fw.Retryable(err)
+	}
+
+	// the pid file is only written once the task is created, telling errors
+	// of ctr from the exit status of the job
+	dir, err := ioutil.TempDir("", "tinyci-ctr")
+	if err != nil {
+		return false, fw.Retryable(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidFile := filepath.Join(dir, "pid")
+	args = append(args[:1], append([]string{"--pid-file", pidFile}, args[1:]...)...)
+
+	cfg := r.config.JobLog
+	stdout := &lineWriter{w: w, timestamps: cfg.Timestamps}
+	stderr := &lineWriter{w: w, timestamps: cfg.Timestamps, color: stderrColor}
+
+	cmd := r.runner.ctr(r.runCtx.Ctx, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	r.containerID = r.taskID()
+	err = cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+
+	if _, statErr := os.Stat(pidFile); os.IsNotExist(statErr) {
+		if err == nil {
+			err = errors.New("the task was not created")
+		}
+
+		r.mirrorLog(w, "could not run container: %v", err)
+		return false, fw.Retryable(err)
+	}
+
+	select {
+	case <-r.runCtx.Ctx.Done():
+		return false, r.runCtx.Ctx.Err()
+	default:
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// containerd does not tell whether the task ran out of memory
+		r.reportExit(exitStatus(exitErr.ExitCode(), false), w)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	r.reportExit(exitStatus(0, false), w)
+
+	return true, nil
+}
+
+// ctrLabels returns the labels of the container, or nil if it does not exist.
+func (r *Runner) ctrLabels(ctx context.Context, id string) (map[string]string, error) {
+	out, err := r.ctrOutput(ctx, "containers", "list", "-q")
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == id {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	out, err = r.ctrOutput(ctx, "containers", "info", id)
+	if err != nil {
+		return nil, err
+	}
+
+	var info struct {
+		Labels map[string]string
+	}
+
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return nil, fmt.Errorf("ctr containers info %v: %w", id, err)
+	}
+
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+
+	return info.Labels, nil
+}
+
+// removeOrphanTask removes the container of the run if it was left behind by
+// a runner which is gone, so its id may be reused.
+func (r *Run) removeOrphanTask(ctx context.Context) error {
+	labels, err := r.runner.ctrLabels(ctx, r.taskID())
+	if err != nil || labels == nil {
+		return err
+	}
+
+	if !leftBehind(labels) {
+		return fmt.Errorf("container %v is in use", r.taskID())
+	}
+
+	return r.runner.removeTask(ctx, r.taskID())
+}
+
+// removeTask kills the task of the container, if any, and removes them.
+func (r *Runner) removeTask(ctx context.Context, id string) error {
+	// fails if the task is gone already
+	r.ctrOutput(ctx, "tasks", "delete", "--force", id)
+
+	_, err := r.ctrOutput(ctx, "containers", "delete", id)
+	return err
+}
+
+// reapTasks removes the containers of runs left behind by runs which did not
+// finish. The runner must be idle.
+func (r *Runner) reapTasks(ctx context.Context) {
+	logger := r.Config().C.Clients.Log
+
+	out, err := r.ctrOutput(ctx, "containers", "list", "-q")
+	if err != nil {
+		logger.Errorf(ctx, "Could not list stale containers: %v", err)
+		return
+	}
+
+	removed := 0
+
+	for _, id := range strings.Fields(out) {
+		if !strings.HasPrefix(id, "tinyci-") {
+			continue
+		}
+
+		labels, err := r.ctrLabels(ctx, id)
+		if err != nil {
+			logger.Errorf(ctx, "Could not inspect container %v: %v", id, err)
+			continue
+		}
+
+		if labels == nil || !r.orphaned(labels) {
+			continue
+		}
+
+		if err := r.removeTask(ctx, id); err != nil {
+			logger.Errorf(ctx, "Could not remove stale container %v: %v", id, err)
+			continue
+		}
+
+		removed++
+	}
+
+	if removed != 0 {
+		logger.Infof(ctx, "Removed %d stale containers", removed)
+	}
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// Labels of the containers and networks made for runs.
+const (
+	labelQueue  = "tinyci.queue"
+	labelRunID  = "tinyci.run_id"
+	labelTaskID = "tinyci.task_id"
+	// labelRun is the name of the run, telling whether it is still live.
+	labelRun    = "tinyci.run"
+	labelRunner = "tinyci.runner"
+	// labelPID is the pid of the runner process, telling which runner may
+	// clean them up once left behind.
+	labelPID = "tinyci.pid"
+)
+
+// unsafeContainerName matches the characters docker refuses in names.
+var unsafeContainerName = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// instanceID is the id of the run, followed by the index of its matrix cell
+// if any, so that the cells of a run executed side by side get containers,
+// networks and images of their own.
+func (r *Run) instanceID() string {
+	id := strconv.FormatInt(r.runCtx.QueueItem.Run.Id, 10)
+	if cell := r.runCtx.Cell; cell != nil {
+		id += "." + strconv.Itoa(cell.Index)
+	}
+
+	return id
+}
+
+// containerName is the name of the container of the run, after its queue and
+// instance id.
+func (r *Run) containerName() string {
+	return unsafeContainerName.ReplaceAllString(fmt.Sprintf("%v.%v", r.runCtx.QueueItem.QueueName, r.instanceID()), "_")
+}
+
+// labels returns the labels of the containers and networks of the run.
+func (r *Run) labels() map[string]string {
+	qi := r.runCtx.QueueItem
+
+	return map[string]string{
+		labelQueue:  qi.QueueName,
+		labelRunID:  strconv.FormatInt(qi.Run.Id, 10),
+		labelTaskID: strconv.FormatInt(qi.Run.Task.Id, 10),
+		labelRun:    r.name,
+		labelRunner: r.runner.Hostname(),
+		labelPID:    strconv.Itoa(os.Getpid()),
+	}
+}
+
+// orphaned returns true if the labels are those of a run of this runner
+// process which is no longer live, or of a runner process which is gone.
+func (r *Runner) orphaned(labels map[string]string) bool {
+	pid, err := strconv.Atoi(labels[labelPID])
+	return err == nil && workspace.Orphaned(pid, labels[labelRun], r.liveRuns())
+}
+
+// leftBehind returns true if the labels are those of another runner process
+// which is gone. What this process made is never taken as left behind, as it
+// may belong to another run, or cell, in progress.
+func leftBehind(labels map[string]string) bool {
+	pid, err := strconv.Atoi(labels[labelPID])
+	return err == nil && pid != os.Getpid() && workspace.Orphaned(pid, "", nil)
+}
+
+// removeOrphan removes the container of the name if it was left behind by a
+// runner which is gone, so its name may be reused.
+func (r *Run) removeOrphan(ctx context.Context, name string) error {
+	info, err := r.runner.Docker.ContainerInspect(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if !leftBehind(info.Config.Labels) {
+		return fmt.Errorf("container %v is in use", name)
+	}
+
+	return r.runner.Docker.ContainerRemove(ctx, info.ID, types.ContainerRemoveOptions{Force: true})
+}
+
+// reapContainers removes the containers of runs, and of their services, left
+// behind by runs which did not finish. The runner must be idle.
+func (r *Runner) reapContainers(ctx context.Context) {
+	logger := r.Config().C.Clients.Log
+
+	containers, err := r.Docker.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("label", labelPID))})
+	if err != nil {
+		logger.Errorf(ctx, "Could not list stale containers: %v", err)
+		return
+	}
+
+	removed := 0
+
+	for _, c := range containers {
+		if !r.orphaned(c.Labels) {
+			continue
+		}
+
+		if err := r.Docker.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil && !errdefs.IsNotFound(err) {
+			logger.Errorf(ctx, "Could not remove stale container %v: %v", c.ID, err)
+			continue
+		}
+
+		removed++
+	}
+
+	if removed != 0 {
+		logger.Infof(ctx, "Removed %d stale containers", removed)
+	}
+}
+
+// reapVolumes removes the volumes of services left behind by runs which did
+// not finish. The runner must be idle.
+func (r *Runner) reapVolumes(ctx context.Context) {
+	logger := r.Config().C.Clients.Log
+
+	volumes, err := r.Docker.VolumeList(ctx, filters.NewArgs(filters.Arg("label", labelPID)))
+	if err != nil {
+		logger.Errorf(ctx, "Could not list stale volumes: %v", err)
+		return
+	}
+
+	removed := 0
+
+	for _, v := range volumes.Volumes {
+		if !r.orphaned(v.Labels) {
+			continue
+		}
+
+		if err := r.Docker.VolumeRemove(ctx, v.Name, false); err != nil && !errdefs.IsNotFound(err) {
+			logger.Errorf(ctx, "Could not remove stale volume %v: %v", v.Name, err)
+			continue
+		}
+
+		removed++
+	}
+
+	if removed != 0 {
+		logger.Infof(ctx, "Removed %d stale volumes", removed)
+	}
+}
@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/dind"
+	"github.com/tinyci/ci-runners/fw/services"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// dockerSocket is where the socket of the dedicated daemon is mounted in the
+// container, where docker clients look for it.
+const dockerSocket = "/var/run/docker.sock"
+
+// dockerRequested returns true if the metadata of the run, or failing that of
+// its task, asks for a docker daemon.
+func (r *Run) dockerRequested() (bool, error) {
+	md := r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()
+	if _, ok := md[dind.DockerKey]; !ok {
+		md = r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap()
+	}
+
+	requested, err := dind.FromMetadata(md)
+	if err != nil || !requested {
+		return false, err
+	}
+
+	if r.config.NestedDocker == nil {
+		return false, fw.Classed(fw.ErrUserJob, errors.New("a docker daemon was requested, but the runner does not provide one"))
+	}
+
+	return true, nil
+}
+
+// dockerSocketMount returns the mount of the socket of the dedicated daemon,
+// in socket mode.
+func (r *Run) dockerSocketMount() mount.Mount {
+	r.dockerHost = "unix://" + dockerSocket
+
+	return mount.Mount{
+		Type:   mount.TypeBind,
+		Source: r.config.NestedDocker.Socket,
+		Target: dockerSocket,
+	}
+}
+
+// dindService returns the docker daemon of the run in dind mode, started as a
+// service, with its storage in the overlay temp dir.
+func (r *Run) dindService() (serviceSpec, error) {
+	dir, err := workspace.MkdirTemp(r.config.OverlayTempdir, r.name+"-docker")
+	if err != nil {
+		return serviceSpec{}, err
+	}
+	r.dindDir = dir
+
+	r.dockerHost = fmt.Sprintf("tcp://%v:%d", dind.Host, dind.Port)
+
+	return serviceSpec{
+		Service: services.Service{
+			Name:  dind.Host,
+			Image: r.config.NestedDocker.Image,
+			// no TLS: the daemon is only reachable from the network of the run
+			Env:         []string{"DOCKER_TLS_CERTDIR="},
+			Healthcheck: []string{"docker", "info"},
+		},
+		privileged: true,
+		mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: dir,
+				Target: "/var/lib/docker",
+			},
+		},
+	}, nil
+}
+
+// removeDinD removes the storage of the docker daemon of the run, which must
+// be stopped.
+func (r *Run) removeDinD() {
+	if r.dindDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(r.dindDir); err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(r.runCtx.Ctx, "Could not remove docker storage: %v", err)
+	}
+	r.dindDir = ""
+}
@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw/disk"
+	"github.com/tinyci/ci-runners/fw/git"
+	"github.com/tinyci/ci-runners/runners/overlay-runner/config"
+)
+
+// StartDiskMonitor launches the disk pressure monitor, if configured. While
+// any monitored filesystem is low on space the runner reports itself as not
+// ready, and space is reclaimed from caches and images. The monitor keeps the
+// settings it was started with. This function does not block.
+func (r *Runner) StartDiskMonitor() {
+	dm := r.Config().DiskMonitor
+	if dm == nil {
+		return
+	}
+
+	go func() {
+		for {
+			r.checkDisk(dm)
+			time.Sleep(dm.Interval)
+		}
+	}()
+}
+
+func (r *Runner) monitoredPaths(dm *config.DiskMonitor) []string {
+	cfg := r.Config()
+
+	tempdir := cfg.OverlayTempdir
+	if tempdir == "" {
+		tempdir = os.TempDir()
+	}
+
+	return []string{cfg.Runner.BaseRepoPath, tempdir, dm.DockerRoot}
+}
+
+// lowDisk returns the monitored paths whose filesystem is below the free space
+// threshold.
+func (r *Runner) lowDisk(ctx context.Context, dm *config.DiskMonitor) []string {
+	low := []string{}
+
+	for _, path := range r.monitoredPaths(dm) {
+		free, _, err := disk.Free(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r.Config().C.Clients.Log.Errorf(ctx, "Could not check free space of %v: %v", path, err)
+			}
+			continue
+		}
+
+		if free < dm.MinFree {
+			low = append(low, path)
+		}
+	}
+
+	return low
+}
+
+func (r *Runner) setDiskPressure(pressure bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.diskPressure = pressure
+}
+
+func (r *Runner) checkDisk(dm *config.DiskMonitor) {
+	ctx, cancel := context.WithTimeout(context.Background(), dm.Interval)
+	defer cancel()
+
+	low := r.lowDisk(ctx, dm)
+	r.setDiskPressure(len(low) != 0)
+
+	if len(low) == 0 {
+		return
+	}
+
+	logger := r.Config().C.Clients.Log
+	logger.Errorf(ctx, "Disk pressure detected on %v; not accepting runs until space is reclaimed", low)
+
+	if !r.acquire() {
+		// a run is in progress; try again once it's done.
+		return
+	}
+	defer r.release()
+
+	r.reclaim(ctx, dm.MinFree)
+
+	low = r.lowDisk(ctx, dm)
+	r.setDiskPressure(len(low) != 0)
+
+	if len(low) == 0 {
+		logger.Info(ctx, "Disk pressure relieved; accepting runs")
+	} else {
+		logger.Errorf(ctx, "Disk pressure remains on %v after reclaiming space", low)
+	}
+}
+
+// reclaim frees space as the regular upkeep of the runner would, only
+// sooner: dangling docker images and build cache are removed, then the image
+// prune policy is applied, and the least recently used git repositories are
+// evicted until the filesystem of the repository cache has minFree bytes
+// free. The runner must be idle. containerd collects the content no image
+// references itself.
+func (r *Runner) reclaim(ctx context.Context, minFree uint64) {
+	if !r.containerd() {
+		r.pruneDocker(ctx)
+		r.pruneImages(ctx)
+	}
+
+	cfg := r.Config()
+	logger := cfg.C.Clients.Log.WithFields(log.FieldMap{"base_repo_path": cfg.Runner.BaseRepoPath})
+
+	if err := git.Reclaim(ctx, cfg.Runner, logger, minFree); err != nil {
+		logger.Errorf(ctx, "Reclaiming space from the repository cache: %v", err)
+	}
+}
+
+// pruneDocker removes dangling docker images and build cache, which no
+// image or build refers to anymore.
+func (r *Runner) pruneDocker(ctx context.Context) {
+	logger := r.Config().C.Clients.Log
+
+	images, err := r.Docker.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
+	if err != nil {
+		logger.Errorf(ctx, "Pruning dangling docker images: %v", err)
+	} else {
+		logger.Infof(ctx, "Pruned %d dangling docker images, reclaiming %d bytes", len(images.ImagesDeleted), images.SpaceReclaimed)
+	}
+
+	buildCache, err := r.Docker.BuildCachePrune(ctx, types.BuildCachePruneOptions{})
+	if err != nil {
+		logger.Errorf(ctx, "Pruning docker build cache: %v", err)
+	} else {
+		logger.Infof(ctx, "Pruned dangling docker build cache, reclaiming %d bytes", buildCache.SpaceReclaimed)
+	}
+}
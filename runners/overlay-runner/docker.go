@@ -2,10 +2,14 @@ package runner
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -13,8 +17,17 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/fatih/color"
-	"github.com/tinyci/ci-runners/fw/overlay"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/dind"
+	"github.com/tinyci/ci-runners/fw/netpolicy"
+	"github.com/tinyci/ci-runners/fw/registry"
+	"github.com/tinyci/ci-runners/fw/retry"
+	"github.com/tinyci/ci-runners/fw/runenv"
+	"github.com/tinyci/ci-runners/fw/secrets"
+	"github.com/tinyci/ci-runners/fw/sections"
+	"github.com/tinyci/ci-runners/fw/workspace"
 )
 
 func init() {
@@ -55,7 +68,6 @@ func processLine(m map[string]interface{}, idMap map[string][]float64) bool {
 
 func outputPullRead(w io.Writer, r io.Reader) error {
 	fmt.Fprintln(w)
-	defer fmt.Fprint(w, color.New(color.FgGreen).Sprint("\nCompleted pull of docker image\n\n"))
 	// map id -> progress report (two floats, current and total)
 	idMap := map[string][]float64{}
 
@@ -66,6 +78,11 @@ func outputPullRead(w io.Writer, r io.Reader) error {
 			return err
 		}
 
+		// the daemon reports failures midway through the pull in the stream
+		if msg, ok := m["error"].(string); ok && msg != "" {
+			return errors.New(msg)
+		}
+
 		if processLine(m, idMap) {
 			continue
 		}
@@ -86,125 +103,228 @@ func outputPullRead(w io.Writer, r io.Reader) error {
 		}
 	}
 
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprint(w, color.New(color.FgGreen).Sprint("\nCompleted pull of docker image\n\n"))
+
 	return nil
 }
 
-func (r *Run) mirrorLog(pw *io.PipeWriter, format string, args ...interface{}) {
+func (r *Run) mirrorLog(w io.Writer, format string, args ...interface{}) {
 	r.runner.LogsvcClient(r.runCtx).Errorf(r.runCtx.Ctx, format, args...)
 
 	select {
 	case <-r.runCtx.Ctx.Done():
 		return
 	default:
-		color.New(color.FgHiRed, color.Bold).Fprintf(pw, "\r\nERROR: "+format+"\n", args...)
+		color.New(color.FgHiRed, color.Bold).Fprintf(w, "\r\nERROR: "+format+"\n", args...)
 	}
 }
 
-func (r *Run) pullImage(client *client.Client, pw *io.PipeWriter) (string, error) {
+func (r *Run) pullImage(ctx context.Context, w io.Writer) (string, error) {
 	img := r.runCtx.QueueItem.Run.Settings.Image
 	start := time.Now()
 	r.runner.LogsvcClient(r.runCtx).Debugf(context.Background(), "starting pull of image %v", img)
 
-	pullRead, err := client.ImagePull(r.runCtx.Ctx, img, types.ImagePullOptions{})
-	if err != nil {
-		return "", err
+	if r.config.RequireDigest && !registry.HasDigest(img) {
+		return "", fw.Classed(fw.ErrUserJob, fmt.Errorf("image %v must be pinned by digest, e.g. %v@sha256:...", img, img))
 	}
-	defer pullRead.Close()
 
-	if err := outputPullRead(pw, pullRead); err != nil {
-		r.mirrorLog(pw, "pull of image %v failed with error: %v", img, err)
+	ref, err := r.runner.pull(ctx, r.config, r.runner.LogsvcClient(r.runCtx), img, w)
+	if err != nil {
+		r.mirrorLog(w, "pull of image %v failed with error: %v", img, err)
 		return "", err
 	}
 
-	r.runner.LogsvcClient(r.runCtx).Debugf(context.Background(), "pull of image %v succeeded in %v", img, time.Since(start))
+	r.runner.LogsvcClient(r.runCtx).Debugf(context.Background(), "pull of image %v as %v succeeded in %v", img, ref, time.Since(start))
 
-	return img, nil
+	return ref, nil
 }
 
-func (r *Run) boot(client *client.Client, pw *io.PipeWriter, img string, m *overlay.Mount) error {
+// env returns the environment of the job: the run and commit metadata,
+// secrets, the docker daemon and egress proxy if any, and the environment of
+// the task and run settings, with the references to the metadata in their
+// values expanded.
+func (r *Run) env() []string {
+	vars := runenv.Vars(r.runCtx.QueueItem, r.runner.Hostname())
+
+	// metadata comes first so the settings may override it
+	env := runenv.Env(vars)
+	if r.commit != nil {
+		for _, e := range r.commit.Env() {
+			env = append(env, e)
+
+			parts := strings.SplitN(e, "=", 2)
+			vars[parts[0]] = parts[1]
+		}
+	}
+	env = append(env, secrets.Env(r.secrets)...)
+	if r.dockerHost != "" {
+		env = append(env, "DOCKER_HOST="+r.dockerHost)
+	}
+	env = append(env, r.proxyEnv()...)
+	env = append(env, runenv.Expand(r.runCtx.QueueItem.Run.Task.Settings.Env, vars)...)
+	env = append(env, runenv.Expand(r.runCtx.QueueItem.Run.Settings.Env, vars)...)
+
+	return env
+}
+
+func (r *Run) boot(client *client.Client, w io.Writer, img string, ws workspace.Workspace, caches []mount.Mount) error {
+	env := r.env()
+
+	tty := !r.config.JobLog.NoTTY
+	if term := r.config.JobLog.Term; tty && term != "" {
+		// first, so the settings may override it
+		env = append([]string{"TERM=" + term}, env...)
+	}
+
+	var err error
+
+	r.termSize, err = r.ttySize()
+	if err != nil {
+		return err
+	}
+
 	config := &container.Config{
 		AttachStdin:  true,
 		AttachStderr: true,
 		AttachStdout: true,
-		Tty:          true,
+		Tty:          tty,
 		Image:        img,
 		WorkingDir:   r.runCtx.QueueItem.Run.Task.Settings.Workdir,
 		StopSignal:   "KILL",
 		Cmd:          r.runCtx.QueueItem.Run.Settings.Command,
-		Env:          append(r.runCtx.QueueItem.Run.Task.Settings.Env, r.runCtx.QueueItem.Run.Settings.Env...),
+		Env:          env,
+		Labels:       r.labels(),
+	}
+
+	if r.plan != nil {
+		config.Cmd = stepsCommand
+	}
+
+	resources, err := r.containerResources()
+	if err != nil {
+		return err
 	}
 
 	hostconfig := &container.HostConfig{
+		Resources:  resources,
 		Privileged: r.runCtx.QueueItem.Run.Settings.Privileged,
-		Mounts: []mount.Mount{
+		Mounts: append([]mount.Mount{
 			{
 				Type:   mount.TypeBind,
-				Source: m.Target,
+				Source: ws.Path(),
 				Target: r.runCtx.QueueItem.Run.Task.Settings.Mountpoint,
 			},
-		},
-		AutoRemove: true,
+		}, caches...),
+	}
+
+	if config.Tty {
+		// sized from the start, as jobs may lay out their output before the
+		// resize below
+		hostconfig.ConsoleSize = [2]uint{r.termSize.Height, r.termSize.Width}
 	}
 
-	client.ContainerRemove(r.runCtx.Ctx, "running", types.ContainerRemoveOptions{Force: true})
+	if r.network != "" {
+		hostconfig.NetworkMode = container.NetworkMode(r.network)
+	} else if r.netMode == netpolicy.ModeNone {
+		hostconfig.NetworkMode = "none"
+	}
 
-	var outErr error
+	lim, err := r.limits()
+	if err != nil {
+		r.mirrorLog(w, "%v", err)
+		return err
+	}
+	hostconfig.Ulimits = lim.DockerUlimits()
+	hostconfig.Sysctls = lim.Sysctls
 
-	for i := 0; i < 5; i++ {
-		resp, err := client.ContainerCreate(r.runCtx.Ctx, config, hostconfig, &network.NetworkingConfig{}, nil, "running")
-		if err != nil {
+	if err := r.applySecurity(config, hostconfig); err != nil {
+		r.mirrorLog(w, "%v", err)
+		return err
+	}
+
+	if r.runner.windows() {
+		if err := r.adaptWindows(hostconfig); err != nil {
+			r.mirrorLog(w, "%v", err)
+			return err
+		}
+	}
+
+	name := r.containerName()
+
+	err = retry.Do(r.runCtx.Ctx, retry.Policy{
+		Attempts: 5,
+		OnError: func(err error, delay time.Duration) {
 			r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "could not create container, retrying: %v", err)
-			outErr = err
-			time.Sleep(time.Second)
-			continue
+		},
+	}, func(ctx context.Context) error {
+		resp, err := client.ContainerCreate(ctx, config, hostconfig, &network.NetworkingConfig{}, nil, name)
+		if errdefs.IsConflict(err) {
+			if err := r.removeOrphan(ctx, name); err != nil {
+				return retry.Permanent(err)
+			}
+			return err
+		} else if err != nil {
+			return err
 		}
 
 		r.containerID = resp.ID
-		outErr = nil
-		break
-	}
-
-	if outErr != nil {
-		r.mirrorLog(pw, "could not create container, giving up: %v", outErr)
-		return outErr
+		return nil
+	})
+	if err != nil {
+		r.mirrorLog(w, "could not create container, giving up: %v", err)
+		return err
 	}
 
 	go func() {
-		for {
-			select {
-			case <-r.runCtx.Ctx.Done():
-				return
-			default:
-			}
+		attached := false
 
-			attach, err := client.ContainerAttach(r.runCtx.Ctx, r.containerID, types.ContainerAttachOptions{Stream: true, Stdin: true, Stdout: true, Stderr: true})
+		err := retry.Do(r.runCtx.Ctx, retry.Policy{
+			OnError: func(err error, delay time.Duration) {
+				r.mirrorLog(w, "error during attach, trying re-attach soon: %v", err)
+			},
+		}, func(ctx context.Context) error {
+			attach, err := client.ContainerAttach(ctx, r.containerID, types.ContainerAttachOptions{Stream: true, Stdin: true, Stdout: true, Stderr: true})
 			if err != nil {
-				attach.Close()
-				r.mirrorLog(pw, "error during attach, trying re-attach soon: %v", err)
-				time.Sleep(time.Second)
-				continue
+				return err
+			}
+			defer attach.Close()
+
+			// the terminal may have been reset while detached
+			if attached && config.Tty {
+				if err := r.resizeTTY(ctx); err != nil {
+					r.mirrorLog(w, "could not resize container's tty, skipping: %v", err)
+				}
 			}
+			attached = true
 
-			io.Copy(pw, attach.Reader)
+			r.copyOutput(w, attach.Reader, config.Tty, "")
+			return nil
+		})
+		if err == nil {
 			r.runner.LogsvcClient(r.runCtx).Debug(context.Background(), "attach closed; returning gracefully")
-			attach.Close()
-			return
 		}
 	}()
 
 	if err := client.ContainerStart(r.runCtx.Ctx, r.containerID, types.ContainerStartOptions{}); err != nil {
-		r.mirrorLog(pw, "could not start container: %v", err)
+		r.mirrorLog(w, "could not start container: %v", err)
 		return err
 	}
 
-	if err := client.ContainerResize(r.runCtx.Ctx, r.containerID, types.ResizeOptions{Height: 25, Width: 80}); err != nil {
-		r.mirrorLog(pw, "could not resize container's tty, skipping: %v", err)
+	if config.Tty {
+		if err := r.resizeTTY(r.runCtx.Ctx); err != nil {
+			r.mirrorLog(w, "could not resize container's tty, skipping: %v", err)
+		}
 	}
 
 	return nil
 }
 
-// RunDocker runs the queue item in docker, pulling any necessary content to do so.
+// RunDocker runs the queue item in docker, or containerd if configured,
+// pulling any necessary content to do so.
 func (r *Run) RunDocker() (bool, error) {
 	defer func() {
 		select {
@@ -215,45 +335,385 @@ func (r *Run) RunDocker() (bool, error) {
 		}
 	}()
 
-	r.StartCancelFunc()
+	w := r.runCtx.Output
+	if w == nil {
+		buf := r.runner.newLog(r.config, r.runCtx)
+		defer buf.Close()
+		w = buf
+	}
 
-	pr, pw := io.Pipe()
-	defer pw.Close()
-	r.StartLogger(pr)
+	var err error
 
-	gr, err := r.PullRepo(pw)
+	r.secrets, err = r.loadSecrets(w)
 	if err != nil {
+		r.mirrorLog(w, "could not load secrets: %v", err)
 		return false, err
 	}
 
-	m, err := r.MountRepo(gr)
+	if len(r.secrets) != 0 {
+		masker := secrets.NewMasker(w, secrets.Values(r.secrets))
+		defer masker.Flush()
+		w = masker
+	}
+
+	// before setup, which may build the image
+	r.netMode, err = r.networkMode()
 	if err != nil {
+		r.mirrorLog(w, "invalid network mode: %v", err)
 		return false, err
 	}
-	defer r.MountCleanup(m)
 
-	img, err := r.pullImage(r.runner.Docker, pw)
-	if err != nil {
-		r.mirrorLog(pw, "could not pull image: %v", err)
+	if r.netMode == netpolicy.ModeRestricted && (r.runner.proxy() == nil || r.runner.containerd()) {
+		err = fw.Classed(fw.ErrUserJob, errors.New("restricted network access needs an egress proxy, which the runner does not provide"))
+		r.mirrorLog(w, "%v", err)
 		return false, err
 	}
 
-	if err := r.boot(r.runner.Docker, pw, img, m); err != nil {
-		r.mirrorLog(pw, "could not boot container: %v", err)
+	ws, img, err := r.setup(w)
+	if ws != nil {
+		defer r.MountCleanup(ws)
+	}
+
+	if err != nil {
 		return false, err
 	}
 
-	return r.supervise(r.runner.Docker, m, pw)
+	r.plan, err = r.stepsPlan()
+	if err != nil {
+		r.mirrorLog(w, "invalid steps: %v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if r.plan != nil && r.runner.containerd() {
+		err = errors.New("steps are not supported by the containerd backend")
+		r.mirrorLog(w, "%v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if r.plan != nil && r.runner.windows() {
+		// steps run in sh
+		err = errors.New("steps are not supported by windows containers")
+		r.mirrorLog(w, "%v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	done := r.runCtx.Trace.Step("mount caches")
+	caches, err := r.MountCaches()
+	done()
+	defer r.CleanupCaches()
+	if err != nil {
+		r.mirrorLog(w, "could not mount caches: %v", err)
+		return false, fw.Retryable(err)
+	}
+
+	if len(r.secrets) != 0 {
+		m, err := r.secretsMount(r.secrets)
+		defer r.removeSecrets()
+		if err != nil {
+			r.mirrorLog(w, "could not write secrets: %v", err)
+			return false, fw.Retryable(err)
+		}
+
+		caches = append(caches, m)
+	}
+
+	mounts, err := r.hostMounts()
+	if err != nil {
+		r.mirrorLog(w, "invalid host mounts: %v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+	caches = append(caches, mounts...)
+
+	list, err := r.servicesList()
+	if err != nil {
+		r.mirrorLog(w, "invalid services: %v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if len(list) != 0 && r.runner.containerd() {
+		err = errors.New("services are not supported by the containerd backend")
+		r.mirrorLog(w, "%v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	specs := []serviceSpec{}
+	for _, svc := range list {
+		specs = append(specs, serviceSpec{Service: svc})
+	}
+
+	docker, err := r.dockerRequested()
+	if err != nil {
+		r.mirrorLog(w, "%v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if docker && r.config.NestedDocker.Mode == dind.ModeSocket && r.netMode != netpolicy.ModeFull {
+		// containers started by the job would have the network of the daemon
+		err = fmt.Errorf("a docker daemon cannot be given to runs in network mode %v", r.netMode)
+		r.mirrorLog(w, "%v", err)
+		return false, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if r.netMode == netpolicy.ModeRestricted {
+		done = r.runCtx.Trace.Step("create network")
+		err = r.createNetwork(r.runCtx.Ctx)
+		if err == nil {
+			err = r.connectProxy(r.runCtx.Ctx)
+		}
+		done()
+
+		if err != nil {
+			r.mirrorLog(w, "could not create network: %v", err)
+			return false, fw.Retryable(err)
+		}
+	}
+
+	if docker && r.config.NestedDocker.Mode == dind.ModeSocket {
+		caches = append(caches, r.dockerSocketMount())
+	} else if docker {
+		// removed once the daemon is stopped, after the run
+		spec, err := r.dindService()
+		if err != nil {
+			r.mirrorLog(w, "could not make docker storage: %v", err)
+			return false, fw.Retryable(err)
+		}
+
+		specs = append(specs, spec)
+	}
+
+	if len(specs) != 0 {
+		end := sections.Runner(w, "services", "Starting services")
+		done = r.runCtx.Trace.Step("start services")
+		err = r.startServices(w, specs)
+		done()
+		end()
+
+		if err != nil {
+			r.mirrorLog(w, "could not start services: %v", err)
+			return false, fw.Retryable(err)
+		}
+	}
+
+	if !r.runner.containerd() {
+		done = r.runCtx.Trace.Step("boot container")
+		err = r.boot(r.runner.Docker, w, img, ws, caches)
+		done()
+
+		if err != nil {
+			r.mirrorLog(w, "could not boot container: %v", err)
+			return false, fw.Retryable(err)
+		}
+	}
+
+	done = r.runCtx.Trace.Step("execute")
+	stopWatch := r.watchUsage(ws, w)
+	stopStats := r.watchStats()
+	var status bool
+	if r.runner.containerd() {
+		// containerd creates and starts the container as one
+		status, err = r.runTask(w, img, ws, caches)
+	} else if r.plan != nil {
+		status, err = r.runSteps(r.plan, w)
+		// the container is stopped once the steps are done
+		r.supervise(r.runner.Docker, ws, w)
+	} else {
+		status, err = r.supervise(r.runner.Docker, ws, w)
+	}
+	written, exceeded := stopWatch()
+	stats, measured := stopStats()
+	done()
+
+	defer sections.Runner(w, "cleanup", "Cleaning up")()
+
+	if measured {
+		r.reportStats(stats, w)
+	}
+	r.reportUsage(ws, w)
+
+	if exceeded {
+		return false, fw.Classed(fw.ErrUserJob, fmt.Errorf("workspace usage of %v exceeds the limit of %v", formatBytes(written), formatBytes(r.config.WorkspaceMaxSize)))
+	}
+
+	if err == nil {
+		done = r.runCtx.Trace.Step("collect reports")
+		r.collectReports(ws, w)
+		done()
+	}
+
+	if err == nil && len(r.volumes) != 0 {
+		defer r.runCtx.Trace.Step("save caches")()
+		r.SaveCaches()
+	}
+
+	return status, err
 }
 
-func (r *Run) supervise(client *client.Client, m *overlay.Mount, pw *io.PipeWriter) (bool, error) {
-	exit, waitErr := client.ContainerWait(r.runCtx.Ctx, r.containerID, container.WaitConditionRemoved)
+// DryRun prepares the repository and the image without booting the
+// container, for the framework's dry-run mode.
+func (r *Run) DryRun() error {
+	w := r.runCtx.Output
+	if w == nil {
+		buf := r.runner.newLog(r.config, r.runCtx)
+		defer buf.Close()
+		w = buf
+	}
+
+	// before setup, which may build the image
+	mode, err := r.networkMode()
+	if err != nil {
+		r.mirrorLog(w, "invalid network mode: %v", err)
+		return err
+	}
+	r.netMode = mode
+
+	ws, img, err := r.setup(w)
+	if ws != nil {
+		defer r.MountCleanup(ws)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nDry run: repository and image %v prepared; not executing\n", img)
+
+	return nil
+}
+
+// setup prepares the repository and the image concurrently. The workspace is
+// returned whenever it was created, even on error, so it may be cleaned up.
+// Only the failures known to be transient, such as failed fetches, image
+// pulls and mounts, are classed as infrastructure errors.
+func (r *Run) setup(w io.Writer) (workspace.Workspace, string, error) {
+	ctx, cancel := context.WithCancel(r.runCtx.Ctx)
+	defer cancel()
+
+	var (
+		ws              workspace.Workspace
+		img             string
+		repoErr, imgErr error
+		wg              sync.WaitGroup
+		once            sync.Once
+		firstErr        error
+	)
+
+	// the first phase to fail cancels the other, whose error is then only
+	// a consequence
+	fail := func(err error) {
+		once.Do(func() { firstErr = err })
+		cancel()
+	}
+
+	spec, err := r.buildSpec()
+	if err != nil {
+		r.mirrorLog(w, "invalid build: %v", err)
+		return nil, "", fw.Classed(fw.ErrUserJob, err)
+	}
+
+	// the pull is held back while the repository is fetched, so each has a
+	// section of the log of its own
+	var pullLog bytes.Buffer
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer sections.Runner(w, "clone", "Fetching the repository")()
+
+		done := r.runCtx.Trace.Step("fetch repository")
+		gr, err := r.PullRepo(ctx, w)
+		done()
+
+		if err != nil {
+			repoErr = err
+			fail(repoErr)
+			return
+		}
+
+		if repoErr = r.checkPaths(w); repoErr != nil {
+			fail(repoErr)
+			return
+		}
+
+		done = r.runCtx.Trace.Step("mount repository")
+		ws, repoErr = r.MountRepo(gr)
+		repoErr = fw.Retryable(repoErr)
+		done()
+
+		if repoErr != nil {
+			fail(repoErr)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		// built from the repository once it is mounted, instead
+		if spec != nil {
+			return
+		}
+
+		defer r.runCtx.Trace.Step("pull image")()
+
+		img, imgErr = r.pullImage(ctx, &pullLog)
+		if imgErr != nil {
+			fail(imgErr)
+		}
+	}()
+
+	wg.Wait()
+
+	if spec == nil {
+		end := sections.Runner(w, "pull", "Pulling image "+r.runCtx.QueueItem.Run.Settings.Image)
+		w.Write(pullLog.Bytes())
+		end()
+	}
+
+	if repoErr != nil && firstErr != imgErr {
+		return ws, "", repoErr
+	}
+
+	if imgErr != nil {
+		r.mirrorLog(w, "could not pull image: %v", imgErr)
+		return ws, "", imgErr
+	}
+
+	if spec != nil {
+		end := sections.Runner(w, "build", "Building the image")
+		done := r.runCtx.Trace.Step("build image")
+		img, err = r.buildImage(ctx, w, spec, ws)
+		done()
+		end()
+
+		if err != nil {
+			r.mirrorLog(w, "could not build image: %v", err)
+			return ws, "", err
+		}
+	}
+
+	return ws, img, nil
+}
+
+func (r *Run) supervise(client *client.Client, ws workspace.Workspace, w io.Writer) (bool, error) {
+	exit, waitErr := client.ContainerWait(r.runCtx.Ctx, r.containerID, container.WaitConditionNotRunning)
 
 	select {
 	case res := <-exit:
+		// the container is only removed after the run, so it can be told
+		// whether it ran out of memory
+		oomKilled := false
+		if info, err := client.ContainerInspect(r.runCtx.Ctx, r.containerID); err == nil && info.State != nil {
+			oomKilled = info.State.OOMKilled
+		}
+
+		// steps report their own exit codes; the container is stopped after
+		if r.plan == nil {
+			r.reportExit(exitStatus(int(res.StatusCode), oomKilled), w)
+		}
+
 		return res.StatusCode == 0, nil
 	case err := <-waitErr:
-		r.mirrorLog(pw, "error waiting with cleanup of cid %v: %v", r.containerID, err)
+		r.mirrorLog(w, "error waiting with cleanup of cid %v: %v", r.containerID, err)
 		return false, err
 	}
 }
@@ -0,0 +1,36 @@
+package runner
+
+import (
+	"io"
+
+	"github.com/fatih/color"
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+)
+
+// exitStatus returns how the job exited from its exit code, and whether it
+// ran out of memory.
+func exitStatus(code int, oomKilled bool) *fwcontext.ExitStatus {
+	es := &fwcontext.ExitStatus{Code: code, OOMKilled: oomKilled}
+
+	if code > 128 {
+		es.Signal = signalName(code - 128)
+	}
+
+	return es
+}
+
+// reportExit records how the job exited for the framework, and writes it to
+// the job log unless it succeeded.
+func (r *Run) reportExit(es *fwcontext.ExitStatus, w io.Writer) {
+	r.runCtx.Exit = es
+
+	if es.Code == 0 && !es.OOMKilled {
+		return
+	}
+
+	color.New(color.FgHiRed, color.Bold).Fprintf(w, "\r\nJob %v\n", es)
+
+	if es.OOMKilled {
+		color.New(color.FgHiRed).Fprintln(w, "The job used more memory than its limit; request more memory in its resources")
+	}
+}
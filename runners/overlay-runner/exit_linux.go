@@ -0,0 +1,12 @@
+package runner
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// signalName returns the name of the signal, such as SIGKILL.
+func signalName(sig int) string {
+	return unix.SignalName(syscall.Signal(sig))
+}
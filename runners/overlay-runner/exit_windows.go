@@ -0,0 +1,7 @@
+package runner
+
+// signalName returns no name, as windows containers are not killed by
+// signals.
+func signalName(sig int) string {
+	return ""
+}
@@ -1,77 +1,253 @@
 package runner
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"path"
-	"strings"
+	"time"
 
 	"github.com/tinyci/ci-agents/clients/log"
 	"github.com/tinyci/ci-agents/types"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/cgroup"
 	"github.com/tinyci/ci-runners/fw/git"
 )
 
-// PullRepo retrieves the repository and puts it in the right spot.
-func (r *Run) PullRepo(w io.Writer) (*git.RepoManager, error) {
+// PullRepo retrieves the repository and puts it in the right spot. The git
+// operations are canceled along with ctx.
+func (r *Run) PullRepo(ctx context.Context, w io.Writer) (*git.RepoManager, error) {
 	queueTok := r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Owner.TokenJSON
 
 	tok := &types.OAuthToken{}
 
 	if err := json.Unmarshal(queueTok, tok); err != nil {
-		return nil, err
+		return nil, fw.Classed(fw.ErrUserJob, err)
 	}
 
 	rm := &git.RepoManager{
-		Config:      r.runner.Config.Runner,
+		Config:      r.config.Runner,
 		Log:         w,
 		AccessToken: tok.Token,
 	}
 
-	defaultBranchName := strings.TrimLeft(strings.TrimLeft(r.runCtx.QueueItem.Run.Task.Submission.BaseRef.RefName, "heads/"), "tags/")
+	if r.config.Cgroup != nil {
+		cg, err := cgroup.New(*r.config.Cgroup, r.name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.releaseCgroup(cg, "git")
+
+		rm.Cgroup = cg
+	}
 
 	wf := r.runner.LogsvcClient(r.runCtx).WithFields(log.FieldMap{
 		"owner":          r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Owner.Username,
-		"base_repo_path": r.runner.Config.Runner.BaseRepoPath,
+		"base_repo_path": r.config.Runner.BaseRepoPath,
 		"repo_name":      r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Name,
 	})
 
-	if err := rm.Init(r.runner.Config.Runner, wf, r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Name, r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Repository.Name); err != nil {
+	if err := rm.Init(r.config.Runner, wf, r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Name, r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Repository.Name); err != nil {
 		wf.Errorf(r.runCtx.Ctx, "Error initializing repo: %v", err)
 		return nil, err
 	}
 
-	mergeConfig := r.runCtx.QueueItem.Run.Task.Settings.Config.MergeOptions
-	doNotMerge := mergeConfig.DoNotMerge
-
-	if !doNotMerge {
-		for _, ref := range mergeConfig.IgnoreRefs {
-			if ref == r.runCtx.QueueItem.Run.Task.Submission.HeadRef.RefName {
-				doNotMerge = true
-			}
-		}
+	strategy, err := r.mergeStrategy()
+	if err != nil {
+		return nil, fw.Classed(fw.ErrUserJob, err)
 	}
 
-	if err := rm.CloneOrFetch(r.runCtx.Ctx, defaultBranchName); err != nil {
+	if err := rm.CloneOrFetch(ctx, r.runCtx.QueueItem.Run.Task.Submission.BaseRef.RefName); err != nil {
 		wf.Errorf(r.runCtx.Ctx, "Error cloning repo: %v", err)
-		return nil, err
+		return nil, transientGitError(err)
 	}
 
-	if err := rm.AddOrFetchFork(); err != nil {
+	if err := rm.AddOrFetchFork(ctx); err != nil {
 		wf.Errorf(r.runCtx.Ctx, "Error cloning fork: %v", err)
+		return nil, transientGitError(err)
+	}
+
+	if err := rm.FetchRef(ctx, rm.ForkRemote, r.runCtx.QueueItem.Run.Task.Submission.HeadRef.RefName); err != nil {
+		wf.Errorf(r.runCtx.Ctx, "Error fetching %v: %v", r.runCtx.QueueItem.Run.Task.Submission.HeadRef.RefName, err)
 		return nil, err
 	}
 
-	if err := rm.Checkout(r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha); err != nil {
+	if r.config.Runner.Worktrees {
+		if err := rm.AddWorktree(ctx, r.name); err != nil {
+			wf.Errorf(r.runCtx.Ctx, "Error adding worktree: %v", err)
+			return nil, err
+		}
+
+		r.repo = rm
+	}
+
+	sparsePaths, err := r.sparsePaths()
+	if err != nil {
+		return nil, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if err := rm.SparseCheckout(ctx, sparsePaths); err != nil {
+		wf.Errorf(r.runCtx.Ctx, "Error configuring sparse checkout: %v", err)
+		return nil, err
+	}
+
+	if err := rm.Checkout(ctx, r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha); err != nil {
 		wf.Errorf(r.runCtx.Ctx, "Error checking out %v: %v", r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha, err)
 		return nil, err
 	}
 
-	if !doNotMerge {
-		if err := rm.Merge(path.Join("origin", defaultBranchName)); err != nil {
-			wf.Errorf(r.runCtx.Ctx, "Error merging master for %v: %v", r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha, err)
-			return nil, err
+	commit, err := rm.Commit(ctx, path.Join("origin", rm.DefaultBranch))
+	if err != nil {
+		// the run does not depend on it; go on without the metadata
+		wf.Errorf(r.runCtx.Ctx, "Error reading metadata of %v: %v", r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha, err)
+	} else {
+		r.commit = commit
+	}
+
+	if err := rm.Integrate(ctx, strategy, path.Join("origin", rm.DefaultBranch)); err != nil {
+		wf.Errorf(r.runCtx.Ctx, "Error combining %v with %v (%v): %v", r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha, rm.DefaultBranch, strategy, err)
+
+		if errors.Is(err, git.ErrMergeConflict) {
+			fmt.Fprintf(w, "\n%v conflicts with %v: %v\nRebase or merge %v and push again.\n", r.runCtx.QueueItem.Run.Task.Submission.HeadRef.Sha, rm.DefaultBranch, err, rm.DefaultBranch)
+			return nil, fw.Classed(fw.ErrMergeConflict, err)
 		}
+
+		return nil, fw.Classed(fw.ErrUserJob, err)
 	}
 
 	return rm, nil
 }
+
+// transientGitError classes err as an infrastructure error if it is one of
+// the failures of git known to be transient: a full repository cache, or a
+// failed transfer from the git host. Others, such as a missing ref or commit,
+// are returned unchanged.
+func transientGitError(err error) error {
+	if errors.Is(err, git.ErrCacheFull) || errors.Is(err, git.ErrFetch) {
+		return fw.Classed(fw.ErrInfra, err)
+	}
+
+	return err
+}
+
+// mergeStrategy returns the merge strategy selected by the metadata of the
+// run or of its task. Empty means that of the configuration. Tasks which do
+// not merge, entirely or for the head ref, test exactly the commit.
+func (r *Run) mergeStrategy() (string, error) {
+	mergeConfig := r.runCtx.QueueItem.Run.Task.Settings.Config.MergeOptions
+	if mergeConfig.DoNotMerge {
+		return git.MergeStrategyNone, nil
+	}
+
+	for _, ref := range mergeConfig.IgnoreRefs {
+		if ref == r.runCtx.QueueItem.Run.Task.Submission.HeadRef.RefName {
+			return git.MergeStrategyNone, nil
+		}
+	}
+
+	strategy, err := git.MergeStrategy(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || strategy != "" {
+		return strategy, err
+	}
+
+	return git.MergeStrategy(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// sparsePaths returns the directories to check out listed in the metadata of
+// the run, or failing that of its task.
+func (r *Run) sparsePaths() ([]string, error) {
+	paths, err := git.SparsePaths(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || len(paths) != 0 {
+		return paths, err
+	}
+
+	return git.SparsePaths(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// pathFilter returns the path filter in the metadata of the run, or failing
+// that of its task.
+func (r *Run) pathFilter() (*git.PathFilter, error) {
+	filter, err := git.PathFilterFrom(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || filter != nil {
+		return filter, err
+	}
+
+	return git.PathFilterFrom(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// checkPaths returns an error classed fw.ErrSkipped if the commit under test
+// changes none of the files selected by the path filter of the run. Runs
+// whose changed files are unknown are not skipped.
+func (r *Run) checkPaths(w io.Writer) error {
+	filter, err := r.pathFilter()
+	if err != nil {
+		return fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if filter == nil || r.commit == nil || filter.Affected(r.commit.ChangedFiles) {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\n%v changes none of the paths of this task; skipping\n", r.commit.SHA)
+
+	return fw.Classed(fw.ErrSkipped, fmt.Errorf("%v changes none of the paths of the task", r.commit.SHA))
+}
+
+// releaseCgroup logs the resource usage of the cgroup for the phase of the
+// run, and destroys it.
+func (r *Run) releaseCgroup(cg *cgroup.Cgroup, phase string) {
+	logger := r.runner.LogsvcClient(r.runCtx)
+
+	usage, err := cg.Usage()
+	if err != nil {
+		logger.Errorf(context.Background(), "Could not collect %v resource usage: %v", phase, err)
+	} else {
+		logger.Infof(context.Background(), "Resource usage of %v: %v", phase, usage)
+	}
+
+	if err := cg.Destroy(); err != nil {
+		logger.Errorf(context.Background(), "Could not remove cgroup %v: %v", cg.Path(), err)
+	}
+}
+
+// StartGitMaintenance launches the periodic maintenance of the repository
+// cache, if configured, every interval it was started with. It only runs
+// while the runner is idle, as runs use their repositories without holding
+// locks. This function does not block.
+func (r *Runner) StartGitMaintenance() {
+	mc := r.Config().Runner.Maintenance
+	if mc == nil {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(mc.Interval)
+			r.maintainGit(mc.Interval)
+		}
+	}()
+}
+
+// maintainGit maintains the repository cache, giving up after the timeout.
+func (r *Runner) maintainGit(timeout time.Duration) {
+	if !r.acquire() {
+		return
+	}
+	defer r.release()
+
+	cfg := r.Config()
+	logger := cfg.C.Clients.Log.WithFields(log.FieldMap{"base_repo_path": cfg.Runner.BaseRepoPath})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := git.Maintain(ctx, cfg.Runner, logger); err != nil {
+		logger.Errorf(ctx, "Maintaining the repository cache: %v", err)
+		return
+	}
+
+	logger.Infof(ctx, "Maintained the repository cache in %v", time.Since(start))
+}
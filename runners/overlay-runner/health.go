@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// daemonHealth is whether docker, or containerd, answered its last health
+// check. While it does not, runs are not accepted and it is checked again
+// with backoff.
+type daemonHealth struct {
+	sync.Mutex
+	down     bool
+	failures int
+	next     time.Time
+}
+
+// daemonReady returns true if the daemon answered its last health check,
+// checking it again once due.
+func (r *Runner) daemonReady() bool {
+	h := &r.health
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+	if now.Before(h.next) {
+		return !h.down
+	}
+
+	cfg := r.Config()
+	logger := cfg.C.Clients.Log
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HealthCheck.Timeout)
+	defer cancel()
+
+	if err := r.pingDaemon(ctx); err != nil {
+		h.failures++
+		h.next = now.Add(cfg.HealthCheck.Backoff.Delay(h.failures - 1))
+
+		if !h.down {
+			logger.Errorf(ctx, "%v is unavailable; not accepting runs until it recovers: %v", cfg.Backend, err)
+		}
+		h.down = true
+
+		r.reconnect()
+		return false
+	}
+
+	if h.down {
+		logger.Infof(ctx, "%v is available again; accepting runs", cfg.Backend)
+	}
+
+	h.down = false
+	h.failures = 0
+	h.next = now.Add(cfg.HealthCheck.Interval)
+
+	return true
+}
+
+func (r *Runner) pingDaemon(ctx context.Context) error {
+	if r.containerd() {
+		_, err := r.containerdServerVersion(ctx)
+		return err
+	}
+
+	r.Lock()
+	docker := r.Docker
+	r.Unlock()
+
+	_, err := docker.Ping(ctx)
+	return err
+}
+
+// reconnect replaces the docker client, should the daemon come back on
+// another API version, unless it is in use.
+func (r *Runner) reconnect() {
+	if r.containerd() {
+		return
+	}
+
+	docker, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		r.Config().C.Clients.Log.Errorf(context.Background(), "Could not create docker client: %v", err)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.runs) != 0 || r.maintenance != nil {
+		docker.Close()
+		return
+	}
+
+	r.Docker.Close()
+	r.Docker = docker
+}
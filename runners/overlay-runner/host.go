@@ -0,0 +1,62 @@
+package runner
+
+import (
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/tinyci/ci-runners/fw/host"
+)
+
+// hostRequest returns the host mounts and devices the metadata of the run, or
+// failing that of its task, asks for, if the runner allows them.
+func (r *Run) hostRequest() ([]host.Mount, []host.Device, error) {
+	md := r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()
+	if _, ok := md[host.HostKey]; !ok {
+		md = r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap()
+	}
+
+	req, err := host.FromMetadata(md)
+	if err != nil || req.Empty() {
+		return nil, nil, err
+	}
+
+	return r.config.Host.Resolve(req)
+}
+
+// hostMounts returns the bind mounts of the host paths requested by the run.
+func (r *Run) hostMounts() ([]mount.Mount, error) {
+	list, _, err := r.hostRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []mount.Mount{}
+	for _, m := range list {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: !m.Writable,
+		})
+	}
+
+	return mounts, nil
+}
+
+// hostDevices returns the host devices requested by the run.
+func (r *Run) hostDevices() ([]container.DeviceMapping, error) {
+	_, list, err := r.hostRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []container.DeviceMapping{}
+	for _, d := range list {
+		devices = append(devices, container.DeviceMapping{
+			PathOnHost:        d.Path,
+			PathInContainer:   d.Target,
+			CgroupPermissions: d.Permissions,
+		})
+	}
+
+	return devices, nil
+}
@@ -0,0 +1,141 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/registry"
+	"github.com/tinyci/ci-runners/fw/retry"
+	"github.com/tinyci/ci-runners/runners/overlay-runner/config"
+)
+
+// pull pulls the image from the first of its mirrors, or its registry, which
+// has it, writing the progress to w, unless the pull policy lets an image
+// already present be used. It returns the reference to create containers
+// from. The settings of the pull are taken from cfg.
+func (r *Runner) pull(ctx context.Context, cfg *config.Config, logger *log.SubLogger, img string, w io.Writer) (string, error) {
+	candidates, err := cfg.Registry.Candidates(img)
+	if err != nil {
+		return "", err
+	}
+
+	policy := cfg.PullPolicy
+
+	if policy != registry.PullAlways || registry.HasDigest(img) {
+		for _, ref := range candidates {
+			present, err := r.imagePresent(ctx, ref)
+			if err != nil {
+				return "", err
+			}
+
+			if present && !policy.Pull(ref, present) {
+				logger.Debugf(ctx, "image %v is present; not pulling it", ref)
+				r.touchImage(ctx, ref)
+				return ref, nil
+			}
+		}
+	}
+
+	if !policy.Pull(img, false) {
+		return "", fw.Classed(fw.ErrUserJob, fmt.Errorf("image %v is not present and the pull policy is %v", img, policy))
+	}
+
+	for i, ref := range candidates {
+		err = r.pullRetrying(ctx, cfg, logger, ref, w)
+		if err == nil {
+			r.touchImage(ctx, ref)
+			return ref, nil
+		}
+
+		if i < len(candidates)-1 {
+			logger.Errorf(ctx, "pull of image %v failed, trying the next mirror: %v", ref, err)
+		}
+	}
+
+	if permanentPullError(err) {
+		return "", fw.Classed(fw.ErrUserJob, err)
+	}
+
+	return "", fw.Classed(fw.ErrInfra, err)
+}
+
+// pullRetrying pulls the image, giving up on each attempt after the pull
+// timeout, and retrying failures which may be transient with backoff.
+func (r *Runner) pullRetrying(ctx context.Context, cfg *config.Config, logger *log.SubLogger, ref string, w io.Writer) error {
+	timeout := cfg.PullTimeout
+
+	return retry.Do(ctx, retry.Policy{
+		Attempts: cfg.PullRetry.Attempts,
+		Backoff:  cfg.PullRetry.Backoff,
+		OnError: func(err error, delay time.Duration) {
+			logger.Errorf(ctx, "pull of image %v failed, retrying in %v: %v", ref, delay, err)
+			fmt.Fprintf(w, "\nPull of image %v failed, retrying in %v: %v\n", ref, delay.Round(time.Second), err)
+		},
+	}, func(ctx context.Context) error {
+		pullCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := r.pullRef(pullCtx, ref, w)
+		if err == nil {
+			return nil
+		}
+
+		// the run is over; the pull is not stuck
+		if ctx.Err() != nil {
+			return retry.Permanent(err)
+		}
+
+		if pullCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("pull timed out after %v: %w", timeout, err)
+		}
+
+		if permanentPullError(err) {
+			return retry.Permanent(err)
+		}
+
+		return err
+	})
+}
+
+// permanentPullError returns true if the pull failed because the image does
+// not exist or may not be pulled, which retrying won't fix.
+func permanentPullError(err error) bool {
+	return errdefs.IsNotFound(err) || errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) || errdefs.IsInvalidParameter(err)
+}
+
+// imagePresent returns true if the image is present locally.
+func (r *Runner) imagePresent(ctx context.Context, ref string) (bool, error) {
+	if r.containerd() {
+		return r.ctrImagePresent(ctx, ref)
+	}
+
+	if _, _, err := r.Docker.ImageInspectWithRaw(ctx, ref); err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r *Runner) pullRef(ctx context.Context, ref string, w io.Writer) error {
+	if r.containerd() {
+		return r.ctrPullRef(ctx, ref, w)
+	}
+
+	pullRead, err := r.Docker.ImagePull(ctx, ref, types.ImagePullOptions{Platform: r.pullPlatform()})
+	if err != nil {
+		return err
+	}
+	defer pullRead.Close()
+
+	return outputPullRead(w, pullRead)
+}
@@ -0,0 +1,35 @@
+package runner
+
+import (
+	"fmt"
+
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/limits"
+)
+
+// limitsOptions returns the ulimits and sysctls in the metadata of the run, or
+// failing that of its task, if any.
+func (r *Run) limitsOptions() (*limits.Options, error) {
+	opts, err := limits.FromMetadata(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || opts != nil {
+		return opts, err
+	}
+
+	return limits.FromMetadata(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// limits returns the ulimits and sysctls of the container of the run, as
+// configured and asked for by the run.
+func (r *Run) limits() (limits.Config, error) {
+	opts, err := r.limitsOptions()
+	if err != nil {
+		return limits.Config{}, fw.Classed(fw.ErrUserJob, fmt.Errorf("invalid limits: %w", err))
+	}
+
+	lim, err := r.config.Limits.Apply(opts)
+	if err != nil {
+		return limits.Config{}, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	return lim, nil
+}
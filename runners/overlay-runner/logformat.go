@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/fatih/color"
+)
+
+// stderrColor sets apart what jobs write to stderr when it is not merged
+// with stdout by a TTY.
+var stderrColor = color.New(color.FgRed)
+
+// lineWriter decorates each line written to it before passing it on, with a
+// timestamp, a prefix and a color.
+type lineWriter struct {
+	w          io.Writer
+	timestamps bool
+	prefix     string
+	color      *color.Color
+
+	buf []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i == -1 {
+			break
+		}
+
+		if err := lw.writeLine(lw.buf[:i], true); err != nil {
+			return 0, err
+		}
+
+		lw.buf = lw.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes what is left of the last line, if it was not terminated.
+func (lw *lineWriter) Flush() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
+
+	err := lw.writeLine(lw.buf, false)
+	lw.buf = nil
+	return err
+}
+
+func (lw *lineWriter) writeLine(line []byte, newline bool) error {
+	var b bytes.Buffer
+
+	if lw.timestamps {
+		b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00 "))
+	}
+
+	if lw.prefix != "" {
+		b.WriteString("[" + lw.prefix + "] ")
+	}
+
+	if lw.color != nil {
+		b.WriteString(lw.color.Sprint(string(line)))
+	} else {
+		b.Write(line)
+	}
+
+	if newline {
+		b.WriteByte('\n')
+	}
+
+	_, err := lw.w.Write(b.Bytes())
+	return err
+}
+
+// copyOutput copies the output of a container, or of a process executed in
+// it, to the job log, decorating its lines as configured, with the prefix if
+// given. Without a TTY, the output is demultiplexed so stderr stands out.
+func (r *Run) copyOutput(w io.Writer, output io.Reader, tty bool, prefix string) error {
+	cfg := r.config.JobLog
+
+	if tty && !cfg.Timestamps && prefix == "" {
+		_, err := io.Copy(w, output)
+		return err
+	}
+
+	stdout := &lineWriter{w: w, timestamps: cfg.Timestamps, prefix: prefix}
+	defer stdout.Flush()
+
+	if tty {
+		_, err := io.Copy(stdout, output)
+		return err
+	}
+
+	stderr := &lineWriter{w: w, timestamps: cfg.Timestamps, prefix: prefix, color: stderrColor}
+	defer stderr.Flush()
+
+	_, err := stdcopy.StdCopy(stdout, stderr, output)
+	return err
+}
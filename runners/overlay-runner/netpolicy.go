@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/netpolicy"
+)
+
+// networkMode returns the network mode of the run: that of its queue, or of
+// forks, tightened by the metadata of the run, or failing that of its task.
+func (r *Run) networkMode() (string, error) {
+	md := r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()
+	if _, ok := md[netpolicy.NetworkKey]; !ok {
+		md = r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap()
+	}
+
+	requested, err := netpolicy.FromMetadata(md)
+	if err != nil {
+		return "", fw.Classed(fw.ErrUserJob, err)
+	}
+
+	mode := r.config.Network.Mode(r.runCtx.QueueItem.QueueName, r.fork())
+	if requested != "" {
+		mode = netpolicy.Stricter(mode, requested)
+	}
+
+	return mode, nil
+}
+
+// proxy returns the egress proxy of the runner, if any.
+func (r *Runner) proxy() *netpolicy.Proxy {
+	cfg := r.Config()
+
+	if cfg.Network == nil {
+		return nil
+	}
+
+	return cfg.Network.Proxy
+}
+
+// createNetwork creates the network of the run, which services and the
+// container of the run join. Unless the run has full network access, it is
+// internal, without a route out.
+func (r *Run) createNetwork(ctx context.Context) error {
+	labels := r.labels()
+	labels[serviceLabel] = r.name
+
+	internal := r.netMode != netpolicy.ModeFull
+	if internal && r.runner.windows() {
+		return fw.Classed(fw.ErrUserJob, fmt.Errorf("windows has no internal networks: services are not available in network mode %v", r.netMode))
+	}
+
+	r.network = "tinyci-" + r.instanceID()
+
+	if _, err := r.runner.Docker.NetworkCreate(ctx, r.network, types.NetworkCreate{
+		CheckDuplicate: true,
+		Internal:       internal,
+		Labels:         labels,
+	}); err != nil {
+		r.network = ""
+		return fmt.Errorf("creating network: %w", err)
+	}
+
+	return nil
+}
+
+// connectProxy connects the egress proxy to the network of the run, as the
+// only way out of it.
+func (r *Run) connectProxy(ctx context.Context) error {
+	proxy := r.runner.proxy()
+
+	if err := r.runner.Docker.NetworkConnect(ctx, r.network, proxy.Container, &network.EndpointSettings{Aliases: []string{proxy.Alias}}); err != nil {
+		return fmt.Errorf("connecting the egress proxy: %w", err)
+	}
+
+	return nil
+}
+
+// disconnectProxy disconnects the egress proxy from the network, if it is
+// connected, so the network may be removed.
+func (r *Runner) disconnectProxy(ctx context.Context, id string) error {
+	proxy := r.proxy()
+	if proxy == nil {
+		return nil
+	}
+
+	err := r.Docker.NetworkDisconnect(ctx, id, proxy.Container, true)
+	if err != nil && !errdefs.IsNotFound(err) && !strings.Contains(err.Error(), "is not connected") {
+		return err
+	}
+
+	return nil
+}
+
+// proxyEnv returns the environment pointing jobs to the egress proxy, in
+// restricted mode.
+func (r *Run) proxyEnv() []string {
+	if r.netMode != netpolicy.ModeRestricted {
+		return nil
+	}
+
+	proxy := r.runner.proxy()
+	url := proxy.URL()
+	noProxy := strings.Join(append(append([]string{"localhost", "127.0.0.1"}, r.hosts...), proxy.NoProxy...), ",")
+
+	// both cases, as tools disagree on them
+	return []string{
+		"HTTP_PROXY=" + url,
+		"HTTPS_PROXY=" + url,
+		"NO_PROXY=" + noProxy,
+		"http_proxy=" + url,
+		"https_proxy=" + url,
+		"no_proxy=" + noProxy,
+	}
+}
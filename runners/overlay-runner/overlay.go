@@ -1,45 +1,156 @@
 package runner
 
 import (
-	"io/ioutil"
+	"context"
+	"os"
+	"time"
 
 	"github.com/tinyci/ci-runners/fw/git"
 	"github.com/tinyci/ci-runners/fw/overlay"
+	"github.com/tinyci/ci-runners/fw/workspace"
 )
 
-// MountRepo mounts the repo through overlayfs so we can quickly clean up the
-// build artifacts and other work done in the container.
-func (r *Run) MountRepo(gr *git.RepoManager) (*overlay.Mount, error) {
-	work, err := ioutil.TempDir(r.runner.Config.OverlayTempdir, "")
-	if err != nil {
-		return nil, err
+// MountRepo makes a throwaway writable copy of the repo, through overlayfs or
+// the configured workspace type, so we can quickly clean up the build
+// artifacts and other work done in the container.
+func (r *Run) MountRepo(gr *git.RepoManager) (workspace.Workspace, error) {
+	if r.persistent() {
+		sub := r.runCtx.QueueItem.Run.Task.Submission
+
+		s := &workspace.Persistent{
+			Config: r.config.PersistentWorkspaces,
+			Dir:    r.config.OverlayTempdir,
+			Key:    workspace.PersistKeyFor(sub.HeadRef.Repository.Name, sub.HeadRef.RefName, r.runCtx.QueueItem.Run.Name),
+		}
+
+		return s.Snapshot(gr.WorkDir(), r.name+"-repo")
 	}
 
-	upper, err := ioutil.TempDir(r.runner.Config.OverlayTempdir, "")
-	if err != nil {
-		return nil, err
+	return r.snapshot(gr.WorkDir(), "repo", r.config.Scratch)
+}
+
+// persistent returns true if the run gets a persistent workspace: the runner
+// keeps them, and the metadata of the run, or failing that of its task, asks
+// for one.
+func (r *Run) persistent() bool {
+	if r.config.PersistentWorkspaces == nil {
+		return false
 	}
 
-	target, err := ioutil.TempDir(r.runner.Config.OverlayTempdir, "")
+	if persist, ok := workspace.PersistRequested(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()); ok {
+		return persist
+	}
+
+	persist, _ := workspace.PersistRequested(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+	return persist
+}
+
+// snapshot makes a throwaway writable copy of the source directory, in a
+// directory of the overlay temp dir named after the run and the purpose.
+// scratch, if set, holds the writes to overlay workspaces. The workspace is
+// returned whenever it was created, even on error, so it may be cleaned up.
+func (r *Run) snapshot(source, purpose string, scratch *overlay.ScratchConfig) (workspace.Workspace, error) {
+	s, err := workspace.New(r.config.Workspace, r.config.OverlayTempdir, scratch)
 	if err != nil {
 		return nil, err
 	}
 
-	m := &overlay.Mount{
-		Lower:  gr.RepoPath,
-		Work:   work,
-		Upper:  upper,
-		Target: target,
+	return s.Snapshot(source, r.name+"-"+purpose)
+}
+
+// checkTempdir creates the overlay temp dir, and the persistent workspace
+// dir if any, and makes sure overlays can be made in them, if they are to be.
+func (r *Runner) checkTempdir() error {
+	cfg := r.Config()
+
+	if cfg.OverlayTempdir != "" {
+		if err := os.MkdirAll(cfg.OverlayTempdir, 0700); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Workspace == workspace.TypeOverlay && cfg.Scratch == nil {
+		if err := workspace.CheckOverlayDir(cfg.OverlayTempdir); err != nil {
+			return err
+		}
 	}
 
-	return m, m.Mount()
+	if cfg.PersistentWorkspaces != nil {
+		if err := os.MkdirAll(cfg.PersistentWorkspaces.Dir, 0700); err != nil {
+			return err
+		}
+
+		return workspace.CheckOverlayDir(cfg.PersistentWorkspaces.Dir)
+	}
+
+	return nil
 }
 
-// MountCleanup cleans up the mount and any dirs created.
-func (r *Run) MountCleanup(m *overlay.Mount) error {
-	if err := m.Unmount(); err != nil {
-		return err
+// MountCleanup releases the workspace and any dirs created.
+func (r *Run) MountCleanup(ws workspace.Workspace) error {
+	return ws.Release()
+}
+
+// StartReaper launches the cleanup of workspaces, containers, networks and
+// volumes left behind by runs which did not finish, as when the runner
+// crashes, and the pruning of persistent workspaces and images, at startup
+// and every reap interval. It only runs while the runner is idle, and spares
+// what belongs to live runs regardless. This function does not block.
+func (r *Runner) StartReaper() {
+	go func() {
+		for {
+			r.reap()
+			time.Sleep(r.Config().ReapInterval)
+		}
+	}()
+}
+
+func (r *Runner) reap() {
+	cfg := r.Config()
+
+	if !r.acquire() {
+		return
+	}
+	defer r.release()
+
+	ctx := context.Background()
+	live := r.liveRuns()
+
+	// the container of a run holds its workspace mounted
+	if r.containerd() {
+		r.reapTasks(ctx)
+	} else {
+		r.reapContainers(ctx)
+		r.reapNetworks(ctx)
+		r.reapVolumes(ctx)
+		r.pruneImages(ctx)
+	}
+
+	reaped, err := workspace.Reap(cfg.OverlayTempdir, live)
+	if len(reaped) != 0 {
+		cfg.C.Clients.Log.Infof(ctx, "Removed %d stale workspaces: %v", len(reaped), reaped)
+	}
+
+	if err != nil {
+		cfg.C.Clients.Log.Errorf(ctx, "Could not remove stale workspaces: %v", err)
+	}
+
+	if cfg.NamedCaches != nil {
+		if _, err := cfg.NamedCaches.Reap(live); err != nil {
+			cfg.C.Clients.Log.Errorf(ctx, "Could not remove stale named cache copies: %v", err)
+		}
+	}
+
+	if cfg.PersistentWorkspaces == nil {
+		return
+	}
+
+	pruned, err := cfg.PersistentWorkspaces.Prune()
+	if len(pruned) != 0 {
+		cfg.C.Clients.Log.Infof(ctx, "Removed %d persistent workspaces: %v", len(pruned), pruned)
 	}
 
-	return m.Cleanup()
+	if err != nil {
+		cfg.C.Clients.Log.Errorf(ctx, "Could not prune persistent workspaces: %v", err)
+	}
 }
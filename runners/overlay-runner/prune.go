@@ -0,0 +1,155 @@
+package runner
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+// touchImage records the use of the image by a run, for the image prune
+// policy.
+func (r *Runner) touchImage(ctx context.Context, ref string) {
+	if r.Config().ImagePrune == nil {
+		return
+	}
+
+	info, _, err := r.Docker.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return
+	}
+
+	r.imagesMutex.Lock()
+	defer r.imagesMutex.Unlock()
+
+	if r.imagesUsed == nil {
+		r.imagesUsed = map[string]time.Time{}
+	}
+	r.imagesUsed[info.ID] = time.Now()
+}
+
+// lastUsed returns when the image was last used by a run. Images the runner
+// has not seen used are taken as used now, so they get the whole MaxAge.
+func (r *Runner) lastUsed(id string) time.Time {
+	r.imagesMutex.Lock()
+	defer r.imagesMutex.Unlock()
+
+	if r.imagesUsed == nil {
+		r.imagesUsed = map[string]time.Time{}
+	}
+
+	if _, ok := r.imagesUsed[id]; !ok {
+		r.imagesUsed[id] = time.Now()
+	}
+
+	return r.imagesUsed[id]
+}
+
+func (r *Runner) forgetImage(id string) {
+	r.imagesMutex.Lock()
+	defer r.imagesMutex.Unlock()
+	delete(r.imagesUsed, id)
+}
+
+type pruneCandidate struct {
+	image    types.ImageSummary
+	lastUsed time.Time
+}
+
+// pruneImages applies the image prune policy. Images used by containers are
+// kept. The runner must be idle.
+func (r *Runner) pruneImages(ctx context.Context) {
+	cfg := r.Config()
+
+	policy := cfg.ImagePrune
+	if policy == nil {
+		return
+	}
+
+	logger := cfg.C.Clients.Log
+
+	images, err := r.Docker.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		logger.Errorf(ctx, "Could not list images: %v", err)
+		return
+	}
+
+	containers, err := r.Docker.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		logger.Errorf(ctx, "Could not list containers: %v", err)
+		return
+	}
+
+	inUse := map[string]bool{}
+	for _, c := range containers {
+		inUse[c.ImageID] = true
+	}
+
+	var (
+		candidates []pruneCandidate
+		total      uint64
+	)
+
+	for _, image := range images {
+		total += uint64(image.Size)
+
+		if !inUse[image.ID] {
+			candidates = append(candidates, pruneCandidate{image: image, lastUsed: r.lastUsed(image.ID)})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed.Before(candidates[j].lastUsed) })
+
+	var (
+		removed   int
+		reclaimed uint64
+	)
+
+	for _, c := range candidates {
+		expired := policy.MaxAge > 0 && time.Since(c.lastUsed) > policy.MaxAge
+		oversize := policy.MaxSize > 0 && total > policy.MaxSize
+
+		if !expired && !oversize {
+			continue
+		}
+
+		if err := r.removeImage(ctx, c.image); err != nil {
+			logger.Errorf(ctx, "Could not remove image %v: %v", c.image.ID, err)
+			continue
+		}
+
+		r.forgetImage(c.image.ID)
+		total -= uint64(c.image.Size)
+		reclaimed += uint64(c.image.Size)
+		removed++
+	}
+
+	if removed != 0 {
+		logger.Infof(ctx, "Pruned %d images, reclaiming %d bytes", removed, reclaimed)
+	}
+}
+
+// removeImage removes the image by each of its tags, so images with several
+// are removed without forcing, which would also remove images in use.
+func (r *Runner) removeImage(ctx context.Context, image types.ImageSummary) error {
+	refs := []string{}
+	for _, tag := range image.RepoTags {
+		if tag != "<none>:<none>" {
+			refs = append(refs, tag)
+		}
+	}
+
+	if len(refs) == 0 {
+		refs = []string{image.ID}
+	}
+
+	for _, ref := range refs {
+		if _, err := r.Docker.ImageRemove(ctx, ref, types.ImageRemoveOptions{PruneChildren: true}); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tinyci/ci-runners/fw/reports"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// collectReports reads the test reports the run left in its workspace, if it
+// lists any, writes their summary to the job log and hands it to the
+// framework.
+func (r *Run) collectReports(ws workspace.Workspace, w io.Writer) {
+	patterns, err := r.reportPatterns()
+	if err != nil {
+		r.mirrorLog(w, "could not read test reports: %v", err)
+		return
+	}
+
+	if len(patterns) == 0 {
+		return
+	}
+
+	summary, err := reports.Collect(ws.Path(), patterns)
+	if err != nil {
+		r.mirrorLog(w, "could not read test reports: %v", err)
+		return
+	}
+
+	if summary == nil {
+		fmt.Fprintf(w, "\nNo test reports found matching %v\n", patterns)
+		return
+	}
+
+	fmt.Fprintf(w, "\n%v\n", summary)
+	r.runCtx.Report = summary
+}
+
+// reportPatterns returns the test report patterns in the metadata of the run,
+// or failing that of its task.
+func (r *Run) reportPatterns() ([]string, error) {
+	patterns, err := reports.Patterns(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || patterns != nil {
+		return patterns, err
+	}
+
+	return reports.Patterns(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
@@ -0,0 +1,83 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/config"
+	"github.com/tinyci/ci-runners/fw/gpu"
+)
+
+// containerResources returns the limits of the container of the run: the CPU
+// and memory requested in its settings, and the configured pids limit.
+// Resources which are not requested are not limited. The GPUs and host
+// devices requested in its metadata are handed to it.
+func (r *Run) containerResources() (container.Resources, error) {
+	var res container.Resources
+
+	requested, err := config.ParseResources(r.runCtx.QueueItem.Run.Settings.GetResources())
+	if err != nil {
+		return res, fw.Classed(fw.ErrUserJob, fmt.Errorf("invalid resources: %w", err))
+	}
+
+	res.NanoCPUs = int64(requested.CPU * 1e9)
+	res.Memory = int64(requested.Memory)
+
+	if r.config.PidsLimit > 0 {
+		pids := r.config.PidsLimit
+		res.PidsLimit = &pids
+	}
+
+	req, err := r.gpuRequest()
+	if err != nil {
+		return res, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	if req != nil {
+		res.DeviceRequests = []container.DeviceRequest{*req}
+	}
+
+	if res.Devices, err = r.hostDevices(); err != nil {
+		return res, fw.Classed(fw.ErrUserJob, err)
+	}
+
+	return res, nil
+}
+
+// gpuRequest returns the request of the GPUs in the metadata of the run, or
+// failing that of its task, if any.
+func (r *Run) gpuRequest() (*container.DeviceRequest, error) {
+	md := r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap()
+	if _, ok := md[gpu.GPUsKey]; !ok {
+		md = r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap()
+	}
+
+	count, err := gpu.FromMetadata(md)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	cfg := r.config.GPUs
+	if cfg == nil {
+		return nil, errors.New("gpus requested, but the runner has none: require the gpu label")
+	}
+
+	devices, err := cfg.Select(count)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &container.DeviceRequest{
+		Driver:       cfg.Driver,
+		DeviceIDs:    devices,
+		Capabilities: [][]string{cfg.Capabilities},
+	}
+
+	if devices == nil {
+		req.Count = -1
+	}
+
+	return req, nil
+}
@@ -3,20 +3,45 @@ package runner
 import (
 	"context"
 	"io"
-	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/tinyci/ci-agents/utils"
 	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/git"
+	"github.com/tinyci/ci-runners/fw/logbuffer"
+	"github.com/tinyci/ci-runners/fw/logtail"
+	"github.com/tinyci/ci-runners/fw/namedcache"
+	"github.com/tinyci/ci-runners/fw/secrets"
+	"github.com/tinyci/ci-runners/fw/steps"
+	"github.com/tinyci/ci-runners/fw/tty"
+	"github.com/tinyci/ci-runners/fw/workspace"
+	"github.com/tinyci/ci-runners/runners/overlay-runner/config"
 )
 
 // Run is a single run.
 type Run struct {
 	runner *Runner
+	// config is the configuration of the runner the run was made with.
+	config *config.Config
 	runCtx *fwcontext.RunContext
 	name   string
 
 	containerID string
+	cacheMounts []workspace.Workspace
+	volumes     []*namedcache.Volume
+	repo        *git.RepoManager
+	commit      *git.Commit
+	plan        *steps.Plan
+	network     string
+	netMode     string
+	services    []string
+	hosts       []string
+	secrets     []secrets.Secret
+	secretsDir  string
+	termSize    tty.Size
+	dockerHost  string
+	dindDir     string
+	builtImage  string
 }
 
 // Name is the name of the run
@@ -45,42 +70,124 @@ func (r *Run) Run() (bool, error) {
 
 // AfterRun is for after the run cleanup
 func (r *Run) AfterRun() error {
-	// FIXME this fails sometimes, we'll classify the errors later. So much for "force".
-	r.runner.Docker.ContainerRemove(context.Background(), r.containerID, types.ContainerRemoveOptions{Force: true})
+	if r.runner.containerd() {
+		if r.containerID != "" {
+			if err := r.runner.removeTask(context.Background(), r.containerID); err != nil {
+				r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "Could not remove container: %v", err)
+			}
+		}
+	} else {
+		// FIXME this fails sometimes, we'll classify the errors later. So much for "force".
+		r.runner.Docker.ContainerRemove(context.Background(), r.containerID, types.ContainerRemoveOptions{Force: true})
+		r.stopServices()
+		r.removeDinD()
+		r.removeBuiltImage()
+	}
+
+	if r.repo != nil {
+		if err := r.repo.RemoveWorktree(context.Background()); err != nil {
+			r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "Could not remove worktree: %v", err)
+		}
+	}
 
 	return nil
 }
 
-// StartCancelFunc launches a goroutine which waits for the cancel signal.
-// Terminates when the run ends; one way or another. This function does not
-// block.
-func (r *Run) StartCancelFunc() {
-	go func() {
-		for {
-			select {
-			case <-r.runCtx.Ctx.Done():
-				return
-			default:
-			}
+// Terminate asks the container to stop by sending it SIGTERM. It is called
+// when the run times out, before it is canceled.
+func (r *Run) Terminate() {
+	if r.containerID == "" {
+		return
+	}
 
-			state, err := r.runner.Config.C.Clients.Queue.GetCancel(r.runCtx.Ctx, r.runCtx.QueueItem.Run.Id)
-			if err != nil || !state {
-				time.Sleep(time.Second)
-				continue
-			}
+	if err := r.kill("TERM"); err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "Could not terminate container: %v", err)
+	}
+}
 
-			r.runCtx.CancelFunc()
-			return
-		}
-	}()
+// kill sends the signal, such as TERM, to the container.
+func (r *Run) kill(signal string) error {
+	if r.runner.containerd() {
+		_, err := r.runner.ctrOutput(context.Background(), "tasks", "kill", "--signal", "SIG"+signal, r.containerID)
+		return err
+	}
+
+	return r.runner.Docker.ContainerKill(context.Background(), r.containerID, signal)
 }
 
 // StartLogger starts a goroutine that writes data produced on the reader to
 // the log.
 func (r *Run) StartLogger(rc io.Reader) {
+	r.runner.startLogger(r.runCtx, rc)
+}
+
+func (r *Runner) startLogger(runCtx *fwcontext.RunContext, rc io.Reader) {
 	go func() {
-		if err := r.runner.Config.C.Clients.Asset.Write(r.runCtx.Ctx, r.runCtx.QueueItem.Run.Id, rc); err != nil {
-			r.runner.LogsvcClient(r.runCtx).Error(r.runCtx.Ctx, utils.WrapError(err, "Writing log for Run ID %d", r.runCtx.QueueItem.Run.Id))
+		if err := r.Config().C.Clients.Asset.Write(runCtx.Ctx, runCtx.QueueItem.Run.Id, rc); err != nil {
+			r.LogsvcClient(runCtx).Error(runCtx.Ctx, utils.WrapError(err, "Writing log for Run ID %d", runCtx.QueueItem.Run.Id))
 		}
 	}()
 }
+
+// logSink holds the output of a run until it is shipped, dropping what it
+// cannot hold rather than slowing down the job.
+type logSink interface {
+	io.WriteCloser
+	// Dropped returns the amount of bytes dropped.
+	Dropped() uint64
+}
+
+// runLog is the job output of a run, shipped to the assetsvc.
+type runLog struct {
+	logSink
+	runner  *Runner
+	runCtx  *fwcontext.RunContext
+	onClose func()
+}
+
+// newLog creates the log for the run and starts shipping it, from a spool on
+// disk if configured, or else from memory. Past the maximum size, if any,
+// only the tail of the log is kept. The log settings are taken from cfg.
+func (r *Runner) newLog(cfg *config.Config, runCtx *fwcontext.RunContext) *runLog {
+	sink := r.newSink(cfg, runCtx)
+
+	if limit := cfg.LogLimit; limit != nil {
+		sink = logtail.New(sink, limit.MaxSize, limit.TailSize)
+	}
+
+	return &runLog{logSink: sink, runner: r, runCtx: runCtx}
+}
+
+func (r *Runner) newSink(cfg *config.Config, runCtx *fwcontext.RunContext) logSink {
+	if cfg.LogSpool != nil {
+		spool, err := r.newSpool(cfg.LogSpool, runCtx)
+		if err == nil {
+			return spool
+		}
+
+		r.LogsvcClient(runCtx).Errorf(context.Background(), "Could not spool the log, holding it in memory instead: %v", err)
+	}
+
+	buf := logbuffer.New(cfg.LogBufferSize)
+	r.startLogger(runCtx, buf)
+	return buf
+}
+
+// Close closes the log, reporting any output that was dropped.
+func (l *runLog) Close() error {
+	err := l.logSink.Close()
+
+	if dropped := l.Dropped(); dropped != 0 {
+		l.runner.LogsvcClient(l.runCtx).Errorf(context.Background(), "%d bytes of output were dropped from the log", dropped)
+	}
+
+	if tail, ok := l.logSink.(*logtail.Writer); ok && tail.Cut() != 0 {
+		l.runner.LogsvcClient(l.runCtx).Infof(context.Background(), "log exceeded its maximum size; %d bytes of output were cut", tail.Cut())
+	}
+
+	if l.onClose != nil {
+		l.onClose()
+	}
+
+	return err
+}
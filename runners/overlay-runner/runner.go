@@ -1,9 +1,15 @@
 package runner
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/docker/client"
 	"github.com/tinyci/ci-agents/clients/log"
@@ -17,90 +23,346 @@ import (
 
 // Runner encapsulates an infinite lifecycle overlay-runner.
 type Runner struct {
-	Config  *config.Config
-	Docker  *client.Client
-	running bool
+	Docker *client.Client
 	sync.Mutex
+
+	// config holds the *config.Config in use; see Config.
+	config atomic.Value
+	// runs are the runs in progress, from MakeRun to AfterRun, by name, with
+	// the configuration each was made with.
+	runs map[string]*config.Config
+	// retired are the configurations swapped out by Reload which runs still
+	// use; their clients are closed once those runs are done.
+	retired []*config.Config
+	// maintenance is closed once the maintenance work in progress, if any, is
+	// done; it is nil otherwise.
+	maintenance chan struct{}
+
+	diskPressure bool
+	// matrices is the amount of matrix runs whose shared log is open.
+	matrices int
+
+	dockerVersion string
+	// dockerOS and dockerArch are the platform of the containers of the
+	// docker daemon, such as windows and amd64.
+	dockerOS   string
+	dockerArch string
+	// containerdVersion is set instead with the containerd backend.
+	containerdVersion string
+
+	health daemonHealth
+
+	imagesMutex sync.Mutex
+	// imagesUsed is when each image, by id, was last used by a run, to prune
+	// those unused for too long.
+	imagesUsed map[string]time.Time
+}
+
+// Config returns the configuration of the runner, which Reload may swap at
+// any time. Runs keep the configuration they were made with.
+func (r *Runner) Config() *config.Config {
+	cfg, _ := r.config.Load().(*config.Config)
+	return cfg
 }
 
-// Ready indicates the runner is ready.
+// Ready indicates the runner is ready for another run: not busy with
+// maintenance work nor a matrix run, with disk space, and with docker, or
+// containerd, answering. The framework keeps the amount of runs in progress
+// within max_concurrent_runs.
 func (r *Runner) Ready() bool {
+	r.Lock()
+	ready := r.maintenance == nil && !r.diskPressure && r.matrices == 0
+	r.Unlock()
+
+	return ready && r.daemonReady()
+}
+
+// MatrixOutput returns the shared log for the cells of a matrix run. The
+// runner is not ready for other runs until it is closed.
+func (r *Runner) MatrixOutput(runCtx *fwcontext.RunContext) io.WriteCloser {
+	r.Lock()
+	r.matrices++
+	r.Unlock()
+
+	l := r.newLog(r.Config(), runCtx)
+	l.onClose = func() {
+		r.Lock()
+		defer r.Unlock()
+		r.matrices--
+	}
+
+	return l
+}
+
+// ParallelMatrix satisfies fw.ParallelMatrixRunner. Cells share the working
+// copy of the repository unless each gets its own worktree.
+func (r *Runner) ParallelMatrix() bool {
+	return r.Config().Runner.Worktrees
+}
+
+// acquire marks the runner busy with maintenance work, if no run, matrix or
+// other maintenance work is in progress. It returns false otherwise. Runs
+// made in the meantime wait for release.
+func (r *Runner) acquire() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.runs) != 0 || r.matrices != 0 || r.maintenance != nil {
+		return false
+	}
+
+	r.maintenance = make(chan struct{})
+	return true
+}
+
+// release marks the maintenance work done, letting runs be made.
+func (r *Runner) release() {
 	r.Lock()
 	defer r.Unlock()
-	return !r.running
+
+	close(r.maintenance)
+	r.maintenance = nil
 }
 
-// MakeRun makes a new run for the framework to use.
+// MakeRun makes a new run for the framework to use, once the maintenance
+// work in progress, if any, is done: the framework may have found the runner
+// ready just before it started.
 func (r *Runner) MakeRun(name string, runCtx *fwcontext.RunContext) (fw.Run, error) {
 	r.Lock()
 	defer r.Unlock()
-	r.running = true
+
+	for r.maintenance != nil {
+		done := r.maintenance
+		r.Unlock()
+		<-done
+		r.Lock()
+	}
+
+	if r.runs == nil {
+		r.runs = map[string]*config.Config{}
+	}
+
+	cfg := r.Config()
+	r.runs[name] = cfg
 
 	return &Run{
 		runner: r,
+		config: cfg,
 		name:   name,
 		runCtx: runCtx,
 	}, nil
 }
 
-// AfterRun sets the running state to false.
+// liveRuns returns the names of the runs in progress.
+func (r *Runner) liveRuns() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	live := []string{}
+	for name := range r.runs {
+		live = append(live, name)
+	}
+
+	return live
+}
+
+// AfterRun marks the run of the name done.
 func (r *Runner) AfterRun(name string, runCtx *fwcontext.RunContext) {
 	r.Lock()
 	defer r.Unlock()
-	r.running = false
+
+	delete(r.runs, name)
+	r.closeRetired()
+}
+
+// closeRetired closes the Vault clients of the retired configurations no run
+// uses anymore. The lock must be held.
+//
+// Their queuesvc and assetsvc clients are left open: they may still be in use
+// after the runs made with them are done, by a poll of the framework started
+// before the reload, or by the upload of a log finishing after its run. Each
+// reload thus keeps a connection to each of those services; reloads are rare
+// enough for this not to matter. The logsvc client is shared by the whole
+// process and is reconfigured in place.
+func (r *Runner) closeRetired() {
+	kept := []*config.Config{}
+
+	for _, cfg := range r.retired {
+		if r.inUse(cfg) {
+			kept = append(kept, cfg)
+			continue
+		}
+
+		if vault := cfg.C.Clients.Vault; vault != nil {
+			vault.Close()
+		}
+	}
+
+	r.retired = kept
+}
+
+// inUse returns true if a run in progress was made with the configuration.
+// The lock must be held.
+func (r *Runner) inUse(cfg *config.Config) bool {
+	for _, runCfg := range r.runs {
+		if runCfg == cfg {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Labels advertises the version of the docker daemon, or containerd, runs are
+// executed on, the platform of the containers of the docker daemon, and the
+// GPUs of the runner, if any.
+func (r *Runner) Labels() map[string]string {
+	cfg := r.Config()
+
+	labels := map[string]string{"docker": r.dockerVersion}
+	if r.dockerOS != "" {
+		// over those of the host, as docker may run linux containers on
+		// windows, or emulate other architectures
+		labels["os"] = r.dockerOS
+		labels["arch"] = r.dockerArch
+	}
+
+	if r.containerd() {
+		labels = map[string]string{"containerd": r.containerdVersion}
+	}
+
+	if cfg.GPUs != nil {
+		for key, value := range cfg.GPUs.Labels() {
+			labels[key] = value
+		}
+	}
+
+	return labels
 }
 
 // Init is the bootstrap of the runner.
 func (r *Runner) Init(ctx *fwcontext.Context) error {
-	// we reload the clients on each run
-	r.Config = &config.Config{C: fwConfig.Config{Clients: &fwConfig.Clients{}}}
-	err := fwConfig.Load(ctx.CLIContext.GlobalString("config"), r.Config)
+	cfg, err := loadConfig(ctx)
 	if err != nil {
 		return err
 	}
+	r.config.Store(cfg)
 
-	if err := r.Config.Runner.Validate(); err != nil {
+	if r.containerd() {
+		r.containerdVersion, err = r.containerdServerVersion(context.Background())
+		if err != nil {
+			return err
+		}
+	} else {
+		r.Docker, err = client.NewClientWithOpts(client.FromEnv)
+		if err != nil {
+			return err
+		}
+
+		version, err := r.Docker.ServerVersion(context.Background())
+		if err != nil {
+			return err
+		}
+		r.dockerVersion = version.Version
+		r.dockerOS = version.Os
+		r.dockerArch = version.Arch
+
+		if err := r.checkPlatform(runtime.GOOS); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkTempdir(); err != nil {
 		return err
 	}
 
-	var eErr error
-	r.Docker, eErr = client.NewClientWithOpts(client.FromEnv)
-	if eErr != nil {
-		return eErr
+	r.StartReaper()
+	r.StartWarmups()
+	r.StartDiskMonitor()
+	r.StartGitMaintenance()
+
+	return nil
+}
+
+// Reload loads the configuration again and swaps it in for new runs; runs in
+// progress keep theirs, whose Vault client is closed once they are done (see
+// closeRetired). Cache warmups, git maintenance and the disk monitor keep the
+// settings they were started with, and the backend cannot change without a
+// restart.
+func (r *Runner) Reload(ctx *fwcontext.Context) error {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if cfg.Backend != r.Config().Backend {
+		return fmt.Errorf("backend changed from %v to %v; restart the runner to apply it", r.Config().Backend, cfg.Backend)
+	}
+
+	r.retired = append(r.retired, r.Config())
+	r.config.Store(cfg)
+	r.closeRetired()
+
+	return nil
+}
+
+func loadConfig(ctx *fwcontext.Context) (*config.Config, error) {
+	cfg := &config.Config{C: fwConfig.Config{Clients: &fwConfig.Clients{}}}
+	if err := fwConfig.Load(ctx.CLIContext.GlobalString("config"), cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Runner.Validate(); err != nil {
+		return nil, err
 	}
 
-	if r.Config.C.Hostname == "" {
+	// runs of the same repository would otherwise share its working copy
+	if cfg.C.MaxConcurrentRuns > 1 && !cfg.Runner.Worktrees {
+		return nil, errors.New("max_concurrent_runs above 1 requires git worktrees")
+	}
+
+	if cfg.C.Hostname == "" {
 		hostname, err := os.Hostname()
 		if err != nil {
-			return utils.WrapError(err, "Could not retrieve hostname")
+			return nil, utils.WrapError(err, "Could not retrieve hostname")
 		}
-		r.Config.C.Hostname = hostname
+		cfg.C.Hostname = hostname
 	}
 
-	r.Config.C.Clients.Log = r.Config.C.Clients.Log.WithFields(log.FieldMap{"hostname": r.Config.C.Hostname})
+	cfg.C.Clients.Log = cfg.C.Clients.Log.WithFields(log.FieldMap{"hostname": cfg.C.Hostname})
 
-	return nil
+	return cfg, nil
 }
 
 // Hostname is the reported hostname of the machine; an identifier. Not
 // necessary for anything and insecure, just ornamental.
 func (r *Runner) Hostname() string {
-	return r.Config.C.Hostname
+	return r.Config().C.Hostname
+}
+
+// FrameworkConfig returns the framework portion of the configuration.
+func (r *Runner) FrameworkConfig() *fwConfig.Config {
+	return &r.Config().C
 }
 
 // QueueName is the name of the queue this runner should be processing.
 func (r *Runner) QueueName() string {
-	return r.Config.C.QueueName
+	return r.Config().C.QueueName
 }
 
 // QueueClient returns the queue client
 func (r *Runner) QueueClient() *queue.Client {
-	return r.Config.C.Clients.Queue
+	return r.Config().C.Clients.Queue
 }
 
 // LogsvcClient returns the system log client. Must be called after configuration is initialized
 func (r *Runner) LogsvcClient(ctx *fwcontext.RunContext) *log.SubLogger {
-	logger := r.Config.C.Clients.Log.WithFields(log.FieldMap{"hostname": r.Config.C.Hostname})
+	cfg := r.Config()
+
+	logger := cfg.C.Clients.Log.WithFields(log.FieldMap{"hostname": cfg.C.Hostname})
 
 	if ctx.QueueItem != nil {
 		return logger.WithFields(log.FieldMap{
@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/tinyci/ci-runners/fw/secrets"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// loadSecrets returns the secrets of the repository of the run. Pull
+// requests from forks get none, unless configured otherwise.
+func (r *Run) loadSecrets(w io.Writer) ([]secrets.Secret, error) {
+	cfg := r.config.Secrets
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if r.fork() && !cfg.Forks {
+		fmt.Fprintf(w, "\nSecrets are not available to pull requests from forks\n")
+		return nil, nil
+	}
+
+	return cfg.Load(r.runCtx.QueueItem.Run.Task.Submission.BaseRef.Repository.Name)
+}
+
+// fork returns true if the run is of a pull request from a fork.
+func (r *Run) fork() bool {
+	sub := r.runCtx.QueueItem.Run.Task.Submission
+	return sub.HeadRef.Repository.Name != sub.BaseRef.Repository.Name
+}
+
+// secretsMount writes the secrets to files, returning their mount in the
+// container. They are removed with removeSecrets.
+func (r *Run) secretsMount(list []secrets.Secret) (mount.Mount, error) {
+	dir, err := workspace.MkdirTemp(r.config.OverlayTempdir, r.name+"-secrets")
+	if err != nil {
+		return mount.Mount{}, err
+	}
+	r.secretsDir = dir
+
+	// dir itself is only accessible by the runner on the host
+	files := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(files, 0755); err != nil {
+		return mount.Mount{}, err
+	}
+
+	if err := secrets.WriteFiles(files, list); err != nil {
+		return mount.Mount{}, err
+	}
+
+	return mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   files,
+		Target:   r.config.Secrets.FilesTarget,
+		ReadOnly: true,
+	}, nil
+}
+
+// removeSecrets removes the files of the secrets, if any.
+func (r *Run) removeSecrets() {
+	if r.secretsDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(r.secretsDir); err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(r.runCtx.Ctx, "Could not remove secrets: %v", err)
+	}
+	r.secretsDir = ""
+}
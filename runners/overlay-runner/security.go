@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/security"
+)
+
+// securityOptions returns the options in the metadata of the run, or failing
+// that of its task, if any.
+func (r *Run) securityOptions() (*security.Options, error) {
+	opts, err := security.FromMetadata(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || opts != nil {
+		return opts, err
+	}
+
+	return security.FromMetadata(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// applySecurity confines the container of the run as configured, tightened
+// by the options of the run.
+func (r *Run) applySecurity(config *container.Config, hostconfig *container.HostConfig) error {
+	opts, err := r.securityOptions()
+	if err != nil {
+		return fw.Classed(fw.ErrUserJob, fmt.Errorf("invalid security options: %w", err))
+	}
+
+	sec, err := r.config.Security.Apply(opts)
+	if err != nil {
+		return fw.Classed(fw.ErrUserJob, err)
+	}
+
+	config.User = sec.User
+	hostconfig.CapAdd = sec.CapAdd
+	hostconfig.CapDrop = sec.CapDrop
+	hostconfig.SecurityOpt = sec.SecurityOpt()
+	hostconfig.ReadonlyRootfs = sec.ReadOnlyRootfs
+	hostconfig.UsernsMode = container.UsernsMode(sec.UsernsMode)
+
+	if sec.ReadOnlyRootfs {
+		hostconfig.Tmpfs = map[string]string{"/tmp": "rw,nosuid,nodev"}
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/services"
+)
+
+// serviceLabel marks the networks and containers of services, so those left
+// behind by crashed runs can be found.
+const serviceLabel = "tinyci.service"
+
+// healthInterval is how often the health checks given by services run.
+const healthInterval = 2 * time.Second
+
+// servicesList returns the services in the metadata of the run, or failing
+// that of its task.
+func (r *Run) servicesList() ([]services.Service, error) {
+	list, err := services.FromMetadata(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || list != nil {
+		return list, err
+	}
+
+	return services.FromMetadata(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// serviceSpec is a service with the host settings the runner may give it,
+// such as the docker daemon of a run, unlike those the run asks for.
+type serviceSpec struct {
+	services.Service
+	privileged bool
+	mounts     []mount.Mount
+}
+
+// startServices starts the services of the run on the network of the run,
+// created unless it exists, which the container of the run joins, and waits
+// until they are ready.
+// Services are reachable by their name.
+func (r *Run) startServices(w io.Writer, list []serviceSpec) error {
+	ctx := r.runCtx.Ctx
+	labels := r.labels()
+	labels[serviceLabel] = r.name
+
+	if r.network == "" {
+		if err := r.createNetwork(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, svc := range list {
+		fmt.Fprintf(w, "\nStarting service %v (%v)\n", svc.Name, svc.Image)
+
+		img, err := r.runner.pull(ctx, r.config, r.runner.LogsvcClient(r.runCtx), svc.Image, ioutil.Discard)
+		if err != nil {
+			return fmt.Errorf("service %v: pulling image %v: %w", svc.Name, svc.Image, err)
+		}
+
+		mounts, err := r.serviceVolumes(ctx, img, labels, svc.mounts)
+		if err != nil {
+			return fmt.Errorf("service %v: %w", svc.Name, err)
+		}
+
+		config := &container.Config{
+			Image:  img,
+			Env:    svc.Env,
+			Cmd:    svc.Command,
+			Labels: labels,
+		}
+
+		if len(svc.Healthcheck) != 0 {
+			config.Healthcheck = &container.HealthConfig{
+				Test:     append([]string{"CMD"}, svc.Healthcheck...),
+				Interval: healthInterval,
+				Retries:  1,
+			}
+		}
+
+		resp, err := r.runner.Docker.ContainerCreate(ctx, config, &container.HostConfig{
+			NetworkMode: container.NetworkMode(r.network),
+			Mounts:      append(svc.mounts, mounts...),
+			Privileged:  svc.privileged,
+		}, &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				r.network: {Aliases: []string{svc.Name}},
+			},
+		}, nil, r.network+"-"+svc.Name)
+		if err != nil {
+			return fmt.Errorf("service %v: %w", svc.Name, err)
+		}
+
+		r.services = append(r.services, resp.ID)
+		r.hosts = append(r.hosts, svc.Name)
+
+		if err := r.runner.Docker.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf("service %v: %w", svc.Name, err)
+		}
+	}
+
+	for i, svc := range list {
+		if err := r.waitService(svc.Service, r.services[i]); err != nil {
+			r.serviceLogs(w, svc.Service, r.services[i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serviceVolumes returns the volumes the image of a service declares as
+// labeled volumes, so those left behind can be found, unlike the anonymous
+// volumes docker would otherwise make. Those where the service already has a
+// mount are left out.
+func (r *Run) serviceVolumes(ctx context.Context, img string, labels map[string]string, existing []mount.Mount) ([]mount.Mount, error) {
+	info, _, err := r.runner.Docker.ImageInspectWithRaw(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []mount.Mount{}
+	if info.Config == nil {
+		return mounts, nil
+	}
+
+	mounted := map[string]bool{}
+	for _, m := range existing {
+		mounted[m.Target] = true
+	}
+
+	for target := range info.Config.Volumes {
+		if mounted[target] {
+			continue
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Type:          mount.TypeVolume,
+			Target:        target,
+			VolumeOptions: &mount.VolumeOptions{Labels: labels},
+		})
+	}
+
+	return mounts, nil
+}
+
+// waitService waits until the service is healthy, or merely running if
+// neither it nor its image has a health check.
+func (r *Run) waitService(svc services.Service, id string) error {
+	ctx, cancel := context.WithTimeout(r.runCtx.Ctx, r.config.ServicesTimeout)
+	defer cancel()
+
+	for {
+		info, err := r.runner.Docker.ContainerInspect(ctx, id)
+		if err != nil {
+			return fmt.Errorf("service %v: %w", svc.Name, err)
+		}
+
+		if !info.State.Running {
+			return fw.Classed(fw.ErrUserJob, fmt.Errorf("service %v exited with code %d", svc.Name, info.State.ExitCode))
+		}
+
+		if info.State.Health == nil || info.State.Health.Status == types.Healthy {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if r.runCtx.Ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fw.Classed(fw.ErrUserJob, fmt.Errorf("service %v was not healthy within %v", svc.Name, r.config.ServicesTimeout))
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// serviceLogs writes the end of the output of the service to the job log,
+// to tell why it did not start.
+func (r *Run) serviceLogs(w io.Writer, svc services.Service, id string) {
+	logs, err := r.runner.Docker.ContainerLogs(context.Background(), id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Tail: "50"})
+	if err != nil {
+		return
+	}
+	defer logs.Close()
+
+	fmt.Fprintf(w, "\nLast output of service %v:\n", svc.Name)
+	io.Copy(w, logs)
+}
+
+// stopServices removes the services of the run and the network of the run.
+func (r *Run) stopServices() {
+	ctx := context.Background()
+
+	for _, id := range r.services {
+		if err := r.runner.Docker.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil && !errdefs.IsNotFound(err) {
+			r.runner.LogsvcClient(r.runCtx).Errorf(ctx, "Could not remove service container: %v", err)
+		}
+	}
+	r.services = nil
+	r.hosts = nil
+
+	if r.network == "" {
+		return
+	}
+
+	if err := r.runner.disconnectProxy(ctx, r.network); err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(ctx, "Could not disconnect the egress proxy from network %v: %v", r.network, err)
+	}
+
+	if err := r.runner.Docker.NetworkRemove(ctx, r.network); err != nil && !errdefs.IsNotFound(err) {
+		r.runner.LogsvcClient(r.runCtx).Errorf(ctx, "Could not remove network %v: %v", r.network, err)
+	}
+	r.network = ""
+}
+
+// reapNetworks removes the networks of services left behind by runs which did
+// not finish; reapContainers must have removed their containers. The runner
+// must be idle.
+func (r *Runner) reapNetworks(ctx context.Context) {
+	logger := r.Config().C.Clients.Log
+
+	networks, err := r.Docker.NetworkList(ctx, types.NetworkListOptions{Filters: filters.NewArgs(filters.Arg("label", serviceLabel))})
+	if err != nil {
+		logger.Errorf(ctx, "Could not list stale service networks: %v", err)
+		return
+	}
+
+	removed := 0
+
+	for _, n := range networks {
+		if !r.orphaned(n.Labels) {
+			continue
+		}
+
+		if err := r.disconnectProxy(ctx, n.ID); err != nil {
+			logger.Errorf(ctx, "Could not disconnect the egress proxy from stale service network %v: %v", n.Name, err)
+		}
+
+		if err := r.Docker.NetworkRemove(ctx, n.ID); err != nil && !errdefs.IsNotFound(err) {
+			logger.Errorf(ctx, "Could not remove stale service network %v: %v", n.Name, err)
+			continue
+		}
+
+		removed++
+	}
+
+	if removed != 0 {
+		logger.Infof(ctx, "Removed %d stale service networks", removed)
+	}
+}
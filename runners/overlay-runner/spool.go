@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	fwcontext "github.com/tinyci/ci-runners/fw/context"
+	"github.com/tinyci/ci-runners/fw/logspool"
+	"github.com/tinyci/ci-runners/fw/retry"
+	"github.com/tinyci/ci-runners/runners/overlay-runner/config"
+)
+
+// newSpool creates the spool of the log of the run and starts shipping it.
+func (r *Runner) newSpool(cfg *config.LogSpool, runCtx *fwcontext.RunContext) (*logspool.Spool, error) {
+	spool, err := logspool.New(cfg.Dir, cfg.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	go r.shipSpool(cfg, runCtx, spool)
+
+	return spool, nil
+}
+
+// shipSpool uploads the spool to the assetsvc, from its start on each
+// attempt, until the upload succeeds or MaxWait has passed since the spool
+// was closed. The spool is released once done.
+func (r *Runner) shipSpool(cfg *config.LogSpool, runCtx *fwcontext.RunContext, spool *logspool.Spool) {
+	defer spool.Release()
+
+	logger := r.LogsvcClient(runCtx)
+	id := runCtx.QueueItem.Run.Id
+
+	// not the context of the run, as the upload may outlive it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shipped := make(chan struct{})
+	defer close(shipped)
+
+	go func() {
+		select {
+		case <-shipped:
+			return
+		case <-spool.Done():
+		}
+
+		select {
+		case <-shipped:
+		case <-time.After(cfg.MaxWait):
+			cancel()
+		}
+	}()
+
+	err := retry.Do(ctx, retry.Policy{
+		Backoff: cfg.Backoff,
+		OnError: func(err error, delay time.Duration) {
+			logger.Errorf(context.Background(), "Could not ship log of run %d, retrying in %v: %v", id, delay, err)
+		},
+	}, func(ctx context.Context) error {
+		return r.Config().C.Clients.Asset.Write(ctx, id, spool.NewReader())
+	})
+	if err != nil {
+		logger.Errorf(context.Background(), "Could not ship log of run %d, giving up: %v", id, err)
+	}
+}
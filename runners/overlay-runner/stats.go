@@ -0,0 +1,157 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/tinyci/ci-runners/fw/cgroup"
+	"github.com/tinyci/ci-runners/fw/metrics"
+)
+
+// statsGrace is how long the stats of the container are waited for once it
+// stopped, for their stream to end.
+const statsGrace = 5 * time.Second
+
+// runStats is the resource usage of the container of a run, from the
+// accounting of its cgroup by docker.
+type runStats struct {
+	cgroup.Usage
+	// Duration is the time over which the usage was sampled.
+	Duration time.Duration
+}
+
+// watchStats follows the stats of the container of the run, which docker
+// samples every second from its cgroup, until it stops. The returned function
+// waits for the stats, and returns the last sample, with the peak memory
+// usage seen, if any was received. The containerd backend has none.
+func (r *Run) watchStats() func() (runStats, bool) {
+	if r.runner.containerd() || r.containerID == "" {
+		return func() (runStats, bool) { return runStats{}, false }
+	}
+
+	var (
+		stats    runStats
+		received bool
+		done     = make(chan struct{})
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		defer close(done)
+
+		resp, err := r.runner.Docker.ContainerStats(ctx, r.containerID, true)
+		if err != nil {
+			r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "Could not follow container stats: %v", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		var first time.Time
+		dec := json.NewDecoder(resp.Body)
+
+		for {
+			var sample types.StatsJSON
+			if err := dec.Decode(&sample); err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					r.runner.LogsvcClient(r.runCtx).Errorf(context.Background(), "Could not read container stats: %v", err)
+				}
+				return
+			}
+
+			// the last sample of a stopped container is empty
+			if sample.Read.IsZero() || sample.CPUStats.CPUUsage.TotalUsage == 0 {
+				continue
+			}
+
+			if first.IsZero() {
+				first = sample.Read
+			}
+
+			stats.Duration = sample.Read.Sub(first)
+			mergeStats(&stats.Usage, sample)
+			received = true
+		}
+	}()
+
+	return func() (runStats, bool) {
+		select {
+		case <-done:
+		case <-time.After(statsGrace):
+			cancel()
+			<-done
+		}
+		cancel()
+
+		return stats, received
+	}
+}
+
+// mergeStats sets the usage to that of the sample, keeping the peak memory
+// usage. Memory usage excludes the inactive page cache, as docker stats do.
+func mergeStats(usage *cgroup.Usage, sample types.StatsJSON) {
+	usage.CPU = time.Duration(sample.CPUStats.CPUUsage.TotalUsage)
+
+	mem := sample.MemoryStats.Usage
+	// total_inactive_file on cgroup v1, inactive_file on v2
+	for _, key := range []string{"total_inactive_file", "inactive_file"} {
+		if inactive, ok := sample.MemoryStats.Stats[key]; ok && inactive < mem {
+			mem -= inactive
+			break
+		}
+	}
+
+	if mem > usage.MemoryPeak {
+		usage.MemoryPeak = mem
+	}
+
+	usage.IORead, usage.IOWrite = 0, 0
+	for _, entry := range sample.BlkioStats.IoServiceBytesRecursive {
+		// "Read" on cgroup v1, "read" on v2
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			usage.IORead += entry.Value
+		case "write":
+			usage.IOWrite += entry.Value
+		}
+	}
+}
+
+// reportStats writes the resource usage of the run to the job log, with the
+// resources it requested if any, and records it in the metrics, so users may
+// size their requests.
+func (r *Run) reportStats(stats runStats, w io.Writer) {
+	queue := r.runCtx.QueueItem.QueueName
+
+	metrics.RunCPUTime.Observe(stats.CPU.Seconds(), queue)
+	metrics.RunMemoryPeak.Observe(float64(stats.MemoryPeak), queue)
+	metrics.RunIO.Observe(float64(stats.IORead), queue, "read")
+	metrics.RunIO.Observe(float64(stats.IOWrite), queue, "write")
+
+	r.runner.LogsvcClient(r.runCtx).Infof(r.runCtx.Ctx, "Resource usage of the run: %v", stats.Usage)
+
+	cpu := stats.CPU.Round(time.Millisecond).String()
+	if stats.Duration >= time.Second {
+		cpu += fmt.Sprintf(" (%.2f CPUs on average)", stats.CPU.Seconds()/stats.Duration.Seconds())
+	}
+
+	mem := formatBytes(stats.MemoryPeak)
+
+	// valid, as the container was created with them
+	if res, err := r.containerResources(); err == nil {
+		if res.NanoCPUs != 0 {
+			cpu += fmt.Sprintf(", %g CPUs requested", float64(res.NanoCPUs)/1e9)
+		}
+
+		if res.Memory != 0 {
+			mem += fmt.Sprintf(", %v requested", formatBytes(uint64(res.Memory)))
+		}
+	}
+
+	fmt.Fprintf(w, "\nResource usage: CPU time %v; memory peak %v; %v read, %v written\n", cpu, mem, formatBytes(stats.IORead), formatBytes(stats.IOWrite))
+}
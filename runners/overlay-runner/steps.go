@@ -0,0 +1,144 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/tinyci/ci-agents/clients/log"
+	"github.com/tinyci/ci-runners/fw/sections"
+	"github.com/tinyci/ci-runners/fw/steps"
+)
+
+// stepsCommand keeps the container of a run with steps alive while they are
+// executed in it, exiting on SIGTERM so Terminate stops it.
+var stepsCommand = []string{"sh", "-c", "trap 'exit 143' TERM; while :; do sleep 3600 & wait $!; done"}
+
+// stepsPlan returns the steps in the metadata of the run, or failing that of
+// its task.
+func (r *Run) stepsPlan() (*steps.Plan, error) {
+	plan, err := steps.FromMetadata(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err != nil || plan != nil {
+		return plan, err
+	}
+
+	return steps.FromMetadata(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+}
+
+// runSteps executes the steps in the container in order, writing their
+// output and a summary to w. Once a step fails, the following ones are
+// skipped if the plan fails fast. The container is stopped when done.
+func (r *Run) runSteps(plan *steps.Plan, w io.Writer) (bool, error) {
+	defer r.runner.Docker.ContainerKill(context.Background(), r.containerID, "KILL")
+
+	var (
+		results = []steps.Result{}
+		failed  bool
+	)
+
+	for _, step := range plan.Steps {
+		if failed && plan.FailFast {
+			results = append(results, steps.Result{Step: step, Status: steps.StatusSkipped})
+			continue
+		}
+
+		res, err := r.runStep(step, w)
+		if err != nil {
+			r.mirrorLog(w, "could not execute step %v: %v", step.Name, err)
+			return false, err
+		}
+
+		results = append(results, res)
+
+		if res.Status == steps.StatusFailed && !step.ContinueOnError {
+			failed = true
+		}
+	}
+
+	fmt.Fprintf(w, "\n%v\n", steps.Summary(results))
+
+	return steps.Passed(results), nil
+}
+
+func (r *Run) runStep(step steps.Step, w io.Writer) (steps.Result, error) {
+	res := steps.Result{Step: step}
+	ctx := r.runCtx.Ctx
+
+	defer sections.Runner(w, "step-"+step.Name, "Step "+step.Name)()
+
+	fmt.Fprintf(w, "\n==> Step %v: %v\n", step.Name, strings.Join(step.Command, " "))
+
+	done := r.runCtx.Trace.Step("step " + step.Name)
+	defer done()
+
+	start := time.Now()
+
+	tty := !r.config.JobLog.NoTTY
+
+	exec, err := r.runner.Docker.ContainerExecCreate(ctx, r.containerID, types.ExecConfig{
+		Tty:          tty,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          step.Command,
+	})
+	if err != nil {
+		return res, err
+	}
+
+	attach, err := r.runner.Docker.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: tty})
+	if err != nil {
+		return res, err
+	}
+
+	if tty {
+		if err := r.resizeExecTTY(ctx, exec.ID); err != nil {
+			r.mirrorLog(w, "could not resize the tty of step %v, skipping: %v", step.Name, err)
+		}
+	}
+
+	prefix := ""
+	if r.config.JobLog.StepNames {
+		prefix = step.Name
+	}
+
+	r.copyOutput(w, attach.Reader, tty, prefix)
+	attach.Close()
+
+	// the output may end slightly before the process does
+	var inspect types.ContainerExecInspect
+	for {
+		inspect, err = r.runner.Docker.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return res, err
+		}
+
+		if !inspect.Running {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	res.Duration = time.Since(start)
+	res.ExitCode = inspect.ExitCode
+
+	if res.ExitCode == 0 {
+		res.Status = steps.StatusPassed
+	} else {
+		res.Status = steps.StatusFailed
+	}
+
+	fmt.Fprintf(w, "\n<== Step %v %v in %v\n", step.Name, res.Status, res.Duration.Round(time.Millisecond))
+
+	r.runner.LogsvcClient(r.runCtx).WithFields(log.FieldMap{
+		"step":      step.Name,
+		"status":    string(res.Status),
+		"exit_code": fmt.Sprintf("%d", res.ExitCode),
+		"duration":  res.Duration.String(),
+	}).Infof(ctx, "Step %v %v", step.Name, res.Status)
+
+	return res, nil
+}
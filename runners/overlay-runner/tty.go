@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/tinyci/ci-runners/fw"
+	"github.com/tinyci/ci-runners/fw/tty"
+)
+
+// ttySize returns the size of the terminal of the run: that in its metadata,
+// or failing that of its task, completed by the configured size.
+func (r *Run) ttySize() (tty.Size, error) {
+	size := r.config.JobLog.TTY
+
+	requested, err := tty.FromMetadata(r.runCtx.QueueItem.Run.Settings.GetMetadata().AsMap())
+	if err == nil && requested == nil {
+		requested, err = tty.FromMetadata(r.runCtx.QueueItem.Run.Task.Settings.GetMetadata().AsMap())
+	}
+
+	if err != nil {
+		return size, fw.Classed(fw.ErrUserJob, fmt.Errorf("invalid tty: %w", err))
+	}
+
+	if requested != nil {
+		if requested.Width != 0 {
+			size.Width = requested.Width
+		}
+
+		if requested.Height != 0 {
+			size.Height = requested.Height
+		}
+	}
+
+	return size, nil
+}
+
+// resizeTTY sets the size of the terminal of the container, which must be
+// running.
+func (r *Run) resizeTTY(ctx context.Context) error {
+	return r.runner.Docker.ContainerResize(ctx, r.containerID, types.ResizeOptions{Height: r.termSize.Height, Width: r.termSize.Width})
+}
+
+// resizeExecTTY sets the size of the terminal of the process executed in the
+// container, which must be started.
+func (r *Run) resizeExecTTY(ctx context.Context, id string) error {
+	return r.runner.Docker.ContainerExecResize(ctx, id, types.ResizeOptions{Height: r.termSize.Height, Width: r.termSize.Width})
+}
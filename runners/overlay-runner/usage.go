@@ -0,0 +1,111 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tinyci/ci-runners/fw/metrics"
+	"github.com/tinyci/ci-runners/fw/workspace"
+)
+
+// watchUsage measures the writes made to the workspace while the run
+// executes, stopping the container should they exceed the configured cap. The
+// returned function stops watching and returns the writes measured last, if
+// the cap was exceeded.
+func (r *Run) watchUsage(ws workspace.Workspace, w io.Writer) func() (uint64, bool) {
+	m, ok := ws.(workspace.Measurable)
+	maxSize := r.config.WorkspaceMaxSize
+
+	if !ok || maxSize == 0 {
+		return func() (uint64, bool) { return 0, false }
+	}
+
+	var (
+		stop     = make(chan struct{})
+		wg       sync.WaitGroup
+		written  uint64
+		exceeded bool
+	)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(r.config.WorkspaceCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-r.runCtx.Ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			size, err := m.Written()
+			if err != nil {
+				r.runner.LogsvcClient(r.runCtx).Errorf(r.runCtx.Ctx, "Could not measure workspace: %v", err)
+				continue
+			}
+
+			if size <= maxSize {
+				continue
+			}
+
+			written, exceeded = size, true
+			r.mirrorLog(w, "workspace usage of %v exceeds the limit of %v; stopping the run", formatBytes(size), formatBytes(maxSize))
+
+			if err := r.kill("KILL"); err != nil {
+				r.runner.LogsvcClient(r.runCtx).Errorf(r.runCtx.Ctx, "Could not stop container: %v", err)
+			}
+
+			return
+		}
+	}()
+
+	return func() (uint64, bool) {
+		close(stop)
+		wg.Wait()
+		return written, exceeded
+	}
+}
+
+// reportUsage writes the amount of bytes the run wrote to its workspace to
+// the job log and the metrics, if it can be measured.
+func (r *Run) reportUsage(ws workspace.Workspace, w io.Writer) {
+	m, ok := ws.(workspace.Measurable)
+	if !ok {
+		return
+	}
+
+	size, err := m.Written()
+	if err != nil {
+		r.runner.LogsvcClient(r.runCtx).Errorf(r.runCtx.Ctx, "Could not measure workspace: %v", err)
+		return
+	}
+
+	metrics.WorkspaceWritten.Observe(float64(size), r.runCtx.QueueItem.QueueName)
+	r.runner.LogsvcClient(r.runCtx).Infof(r.runCtx.Ctx, "Run wrote %d bytes to its workspace", size)
+	fmt.Fprintf(w, "\nWorkspace usage: %v written\n", formatBytes(size))
+}
+
+// formatBytes renders a size in bytes in binary units, for the job log.
+func formatBytes(size uint64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/tinyci/ci-runners/fw"
+)
+
+// windows returns true if runs are executed in windows containers.
+func (r *Runner) windows() bool {
+	return !r.containerd() && r.dockerOS == "windows"
+}
+
+// checkPlatform errors out if the docker daemon cannot run the containers of
+// this host: a windows runner hands its daemon windows paths to mount, which
+// only windows containers take.
+func (r *Runner) checkPlatform(goos string) error {
+	if goos == "windows" && r.dockerOS != "windows" {
+		return fmt.Errorf("the docker daemon runs %v containers: switch it to windows containers", r.dockerOS)
+	}
+
+	return nil
+}
+
+// pullPlatform is the platform of the images pulled, where the daemon does
+// not pick it: windows daemons may also run linux images, so the windows
+// variant of images must be asked for.
+func (r *Runner) pullPlatform() string {
+	if !r.windows() {
+		return ""
+	}
+
+	return r.dockerOS + "/" + r.dockerArch
+}
+
+// adaptWindows sets the isolation of the container of the run, and errors out
+// on the settings the run asks for which windows containers do not support.
+func (r *Run) adaptWindows(hostconfig *container.HostConfig) error {
+	hostconfig.Isolation = container.Isolation(r.config.Isolation)
+
+	unsupported := []string{}
+
+	if hostconfig.Privileged {
+		unsupported = append(unsupported, "privileged runs")
+	}
+
+	if len(hostconfig.Ulimits) != 0 || len(hostconfig.Sysctls) != 0 {
+		unsupported = append(unsupported, "limits")
+	}
+
+	if len(hostconfig.Devices) != 0 || len(hostconfig.DeviceRequests) != 0 {
+		unsupported = append(unsupported, "gpus and host devices")
+	}
+
+	if hostconfig.ReadonlyRootfs || len(hostconfig.SecurityOpt) != 0 || len(hostconfig.CapAdd) != 0 || len(hostconfig.CapDrop) != 0 || hostconfig.UsernsMode != "" {
+		unsupported = append(unsupported, "security options other than the user")
+	}
+
+	if len(unsupported) != 0 {
+		return fw.Classed(fw.ErrUserJob, fmt.Errorf("%v are not supported by windows containers", strings.Join(unsupported, ", ")))
+	}
+
+	return nil
+}